@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"github.com/keij-sama/Concurrency/database/internal/database/compute/parser"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/network"
 	"github.com/keij-sama/Concurrency/pkg/logger"
 )
 
@@ -31,15 +33,30 @@ func main() {
 
 	// Инициализация компонентов
 	parser := parser.NewParser()
-	engine := engine.NewInMemoryEngine()
+	engineOptions, err := cfg.GetEngineOptions()
+	if err != nil {
+		fmt.Printf("ERROR: Invalid engine configuration: %v\n", err)
+		os.Exit(1)
+	}
+	engine, err := engine.New(cfg.Engine.Type, engineOptions...)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to create engine: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Получаем конфигурацию WAL
 	walConfig := cfg.GetWALConfig()
+	snapshotConfig, err := cfg.GetSnapshotConfig()
+	if err != nil {
+		fmt.Printf("ERROR: Invalid snapshot configuration: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Инициализируем хранилище с WAL, если он включен
 	storage, err := storage.NewStorage(engine, customLogger, storage.StorageOptions{
 		WALConfig:         walConfig,
 		ReplicationConfig: nil,
+		SnapshotConfig:    snapshotConfig,
 	})
 	if err != nil {
 		fmt.Printf("ERROR: Failed to initialize storage: %v\n", err)
@@ -55,10 +72,13 @@ func main() {
 	} else {
 		fmt.Println("WAL is disabled - data will be lost after restart")
 	}
-	fmt.Println("Available commands: SET, GET, DEL")
+	fmt.Println("Available commands: SET, GET, DEL, EXPIRE, TTL, PERSIST, INCR, DECR, INCRBY, SETNX, GETSET, CAS, MGET, MSET, MDEL, RANGE, PREFIX, SCAN, KEYS, MULTI, EXEC, DISCARD, WATCH, UNWATCH, SNAPSHOT, WAIT, REPLICAOF")
 	fmt.Println("To exit, type exit or quit")
 	fmt.Println()
 
+	// Локальный режим - одно соединение, в его сессии хранится состояние транзакции
+	ctx := network.ContextWithSession(context.Background(), network.NewSession(1))
+
 	// Цикл обработки команд
 	scanner := bufio.NewScanner(os.Stdin)
 	for {
@@ -81,7 +101,7 @@ func main() {
 		}
 
 		// Обработка команды
-		result, err := compute.Process(input)
+		result, err := compute.ProcessContext(ctx, input)
 		if err != nil {
 			fmt.Printf("ERROR: %s\n", err)
 		} else {
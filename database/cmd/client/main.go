@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -15,6 +16,7 @@ func main() {
 	// Парсим флаги командной строки
 	address := flag.String("address", "127.0.0.1:3223", "Address of the database server")
 	timeout := flag.Duration("timeout", 5*time.Minute, "Idle timeout for connection")
+	pipeline := flag.Int("pipeline", 0, "Read commands from stdin and send them in batches of this size")
 	flag.Parse()
 
 	// Создаем клиента
@@ -26,7 +28,16 @@ func main() {
 	}
 	defer client.Close()
 
-	fmt.Println("Connected to database server. Enter commands (SET, GET, DEL) or 'exit' to quit.")
+	// Пакетная загрузка: команды из stdin отправляются конвейером без ожидания каждого ответа
+	if *pipeline > 0 {
+		if err := runPipeline(client, os.Stdin, *pipeline); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Println("Connected to database server. Enter commands (SET, GET, DEL, EXPIRE, TTL, PERSIST, INCR, DECR, INCRBY, SETNX, GETSET, CAS, MGET, MSET, MDEL, RANGE, PREFIX, SCAN, KEYS, MULTI, EXEC, DISCARD, WATCH, UNWATCH, SNAPSHOT, WAIT, REPLICAOF) or 'exit' to quit.")
 
 	// Читаем команды от пользователя
 	scanner := bufio.NewScanner(os.Stdin)
@@ -62,3 +73,39 @@ func main() {
 		fmt.Printf("Error reading input: %v\n", err)
 	}
 }
+
+// runPipeline читает команды по одной на строку и отправляет их пачками по batchSize
+func runPipeline(client *network.TCPClient, input io.Reader, batchSize int) error {
+	send := func(batch []string) error {
+		responses, err := client.Pipeline(batch)
+		if err != nil {
+			return err
+		}
+		for _, response := range responses {
+			fmt.Println(response)
+		}
+		return nil
+	}
+
+	batch := make([]string, 0, batchSize)
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		batch = append(batch, line)
+		if len(batch) == batchSize {
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	return send(batch)
+}
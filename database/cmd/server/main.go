@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/keij-sama/Concurrency/database/internal/config"
 	"github.com/keij-sama/Concurrency/database/internal/database/compute"
@@ -21,6 +24,8 @@ import (
 func main() {
 	// Парсим флаги командной строки
 	configPath := flag.String("config", "config.yaml", "Path to config file")
+	recoverToLSN := flag.String("recover-to-lsn", "", "Replay WAL up to this LSN inclusive and start read-only")
+	recoverToTime := flag.String("recover-to-time", "", "Replay WAL up to this RFC 3339 time inclusive and start read-only")
 	flag.Parse()
 
 	// Загружаем конфигурацию
@@ -40,12 +45,31 @@ func main() {
 
 	// Инициализируем компоненты базы данных
 	parser := parser.NewParser()
-	eng := engine.NewInMemoryEngine()
+	engineOptions, err := cfg.GetEngineOptions()
+	if err != nil {
+		zapLogger.Fatal("Invalid engine configuration", zap.Error(err))
+	}
+	eng, err := engine.New(cfg.Engine.Type, engineOptions...)
+	if err != nil {
+		zapLogger.Fatal("Failed to create engine", zap.Error(err))
+	}
+
+	snapshotConfig, err := cfg.GetSnapshotConfig()
+	if err != nil {
+		zapLogger.Fatal("Invalid snapshot configuration", zap.Error(err))
+	}
+
+	recoveryTarget, err := parseRecoveryTarget(*recoverToLSN, *recoverToTime)
+	if err != nil {
+		zapLogger.Fatal("Invalid recovery target", zap.Error(err))
+	}
 
 	// Опции для хранилища
 	options := storage.StorageOptions{
 		WALConfig:         cfg.GetWALConfig(),
 		ReplicationConfig: cfg.GetReplicationConfig(),
+		SnapshotConfig:    snapshotConfig,
+		RecoveryTarget:    recoveryTarget,
 	}
 
 	// Инициализируем хранилище с WAL и репликацией
@@ -63,14 +87,14 @@ func main() {
 		zapLogger.Info("Running in slave mode, listening for client connections")
 	}
 
-	// Создаем TCP-сервер для клиентских запросов
-	var bufferSize int
-	if cfg.Network.MaxMessageSize != "" {
-		fmt.Sscanf(cfg.Network.MaxMessageSize, "%dKB", &bufferSize)
-		bufferSize = bufferSize << 10
+	// Размер буфера чтения и жесткий предел размера сообщения
+	bufferSize, messageSizeLimit, err := cfg.GetMessageSizes()
+	if err != nil {
+		zapLogger.Fatal("Invalid network configuration", zap.Error(err))
 	}
-	if bufferSize == 0 {
-		bufferSize = 4 << 10
+	protocol, err := network.ParseProtocol(cfg.Network.Protocol)
+	if err != nil {
+		zapLogger.Fatal("Invalid network configuration", zap.Error(err))
 	}
 
 	// Создаем сетевой сервер
@@ -79,7 +103,11 @@ func main() {
 		zapLogger,
 		network.WithMaxConnections(cfg.Network.MaxConnections),
 		network.WithIdleTimeout(cfg.Network.IdleTimeout),
+		network.WithRequestTimeout(cfg.Network.RequestTimeout),
 		network.WithBufferSize(bufferSize),
+		network.WithMaxMessageSize(messageSizeLimit),
+		network.WithProtocol(protocol),
+		network.WithRESPHandler(compute.ProcessRESP),
 	)
 	if err != nil {
 		zapLogger.Fatal("Failed to create server", zap.Error(err))
@@ -101,7 +129,7 @@ func main() {
 	// Запускаем TCP сервер для клиентских запросов
 	zapLogger.Info("Starting server", zap.String("address", cfg.Network.Address))
 	server.HandleQueries(ctx, func(ctx context.Context, query []byte) []byte {
-		result, err := compute.Process(string(query))
+		result, err := compute.ProcessContext(ctx, string(query))
 		if err != nil {
 			return []byte(fmt.Sprintf("ERROR: %s", err))
 		}
@@ -110,3 +138,25 @@ func main() {
 
 	zapLogger.Info("Server stopped")
 }
+
+// parseRecoveryTarget разбирает флаги восстановления на момент времени. Без флагов возвращает nil
+func parseRecoveryTarget(lsn, at string) (*storage.RecoveryTarget, error) {
+	switch {
+	case lsn != "" && at != "":
+		return nil, errors.New("--recover-to-lsn and --recover-to-time are mutually exclusive")
+	case lsn != "":
+		n, err := strconv.ParseUint(lsn, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --recover-to-lsn %q: %w", lsn, err)
+		}
+		return &storage.RecoveryTarget{LSN: n}, nil
+	case at != "":
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --recover-to-time %q: %w", at, err)
+		}
+		return &storage.RecoveryTarget{Time: t}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/snapshot"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+)
+
+const usage = `Usage: waltool <command> [flags] <wal directory | segment files...>
+
+Commands:
+  dump                       print records as JSON lines
+  verify                     check record integrity and LSN continuity
+  stats                      print operation counts and segment sizes
+  truncate --after-lsn N     remove all records with LSN greater than N (directory only)
+`
+
+// errProblemsFound возвращается verify, если найдены ошибки; код выхода 1 без лишнего вывода
+var errProblemsFound = errors.New("problems found")
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "dump":
+		err = runDump(args, os.Stdout)
+	case "verify":
+		err = runVerify(args, os.Stdout)
+	case "stats":
+		err = runStats(args, os.Stdout)
+	case "truncate":
+		err = runTruncate(args, os.Stdout)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+
+	if errors.Is(err, errProblemsFound) {
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// segment - файл сегмента вместе с прочитанными записями
+type segment struct {
+	path       string
+	size       int64
+	logs       []wal.Log
+	corrupted  []*wal.CorruptionError
+	firstLSN   uint64 // LSN из имени файла
+	namedByLSN bool
+}
+
+// segmentPaths возвращает сегменты WAL: из директории в порядке LSN или файлы в переданном порядке.
+// Файлы с именами старого формата можно передать явно
+func segmentPaths(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, errors.New("WAL directory or segment files are required")
+	}
+
+	if len(args) == 1 {
+		info, err := os.Stat(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			names, err := wal.ListSegments(args[0])
+			if err != nil {
+				return nil, err
+			}
+			paths := make([]string, 0, len(names))
+			for _, name := range names {
+				paths = append(paths, filepath.Join(args[0], name))
+			}
+			return paths, nil
+		}
+	}
+	return args, nil
+}
+
+// readSegments читает сегменты, пропуская поврежденные записи
+func readSegments(args []string) ([]segment, error) {
+	paths, err := segmentPaths(args)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]segment, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		logs, corrupted, err := wal.ReadSegments([]string{path}, true)
+		if err != nil {
+			return nil, err
+		}
+		first, ok := wal.SegmentLSN(filepath.Base(path))
+		segments = append(segments, segment{
+			path:       path,
+			size:       info.Size(),
+			logs:       logs,
+			corrupted:  corrupted,
+			firstLSN:   first,
+			namedByLSN: ok,
+		})
+	}
+	return segments, nil
+}
+
+// runDump печатает записи построчно в JSON. Аргументы, не являющиеся корректным UTF-8,
+// выводятся в поле args_base64, как в старом формате сегментов
+func runDump(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	fromLSN := flags.Uint64("from-lsn", 0, "Print records starting from this LSN")
+	toLSN := flags.Uint64("to-lsn", ^uint64(0), "Print records up to this LSN inclusive")
+	flags.Parse(args)
+
+	segments, err := readSegments(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	for _, seg := range segments {
+		for _, corruption := range seg.corrupted {
+			fmt.Fprintf(os.Stderr, "Skipped: %v\n", corruption)
+		}
+		for _, log := range seg.logs {
+			if log.LSN < *fromLSN || log.LSN > *toLSN {
+				continue
+			}
+			if err := encoder.Encode(log); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runVerify проверяет контрольные суммы записей, непрерывность LSN и имена сегментов
+func runVerify(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args)
+
+	segments, err := readSegments(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	report := func(format string, a ...interface{}) {
+		problems++
+		fmt.Fprintf(out, "ERROR: "+format+"\n", a...)
+	}
+
+	var (
+		records  int
+		prev     uint64
+		havePrev bool
+	)
+	for _, seg := range segments {
+		name := filepath.Base(seg.path)
+		for _, corruption := range seg.corrupted {
+			report("%v", corruption)
+		}
+		if len(seg.logs) > 0 && seg.namedByLSN && seg.logs[0].LSN < seg.firstLSN {
+			report("segment %s starts with LSN %d, lower than its name", name, seg.logs[0].LSN)
+		}
+
+		for _, log := range seg.logs {
+			records++
+			if havePrev && log.LSN != prev+1 {
+				if log.LSN <= prev {
+					report("segment %s: LSN %d after %d is out of order", name, log.LSN, prev)
+				} else {
+					report("segment %s: LSN gap %d..%d", name, prev+1, log.LSN-1)
+				}
+			}
+			if log.Operation == wal.OperationBatch {
+				if _, err := wal.DecodeBatch(log.Args); err != nil {
+					report("segment %s: LSN %d: %v", name, log.LSN, err)
+				}
+			}
+			prev, havePrev = log.LSN, true
+		}
+	}
+
+	if len(segments) > 0 && len(segments[0].logs) > 0 && segments[0].logs[0].LSN != 0 {
+		fmt.Fprintf(out, "NOTE: WAL starts at LSN %d, earlier records were compacted into a snapshot\n", segments[0].logs[0].LSN)
+	}
+	fmt.Fprintf(out, "Checked %d segments, %d records, %d problems\n", len(segments), records, problems)
+
+	if problems > 0 {
+		return errProblemsFound
+	}
+	return nil
+}
+
+// runStats печатает количество операций каждого вида и размеры сегментов
+func runStats(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+
+	segments, err := readSegments(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	var (
+		totalSize  int64
+		records    int
+		corrupted  int
+		operations = make(map[string]int)
+		batched    = make(map[string]int)
+		first      *wal.Log
+		last       *wal.Log
+	)
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SEGMENT\tSIZE\tRECORDS\tFIRST LSN\tLAST LSN\tCORRUPT")
+	for _, seg := range segments {
+		totalSize += seg.size
+		records += len(seg.logs)
+		corrupted += len(seg.corrupted)
+
+		firstLSN, lastLSN := "-", "-"
+		if len(seg.logs) > 0 {
+			firstLSN = strconv.FormatUint(seg.logs[0].LSN, 10)
+			lastLSN = strconv.FormatUint(seg.logs[len(seg.logs)-1].LSN, 10)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\t%d\n",
+			filepath.Base(seg.path), formatSize(seg.size), len(seg.logs), firstLSN, lastLSN, len(seg.corrupted))
+
+		for i := range seg.logs {
+			log := &seg.logs[i]
+			operations[log.Operation]++
+			if log.Operation == wal.OperationBatch {
+				if inner, err := wal.DecodeBatch(log.Args); err == nil {
+					for _, op := range inner {
+						batched[op.Operation]++
+					}
+				}
+			}
+			if first == nil {
+				first = log
+			}
+			last = log
+		}
+	}
+	table.Flush()
+
+	fmt.Fprintf(out, "\nSegments: %d, total size: %s, records: %d, corrupt records: %d\n",
+		len(segments), formatSize(totalSize), records, corrupted)
+	if first != nil && !first.Time().IsZero() && !last.Time().IsZero() {
+		fmt.Fprintf(out, "Time range: %s .. %s\n",
+			first.Time().Format(time.RFC3339Nano), last.Time().Format(time.RFC3339Nano))
+	}
+
+	fmt.Fprintln(out, "\nOperations:")
+	table = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, op := range sortedKeys(operations) {
+		fmt.Fprintf(table, "  %s\t%d\n", op, operations[op])
+	}
+	for _, op := range sortedKeys(batched) {
+		fmt.Fprintf(table, "  %s in BATCH\t%d\n", op, batched[op])
+	}
+	return table.Flush()
+}
+
+// runTruncate удаляет записи с LSN больше --after-lsn
+func runTruncate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("truncate", flag.ExitOnError)
+	afterLSN := flags.String("after-lsn", "", "Keep records up to this LSN inclusive")
+	snapshotDir := flags.String("snapshot-dir", "", "Snapshot directory to check, defaults to the WAL directory")
+	flags.Parse(args)
+
+	if *afterLSN == "" || flags.NArg() != 1 {
+		return errors.New("usage: waltool truncate --after-lsn N <wal directory>")
+	}
+	lsn, err := strconv.ParseUint(*afterLSN, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid --after-lsn %q: %w", *afterLSN, err)
+	}
+	directory := flags.Arg(0)
+
+	// Снимок новее точки обрезки содержит удаляемые записи и будет загружен при запуске
+	if *snapshotDir == "" {
+		*snapshotDir = directory
+	}
+	snapshots, err := snapshot.List(*snapshotDir)
+	if err != nil {
+		return err
+	}
+	for _, info := range snapshots {
+		if info.LSN > lsn {
+			return fmt.Errorf("snapshot %s includes records after LSN %d, remove it before truncating", info.Path, lsn)
+		}
+	}
+
+	result, err := wal.TruncateAfter(directory, lsn)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range result.Removed {
+		fmt.Fprintf(out, "Removed %s\n", path)
+	}
+	if result.Rewritten != "" {
+		fmt.Fprintf(out, "Rewrote %s\n", result.Rewritten)
+	}
+	fmt.Fprintf(out, "Dropped %d records after LSN %d\n", result.Dropped, lsn)
+	return nil
+}
+
+// formatSize форматирует размер в байтах
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
+
+// sortedKeys возвращает ключи словаря по алфавиту
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
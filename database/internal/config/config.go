@@ -1,11 +1,16 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/replication"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/snapshot"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
 	"gopkg.in/yaml.v3"
 )
@@ -17,19 +22,25 @@ type Config struct {
 	Logging     LoggingConfig     `yaml:"logging"`
 	WAL         WALConfig         `yaml:"wal"`
 	Replication ReplicationConfig `yaml:"replication"`
+	Snapshot    SnapshotConfig    `yaml:"snapshot"`
 }
 
 // EngineConfig представляет конфигурацию движка базы данных
 type EngineConfig struct {
-	Type string `yaml:"type"`
+	Type           string `yaml:"type"`
+	MaxMemory      string `yaml:"max_memory"`      // лимит памяти, например "256MB"; пусто или 0 - без лимита
+	EvictionPolicy string `yaml:"eviction_policy"` // noeviction, allkeys-lru, allkeys-lfu, volatile-ttl
 }
 
 // NetworkConfig представляет конфигурацию сети
 type NetworkConfig struct {
-	Address        string        `yaml:"address"`
-	MaxConnections int           `yaml:"max_connections"`
-	MaxMessageSize string        `yaml:"max_message_size"`
-	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	Address          string        `yaml:"address"`
+	MaxConnections   int           `yaml:"max_connections"`
+	MaxMessageSize   string        `yaml:"max_message_size"`   // размер буфера чтения
+	MessageSizeLimit string        `yaml:"message_size_limit"` // жесткий предел размера одного сообщения
+	Protocol         string        `yaml:"protocol"`           // auto, text или resp
+	IdleTimeout      time.Duration `yaml:"idle_timeout"`
+	RequestTimeout   time.Duration `yaml:"request_timeout"` // предельное время обработки запроса, 0 - без ограничения
 }
 
 // LoggingConfig представляет конфигурацию логирования
@@ -44,26 +55,50 @@ type WALConfig struct {
 	FlushingBatchTimeout string `yaml:"flushing_batch_timeout"`
 	MaxSegmentSize       string `yaml:"max_segment_size"`
 	DataDirectory        string `yaml:"data_directory"`
+	RecoveryMode         string `yaml:"recovery_mode"`      // strict, truncate_tail или skip_corrupt
+	Fsync                string `yaml:"fsync"`              // always, batch, interval:<dur> или never
+	MaxPendingWrites     int    `yaml:"max_pending_writes"` // Предел очереди записей, ожидающих записи на диск
+	QueueTimeout         string `yaml:"queue_timeout"`      // Сколько запись ждет места в очереди
 }
 
 // ReplicationConfig представляет конфигурацию репликации
 type ReplicationConfig struct {
 	Enabled       bool   `yaml:"enabled"`        // Включена ли репликация
-	ReplicaType   string `yaml:"replica_type"`   // Тип реплики (master/slave)
+	ReplicaType   string `yaml:"replica_type"`   // Тип реплики (master/slave/raft)
 	MasterAddress string `yaml:"master_address"` // Адрес мастера (для slave)
+	ListenAddress string `yaml:"listen_address"` // Адрес сервера репликации, если узел станет мастером, или узла raft
 	SyncInterval  string `yaml:"sync_interval"`  // Интервал синхронизации
+	SyncReplicas  int    `yaml:"sync_replicas"`  // Сколько слейвов подтверждают запись, 0 - асинхронно
+	SyncTimeout   string `yaml:"sync_timeout"`   // Сколько запись ждет подтверждений слейвов
+	// Peers - адреса серверов репликации остальных узлов группы raft
+	Peers []string `yaml:"peers"`
+	// ElectionTimeout - сколько узел raft ждет лидера, прежде чем начать выборы
+	ElectionTimeout string `yaml:"election_timeout"`
+}
+
+// SnapshotConfig представляет конфигурацию снимков
+type SnapshotConfig struct {
+	Enabled          bool   `yaml:"enabled"`           // Включены ли снимки (требуется WAL)
+	Directory        string `yaml:"directory"`         // Директория снимков, по умолчанию директория WAL
+	Interval         string `yaml:"interval"`          // Период автоматических снимков, пусто или 0 - только по команде SNAPSHOT
+	Retain           int    `yaml:"retain"`            // Сколько последних снимков хранить
+	ArchiveDirectory string `yaml:"archive_directory"` // Куда переносить покрытые сегменты WAL, пусто - удалять
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		Engine: EngineConfig{
-			Type: "in_memory",
+			Type:           "in_memory",
+			EvictionPolicy: "noeviction",
 		},
 		Network: NetworkConfig{
-			Address:        "127.0.0.1:3223",
-			MaxConnections: 100,
-			MaxMessageSize: "4KB",
-			IdleTimeout:    5 * time.Minute,
+			Address:          "127.0.0.1:3223",
+			MaxConnections:   100,
+			MaxMessageSize:   "4KB",
+			MessageSizeLimit: "4MB",
+			Protocol:         "auto",
+			IdleTimeout:      5 * time.Minute,
+			RequestTimeout:   5 * time.Second,
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
@@ -75,16 +110,104 @@ func DefaultConfig() *Config {
 			FlushingBatchTimeout: "10ms",
 			MaxSegmentSize:       "10MB",
 			DataDirectory:        "/data/spider/wal",
+			RecoveryMode:         "truncate_tail",
+			Fsync:                "batch",
+			MaxPendingWrites:     10000,
+			QueueTimeout:         "1s",
 		},
 		Replication: ReplicationConfig{
-			Enabled:       false,
-			ReplicaType:   "master",
-			MasterAddress: "127.0.0.1:3232",
-			SyncInterval:  "1s",
+			Enabled:         false,
+			ReplicaType:     "master",
+			MasterAddress:   "127.0.0.1:3232",
+			SyncInterval:    "1s",
+			SyncTimeout:     "1s",
+			ElectionTimeout: "1s",
+		},
+		Snapshot: SnapshotConfig{
+			Enabled: false,
+			Retain:  2,
 		},
 	}
 }
 
+// GetMessageSizes возвращает размер буфера чтения и жесткий предел размера сообщения в байтах
+func (c *Config) GetMessageSizes() (int, int, error) {
+	bufferSize, err := parseSize(c.Network.MaxMessageSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid network.max_message_size: %w", err)
+	}
+	if bufferSize == 0 {
+		bufferSize = 4 << 10
+	}
+
+	limit, err := parseSize(c.Network.MessageSizeLimit)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid network.message_size_limit: %w", err)
+	}
+	if limit == 0 {
+		limit = 4 << 20
+	}
+
+	// Предел не может быть меньше буфера
+	if limit < bufferSize {
+		limit = bufferSize
+	}
+
+	return int(bufferSize), int(limit), nil
+}
+
+// GetEngineOptions конвертирует настройки лимита памяти в опции движка
+func (c *Config) GetEngineOptions() ([]engine.Option, error) {
+	maxMemory, err := parseSize(c.Engine.MaxMemory)
+	if err != nil {
+		return nil, fmt.Errorf("invalid engine.max_memory: %w", err)
+	}
+	if maxMemory == 0 {
+		return nil, nil
+	}
+
+	policy, err := engine.ParseEvictionPolicy(c.Engine.EvictionPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	return []engine.Option{
+		engine.WithMaxMemory(maxMemory),
+		engine.WithEvictionPolicy(policy),
+	}, nil
+}
+
+// parseSize разбирает размер вида "512", "64KB", "256MB" или "1GB" в байты
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
 // GetWALConfig конвертирует конфигурацию WAL из YAML в объект wal.WALConfig
 func (c *Config) GetWALConfig() *wal.WALConfig {
 	if !c.WAL.Enabled {
@@ -99,6 +222,11 @@ func (c *Config) GetWALConfig() *wal.WALConfig {
 		flushTimeout = 10 * time.Millisecond
 	}
 
+	var queueTimeout time.Duration
+	if c.WAL.QueueTimeout != "" {
+		queueTimeout, _ = time.ParseDuration(c.WAL.QueueTimeout)
+	}
+
 	var maxSegmentSize int64
 	if c.WAL.MaxSegmentSize != "" {
 		fmt.Sscanf(c.WAL.MaxSegmentSize, "%dMB", &maxSegmentSize)
@@ -113,6 +241,10 @@ func (c *Config) GetWALConfig() *wal.WALConfig {
 		FlushingBatchTimeout: flushTimeout,
 		MaxSegmentSize:       maxSegmentSize,
 		DataDirectory:        c.WAL.DataDirectory,
+		RecoveryMode:         wal.RecoveryMode(c.WAL.RecoveryMode),
+		Fsync:                wal.FsyncPolicy(c.WAL.Fsync),
+		MaxPendingWrites:     c.WAL.MaxPendingWrites,
+		QueueTimeout:         queueTimeout,
 	}
 }
 
@@ -148,18 +280,68 @@ func (c *Config) GetReplicationConfig() *replication.ReplicationConfig {
 		syncInterval = 1 * time.Second // По умолчанию 1 секунда
 	}
 
+	syncTimeout, err := time.ParseDuration(c.Replication.SyncTimeout)
+	if err != nil || syncTimeout <= 0 {
+		syncTimeout = 1 * time.Second // По умолчанию 1 секунда
+	}
+
+	electionTimeout, err := time.ParseDuration(c.Replication.ElectionTimeout)
+	if err != nil || electionTimeout <= 0 {
+		electionTimeout = 1 * time.Second // По умолчанию 1 секунда
+	}
+
 	var replicaType replication.ReplicationType
 	switch c.Replication.ReplicaType {
 	case "slave":
 		replicaType = replication.TypeSlave
+	case "raft":
+		replicaType = replication.TypeRaft
 	default:
 		replicaType = replication.TypeMaster
 	}
 
 	return &replication.ReplicationConfig{
-		Enabled:       c.Replication.Enabled,
-		ReplicaType:   replicaType,
-		MasterAddress: c.Replication.MasterAddress,
-		SyncInterval:  syncInterval,
+		Enabled:         c.Replication.Enabled,
+		ReplicaType:     replicaType,
+		MasterAddress:   c.Replication.MasterAddress,
+		ListenAddress:   c.Replication.ListenAddress,
+		SyncInterval:    syncInterval,
+		SyncReplicas:    c.Replication.SyncReplicas,
+		SyncTimeout:     syncTimeout,
+		Peers:           c.Replication.Peers,
+		ElectionTimeout: electionTimeout,
+	}
+}
+
+// GetSnapshotConfig преобразует конфигурацию снимков. Снимки работают только вместе с WAL
+// и не поддерживаются в режиме raft: его лог не сжимается
+func (c *Config) GetSnapshotConfig() (*snapshot.Config, error) {
+	if !c.Snapshot.Enabled || !c.WAL.Enabled {
+		return nil, nil
+	}
+	if c.Replication.Enabled && c.Replication.ReplicaType == "raft" {
+		return nil, errors.New("snapshot.enabled is not supported with raft replication, the raft log is never compacted")
 	}
+
+	var interval time.Duration
+	if c.Snapshot.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Snapshot.Interval)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid snapshot.interval %q", c.Snapshot.Interval)
+		}
+	}
+
+	directory := c.Snapshot.Directory
+	if directory == "" {
+		directory = c.WAL.DataDirectory
+	}
+
+	return &snapshot.Config{
+		Enabled:          true,
+		Directory:        directory,
+		Interval:         interval,
+		Retain:           c.Snapshot.Retain,
+		ArchiveDirectory: c.Snapshot.ArchiveDirectory,
+	}, nil
 }
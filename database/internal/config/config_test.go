@@ -94,3 +94,69 @@ func TestMissingConfigFile(t *testing.T) {
 		t.Errorf("Should use default values when file not found")
 	}
 }
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"":      0,
+		"0":     0,
+		"512":   512,
+		"512B":  512,
+		"4KB":   4 << 10,
+		"256MB": 256 << 20,
+		"1GB":   1 << 30,
+		"2mb":   2 << 20,
+	}
+
+	for input, want := range tests {
+		got, err := parseSize(input)
+		if err != nil {
+			t.Errorf("parseSize(%q) error: %v", input, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseSize(%q) = %d, want %d", input, got, want)
+		}
+	}
+
+	if _, err := parseSize("lots"); err == nil {
+		t.Errorf("parseSize() should fail on invalid input")
+	}
+}
+
+func TestGetEngineOptions(t *testing.T) {
+	cfg := DefaultConfig()
+
+	options, err := cfg.GetEngineOptions()
+	if err != nil || len(options) != 0 {
+		t.Errorf("Default config should have no engine options, got %d, %v", len(options), err)
+	}
+
+	cfg.Engine.MaxMemory = "64MB"
+	cfg.Engine.EvictionPolicy = "allkeys-lru"
+	options, err = cfg.GetEngineOptions()
+	if err != nil || len(options) != 2 {
+		t.Errorf("Expected memory limit options, got %d, %v", len(options), err)
+	}
+
+	cfg.Engine.EvictionPolicy = "random"
+	if _, err := cfg.GetEngineOptions(); err == nil {
+		t.Errorf("Expected error for unknown eviction policy")
+	}
+}
+
+func TestGetSnapshotConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WAL.Enabled = true
+	cfg.Snapshot.Enabled = true
+
+	if snapshots, err := cfg.GetSnapshotConfig(); err != nil || snapshots == nil {
+		t.Errorf("Expected snapshot config, got %v, %v", snapshots, err)
+	}
+
+	// Лог raft не сжимается, снимки в этом режиме отклоняются
+	cfg.Replication.Enabled = true
+	cfg.Replication.ReplicaType = "raft"
+	if _, err := cfg.GetSnapshotConfig(); err == nil {
+		t.Errorf("Expected error for snapshots in raft mode")
+	}
+}
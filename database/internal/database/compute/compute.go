@@ -1,10 +1,19 @@
 package compute
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/keij-sama/Concurrency/database/internal/database/compute/parser"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/network/resp"
 	"github.com/keij-sama/Concurrency/pkg/logger"
 	"go.uber.org/zap"
 )
@@ -12,6 +21,10 @@ import (
 // Compute определяет интерфейс для обработки запросов
 type Compute interface {
 	Process(input string) (string, error)
+	// ProcessContext обрабатывает запрос в контексте соединения, которому принадлежит транзакция
+	ProcessContext(ctx context.Context, input string) (string, error)
+	// ProcessRESP выполняет команду, полученную по протоколу RESP, и возвращает ответ RESP
+	ProcessRESP(ctx context.Context, args []string) resp.Value
 }
 
 // SimpleCompute реализует интерфейс Compute
@@ -30,8 +43,13 @@ func NewCompute(p parser.Parser, s storage.Storage, log logger.Logger) Compute {
 	}
 }
 
-// Process обрабатывает запрос
+// Process обрабатывает запрос вне соединения, транзакции в этом режиме недоступны
 func (c *SimpleCompute) Process(input string) (string, error) {
+	return c.ProcessContext(context.Background(), input)
+}
+
+// ProcessContext обрабатывает запрос
+func (c *SimpleCompute) ProcessContext(ctx context.Context, input string) (string, error) {
 	c.logger.Info("Processing request",
 		zap.String("input", input),
 	)
@@ -43,36 +61,369 @@ func (c *SimpleCompute) Process(input string) (string, error) {
 			zap.String("input", input),
 			zap.Error(err),
 		)
+		rejectQueued(ctx)
+		return "", err
+	}
+
+	result, handled, err := c.transaction(ctx, cmd, textResult)
+	if !handled {
+		result, err = c.execute(ctx, c.storage, cmd)
+	}
+	if err != nil {
 		return "", err
 	}
+	return formatText(result), nil
+}
+
+// execute выполняет разобранную команду и возвращает структурированный результат.
+// Операции над ключами выполняются через ops: хранилище или транзакцию. SET, GET и DEL
+// прерываются вместе с ctx, например по дедлайну запроса
+func (c *SimpleCompute) execute(ctx context.Context, ops storage.Operations, cmd *parser.Command) (resp.Value, error) {
+	var err error
 
 	// Обработка команды
 	switch cmd.Type {
 	case parser.CommandSet:
 		key, value := cmd.Arguments[0], cmd.Arguments[1]
-		err = c.storage.Set(key, value)
+		if len(cmd.Arguments) == 4 {
+			ttl, err := parseTTL(cmd.Arguments[2], cmd.Arguments[3])
+			if err != nil {
+				return resp.Value{}, err
+			}
+			err = ops.SetWithTTLCtx(ctx, key, value, ttl)
+			if err != nil {
+				return resp.Value{}, err
+			}
+			return resp.SimpleString("OK"), nil
+		}
+		err = ops.SetCtx(ctx, key, value)
 		if err != nil {
-			return "", err
+			return resp.Value{}, err
 		}
-		return "OK", nil
+		return resp.SimpleString("OK"), nil
 
 	case parser.CommandGet:
 		key := cmd.Arguments[0]
-		value, err := c.storage.Get(key)
+		value, err := ops.GetCtx(ctx, key)
 		if err != nil {
-			return "", err
+			return resp.Value{}, err
 		}
-		return value, nil
+		return resp.BulkString(value), nil
 
 	case parser.CommandDel:
 		key := cmd.Arguments[0]
-		err = c.storage.Delete(key)
+		err = ops.DeleteCtx(ctx, key)
 		if err != nil {
-			return "", err
+			return resp.Value{}, err
 		}
-		return "OK", nil
+		return resp.SimpleString("OK"), nil
 
+	case parser.CommandExpire:
+		key := cmd.Arguments[0]
+		ttl, err := parseTTL(parser.OptionEX, cmd.Arguments[1])
+		if err != nil {
+			return resp.Value{}, err
+		}
+		err = ops.ExpireCtx(ctx, key, ttl)
+		if errors.Is(err, engine.ErrKeyNotFound) {
+			return resp.Integer(0), nil
+		} else if err != nil {
+			return resp.Value{}, err
+		}
+		return resp.Integer(1), nil
+
+	case parser.CommandTTL:
+		// Как в Redis: -2 для отсутствующего ключа, -1 для ключа без срока жизни
+		ttl, err := ops.TTL(cmd.Arguments[0])
+		if errors.Is(err, engine.ErrKeyNotFound) {
+			return resp.Integer(-2), nil
+		} else if errors.Is(err, engine.ErrNoExpiration) {
+			return resp.Integer(-1), nil
+		} else if err != nil {
+			return resp.Value{}, err
+		}
+		// Округляем до ближайшего, как Redis: ключ с EX 10 сразу начинает отсчет с 9
+		return resp.Integer(int64((ttl + time.Second/2) / time.Second)), nil
+
+	case parser.CommandPersist:
+		err = ops.PersistCtx(ctx, cmd.Arguments[0])
+		if errors.Is(err, engine.ErrKeyNotFound) || errors.Is(err, engine.ErrNoExpiration) {
+			return resp.Integer(0), nil
+		} else if err != nil {
+			return resp.Value{}, err
+		}
+		return resp.Integer(1), nil
+
+	case parser.CommandIncr, parser.CommandIncrBy, parser.CommandDecr:
+		delta := int64(1)
+		switch cmd.Type {
+		case parser.CommandDecr:
+			delta = -1
+		case parser.CommandIncrBy:
+			delta, err = strconv.ParseInt(cmd.Arguments[1], 10, 64)
+			if err != nil {
+				return resp.Value{}, fmt.Errorf("invalid increment: %w", err)
+			}
+		}
+		n, err := ops.IncrByCtx(ctx, cmd.Arguments[0], delta)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return resp.Integer(n), nil
+
+	case parser.CommandSetNX:
+		stored, err := ops.SetNXCtx(ctx, cmd.Arguments[0], cmd.Arguments[1])
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return boolValue(stored), nil
+
+	case parser.CommandGetSet:
+		old, existed, err := ops.GetSetCtx(ctx, cmd.Arguments[0], cmd.Arguments[1])
+		if err != nil {
+			return resp.Value{}, err
+		}
+		if !existed {
+			return resp.Null(), nil
+		}
+		return resp.BulkString(old), nil
+
+	case parser.CommandCAS:
+		swapped, err := ops.CompareAndSwapCtx(ctx, cmd.Arguments[0], cmd.Arguments[1], cmd.Arguments[2])
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return boolValue(swapped), nil
+
+	case parser.CommandMGet:
+		values, err := ops.MGetCtx(ctx, cmd.Arguments)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		// Как в Redis: значения в порядке ключей, пустой ответ для отсутствующих
+		elems := make([]resp.Value, 0, len(cmd.Arguments))
+		for _, key := range cmd.Arguments {
+			if value, ok := values[key]; ok {
+				elems = append(elems, resp.BulkString(value))
+			} else {
+				elems = append(elems, resp.Null())
+			}
+		}
+		return resp.Array(elems...), nil
+
+	case parser.CommandMSet:
+		pairs := make([]engine.KeyValue, 0, len(cmd.Arguments)/2)
+		for i := 0; i+1 < len(cmd.Arguments); i += 2 {
+			pairs = append(pairs, engine.KeyValue{Key: cmd.Arguments[i], Value: cmd.Arguments[i+1]})
+		}
+		if err := ops.MSetCtx(ctx, pairs); err != nil {
+			return resp.Value{}, err
+		}
+		return resp.SimpleString("OK"), nil
+
+	case parser.CommandMDel:
+		deleted, err := ops.MDeleteCtx(ctx, cmd.Arguments)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return resp.Integer(int64(deleted)), nil
+
+	case parser.CommandRange:
+		limit := 0
+		if len(cmd.Arguments) == 4 {
+			limit, err = strconv.Atoi(cmd.Arguments[3])
+			if err != nil {
+				return resp.Value{}, fmt.Errorf("invalid limit: %w", err)
+			}
+		}
+		pairs, err := c.storage.Range(cmd.Arguments[0], cmd.Arguments[1], limit)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return pairsValue(pairs), nil
+
+	case parser.CommandPrefix:
+		pairs, err := c.storage.Prefix(cmd.Arguments[0])
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return pairsValue(pairs), nil
+
+	case parser.CommandScan:
+		cursor, err := strconv.ParseUint(cmd.Arguments[0], 10, 64)
+		if err != nil {
+			return resp.Value{}, fmt.Errorf("invalid cursor: %w", err)
+		}
+		pattern, count := "", 0
+		for i := 1; i+1 < len(cmd.Arguments); i += 2 {
+			switch cmd.Arguments[i] {
+			case parser.OptionMatch:
+				pattern = cmd.Arguments[i+1]
+			case parser.OptionCount:
+				count, err = strconv.Atoi(cmd.Arguments[i+1])
+				if err != nil {
+					return resp.Value{}, fmt.Errorf("invalid count: %w", err)
+				}
+			}
+		}
+		keys, next, err := c.storage.Scan(cursor, pattern, count)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		// Как в Redis: курсор для следующего вызова и массив найденных ключей
+		return resp.Array(resp.BulkString(strconv.FormatUint(next, 10)), resp.BulkStrings(keys)), nil
+
+	case parser.CommandKeys:
+		keys, err := c.storage.Keys(cmd.Arguments[0])
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return resp.BulkStrings(keys), nil
+
+	case parser.CommandSnapshot:
+		if _, err := c.storage.Snapshot(); err != nil {
+			return resp.Value{}, err
+		}
+		return resp.SimpleString("OK"), nil
+
+	case parser.CommandInfo:
+		section := ""
+		if len(cmd.Arguments) > 0 {
+			section = strings.ToLower(cmd.Arguments[0])
+		}
+		return resp.BulkString(c.info(section)), nil
+
+	case parser.CommandWait:
+		replicas, err := strconv.Atoi(cmd.Arguments[0])
+		if err != nil {
+			return resp.Value{}, fmt.Errorf("invalid number of replicas: %w", err)
+		}
+		timeout, err := strconv.ParseInt(cmd.Arguments[1], 10, 64)
+		if err != nil {
+			return resp.Value{}, fmt.Errorf("invalid timeout: %w", err)
+		}
+		// Как в Redis: количество слейвов, подтвердивших все предыдущие записи
+		acked, err := c.storage.WaitReplicas(ctx, replicas, time.Duration(timeout)*time.Millisecond)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		return resp.Integer(int64(acked)), nil
+
+	case parser.CommandReplicaOf:
+		// REPLICAOF NO ONE делает узел мастером
+		address := ""
+		if cmd.Arguments[0] != parser.OptionNo || cmd.Arguments[1] != parser.OptionOne {
+			address = net.JoinHostPort(cmd.Arguments[0], cmd.Arguments[1])
+		}
+		if err := c.storage.ReplicaOf(address); err != nil {
+			return resp.Value{}, err
+		}
+		return resp.SimpleString("OK"), nil
+
+	default:
+		return resp.Value{}, fmt.Errorf("unknown command: %s", cmd.Type)
+	}
+}
+
+// info возвращает сведения о сервере в формате INFO Redis: строки "поле:значение"
+// под заголовками разделов. Пустой section, "all" и "default" означают все разделы
+func (c *SimpleCompute) info(section string) string {
+	var b strings.Builder
+	if section == "" || section == "all" || section == "default" || section == "persistence" {
+		stats, enabled := c.storage.WALStats()
+		b.WriteString("# Persistence\r\n")
+		fmt.Fprintf(&b, "wal_enabled:%d\r\n", boolValue(enabled).Int)
+		if enabled {
+			fmt.Fprintf(&b, "wal_pending_writes:%d\r\n", stats.Pending)
+			fmt.Fprintf(&b, "wal_max_pending_writes:%d\r\n", stats.MaxPending)
+			fmt.Fprintf(&b, "wal_accepted_writes:%d\r\n", stats.Accepted)
+			fmt.Fprintf(&b, "wal_waited_writes:%d\r\n", stats.Waited)
+			fmt.Fprintf(&b, "wal_rejected_writes:%d\r\n", stats.Rejected)
+			fmt.Fprintf(&b, "wal_wait_total_usec:%d\r\n", stats.WaitTotal.Microseconds())
+			fmt.Fprintf(&b, "wal_wait_max_usec:%d\r\n", stats.WaitMax.Microseconds())
+		}
+	}
+	return b.String()
+}
+
+// boolValue представляет результат условной операции числом 1 или 0, как в Redis
+func boolValue(ok bool) resp.Value {
+	if ok {
+		return resp.Integer(1)
+	}
+	return resp.Integer(0)
+}
+
+// pairsValue представляет пары ключ-значение словарем
+func pairsValue(pairs []engine.KeyValue) resp.Value {
+	elems := make([]resp.Value, 0, 2*len(pairs))
+	for _, pair := range pairs {
+		elems = append(elems, resp.BulkString(pair.Key), resp.BulkString(pair.Value))
+	}
+	return resp.Map(elems...)
+}
+
+// textResult приводит результат команды внутри EXEC к ответу текстового протокола
+func textResult(_ string, value resp.Value, err error) resp.Value {
+	if err != nil {
+		return resp.Error(err.Error())
+	}
+	return value
+}
+
+// formatText форматирует результат для текстового протокола: элементы массивов по одному
+// на строку, пары словаря через пробел, пустой массив - "(empty)"
+func formatText(v resp.Value) string {
+	switch v.Kind {
+	case resp.KindError:
+		return "ERROR: " + v.Str
+	case resp.KindInteger:
+		return strconv.FormatInt(v.Int, 10)
+	case resp.KindNull:
+		return "(nil)"
+	case resp.KindArray, resp.KindMap:
+		lines := appendLines(nil, v)
+		if len(lines) == 0 {
+			return "(empty)"
+		}
+		return strings.Join(lines, "\n")
 	default:
-		return "", fmt.Errorf("unknown command: %s", cmd.Type)
+		return v.Str
+	}
+}
+
+// appendLines добавляет строки текстового представления значения, вложенные массивы разворачиваются
+func appendLines(lines []string, v resp.Value) []string {
+	switch v.Kind {
+	case resp.KindMap:
+		for i := 0; i+1 < len(v.Elems); i += 2 {
+			lines = append(lines, formatText(v.Elems[i])+" "+formatText(v.Elems[i+1]))
+		}
+	case resp.KindArray:
+		for _, elem := range v.Elems {
+			lines = appendLines(lines, elem)
+		}
+	default:
+		lines = append(lines, formatText(v))
+	}
+	return lines
+}
+
+// parseTTL переводит опцию EX/PX и ее значение в длительность
+func parseTTL(option, value string) (time.Duration, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expire time: %w", err)
+	}
+
+	unit := time.Second
+	if option == parser.OptionPX {
+		unit = time.Millisecond
+	}
+	// Как в Redis: срок, при котором момент истечения не помещается в int64 наносекунд,
+	// - ошибка, а не переполнение в отрицательный или слишком короткий срок
+	if n > (math.MaxInt64-time.Now().UnixNano())/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, errors.New("invalid expire time")
 	}
+	return time.Duration(n) * unit, nil
 }
@@ -0,0 +1,114 @@
+package compute
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/compute/parser"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+	"github.com/keij-sama/Concurrency/pkg/logger"
+	"go.uber.org/zap"
+)
+
+func TestExpireTimeOverflow(t *testing.T) {
+	c := newTestCompute(t)
+	ctx := newSessionContext(1)
+
+	for _, input := range []string{
+		"SET k v EX 9223372036854775807",
+		"SET k v PX 9223372036854775807",
+		"EXPIRE k 9223372036854775807",
+	} {
+		if _, err := c.ProcessContext(ctx, input); err == nil {
+			t.Errorf("ProcessContext(%q) error = nil, want invalid expire time", input)
+		}
+	}
+	if _, err := c.ProcessContext(context.Background(), "GET k"); err == nil {
+		t.Error("GET k after rejected SET succeeded, want key not found")
+	}
+
+	// Срок в 100 лет помещается в момент истечения
+	if got, err := c.ProcessContext(ctx, "SET k v EX 3153600000"); err != nil || got != "OK" {
+		t.Fatalf("SET with 100 years EX = %q, %v, want OK", got, err)
+	}
+	if got, err := c.ProcessContext(ctx, "TTL k"); err != nil || got != "3153600000" {
+		t.Errorf("TTL k = %q, %v, want 3153600000", got, err)
+	}
+
+	// TTL округляется до ближайшей секунды, как в Redis
+	for _, tt := range []struct{ px, want string }{
+		{"10400", "10"},
+		{"9600", "10"},
+		{"9400", "9"},
+		{"400", "0"},
+	} {
+		if _, err := c.ProcessContext(ctx, "SET r v PX "+tt.px); err != nil {
+			t.Fatalf("SET r v PX %s error: %v", tt.px, err)
+		}
+		if got, err := c.ProcessContext(ctx, "TTL r"); err != nil || got != tt.want {
+			t.Errorf("TTL after PX %s = %q, %v, want %s", tt.px, got, err, tt.want)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	log := logger.NewLoggerWithZap(zap.NewNop())
+	s, err := storage.NewStorage(engine.NewInMemoryEngine(), log, storage.StorageOptions{
+		WALConfig: &wal.WALConfig{
+			Enabled:              true,
+			FlushingBatchSize:    1,
+			FlushingBatchTimeout: 5 * time.Millisecond,
+			MaxSegmentSize:       1 << 20,
+			MaxPendingWrites:     128,
+			DataDirectory:        t.TempDir(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewStorage() error: %v", err)
+	}
+	defer s.Close()
+	c := NewCompute(parser.NewParser(), s, log).(*SimpleCompute)
+	ctx := newSessionContext(1)
+
+	for _, input := range []string{"SET a 1", "SET b 2", "DEL a"} {
+		if _, err := c.ProcessContext(ctx, input); err != nil {
+			t.Fatalf("ProcessContext(%q) error: %v", input, err)
+		}
+	}
+
+	// Счетчики очереди WAL доступны через INFO в обоих протоколах
+	text, err := c.ProcessContext(ctx, "INFO")
+	if err != nil {
+		t.Fatalf("INFO error: %v", err)
+	}
+	reply := c.ProcessRESP(ctx, []string{"info", "Persistence"})
+	for _, want := range []string{
+		"# Persistence\r\n",
+		"wal_enabled:1\r\n",
+		"wal_pending_writes:0\r\n",
+		"wal_max_pending_writes:128\r\n",
+		"wal_accepted_writes:3\r\n",
+		"wal_rejected_writes:0\r\n",
+		"wal_wait_max_usec:",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("INFO = %q, want %q", text, want)
+		}
+		if !strings.Contains(reply.Str, want) {
+			t.Errorf("RESP INFO persistence = %q, want %q", reply.Str, want)
+		}
+	}
+
+	if got, err := c.ProcessContext(ctx, "INFO memory"); err != nil || got != "" {
+		t.Errorf("INFO memory = %q, %v, want empty section", got, err)
+	}
+
+	// Без WAL раздел сообщает только, что WAL выключен
+	if got, err := newTestCompute(t).ProcessContext(ctx, "INFO persistence"); err != nil || got != "# Persistence\r\nwal_enabled:0\r\n" {
+		t.Errorf("INFO without WAL = %q, %v", got, err)
+	}
+}
@@ -2,14 +2,63 @@ package parser
 
 import (
 	"errors"
+	"strconv"
 	"strings"
 )
 
 // Константы для типов команд
 const (
-	CommandSet = "SET"
-	CommandGet = "GET"
-	CommandDel = "DEL"
+	CommandSet     = "SET"
+	CommandGet     = "GET"
+	CommandDel     = "DEL"
+	CommandExpire  = "EXPIRE"
+	CommandTTL     = "TTL"
+	CommandPersist = "PERSIST"
+	CommandRange   = "RANGE"
+	CommandPrefix  = "PREFIX"
+	CommandScan    = "SCAN"
+	CommandKeys    = "KEYS"
+
+	// Атомарные операции над одним ключом
+	CommandIncr   = "INCR"
+	CommandIncrBy = "INCRBY"
+	CommandDecr   = "DECR"
+	CommandSetNX  = "SETNX"
+	CommandGetSet = "GETSET"
+	CommandCAS    = "CAS"
+
+	// Операции над несколькими ключами
+	CommandMGet = "MGET"
+	CommandMSet = "MSET"
+	CommandMDel = "MDEL"
+
+	// Транзакции
+	CommandMulti   = "MULTI"
+	CommandExec    = "EXEC"
+	CommandDiscard = "DISCARD"
+	CommandWatch   = "WATCH"
+	CommandUnwatch = "UNWATCH"
+
+	// Администрирование
+	CommandSnapshot = "SNAPSHOT"
+	CommandInfo     = "INFO"
+
+	// Репликация
+	CommandWait      = "WAIT"
+	CommandReplicaOf = "REPLICAOF"
+)
+
+// Опции команд
+const (
+	OptionEX = "EX" // срок жизни в секундах
+	OptionPX = "PX" // срок жизни в миллисекундах
+
+	OptionLimit = "LIMIT" // ограничение количества результатов RANGE
+	OptionMatch = "MATCH" // шаблон ключей SCAN
+	OptionCount = "COUNT" // количество просматриваемых за вызов SCAN ключей
+
+	OptionNo  = "NO"  // REPLICAOF NO ONE - стать мастером
+	OptionOne = "ONE" // REPLICAOF NO ONE - стать мастером
 )
 
 // Cодержит типы команды (SET, GET, DEL) и список аргументов команды
@@ -21,6 +70,8 @@ type Command struct {
 // Определяет поведение для любого парсера. Любой парсер должен реализовать метод Parse, который принимает строку и возвращает указатель на Command или ошибку
 type Parser interface {
 	Parse(input string) (*Command, error)
+	// ParseArgs проверяет уже разделенную на части команду, например полученную по протоколу RESP
+	ParseArgs(parts []string) (*Command, error)
 }
 
 // Ошибки
@@ -28,8 +79,43 @@ var (
 	ErrEmptyCommand        = errors.New("empty command")
 	ErrInvalidCommand      = errors.New("invalid command")
 	ErrInvalidArgumentsNum = errors.New("invalid number of arguments")
+	ErrInvalidArgument     = errors.New("invalid argument")
 )
 
+// validators содержит проверку аргументов для каждой поддерживаемой команды
+var validators = map[string]func(args []string) error{
+	CommandSet:     validateSet,
+	CommandGet:     exactArgs(1),
+	CommandDel:     exactArgs(1),
+	CommandExpire:  validateExpire,
+	CommandTTL:     exactArgs(1),
+	CommandPersist: exactArgs(1),
+	CommandRange:   validateRange,
+	CommandPrefix:  exactArgs(1),
+	CommandScan:    validateScan,
+	CommandKeys:    exactArgs(1),
+	CommandIncr:    exactArgs(1),
+	CommandIncrBy:  validateIncrBy,
+	CommandDecr:    exactArgs(1),
+	CommandSetNX:   exactArgs(2),
+	CommandGetSet:  exactArgs(2),
+	CommandCAS:     exactArgs(3),
+	CommandMGet:    minArgs(1),
+	CommandMSet:    validateMSet,
+	CommandMDel:    minArgs(1),
+	CommandMulti:   exactArgs(0),
+	CommandExec:    exactArgs(0),
+	CommandDiscard: exactArgs(0),
+	CommandWatch:   minArgs(1),
+	CommandUnwatch: exactArgs(0),
+
+	CommandSnapshot: exactArgs(0),
+	CommandInfo:     maxArgs(1),
+
+	CommandWait:      validateWait,
+	CommandReplicaOf: validateReplicaOf,
+}
+
 // Конкретная реализация парсера
 type SimpleParser struct{}
 
@@ -45,24 +131,34 @@ func (p *SimpleParser) Parse(input string) (*Command, error) {
 		return nil, ErrEmptyCommand
 	}
 
-	// Разделяет входную строку на части
-	parts := strings.Fields(input)
+	// Разделяет входную строку на части с учетом кавычек и экранирования
+	parts, err := Tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	return p.ParseArgs(parts)
+}
+
+// ParseArgs проверяет команду, первый элемент parts - тип команды, остальные - аргументы.
+// Ключевые слова опций (EX, LIMIT, MATCH, ...) принимаются в любом регистре и приводятся к верхнему
+func (p *SimpleParser) ParseArgs(parts []string) (*Command, error) {
+	if len(parts) == 0 {
+		return nil, ErrEmptyCommand
+	}
 
 	// Извлекает тип команды (первое слово) и аргументы (все последующие слова)
 	commandType := parts[0]
-	args := parts[1:]
+	args := append([]string(nil), parts[1:]...)
 
 	// Проверяет тип команды
-	if commandType != CommandSet && commandType != CommandGet && commandType != CommandDel {
+	validate, ok := validators[commandType]
+	if !ok {
 		return nil, ErrInvalidCommand
 	}
 
-	// Проверяет количество аргументов
-	if commandType == CommandSet && len(args) != 2 {
-		return nil, ErrInvalidArgumentsNum
-	}
-	if (commandType == CommandGet || commandType == CommandDel) && len(args) != 1 {
-		return nil, ErrInvalidArgumentsNum
+	// Проверяет аргументы команды
+	if err := validate(args); err != nil {
+		return nil, err
 	}
 
 	// Если все проверки пройдены, создает и возвращает структуру Command с типом команды и аргументами
@@ -71,3 +167,162 @@ func (p *SimpleParser) Parse(input string) (*Command, error) {
 		Arguments: args,
 	}, nil
 }
+
+// exactArgs возвращает проверку точного количества аргументов
+func exactArgs(n int) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != n {
+			return ErrInvalidArgumentsNum
+		}
+		return nil
+	}
+}
+
+// minArgs возвращает проверку минимального количества аргументов
+func minArgs(n int) func(args []string) error {
+	return func(args []string) error {
+		if len(args) < n {
+			return ErrInvalidArgumentsNum
+		}
+		return nil
+	}
+}
+
+// maxArgs возвращает проверку максимального количества аргументов
+func maxArgs(n int) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > n {
+			return ErrInvalidArgumentsNum
+		}
+		return nil
+	}
+}
+
+// validateSet проверяет аргументы SET key value [EX seconds | PX milliseconds]
+func validateSet(args []string) error {
+	switch len(args) {
+	case 2:
+		return nil
+	case 4:
+		if !isOption(args, 2, OptionEX, OptionPX) {
+			return ErrInvalidArgument
+		}
+		return validatePositive(args[3])
+	default:
+		return ErrInvalidArgumentsNum
+	}
+}
+
+// validateMSet проверяет аргументы MSET key value [key value ...]
+func validateMSet(args []string) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return ErrInvalidArgumentsNum
+	}
+	return nil
+}
+
+// validateExpire проверяет аргументы EXPIRE key seconds
+func validateExpire(args []string) error {
+	if len(args) != 2 {
+		return ErrInvalidArgumentsNum
+	}
+	if _, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+// validateIncrBy проверяет аргументы INCRBY key increment
+func validateIncrBy(args []string) error {
+	if len(args) != 2 {
+		return ErrInvalidArgumentsNum
+	}
+	if _, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+// validateWait проверяет аргументы WAIT numreplicas timeout, таймаут в миллисекундах
+func validateWait(args []string) error {
+	if len(args) != 2 {
+		return ErrInvalidArgumentsNum
+	}
+	for _, arg := range args {
+		if n, err := strconv.ParseInt(arg, 10, 64); err != nil || n < 0 {
+			return ErrInvalidArgument
+		}
+	}
+	return nil
+}
+
+// validateReplicaOf проверяет аргументы REPLICAOF host port | REPLICAOF NO ONE
+func validateReplicaOf(args []string) error {
+	if len(args) != 2 {
+		return ErrInvalidArgumentsNum
+	}
+	if isOption(args, 0, OptionNo) && isOption(args, 1, OptionOne) {
+		return nil
+	}
+	if port, err := strconv.Atoi(args[1]); err != nil || port <= 0 || port > 65535 {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+// validateRange проверяет аргументы RANGE start end [LIMIT n]
+func validateRange(args []string) error {
+	switch len(args) {
+	case 2:
+		return nil
+	case 4:
+		if !isOption(args, 2, OptionLimit) {
+			return ErrInvalidArgument
+		}
+		return validatePositive(args[3])
+	default:
+		return ErrInvalidArgumentsNum
+	}
+}
+
+// validateScan проверяет аргументы SCAN cursor [MATCH pattern] [COUNT n]
+func validateScan(args []string) error {
+	if len(args) == 0 || len(args)%2 == 0 {
+		return ErrInvalidArgumentsNum
+	}
+	if _, err := strconv.ParseUint(args[0], 10, 64); err != nil {
+		return ErrInvalidArgument
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		if !isOption(args, i, OptionMatch, OptionCount) {
+			return ErrInvalidArgument
+		}
+		if args[i] == OptionCount {
+			if err := validatePositive(args[i+1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validatePositive проверяет, что аргумент - положительное целое число
+func validatePositive(arg string) error {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n <= 0 {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+// isOption проверяет, что args[i] - одна из опций без учета регистра, и приводит ее к каноническому виду
+func isOption(args []string, i int, options ...string) bool {
+	for _, option := range options {
+		if strings.EqualFold(args[i], option) {
+			args[i] = option
+			return true
+		}
+	}
+	return false
+}
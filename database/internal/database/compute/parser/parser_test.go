@@ -31,6 +31,236 @@ func TestParse(t *testing.T) {
 			args:    []string{"key"},
 			err:     false,
 		},
+		{
+			name:    "SET with EX",
+			input:   "SET key value EX 10",
+			comType: CommandSet,
+			args:    []string{"key", "value", "EX", "10"},
+		},
+		{
+			name:    "SET with PX",
+			input:   "SET key value PX 1500",
+			comType: CommandSet,
+			args:    []string{"key", "value", "PX", "1500"},
+		},
+		{
+			name:  "SET with unknown option",
+			input: "SET key value XX 10",
+			err:   true,
+		},
+		{
+			name:  "SET with non-positive EX",
+			input: "SET key value EX 0",
+			err:   true,
+		},
+		{
+			name:    "EXPIRE command",
+			input:   "EXPIRE key 60",
+			comType: CommandExpire,
+			args:    []string{"key", "60"},
+		},
+		{
+			name:  "EXPIRE with invalid seconds",
+			input: "EXPIRE key soon",
+			err:   true,
+		},
+		{
+			name:    "TTL command",
+			input:   "TTL key",
+			comType: CommandTTL,
+			args:    []string{"key"},
+		},
+		{
+			name:    "PERSIST command",
+			input:   "PERSIST key",
+			comType: CommandPersist,
+			args:    []string{"key"},
+		},
+		{
+			name:    "RANGE command",
+			input:   "RANGE a c",
+			comType: CommandRange,
+			args:    []string{"a", "c"},
+		},
+		{
+			name:    "RANGE with LIMIT",
+			input:   "RANGE a c LIMIT 10",
+			comType: CommandRange,
+			args:    []string{"a", "c", "LIMIT", "10"},
+		},
+		{
+			name:  "RANGE with invalid LIMIT",
+			input: "RANGE a c LIMIT -1",
+			err:   true,
+		},
+		{
+			name:    "PREFIX command",
+			input:   "PREFIX user:",
+			comType: CommandPrefix,
+			args:    []string{"user:"},
+		},
+		{
+			name:    "SCAN command",
+			input:   "SCAN 0",
+			comType: CommandScan,
+			args:    []string{"0"},
+		},
+		{
+			name:    "SCAN with options",
+			input:   "SCAN 4294967296 COUNT 100 MATCH user:*",
+			comType: CommandScan,
+			args:    []string{"4294967296", "COUNT", "100", "MATCH", "user:*"},
+		},
+		{
+			name:  "SCAN with invalid cursor",
+			input: "SCAN abc",
+			err:   true,
+		},
+		{
+			name:  "SCAN with missing option value",
+			input: "SCAN 0 MATCH",
+			err:   true,
+		},
+		{
+			name:    "KEYS command",
+			input:   "KEYS user:*",
+			comType: CommandKeys,
+			args:    []string{"user:*"},
+		},
+		{
+			name:    "MULTI command",
+			input:   "MULTI",
+			comType: CommandMulti,
+			args:    []string{},
+		},
+		{
+			name:  "EXEC with arguments",
+			input: "EXEC now",
+			err:   true,
+		},
+		{
+			name:    "WATCH command",
+			input:   "WATCH a b",
+			comType: CommandWatch,
+			args:    []string{"a", "b"},
+		},
+		{
+			name:  "WATCH without keys",
+			input: "WATCH",
+			err:   true,
+		},
+		{
+			name:    "INCRBY command",
+			input:   "INCRBY counter -5",
+			comType: CommandIncrBy,
+			args:    []string{"counter", "-5"},
+		},
+		{
+			name:  "INCRBY with non-integer increment",
+			input: "INCRBY counter five",
+			err:   true,
+		},
+		{
+			name:    "CAS command",
+			input:   "CAS lock owner1 owner2",
+			comType: CommandCAS,
+			args:    []string{"lock", "owner1", "owner2"},
+		},
+		{
+			name:  "CAS without new value",
+			input: "CAS lock owner1",
+			err:   true,
+		},
+		{
+			name:    "MSET command",
+			input:   "MSET a 1 b 2",
+			comType: CommandMSet,
+			args:    []string{"a", "1", "b", "2"},
+		},
+		{
+			name:  "MSET without value",
+			input: "MSET a 1 b",
+			err:   true,
+		},
+		{
+			name:    "SNAPSHOT command",
+			input:   "SNAPSHOT",
+			comType: CommandSnapshot,
+			args:    []string{},
+		},
+		{
+			name:  "SNAPSHOT with argument",
+			input: "SNAPSHOT now",
+			err:   true,
+		},
+		{
+			name:    "INFO command",
+			input:   "INFO",
+			comType: CommandInfo,
+			args:    []string{},
+		},
+		{
+			name:    "INFO with section",
+			input:   "INFO persistence",
+			comType: CommandInfo,
+			args:    []string{"persistence"},
+		},
+		{
+			name:  "INFO with two sections",
+			input: "INFO persistence memory",
+			err:   true,
+		},
+		{
+			name:    "WAIT command",
+			input:   "WAIT 1 100",
+			comType: CommandWait,
+			args:    []string{"1", "100"},
+		},
+		{
+			name:  "WAIT with negative timeout",
+			input: "WAIT 1 -5",
+			err:   true,
+		},
+		{
+			name:    "REPLICAOF command",
+			input:   "REPLICAOF 127.0.0.1 3232",
+			comType: CommandReplicaOf,
+			args:    []string{"127.0.0.1", "3232"},
+		},
+		{
+			name:    "REPLICAOF NO ONE",
+			input:   "REPLICAOF no one",
+			comType: CommandReplicaOf,
+			args:    []string{OptionNo, OptionOne},
+		},
+		{
+			name:  "REPLICAOF with invalid port",
+			input: "REPLICAOF 127.0.0.1 port",
+			err:   true,
+		},
+		{
+			name:    "MGET command",
+			input:   "MGET a b",
+			comType: CommandMGet,
+			args:    []string{"a", "b"},
+		},
+		{
+			name:    "SET with quoted value",
+			input:   `SET user:1 "{\"name\": \"A B\"}"`,
+			comType: CommandSet,
+			args:    []string{"user:1", `{"name": "A B"}`},
+		},
+		{
+			name:  "SET with unclosed quote",
+			input: `SET key "value`,
+			err:   true,
+		},
+		{
+			name:    "lowercase options",
+			input:   "SCAN 0 match user:* count 5",
+			comType: CommandScan,
+			args:    []string{"0", "MATCH", "user:*", "COUNT", "5"},
+		},
 		{
 			name:  "unknown name",
 			input: "unknown key",
@@ -79,3 +309,30 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestParseArgs(t *testing.T) {
+	p := NewParser()
+
+	// Аргументы, полученные по RESP, могут содержать пробелы и быть пустыми
+	parts := []string{CommandSet, "my key", "", "ex", "10"}
+	cmd, err := p.ParseArgs(parts)
+	if err != nil {
+		t.Fatalf("ParseArgs() error: %v", err)
+	}
+	want := []string{"my key", "", OptionEX, "10"}
+	if len(cmd.Arguments) != len(want) {
+		t.Fatalf("ParseArgs() arguments = %q, want %q", cmd.Arguments, want)
+	}
+	for i := range want {
+		if cmd.Arguments[i] != want[i] {
+			t.Errorf("ParseArgs() argument[%d] = %q, want %q", i, cmd.Arguments[i], want[i])
+		}
+	}
+	if parts[3] != "ex" {
+		t.Errorf("ParseArgs() must not modify its input")
+	}
+
+	if _, err := p.ParseArgs(nil); err != ErrEmptyCommand {
+		t.Errorf("ParseArgs(nil) error = %v, want %v", err, ErrEmptyCommand)
+	}
+}
@@ -0,0 +1,145 @@
+package parser
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrUnbalancedQuotes возвращается, если в запросе не закрыта кавычка
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes in request")
+
+// Tokenize разбивает строку запроса на аргументы по правилам redis-cli:
+//   - аргументы разделяются пробельными символами;
+//   - в двойных кавычках работают экранирования \n, \r, \t, \b, \a, \xHH и \<символ>;
+//   - в одинарных кавычках экранируется только \', остальное берется как есть;
+//   - вне кавычек обратная косая черта не экранирует, поэтому шаблоны KEYS вида \* не меняются;
+//   - закрывающая кавычка должна завершать аргумент.
+//
+// Аргументы могут содержать любые байты, в том числе пробелы, переводы строк и \x00
+func Tokenize(input string) ([]string, error) {
+	var (
+		args  []string
+		token strings.Builder
+	)
+
+	for i := 0; i < len(input); {
+		// Пропускаем пробелы между аргументами
+		if isSpace(input[i]) {
+			i++
+			continue
+		}
+
+		token.Reset()
+		for i < len(input) && !isSpace(input[i]) {
+			switch input[i] {
+			case '"':
+				end, err := readDoubleQuoted(input, i+1, &token)
+				if err != nil {
+					return nil, err
+				}
+				i = end
+			case '\'':
+				end, err := readSingleQuoted(input, i+1, &token)
+				if err != nil {
+					return nil, err
+				}
+				i = end
+			default:
+				token.WriteByte(input[i])
+				i++
+			}
+		}
+		args = append(args, token.String())
+	}
+
+	return args, nil
+}
+
+// readDoubleQuoted читает содержимое двойных кавычек начиная с позиции start
+// и возвращает позицию после закрывающей кавычки
+func readDoubleQuoted(input string, start int, token *strings.Builder) (int, error) {
+	for i := start; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == '"':
+			return closeQuote(input, i+1)
+
+		case c == '\\' && i+3 < len(input) && input[i+1] == 'x' && isHex(input[i+2]) && isHex(input[i+3]):
+			token.WriteByte(hexValue(input[i+2])<<4 | hexValue(input[i+3]))
+			i += 3
+
+		case c == '\\' && i+1 < len(input):
+			i++
+			switch input[i] {
+			case 'n':
+				token.WriteByte('\n')
+			case 'r':
+				token.WriteByte('\r')
+			case 't':
+				token.WriteByte('\t')
+			case 'b':
+				token.WriteByte('\b')
+			case 'a':
+				token.WriteByte('\a')
+			default:
+				token.WriteByte(input[i])
+			}
+
+		default:
+			token.WriteByte(c)
+		}
+	}
+	return 0, ErrUnbalancedQuotes
+}
+
+// readSingleQuoted читает содержимое одинарных кавычек начиная с позиции start
+// и возвращает позицию после закрывающей кавычки
+func readSingleQuoted(input string, start int, token *strings.Builder) (int, error) {
+	for i := start; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == '\'':
+			return closeQuote(input, i+1)
+		case c == '\\' && i+1 < len(input) && input[i+1] == '\'':
+			token.WriteByte('\'')
+			i++
+		default:
+			token.WriteByte(c)
+		}
+	}
+	return 0, ErrUnbalancedQuotes
+}
+
+// closeQuote проверяет, что за закрывающей кавычкой аргумент заканчивается
+func closeQuote(input string, next int) (int, error) {
+	if next < len(input) && !isSpace(input[next]) {
+		return 0, ErrUnbalancedQuotes
+	}
+	return next, nil
+}
+
+// isSpace проверяет, что байт - пробельный символ ASCII
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+// isHex проверяет, что байт - шестнадцатеричная цифра
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// hexValue возвращает значение шестнадцатеричной цифры
+func hexValue(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
+}
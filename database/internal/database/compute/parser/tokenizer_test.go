@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   error
+	}{
+		{
+			name:  "plain arguments",
+			input: "SET  key\tvalue",
+			want:  []string{"SET", "key", "value"},
+		},
+		{
+			name:  "double quotes with spaces",
+			input: `SET key "hello world"`,
+			want:  []string{"SET", "key", "hello world"},
+		},
+		{
+			name:  "JSON document",
+			input: `SET user:1 "{\"name\": \"A B\"}"`,
+			want:  []string{"SET", "user:1", `{"name": "A B"}`},
+		},
+		{
+			name:  "escapes in double quotes",
+			input: `SET key "line1\nline2\t\\\x00\xff"`,
+			want:  []string{"SET", "key", "line1\nline2\t\\\x00\xff"},
+		},
+		{
+			name:  "single quotes keep backslashes",
+			input: `SET key 'it\'s \n raw'`,
+			want:  []string{"SET", "key", `it's \n raw`},
+		},
+		{
+			name:  "empty quoted argument",
+			input: `SET key ""`,
+			want:  []string{"SET", "key", ""},
+		},
+		{
+			name:  "backslash outside quotes",
+			input: `KEYS user\*`,
+			want:  []string{"KEYS", `user\*`},
+		},
+		{
+			name:  "unclosed quote",
+			input: `SET key "value`,
+			err:   ErrUnbalancedQuotes,
+		},
+		{
+			name:  "text after closing quote",
+			input: `SET key "value"x`,
+			err:   ErrUnbalancedQuotes,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Tokenize(tt.input)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Tokenize() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Tokenize() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package compute
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/compute/parser"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/network/resp"
+	"go.uber.org/zap"
+)
+
+// respCommands содержит служебные команды, которые клиенты Redis отправляют при подключении
+// (redis-cli, go-redis, redis-benchmark). Они не затрагивают данные и не попадают в парсер
+var respCommands = map[string]func(args []string) resp.Value{
+	"PING":    respPing,
+	"ECHO":    respEcho,
+	"SELECT":  respSelect,
+	"COMMAND": func([]string) resp.Value { return resp.Array() },
+	"CONFIG":  respConfig,
+	"CLIENT":  func([]string) resp.Value { return resp.SimpleString("OK") },
+}
+
+// ProcessRESP выполняет команду, полученную по протоколу RESP. Имя команды не зависит от регистра
+func (c *SimpleCompute) ProcessRESP(ctx context.Context, args []string) resp.Value {
+	name := strings.ToUpper(args[0])
+	if handler, ok := respCommands[name]; ok {
+		return handler(args[1:])
+	}
+
+	c.logger.Info("Processing request",
+		zap.String("command", name),
+		zap.Int("args", len(args)-1),
+	)
+
+	parts := append([]string{name}, args[1:]...)
+	cmd, err := c.parser.ParseArgs(parts)
+	if err != nil {
+		c.logger.Error("Parse error",
+			zap.String("command", name),
+			zap.Error(err),
+		)
+		rejectQueued(ctx)
+		return respParseError(args[0], err)
+	}
+
+	result, handled, err := c.transaction(ctx, cmd, respResult)
+	if handled {
+		if err != nil {
+			return respResult("", result, err)
+		}
+		return result
+	}
+
+	result, err = c.execute(ctx, c.storage, cmd)
+	return respResult(cmd.Type, result, err)
+}
+
+// respResult приводит результат команды к ответу в стиле Redis
+func respResult(command string, result resp.Value, err error) resp.Value {
+	switch {
+	case errors.Is(err, engine.ErrKeyNotFound) && command == parser.CommandGet:
+		return resp.Null()
+	case errors.Is(err, engine.ErrKeyNotFound) && command == parser.CommandDel:
+		return resp.Integer(0)
+	case errors.Is(err, engine.ErrOutOfMemory):
+		return resp.Error("OOM " + err.Error())
+	case errors.Is(err, ErrExecAborted):
+		return resp.Error("EXECABORT " + err.Error())
+	case err != nil:
+		return resp.Error("ERR " + err.Error())
+	case command == parser.CommandDel:
+		// DEL в Redis возвращает количество удаленных ключей
+		return resp.Integer(1)
+	}
+	return result
+}
+
+// respParseError переводит ошибку парсера в текст ошибки Redis
+func respParseError(name string, err error) resp.Value {
+	switch {
+	case errors.Is(err, parser.ErrInvalidCommand):
+		return resp.Error("ERR unknown command '" + name + "'")
+	case errors.Is(err, parser.ErrInvalidArgumentsNum):
+		return resp.Error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+	default:
+		return resp.Error("ERR " + err.Error())
+	}
+}
+
+// respPing обрабатывает PING [message]
+func respPing(args []string) resp.Value {
+	switch len(args) {
+	case 0:
+		return resp.SimpleString("PONG")
+	case 1:
+		return resp.BulkString(args[0])
+	default:
+		return resp.Error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// respEcho обрабатывает ECHO message
+func respEcho(args []string) resp.Value {
+	if len(args) != 1 {
+		return resp.Error("ERR wrong number of arguments for 'echo' command")
+	}
+	return resp.BulkString(args[0])
+}
+
+// respSelect обрабатывает SELECT index: поддерживается только база 0
+func respSelect(args []string) resp.Value {
+	if len(args) != 1 {
+		return resp.Error("ERR wrong number of arguments for 'select' command")
+	}
+	if args[0] != "0" {
+		return resp.Error("ERR DB index is out of range")
+	}
+	return resp.SimpleString("OK")
+}
+
+// respConfig обрабатывает CONFIG GET: параметры Redis не поддерживаются, ответ всегда пустой
+func respConfig(args []string) resp.Value {
+	if len(args) == 0 {
+		return resp.Error("ERR wrong number of arguments for 'config' command")
+	}
+	if strings.ToUpper(args[0]) == "GET" {
+		return resp.Map()
+	}
+	return resp.Error("ERR unsupported CONFIG subcommand '" + args[0] + "'")
+}
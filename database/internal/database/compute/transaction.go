@@ -0,0 +1,203 @@
+package compute
+
+import (
+	"context"
+	"errors"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/compute/parser"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage"
+	"github.com/keij-sama/Concurrency/database/internal/network"
+	"github.com/keij-sama/Concurrency/database/internal/network/resp"
+	"go.uber.org/zap"
+)
+
+// Ошибки транзакций
+var (
+	ErrNoSession           = errors.New("transactions require a client session")
+	ErrNestedMulti         = errors.New("MULTI calls can not be nested")
+	ErrExecWithoutMulti    = errors.New("EXEC without MULTI")
+	ErrDiscardWithoutMulti = errors.New("DISCARD without MULTI")
+	ErrWatchInsideMulti    = errors.New("WATCH inside MULTI is not allowed")
+	ErrNotInTransaction    = errors.New("command is not allowed inside a transaction")
+	ErrExecAborted         = errors.New("transaction discarded because of previous errors")
+)
+
+// transactionalCommands содержит команды, которые можно поставить в очередь MULTI
+var transactionalCommands = map[string]bool{
+	parser.CommandSet:     true,
+	parser.CommandGet:     true,
+	parser.CommandDel:     true,
+	parser.CommandExpire:  true,
+	parser.CommandTTL:     true,
+	parser.CommandPersist: true,
+	parser.CommandIncr:    true,
+	parser.CommandIncrBy:  true,
+	parser.CommandDecr:    true,
+	parser.CommandSetNX:   true,
+	parser.CommandGetSet:  true,
+	parser.CommandCAS:     true,
+	parser.CommandMGet:    true,
+	parser.CommandMSet:    true,
+	parser.CommandMDel:    true,
+}
+
+// appendKeys добавляет ключи, которые затрагивает команда. У MGET и MDEL ключи - все аргументы,
+// у MSET - каждый второй, у остальных команд ключ - первый аргумент
+func appendKeys(keys []string, cmd *parser.Command) []string {
+	switch cmd.Type {
+	case parser.CommandMGet, parser.CommandMDel:
+		return append(keys, cmd.Arguments...)
+	case parser.CommandMSet:
+		for i := 0; i < len(cmd.Arguments); i += 2 {
+			keys = append(keys, cmd.Arguments[i])
+		}
+		return keys
+	default:
+		return append(keys, cmd.Arguments[0])
+	}
+}
+
+// session хранит состояние транзакции одного соединения
+type session struct {
+	multi   bool              // открыт MULTI, команды ставятся в очередь
+	failed  bool              // команда не встала в очередь, EXEC будет отклонен
+	queued  []*parser.Command // команды, ожидающие EXEC
+	watched map[string]uint64 // версии ключей на момент WATCH
+}
+
+// renderFunc приводит результат команды к ответу протокола
+type renderFunc func(command string, value resp.Value, err error) resp.Value
+
+// sessionFromContext возвращает состояние транзакции соединения или nil, если запрос пришел не из соединения
+func sessionFromContext(ctx context.Context) *session {
+	conn, ok := network.SessionFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	state, ok := conn.State().(*session)
+	if !ok {
+		state = &session{}
+		conn.SetState(state)
+	}
+	return state
+}
+
+// reset закрывает транзакцию и снимает WATCH
+func (s *session) reset() {
+	s.multi = false
+	s.failed = false
+	s.queued = nil
+	s.watched = nil
+}
+
+// rejectQueued отмечает, что команда внутри MULTI не прошла разбор, и EXEC должен быть отклонен
+func rejectQueued(ctx context.Context) {
+	if state := sessionFromContext(ctx); state != nil && state.multi {
+		state.failed = true
+	}
+}
+
+// transaction обрабатывает команды транзакций и постановку команд в очередь внутри MULTI.
+// EXEC выполняет очередь атомарно и форматирует результаты через render.
+// Возвращает false, если команду нужно выполнить обычным образом
+func (c *SimpleCompute) transaction(ctx context.Context, cmd *parser.Command, render renderFunc) (resp.Value, bool, error) {
+	state := sessionFromContext(ctx)
+
+	switch cmd.Type {
+	case parser.CommandMulti:
+		if state == nil {
+			return resp.Value{}, true, ErrNoSession
+		}
+		if state.multi {
+			return resp.Value{}, true, ErrNestedMulti
+		}
+		state.multi = true
+		return resp.SimpleString("OK"), true, nil
+
+	case parser.CommandExec:
+		if state == nil || !state.multi {
+			return resp.Value{}, true, ErrExecWithoutMulti
+		}
+		defer state.reset()
+		if state.failed {
+			return resp.Value{}, true, ErrExecAborted
+		}
+		value, err := c.exec(ctx, state, render)
+		return value, true, err
+
+	case parser.CommandDiscard:
+		if state == nil || !state.multi {
+			return resp.Value{}, true, ErrDiscardWithoutMulti
+		}
+		state.reset()
+		return resp.SimpleString("OK"), true, nil
+
+	case parser.CommandWatch:
+		if state == nil {
+			return resp.Value{}, true, ErrNoSession
+		}
+		if state.multi {
+			return resp.Value{}, true, ErrWatchInsideMulti
+		}
+		if state.watched == nil {
+			state.watched = make(map[string]uint64)
+		}
+		for _, key := range cmd.Arguments {
+			// Повторный WATCH не сдвигает уже запомненную версию
+			if _, exists := state.watched[key]; !exists {
+				state.watched[key] = c.storage.Version(key)
+			}
+		}
+		return resp.SimpleString("OK"), true, nil
+
+	case parser.CommandUnwatch:
+		if state != nil {
+			state.watched = nil
+		}
+		return resp.SimpleString("OK"), true, nil
+	}
+
+	if state != nil && state.multi {
+		if !transactionalCommands[cmd.Type] {
+			state.failed = true
+			return resp.Value{}, true, ErrNotInTransaction
+		}
+		state.queued = append(state.queued, cmd)
+		return resp.SimpleString("QUEUED"), true, nil
+	}
+
+	return resp.Value{}, false, nil
+}
+
+// exec атомарно выполняет команды из очереди. Ошибка отдельной команды не отменяет
+// остальные, как в Redis; изменение ключа из WATCH отменяет всю транзакцию
+func (c *SimpleCompute) exec(ctx context.Context, state *session, render renderFunc) (resp.Value, error) {
+	keys := make([]string, 0, len(state.queued))
+	for _, cmd := range state.queued {
+		keys = appendKeys(keys, cmd)
+	}
+
+	var results []resp.Value
+	err := c.storage.AtomicCtx(ctx, keys, state.watched, func(tx storage.Operations) error {
+		results = make([]resp.Value, 0, len(state.queued))
+		for _, cmd := range state.queued {
+			value, err := c.execute(ctx, tx, cmd)
+			results = append(results, render(cmd.Type, value, err))
+		}
+		return nil
+	})
+	if errors.Is(err, storage.ErrWatchConflict) {
+		// Как в Redis: отмененная транзакция возвращает пустой ответ
+		return resp.Null(), nil
+	}
+	if err != nil {
+		c.logger.Error("Transaction failed",
+			zap.Int("commands", len(state.queued)),
+			zap.Error(err),
+		)
+		return resp.Value{}, err
+	}
+
+	return resp.Array(results...), nil
+}
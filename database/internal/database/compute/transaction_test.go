@@ -0,0 +1,205 @@
+package compute
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/compute/parser"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/network"
+	"github.com/keij-sama/Concurrency/database/internal/network/resp"
+	"github.com/keij-sama/Concurrency/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// newTestCompute создает обработчик поверх хранилища без WAL
+func newTestCompute(t *testing.T) *SimpleCompute {
+	t.Helper()
+
+	log := logger.NewLoggerWithZap(zap.NewNop())
+	s, err := storage.NewStorage(engine.NewInMemoryEngine(), log, storage.StorageOptions{})
+	if err != nil {
+		t.Fatalf("NewStorage() error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return NewCompute(parser.NewParser(), s, log).(*SimpleCompute)
+}
+
+// newSessionContext создает контекст отдельного соединения
+func newSessionContext(id int64) context.Context {
+	return network.ContextWithSession(context.Background(), network.NewSession(id))
+}
+
+func TestTransaction(t *testing.T) {
+	c := newTestCompute(t)
+	ctx := newSessionContext(1)
+
+	steps := []struct {
+		input string
+		want  string
+	}{
+		{"SET a 1", "OK"},
+		{"MULTI", "OK"},
+		{"SET a 2", "QUEUED"},
+		{"GET a", "QUEUED"},
+		{"DEL missing", "QUEUED"},
+		{"SET b 3", "QUEUED"},
+		{"EXEC", "OK\n2\nERROR: key not found\nOK"},
+		{"GET b", "3"},
+	}
+	for _, step := range steps {
+		got, err := c.ProcessContext(ctx, step.input)
+		if err != nil {
+			t.Fatalf("ProcessContext(%q) error: %v", step.input, err)
+		}
+		if got != step.want {
+			t.Errorf("ProcessContext(%q) = %q, want %q", step.input, got, step.want)
+		}
+	}
+
+	// До EXEC изменения не видны другим соединениям
+	other := newSessionContext(2)
+	c.ProcessContext(ctx, "MULTI")
+	c.ProcessContext(ctx, "SET a 100")
+	if got, _ := c.ProcessContext(other, "GET a"); got != "2" {
+		t.Errorf("GET from another session during MULTI = %q, want %q", got, "2")
+	}
+	if got, _ := c.ProcessContext(ctx, "DISCARD"); got != "OK" {
+		t.Errorf("DISCARD = %q, want OK", got)
+	}
+	if got, _ := c.ProcessContext(ctx, "GET a"); got != "2" {
+		t.Errorf("GET after DISCARD = %q, want %q", got, "2")
+	}
+
+	// Ошибка постановки в очередь отменяет EXEC
+	c.ProcessContext(ctx, "MULTI")
+	c.ProcessContext(ctx, "SET a 5")
+	if _, err := c.ProcessContext(ctx, "SET a"); err == nil {
+		t.Errorf("invalid command inside MULTI should fail")
+	}
+	if _, err := c.ProcessContext(ctx, "EXEC"); !errors.Is(err, ErrExecAborted) {
+		t.Errorf("EXEC after invalid command error = %v, want ErrExecAborted", err)
+	}
+	if got, _ := c.ProcessContext(ctx, "GET a"); got != "2" {
+		t.Errorf("GET after aborted EXEC = %q, want %q", got, "2")
+	}
+
+	if _, err := c.ProcessContext(ctx, "EXEC"); !errors.Is(err, ErrExecWithoutMulti) {
+		t.Errorf("EXEC without MULTI error = %v, want ErrExecWithoutMulti", err)
+	}
+	if _, err := c.Process("MULTI"); !errors.Is(err, ErrNoSession) {
+		t.Errorf("MULTI without session error = %v, want ErrNoSession", err)
+	}
+}
+
+func TestTransactionWatch(t *testing.T) {
+	c := newTestCompute(t)
+	ctx := newSessionContext(1)
+	other := newSessionContext(2)
+
+	c.ProcessContext(ctx, "SET counter 1")
+
+	// Ключ изменен другим соединением между WATCH и EXEC
+	c.ProcessContext(ctx, "WATCH counter")
+	c.ProcessContext(ctx, "MULTI")
+	c.ProcessContext(ctx, "SET counter 10")
+	c.ProcessContext(other, "SET counter 2")
+	if got, _ := c.ProcessContext(ctx, "EXEC"); got != "(nil)" {
+		t.Errorf("EXEC after watched key changed = %q, want (nil)", got)
+	}
+	if got, _ := c.ProcessContext(ctx, "GET counter"); got != "2" {
+		t.Errorf("GET counter = %q, want %q", got, "2")
+	}
+
+	// EXEC снимает WATCH, следующая транзакция проходит
+	c.ProcessContext(ctx, "WATCH counter")
+	c.ProcessContext(ctx, "MULTI")
+	c.ProcessContext(ctx, "SET counter 10")
+	if got, _ := c.ProcessContext(ctx, "EXEC"); got != "OK" {
+		t.Errorf("EXEC without conflicts = %q, want OK", got)
+	}
+
+	// RESP: DEL в очереди отвечает QUEUED, а в результатах EXEC - числом
+	if got := c.ProcessRESP(ctx, []string{"multi"}); got.Str != "OK" {
+		t.Fatalf("MULTI = %+v", got)
+	}
+	if got := c.ProcessRESP(ctx, []string{"del", "counter"}); got.Str != "QUEUED" {
+		t.Errorf("queued DEL = %+v, want QUEUED", got)
+	}
+	c.ProcessRESP(ctx, []string{"get", "counter"})
+	got := c.ProcessRESP(ctx, []string{"exec"})
+	want := resp.Array(resp.Integer(1), resp.Null())
+	if string(got.Append(nil, resp.Version2)) != string(want.Append(nil, resp.Version2)) {
+		t.Errorf("EXEC = %+v, want %+v", got, want)
+	}
+}
+
+func TestTransactionAtomicCommands(t *testing.T) {
+	c := newTestCompute(t)
+	ctx := newSessionContext(1)
+
+	steps := []struct {
+		input string
+		want  string
+	}{
+		{"INCR hits", "1"},
+		{"MULTI", "OK"},
+		{"INCRBY hits 10", "QUEUED"},
+		{"DECR hits", "QUEUED"},
+		{"SETNX lock me", "QUEUED"},
+		{"CAS lock me you", "QUEUED"},
+		{"GETSET lock them", "QUEUED"},
+		{"EXEC", "11\n10\n1\n1\nyou"},
+		{"GETSET fresh value", "(nil)"},
+	}
+	for _, step := range steps {
+		got, err := c.ProcessContext(ctx, step.input)
+		if err != nil {
+			t.Fatalf("ProcessContext(%q) error: %v", step.input, err)
+		}
+		if got != step.want {
+			t.Errorf("ProcessContext(%q) = %q, want %q", step.input, got, step.want)
+		}
+	}
+
+	got := c.ProcessRESP(ctx, []string{"incr", "lock"})
+	if got.Kind != resp.KindError || got.Str != "ERR "+storage.ErrNotInteger.Error() {
+		t.Errorf("INCR of non-integer = %+v", got)
+	}
+}
+
+func TestMultiKeyCommands(t *testing.T) {
+	c := newTestCompute(t)
+	ctx := newSessionContext(1)
+
+	steps := []struct {
+		input string
+		want  string
+	}{
+		{"MSET a 1 b 2 c 3", "OK"},
+		{"MGET a missing c", "1\n(nil)\n3"},
+		{"MULTI", "OK"},
+		{"MSET a 10 d 4", "QUEUED"},
+		{"MDEL b c missing", "QUEUED"},
+		{"MGET a b d", "QUEUED"},
+		{"EXEC", "OK\n2\n10\n(nil)\n4"},
+	}
+	for _, step := range steps {
+		got, err := c.ProcessContext(ctx, step.input)
+		if err != nil {
+			t.Fatalf("ProcessContext(%q) error: %v", step.input, err)
+		}
+		if got != step.want {
+			t.Errorf("ProcessContext(%q) = %q, want %q", step.input, got, step.want)
+		}
+	}
+
+	got := c.ProcessRESP(ctx, []string{"mget", "a", "b"})
+	want := resp.Array(resp.BulkString("10"), resp.Null())
+	if string(got.Append(nil, resp.Version2)) != string(want.Append(nil, resp.Version2)) {
+		t.Errorf("MGET = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+)
+
+// ErrNotInteger возвращается, если значение ключа нельзя увеличить как целое число
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+// maxIntegerValue - самое длинное значение, которое может получить IncrBy
+var maxIntegerValue = strconv.FormatInt(math.MinInt64, 10)
+
+// Атомарные операции над одним ключом выполняются под блокировкой его партиции.
+// В WAL записывается итоговое значение как SET, поэтому повтор лога всегда дает тот же результат
+
+// IncrBy увеличивает целое значение ключа на delta и возвращает новое значение.
+// Отсутствующий ключ считается равным 0, срок жизни ключа сохраняется
+func (s *SimpleStorage) IncrBy(key string, delta int64) (int64, error) {
+	return s.IncrByCtx(context.Background(), key, delta)
+}
+
+// IncrByCtx - IncrBy, ожидание записи которого в WAL прерывается, как в SetCtx
+func (s *SimpleStorage) IncrByCtx(ctx context.Context, key string, delta int64) (int64, error) {
+	// Новое значение неизвестно до чтения ключа, поэтому память резервируется под самое длинное
+	if err := s.reserveMemory(key, maxIntegerValue); err != nil {
+		return 0, err
+	}
+
+	var result int64
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		var err error
+		result, err = tx.IncrBy(key, delta)
+		return err
+	})
+	return result, err
+}
+
+// SetNX сохраняет значение, только если ключа нет. Возвращает true, если значение сохранено
+func (s *SimpleStorage) SetNX(key, value string) (bool, error) {
+	return s.SetNXCtx(context.Background(), key, value)
+}
+
+// SetNXCtx - SetNX с контекстом, как SetCtx
+func (s *SimpleStorage) SetNXCtx(ctx context.Context, key, value string) (bool, error) {
+	if err := s.reserveMemory(key, value); err != nil {
+		return false, err
+	}
+
+	var stored bool
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		var err error
+		stored, err = tx.SetNX(key, value)
+		return err
+	})
+	return stored, err
+}
+
+// GetSet сохраняет новое значение и возвращает предыдущее. Срок жизни ключа снимается, как в SET
+func (s *SimpleStorage) GetSet(key, value string) (string, bool, error) {
+	return s.GetSetCtx(context.Background(), key, value)
+}
+
+// GetSetCtx - GetSet с контекстом, как SetCtx
+func (s *SimpleStorage) GetSetCtx(ctx context.Context, key, value string) (string, bool, error) {
+	if err := s.reserveMemory(key, value); err != nil {
+		return "", false, err
+	}
+
+	var (
+		old     string
+		existed bool
+	)
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		var err error
+		old, existed, err = tx.GetSet(key, value)
+		return err
+	})
+	return old, existed, err
+}
+
+// CompareAndSwap заменяет значение ключа на value, только если текущее значение равно expected.
+// Срок жизни ключа сохраняется, поэтому продление блокировки не делает ее вечной
+func (s *SimpleStorage) CompareAndSwap(key, expected, value string) (bool, error) {
+	return s.CompareAndSwapCtx(context.Background(), key, expected, value)
+}
+
+// CompareAndSwapCtx - CompareAndSwap с контекстом, как SetCtx
+func (s *SimpleStorage) CompareAndSwapCtx(ctx context.Context, key, expected, value string) (bool, error) {
+	if err := s.reserveMemory(key, value); err != nil {
+		return false, err
+	}
+
+	var swapped bool
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		var err error
+		swapped, err = tx.CompareAndSwap(key, expected, value)
+		return err
+	})
+	return swapped, err
+}
+
+// put сохраняет значение, сохраняя срок жизни expiresAt, и запоминает итоговый SET для WAL
+func (t *storageTx) put(key, value string, expiresAt time.Time) {
+	t.tx.Put(key, value, expiresAt)
+	if expiresAt.IsZero() {
+		t.record(wal.OperationSet, key, value)
+	} else {
+		t.record(wal.OperationSet, key, value, wal.FormatDeadline(expiresAt))
+	}
+}
+
+// IncrBy увеличивает целое значение ключа на delta
+func (t *storageTx) IncrBy(key string, delta int64) (int64, error) {
+	if t.readOnly != nil {
+		return 0, t.readOnly
+	}
+
+	var current int64
+	value, expiresAt, ok := t.tx.Lookup(key)
+	if ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		current = n
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrNotInteger
+	}
+
+	current += delta
+	t.put(key, strconv.FormatInt(current, 10), expiresAt)
+	return current, nil
+}
+
+// SetNX сохраняет значение, только если ключа нет
+func (t *storageTx) SetNX(key, value string) (bool, error) {
+	if t.readOnly != nil {
+		return false, t.readOnly
+	}
+
+	if _, _, ok := t.tx.Lookup(key); ok {
+		return false, nil
+	}
+
+	t.put(key, value, time.Time{})
+	return true, nil
+}
+
+// GetSet сохраняет новое значение и возвращает предыдущее
+func (t *storageTx) GetSet(key, value string) (string, bool, error) {
+	if t.readOnly != nil {
+		return "", false, t.readOnly
+	}
+
+	old, _, existed := t.tx.Lookup(key)
+	t.put(key, value, time.Time{})
+	return old, existed, nil
+}
+
+// CompareAndSwap заменяет значение, если текущее равно expected
+func (t *storageTx) CompareAndSwap(key, expected, value string) (bool, error) {
+	if t.readOnly != nil {
+		return false, t.readOnly
+	}
+
+	current, expiresAt, ok := t.tx.Lookup(key)
+	if !ok || current != expected {
+		return false, nil
+	}
+
+	t.put(key, value, expiresAt)
+	return true, nil
+}
+
+// IncrByCtx увеличивает значение ключа. Транзакция записывается в WAL целиком в Atomic,
+// поэтому контекст отдельной операции не используется
+func (t *storageTx) IncrByCtx(_ context.Context, key string, delta int64) (int64, error) {
+	return t.IncrBy(key, delta)
+}
+
+// SetNXCtx сохраняет значение, только если ключа нет
+func (t *storageTx) SetNXCtx(_ context.Context, key, value string) (bool, error) {
+	return t.SetNX(key, value)
+}
+
+// GetSetCtx сохраняет новое значение и возвращает предыдущее
+func (t *storageTx) GetSetCtx(_ context.Context, key, value string) (string, bool, error) {
+	return t.GetSet(key, value)
+}
+
+// CompareAndSwapCtx заменяет значение, если текущее равно expected
+func (t *storageTx) CompareAndSwapCtx(_ context.Context, key, expected, value string) (bool, error) {
+	return t.CompareAndSwap(key, expected, value)
+}
+
+// Проверяем на этапе компиляции, что транзакция реализует все операции хранилища
+var _ Operations = (*storageTx)(nil)
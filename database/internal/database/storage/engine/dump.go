@@ -0,0 +1,62 @@
+package engine
+
+import "time"
+
+// dumpEntry - копия записи, снятая под блокировкой для передачи в Dump
+type dumpEntry struct {
+	key       string
+	value     string
+	expiresAt int64
+}
+
+// Dump передает fn все живые ключи. Партиции блокируются по очереди только на время
+// копирования, fn вызывается без блокировок, поэтому запись снимка на диск не задерживает запросы
+func (e *InMemoryEngine) Dump(fn func(key, value string, expiresAt time.Time) error) error {
+	for i := range e.partitions {
+		partition := &e.partitions[i]
+
+		partition.mu.RLock()
+		now := e.clock()
+		entries := make([]dumpEntry, 0, len(partition.data))
+		for key, item := range partition.data {
+			if !item.expired(now) {
+				entries = append(entries, dumpEntry{key: key, value: item.value, expiresAt: item.expiresAt})
+			}
+		}
+		partition.mu.RUnlock()
+
+		if err := emitDump(entries, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dump передает fn все живые ключи в порядке сортировки
+func (e *OrderedMemoryEngine) Dump(fn func(key, value string, expiresAt time.Time) error) error {
+	e.mu.RLock()
+	now := e.clock()
+	var entries []dumpEntry
+	for node := e.head.next[0]; node != nil; node = node.next[0] {
+		if !node.entry.expired(now) {
+			entries = append(entries, dumpEntry{key: node.key, value: node.entry.value, expiresAt: node.entry.expiresAt})
+		}
+	}
+	e.mu.RUnlock()
+
+	return emitDump(entries, fn)
+}
+
+// emitDump передает скопированные записи в fn
+func emitDump(entries []dumpEntry, fn func(key, value string, expiresAt time.Time) error) error {
+	for _, item := range entries {
+		var expiresAt time.Time
+		if item.expiresAt != 0 {
+			expiresAt = time.Unix(0, item.expiresAt)
+		}
+		if err := fn(item.key, item.value, expiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,19 +1,36 @@
 package engine
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Константы
 const (
 	// Количество партиций в хеш-таблице
 	numPartitions = 16
+
+	// Интервал запуска фоновой очистки истекших ключей
+	sweepInterval = 100 * time.Millisecond
+	// Количество ключей с TTL, проверяемых за один проход очистки
+	sweepSampleSize = 20
+)
+
+// Типы движков, выбираемые через engine.type в конфигурации
+const (
+	TypeInMemory = "in_memory"
+	TypeOrdered  = "ordered"
 )
 
 // Errors
 var (
-	ErrKeyNotFound = errors.New("key not found")
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrNoExpiration  = errors.New("key has no expiration")
+	ErrInvalidExpiry = errors.New("invalid expiration time")
 )
 
 // Engine определяет интерфейс для хранения и получения пар ключ-значение
@@ -21,31 +38,139 @@ type Engine interface {
 	Set(key, value string) error
 	Get(key string) (string, error)
 	Delete(key string) error
+
+	// SetWithExpiration сохраняет пару ключ-значение, которая истечет в момент expiresAt
+	SetWithExpiration(key, value string, expiresAt time.Time) error
+	// Expire устанавливает абсолютный срок жизни существующего ключа
+	Expire(key string, expiresAt time.Time) error
+	// Persist снимает срок жизни с ключа
+	Persist(key string) error
+	// TTL возвращает оставшееся время жизни ключа
+	TTL(key string) (time.Duration, error)
+
+	// Scan просматривает до count ключей начиная с cursor и возвращает подходящие под
+	// glob-шаблон pattern вместе со следующим курсором. Курсор 0 начинает и завершает обход
+	Scan(cursor uint64, count int, pattern string) ([]string, uint64, error)
+
+	// Dump передает fn все живые ключи со сроками жизни (нулевое время - бессрочно) для снимка
+	Dump(fn func(key, value string, expiresAt time.Time) error) error
+
+	// Version возвращает счетчик изменений ключа для оптимистических блокировок (WATCH).
+	// Счетчик общий для группы ключей, поэтому может измениться и без изменения самого ключа
+	Version(key string) uint64
+	// Update атомарно выполняет fn над ключами keys: изменения применяются целиком и
+	// только если fn завершилась без ошибки. Обращаться через tx можно только к keys
+	Update(keys []string, fn func(tx Tx) error) error
+
+	// SetLoading включает режим загрузки: пока применяется WAL, ключи не истекают,
+	// иначе EXPIRE с прошедшим сроком, за которым следует PERSIST, потерял бы ключ
+	SetLoading(loading bool)
+
+	// Start запускает фоновые процессы движка (очистку истекших ключей)
+	Start(ctx context.Context)
+}
+
+// entry представляет значение ключа вместе со сроком его жизни
+type entry struct {
+	value     string
+	expiresAt int64 // момент истечения в наносекундах unix-времени, 0 - бессрочно
+
+	// Статистика обращений для политик вытеснения, обновляется и под блокировкой на чтение
+	lastAccess atomic.Int64
+	frequency  atomic.Uint32
+}
+
+// expired проверяет, истек ли срок жизни записи к моменту now
+func (e *entry) expired(now int64) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
 }
 
 // Partition представляет одну партицию хеш-таблицы
 type Partition struct {
-	data map[string]string
-	mu   sync.RWMutex
+	data     map[string]*entry
+	expiring map[string]struct{}    // ключи, у которых установлен срок жизни
+	used     *atomic.Int64          // общий для движка счетчик занятой памяти
+	versions [versionBuckets]uint64 // счетчики изменений ключей для WATCH
+	index    *scanIndex             // порядок обхода ключей для SCAN
+	mu       sync.RWMutex
 }
 
 // InMemoryEngine реализует in-memory движок с партицированием
 type InMemoryEngine struct {
 	partitions [numPartitions]Partition
+	now        func() time.Time
+	loading    atomic.Bool
+
+	// Ограничение памяти и вытеснение
+	maxMemory      int64
+	policy         EvictionPolicy
+	usedMemory     atomic.Int64
+	evictCursor    atomic.Uint32
+	evictionMu     sync.Mutex
+	evictionHandle func(key string) error
+
+	// Ключи, выбранные для вытеснения, но еще не удаленные, и их суммарный размер. Под evictionMu
+	evicting     map[string]int64
+	evictingSize int64
+}
+
+// Option настраивает InMemoryEngine
+type Option func(*InMemoryEngine)
+
+// WithMaxMemory ограничивает примерный объем памяти, занимаемый ключами и значениями.
+// Ноль означает отсутствие ограничения
+func WithMaxMemory(bytes int64) Option {
+	return func(e *InMemoryEngine) {
+		e.maxMemory = bytes
+	}
+}
+
+// WithEvictionPolicy задает политику вытеснения при достижении лимита памяти
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(e *InMemoryEngine) {
+		e.policy = policy
+	}
 }
 
 // NewInMemoryEngine создает новый in-memory движок
-func NewInMemoryEngine() Engine {
-	engine := &InMemoryEngine{}
+func NewInMemoryEngine(options ...Option) Engine {
+	engine := &InMemoryEngine{
+		now:      time.Now,
+		policy:   PolicyNoEviction,
+		evicting: make(map[string]int64),
+	}
+
+	for _, option := range options {
+		option(engine)
+	}
 
 	// Инициализируем партиции
 	for i := 0; i < numPartitions; i++ {
-		engine.partitions[i].data = make(map[string]string)
+		engine.partitions[i].data = make(map[string]*entry)
+		engine.partitions[i].expiring = make(map[string]struct{})
+		engine.partitions[i].used = &engine.usedMemory
+		engine.partitions[i].index = newScanIndex()
 	}
 
 	return engine
 }
 
+// New создает движок указанного типа. Пустой тип соответствует in_memory.
+// Опции ограничения памяти поддерживает только in_memory
+func New(engineType string, options ...Option) (Engine, error) {
+	switch engineType {
+	case "", TypeInMemory:
+		return NewInMemoryEngine(options...), nil
+	case TypeOrdered:
+		if len(options) > 0 {
+			return nil, errors.New("memory limit is supported only by in_memory engine")
+		}
+		return NewOrderedEngine(), nil
+	default:
+		return nil, fmt.Errorf("unknown engine type: %s", engineType)
+	}
+}
+
 // getPartition возвращает номер партиции для ключа
 func getPartition(key string) int {
 	// Простая хеш-функция для определения партиции
@@ -61,6 +186,20 @@ func getPartition(key string) int {
 	return hash % numPartitions
 }
 
+// clock возвращает текущее время в наносекундах. В режиме загрузки возвращает 0,
+// поэтому ни одна запись не считается истекшей
+func (e *InMemoryEngine) clock() int64 {
+	if e.loading.Load() {
+		return 0
+	}
+	return e.now().UnixNano()
+}
+
+// SetLoading включает или выключает режим загрузки данных из WAL
+func (e *InMemoryEngine) SetLoading(loading bool) {
+	e.loading.Store(loading)
+}
+
 // Set сохраняет пару ключ-значение
 func (e *InMemoryEngine) Set(key, value string) error {
 	// Определяем партицию
@@ -71,7 +210,29 @@ func (e *InMemoryEngine) Set(key, value string) error {
 	partition.mu.Lock()
 	defer partition.mu.Unlock()
 
-	partition.data[key] = value
+	partition.store(key, e.newEntry(value, 0))
+	return nil
+}
+
+// SetWithExpiration сохраняет пару ключ-значение со сроком жизни
+func (e *InMemoryEngine) SetWithExpiration(key, value string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		return ErrInvalidExpiry
+	}
+
+	partIdx := getPartition(key)
+	partition := &e.partitions[partIdx]
+
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	// Уже истекшая запись просто удаляет ключ
+	if expiresAt.UnixNano() <= e.clock() {
+		partition.remove(key)
+		return nil
+	}
+
+	partition.store(key, e.newEntry(value, expiresAt.UnixNano()))
 	return nil
 }
 
@@ -83,14 +244,28 @@ func (e *InMemoryEngine) Get(key string) (string, error) {
 
 	// Блокируем только нужную партицию для чтения
 	partition.mu.RLock()
-	defer partition.mu.RUnlock()
-
-	value, exists := partition.data[key]
+	item, exists := partition.data[key]
 	if !exists {
+		partition.mu.RUnlock()
 		return "", ErrKeyNotFound
 	}
 
-	return value, nil
+	if !item.expired(e.clock()) {
+		value := item.value
+		e.touch(item)
+		partition.mu.RUnlock()
+		return value, nil
+	}
+	partition.mu.RUnlock()
+
+	// Ленивое удаление: ключ истек, удаляем его под блокировкой на запись
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	if item, exists := partition.data[key]; exists && item.expired(e.clock()) {
+		partition.remove(key)
+	}
+	return "", ErrKeyNotFound
 }
 
 // Delete удаляет пару ключ-значение
@@ -103,10 +278,165 @@ func (e *InMemoryEngine) Delete(key string) error {
 	partition.mu.Lock()
 	defer partition.mu.Unlock()
 
-	if _, exists := partition.data[key]; !exists {
+	item, exists := partition.data[key]
+	if !exists {
 		return ErrKeyNotFound
 	}
 
-	delete(partition.data, key)
+	partition.remove(key)
+	if item.expired(e.clock()) {
+		return ErrKeyNotFound
+	}
 	return nil
 }
+
+// Expire устанавливает абсолютный срок жизни существующего ключа
+func (e *InMemoryEngine) Expire(key string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		return ErrInvalidExpiry
+	}
+
+	partIdx := getPartition(key)
+	partition := &e.partitions[partIdx]
+
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	now := e.clock()
+	item, exists := partition.data[key]
+	if !exists || item.expired(now) {
+		partition.remove(key)
+		return ErrKeyNotFound
+	}
+
+	// Срок в прошлом означает немедленное удаление ключа
+	if expiresAt.UnixNano() <= now {
+		partition.remove(key)
+		return nil
+	}
+
+	item.expiresAt = expiresAt.UnixNano()
+	partition.expiring[key] = struct{}{}
+	partition.versions[versionBucket(key)]++
+	return nil
+}
+
+// Persist снимает срок жизни с ключа
+func (e *InMemoryEngine) Persist(key string) error {
+	partIdx := getPartition(key)
+	partition := &e.partitions[partIdx]
+
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	item, exists := partition.data[key]
+	if !exists || item.expired(e.clock()) {
+		partition.remove(key)
+		return ErrKeyNotFound
+	}
+
+	if item.expiresAt == 0 {
+		return ErrNoExpiration
+	}
+
+	item.expiresAt = 0
+	delete(partition.expiring, key)
+	partition.versions[versionBucket(key)]++
+	return nil
+}
+
+// TTL возвращает оставшееся время жизни ключа
+func (e *InMemoryEngine) TTL(key string) (time.Duration, error) {
+	partIdx := getPartition(key)
+	partition := &e.partitions[partIdx]
+
+	partition.mu.RLock()
+	defer partition.mu.RUnlock()
+
+	now := e.now().UnixNano()
+	item, exists := partition.data[key]
+	if !exists || item.expired(e.clock()) {
+		return 0, ErrKeyNotFound
+	}
+
+	if item.expiresAt == 0 {
+		return 0, ErrNoExpiration
+	}
+
+	return time.Duration(item.expiresAt - now), nil
+}
+
+// Start запускает фоновую очистку истекших ключей, по одной горутине на партицию
+func (e *InMemoryEngine) Start(ctx context.Context) {
+	for i := 0; i < numPartitions; i++ {
+		go e.sweepLoop(ctx, &e.partitions[i])
+	}
+}
+
+// sweepLoop периодически удаляет истекшие ключи из партиции
+func (e *InMemoryEngine) sweepLoop(ctx context.Context, partition *Partition) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Как и в Redis, повторяем проход, пока истекших ключей в выборке много
+			for partition.sweep(e.clock()) > sweepSampleSize/4 {
+			}
+		}
+	}
+}
+
+// sweep проверяет выборку ключей с TTL и удаляет истекшие, возвращает количество удаленных
+func (p *Partition) sweep(now int64) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	checked, removed := 0, 0
+	for key := range p.expiring {
+		if checked >= sweepSampleSize {
+			break
+		}
+		checked++
+
+		if item, exists := p.data[key]; !exists || item.expired(now) {
+			p.remove(key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// store сохраняет запись в партиции и учитывает занятую память, вызывается под блокировкой на запись
+func (p *Partition) store(key string, item *entry) {
+	delta := entrySize(key, item.value)
+	if old, exists := p.data[key]; exists {
+		delta -= entrySize(key, old.value)
+	} else {
+		p.index.insert(key)
+	}
+	p.used.Add(delta)
+
+	p.data[key] = item
+	p.versions[versionBucket(key)]++
+	if item.expiresAt != 0 {
+		p.expiring[key] = struct{}{}
+	} else {
+		delete(p.expiring, key)
+	}
+}
+
+// remove удаляет ключ из партиции, вызывается под блокировкой на запись
+func (p *Partition) remove(key string) {
+	if old, exists := p.data[key]; exists {
+		p.used.Add(-entrySize(key, old.value))
+		p.versions[versionBucket(key)]++
+		p.index.delete(key)
+	}
+	delete(p.data, key)
+	delete(p.expiring, key)
+}
@@ -1,6 +1,11 @@
 package engine
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
 
 func TestInMemoryEngine(t *testing.T) {
 	t.Run("Set and Get", func(t *testing.T) {
@@ -51,3 +56,99 @@ func TestInMemoryEngine(t *testing.T) {
 		}
 	})
 }
+
+func TestInMemoryEngineExpiration(t *testing.T) {
+	t.Run("Expired key is not returned", func(t *testing.T) {
+		e := NewInMemoryEngine()
+
+		if err := e.SetWithExpiration("key", "value", time.Now().Add(20*time.Millisecond)); err != nil {
+			t.Fatalf("SetWithExpiration() error: %v", err)
+		}
+
+		if val, err := e.Get("key"); err != nil || val != "value" {
+			t.Fatalf("Get() before expiration = %q, %v", val, err)
+		}
+
+		time.Sleep(30 * time.Millisecond)
+
+		if _, err := e.Get("key"); err != ErrKeyNotFound {
+			t.Errorf("Get() after expiration should return ErrKeyNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Deadline in the past deletes the key", func(t *testing.T) {
+		e := NewInMemoryEngine()
+		e.Set("key", "value")
+
+		if err := e.SetWithExpiration("key", "new", time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("SetWithExpiration() error: %v", err)
+		}
+
+		if _, err := e.Get("key"); err != ErrKeyNotFound {
+			t.Errorf("Get() should return ErrKeyNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Expire, TTL and Persist", func(t *testing.T) {
+		e := NewInMemoryEngine()
+
+		if err := e.Expire("missing", time.Now().Add(time.Minute)); err != ErrKeyNotFound {
+			t.Errorf("Expire() of a missing key should return ErrKeyNotFound, got %v", err)
+		}
+
+		e.Set("key", "value")
+		if _, err := e.TTL("key"); err != ErrNoExpiration {
+			t.Errorf("TTL() of a key without expiration should return ErrNoExpiration, got %v", err)
+		}
+
+		if err := e.Expire("key", time.Now().Add(time.Minute)); err != nil {
+			t.Fatalf("Expire() error: %v", err)
+		}
+
+		ttl, err := e.TTL("key")
+		if err != nil {
+			t.Fatalf("TTL() error: %v", err)
+		}
+		if ttl <= 0 || ttl > time.Minute {
+			t.Errorf("TTL() = %v, want (0, 1m]", ttl)
+		}
+
+		if err := e.Persist("key"); err != nil {
+			t.Fatalf("Persist() error: %v", err)
+		}
+		if err := e.Persist("key"); err != ErrNoExpiration {
+			t.Errorf("second Persist() should return ErrNoExpiration, got %v", err)
+		}
+
+		// Set без срока сбрасывает ранее установленный TTL
+		e.Expire("key", time.Now().Add(time.Minute))
+		e.Set("key", "value2")
+		if _, err := e.TTL("key"); err != ErrNoExpiration {
+			t.Errorf("Set() should clear expiration, got %v", err)
+		}
+	})
+
+	t.Run("Background sweeper removes expired keys", func(t *testing.T) {
+		e := NewInMemoryEngine().(*InMemoryEngine)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		e.Start(ctx)
+
+		for i := 0; i < 100; i++ {
+			e.SetWithExpiration(fmt.Sprintf("key%d", i), "value", time.Now().Add(10*time.Millisecond))
+		}
+
+		time.Sleep(10*time.Millisecond + 3*sweepInterval)
+
+		for i := range e.partitions {
+			p := &e.partitions[i]
+			p.mu.RLock()
+			remaining := len(p.data)
+			p.mu.RUnlock()
+			if remaining != 0 {
+				t.Errorf("partition %d still holds %d expired keys", i, remaining)
+			}
+		}
+	})
+}
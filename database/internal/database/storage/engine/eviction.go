@@ -0,0 +1,320 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// EvictionPolicy определяет, какие ключи вытесняются при достижении лимита памяти
+type EvictionPolicy string
+
+const (
+	// PolicyNoEviction - новые записи отклоняются с ErrOutOfMemory
+	PolicyNoEviction EvictionPolicy = "noeviction"
+	// PolicyAllKeysLRU - вытесняются давно не использованные ключи
+	PolicyAllKeysLRU EvictionPolicy = "allkeys-lru"
+	// PolicyAllKeysLFU - вытесняются редко используемые ключи
+	PolicyAllKeysLFU EvictionPolicy = "allkeys-lfu"
+	// PolicyVolatileTTL - вытесняются ключи с ближайшим сроком истечения
+	PolicyVolatileTTL EvictionPolicy = "volatile-ttl"
+)
+
+const (
+	// Примерные накладные расходы на запись: узел карты, указатель и структура entry
+	entryOverhead = 64
+
+	// Количество партиций и ключей в каждой из них, просматриваемых при выборе жертвы
+	evictionPartitions = 4
+	evictionSamples    = 5
+
+	// Параметры логарифмического счетчика LFU, как в Redis
+	lfuInitValue   = 5
+	lfuLogFactor   = 10
+	lfuDecayPeriod = time.Minute
+	lfuMaxValue    = 255
+)
+
+// ErrOutOfMemory возвращается, если запись не помещается в лимит памяти
+var ErrOutOfMemory = errors.New("out of memory: max_memory limit reached")
+
+// Evictor реализуется движками с ограничением памяти
+type Evictor interface {
+	// Reserve освобождает память под запись key=value согласно политике вытеснения.
+	// Вызывается до записи в WAL, чтобы удаления попали в лог раньше самой записи
+	Reserve(key, value string) error
+	// ReserveSize освобождает size байт согласно политике вытеснения, например под изменения
+	// транзакции. Как и Reserve, вызывается до записи в WAL
+	ReserveSize(size int64) error
+	// SetEvictionHandler задает функцию, которая удаляет выбранный для вытеснения ключ вместо
+	// движка, например сначала записав удаление в WAL. Ошибка функции прерывает освобождение
+	// памяти и возвращается из Reserve, кроме ErrKeyNotFound: ключ уже удален
+	SetEvictionHandler(handler func(key string) error)
+	// UsedMemory возвращает примерный объем занятой памяти в байтах
+	UsedMemory() int64
+	// MaxMemory возвращает лимит памяти в байтах, 0 - без лимита
+	MaxMemory() int64
+}
+
+// ParseEvictionPolicy разбирает название политики вытеснения. Пустая строка означает noeviction
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch policy := EvictionPolicy(name); policy {
+	case "":
+		return PolicyNoEviction, nil
+	case PolicyNoEviction, PolicyAllKeysLRU, PolicyAllKeysLFU, PolicyVolatileTTL:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown eviction policy: %s", name)
+	}
+}
+
+// entrySize возвращает примерный размер записи в памяти
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value) + entryOverhead)
+}
+
+// newEntry создает запись с начальной статистикой обращений
+func (e *InMemoryEngine) newEntry(value string, expiresAt int64) *entry {
+	item := &entry{value: value, expiresAt: expiresAt}
+	item.lastAccess.Store(e.now().UnixNano())
+	item.frequency.Store(lfuInitValue)
+	return item
+}
+
+// touch обновляет статистику обращений к записи, если она нужна политике
+func (e *InMemoryEngine) touch(item *entry) {
+	switch e.policy {
+	case PolicyAllKeysLRU:
+		item.lastAccess.Store(e.now().UnixNano())
+	case PolicyAllKeysLFU:
+		now := e.now().UnixNano()
+		counter := lfuDecay(item, now)
+		item.frequency.Store(lfuIncrement(counter))
+		item.lastAccess.Store(now)
+	}
+}
+
+// lfuDecay возвращает счетчик LFU, уменьшенный на число прошедших периодов без обращений
+func lfuDecay(item *entry, now int64) uint32 {
+	counter := item.frequency.Load()
+	periods := uint32((now - item.lastAccess.Load()) / int64(lfuDecayPeriod))
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// lfuIncrement увеличивает счетчик LFU с вероятностью, убывающей по мере его роста
+func lfuIncrement(counter uint32) uint32 {
+	if counter >= lfuMaxValue {
+		return counter
+	}
+
+	base := float64(counter) - lfuInitValue
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// SetEvictionHandler задает функцию, которая удаляет выбранный для вытеснения ключ вместо движка
+func (e *InMemoryEngine) SetEvictionHandler(handler func(key string) error) {
+	e.evictionMu.Lock()
+	defer e.evictionMu.Unlock()
+
+	e.evictionHandle = handler
+}
+
+// UsedMemory возвращает примерный объем занятой памяти в байтах
+func (e *InMemoryEngine) UsedMemory() int64 {
+	return e.usedMemory.Load()
+}
+
+// MaxMemory возвращает лимит памяти в байтах, 0 - без лимита
+func (e *InMemoryEngine) MaxMemory() int64 {
+	return e.maxMemory
+}
+
+// Reserve освобождает память под запись key=value согласно политике вытеснения
+func (e *InMemoryEngine) Reserve(key, value string) error {
+	if e.maxMemory <= 0 {
+		return nil
+	}
+
+	// Учитываем, что перезапись ключа освобождает память старого значения
+	delta := entrySize(key, value)
+	partition := &e.partitions[getPartition(key)]
+	partition.mu.RLock()
+	if old, exists := partition.data[key]; exists {
+		delta -= entrySize(key, old.value)
+	}
+	partition.mu.RUnlock()
+
+	return e.ReserveSize(delta)
+}
+
+// ReserveSize освобождает size байт согласно политике вытеснения. Вызывается без блокировок
+// партиций: вытеснение блокирует партиции жертв
+func (e *InMemoryEngine) ReserveSize(size int64) error {
+	if e.maxMemory <= 0 {
+		return nil
+	}
+
+	// Жертвы выбираются под evictionMu, а удаляются без нее: обработчик вытеснения может
+	// ждать записи в WAL, и остальные записи не должны стоять за ним в очереди
+	for {
+		victims, handler, err := e.pickVictims(size)
+		if err != nil || len(victims) == 0 {
+			return err
+		}
+
+		for i, victim := range victims {
+			if err := e.evictVictim(victim, handler); err != nil {
+				e.releaseVictims(victims[i+1:])
+				return err
+			}
+		}
+	}
+}
+
+// pickVictims выбирает ключи, вытеснение которых освобождает память под size байт, с учетом
+// ключей, уже выбранных другими вызовами. Выбранные ключи учитываются в evicting, пока
+// не будут удалены. Пустой результат означает, что память уже есть
+func (e *InMemoryEngine) pickVictims(size int64) ([]string, func(key string) error, error) {
+	e.evictionMu.Lock()
+	defer e.evictionMu.Unlock()
+
+	excess := e.usedMemory.Load() + size - e.evictingSize - e.maxMemory
+	if excess <= 0 {
+		return nil, nil, nil
+	}
+	if e.policy == PolicyNoEviction {
+		return nil, nil, ErrOutOfMemory
+	}
+
+	var victims []string
+	for freed := int64(0); freed < excess; {
+		victim, victimSize, ok := e.pickVictim()
+		if !ok {
+			break
+		}
+		e.evicting[victim] = victimSize
+		e.evictingSize += victimSize
+		victims = append(victims, victim)
+		freed += victimSize
+	}
+
+	// Если ключей не хватило, следующий вызов после их удаления не найдет новых и вернет ошибку
+	if len(victims) == 0 {
+		return nil, nil, ErrOutOfMemory
+	}
+	return victims, e.evictionHandle, nil
+}
+
+// evictVictim удаляет выбранный ключ сам или через обработчик вытеснения
+func (e *InMemoryEngine) evictVictim(key string, handler func(key string) error) error {
+	defer e.releaseVictims([]string{key})
+
+	if handler == nil {
+		e.evict(key)
+		return nil
+	}
+	if err := handler(key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+// releaseVictims снимает с ключей отметку о выбранном вытеснении
+func (e *InMemoryEngine) releaseVictims(keys []string) {
+	e.evictionMu.Lock()
+	defer e.evictionMu.Unlock()
+
+	for _, key := range keys {
+		e.evictingSize -= e.evicting[key]
+		delete(e.evicting, key)
+	}
+}
+
+// pickVictim выбирает ключ для вытеснения по выборке из нескольких партиций, как это делает Redis,
+// и возвращает его размер. Ключи, уже выбранные для вытеснения, пропускаются. Вызывается под evictionMu
+func (e *InMemoryEngine) pickVictim() (string, int64, bool) {
+	var (
+		victim string
+		size   int64
+		best   int64
+		found  bool
+	)
+
+	now := e.now().UnixNano()
+	start := int(e.evictCursor.Add(1))
+	for i := 0; i < numPartitions; i++ {
+		partition := &e.partitions[(start+i)%numPartitions]
+
+		partition.mu.RLock()
+		sampled := 0
+		// Порядок обхода карты в Go случайный, поэтому первые ключи - случайная выборка
+		if e.policy == PolicyVolatileTTL {
+			for key := range partition.expiring {
+				if sampled >= evictionSamples {
+					break
+				}
+				if _, chosen := e.evicting[key]; chosen {
+					continue
+				}
+				sampled++
+				if item, exists := partition.data[key]; exists && (!found || item.expiresAt < best) {
+					victim, size, best, found = key, entrySize(key, item.value), item.expiresAt, true
+				}
+			}
+		} else {
+			for key, item := range partition.data {
+				if sampled >= evictionSamples {
+					break
+				}
+				if _, chosen := e.evicting[key]; chosen {
+					continue
+				}
+				sampled++
+				if score := e.evictionScore(item, now); !found || score < best {
+					victim, size, best, found = key, entrySize(key, item.value), score, true
+				}
+			}
+		}
+		partition.mu.RUnlock()
+
+		// Достаточно нескольких непустых партиций, но пустые не считаются
+		if found && i+1 >= evictionPartitions {
+			break
+		}
+	}
+
+	return victim, size, found
+}
+
+// evictionScore возвращает оценку записи: чем меньше, тем раньше ее стоит вытеснить
+func (e *InMemoryEngine) evictionScore(item *entry, now int64) int64 {
+	if e.policy == PolicyAllKeysLFU {
+		// При равной частоте раньше вытесняется давно не использованный ключ
+		return int64(lfuDecay(item, now))<<40 | (item.lastAccess.Load() >> 24)
+	}
+	return item.lastAccess.Load()
+}
+
+// evict удаляет выбранный ключ, возвращает false, если ключ уже удален
+func (e *InMemoryEngine) evict(key string) bool {
+	partition := &e.partitions[getPartition(key)]
+
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	if _, exists := partition.data[key]; !exists {
+		return false
+	}
+	partition.remove(key)
+	return true
+}
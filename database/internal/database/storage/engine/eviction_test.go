@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fill записывает count ключей через Reserve, как это делает хранилище
+func fill(t *testing.T, e *InMemoryEngine, prefix string, count int, value string) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		if err := e.Reserve(key, value); err != nil {
+			t.Fatalf("Reserve(%s) error: %v", key, err)
+		}
+		e.Set(key, value)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	limit := 20 * entrySize("key00", value)
+
+	t.Run("noeviction rejects writes", func(t *testing.T) {
+		e := NewInMemoryEngine(WithMaxMemory(limit)).(*InMemoryEngine)
+		fill(t, e, "key", 10, value)
+
+		for i := 10; i < 40; i++ {
+			key := fmt.Sprintf("key%d", i)
+			if err := e.Reserve(key, value); err != nil {
+				if err != ErrOutOfMemory {
+					t.Fatalf("Reserve() error = %v, want ErrOutOfMemory", err)
+				}
+				return
+			}
+			e.Set(key, value)
+		}
+		t.Errorf("Reserve() should fail once max_memory is reached")
+	})
+
+	t.Run("allkeys-lru evicts cold keys", func(t *testing.T) {
+		e := NewInMemoryEngine(WithMaxMemory(limit), WithEvictionPolicy(PolicyAllKeysLRU)).(*InMemoryEngine)
+
+		var evicted []string
+		e.SetEvictionHandler(func(key string) error {
+			evicted = append(evicted, key)
+			return e.Delete(key)
+		})
+
+		fill(t, e, "hot", 5, value)
+		time.Sleep(time.Millisecond)
+		fill(t, e, "cold", 10, value)
+		time.Sleep(time.Millisecond)
+
+		// Обращения к горячим ключам делают их самыми свежими
+		for i := 0; i < 5; i++ {
+			e.Get(fmt.Sprintf("hot%d", i))
+		}
+
+		fill(t, e, "new", 20, value)
+
+		if used := e.UsedMemory(); used > limit {
+			t.Errorf("UsedMemory() = %d, exceeds limit %d", used, limit)
+		}
+		if len(evicted) == 0 {
+			t.Fatalf("expected keys to be evicted")
+		}
+		for _, key := range evicted {
+			if _, err := e.Get(key); err != ErrKeyNotFound {
+				t.Errorf("evicted key %s is still present", key)
+			}
+		}
+	})
+
+	t.Run("allkeys-lfu keeps frequently used keys", func(t *testing.T) {
+		e := NewInMemoryEngine(WithMaxMemory(limit), WithEvictionPolicy(PolicyAllKeysLFU)).(*InMemoryEngine)
+
+		fill(t, e, "freq", 5, value)
+		for n := 0; n < 200; n++ {
+			for i := 0; i < 5; i++ {
+				e.Get(fmt.Sprintf("freq%d", i))
+			}
+		}
+		fill(t, e, "rare", 40, value)
+
+		kept := 0
+		for i := 0; i < 5; i++ {
+			if _, err := e.Get(fmt.Sprintf("freq%d", i)); err == nil {
+				kept++
+			}
+		}
+		if kept < 3 {
+			t.Errorf("only %d of 5 frequently used keys survived eviction", kept)
+		}
+	})
+
+	t.Run("volatile-ttl evicts only keys with expiration", func(t *testing.T) {
+		e := NewInMemoryEngine(WithMaxMemory(limit), WithEvictionPolicy(PolicyVolatileTTL)).(*InMemoryEngine)
+
+		fill(t, e, "persistent", 10, value)
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("volatile%d", i)
+			if err := e.Reserve(key, value); err != nil {
+				t.Fatalf("Reserve() error: %v", err)
+			}
+			e.SetWithExpiration(key, value, time.Now().Add(time.Duration(i+1)*time.Hour))
+		}
+
+		// Место заканчивается: вытесняются только ключи с TTL, затем запись отклоняется
+		var err error
+		for i := 0; i < 20 && err == nil; i++ {
+			key := fmt.Sprintf("extra%d", i)
+			if err = e.Reserve(key, value); err == nil {
+				e.Set(key, value)
+			}
+		}
+		if err != ErrOutOfMemory {
+			t.Errorf("Reserve() should fail when no volatile keys are left, got %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := e.Get(fmt.Sprintf("persistent%d", i)); err != nil {
+				t.Errorf("persistent%d should not be evicted", i)
+			}
+		}
+	})
+
+	t.Run("failed eviction fails the reservation", func(t *testing.T) {
+		e := NewInMemoryEngine(WithMaxMemory(limit), WithEvictionPolicy(PolicyAllKeysLRU)).(*InMemoryEngine)
+		fill(t, e, "key", 20, value)
+
+		// Обработчик отказал: ключ остается, а память не считается освобожденной
+		errRejected := errors.New("rejected")
+		var victim string
+		e.SetEvictionHandler(func(key string) error {
+			victim = key
+			return errRejected
+		})
+		if err := e.Reserve("new", value); !errors.Is(err, errRejected) {
+			t.Fatalf("Reserve() error = %v, want handler error", err)
+		}
+		if _, err := e.Get(victim); err != nil {
+			t.Errorf("Key %s was removed although its eviction failed: %v", victim, err)
+		}
+
+		e.SetEvictionHandler(func(key string) error { return e.Delete(key) })
+		if err := e.Reserve("new", value); err != nil {
+			t.Errorf("Reserve() after handler recovered error: %v", err)
+		}
+		if len(e.evicting) != 0 || e.evictingSize != 0 {
+			t.Errorf("Victims left marked for eviction: %v", e.evicting)
+		}
+	})
+
+	t.Run("slow eviction does not block other reservations", func(t *testing.T) {
+		e := NewInMemoryEngine(WithMaxMemory(limit), WithEvictionPolicy(PolicyAllKeysLRU)).(*InMemoryEngine)
+		fill(t, e, "key", 20, value)
+
+		// Первое вытеснение ждет, как запись удаления в WAL
+		release := make(chan struct{})
+		started := make(chan struct{})
+		var once sync.Once
+		e.SetEvictionHandler(func(key string) error {
+			blocked := false
+			once.Do(func() { blocked = true })
+			if blocked {
+				close(started)
+				<-release
+			}
+			return e.Delete(key)
+		})
+
+		slow := make(chan error, 1)
+		go func() { slow <- e.Reserve("slow", value) }()
+		<-started
+
+		done := make(chan error, 1)
+		go func() { done <- e.Reserve("fast", value) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Reserve() error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Reserve() waited for another eviction")
+		}
+
+		close(release)
+		if err := <-slow; err != nil {
+			t.Errorf("Reserve() with slow eviction error: %v", err)
+		}
+	})
+
+	t.Run("memory accounting", func(t *testing.T) {
+		e := NewInMemoryEngine().(*InMemoryEngine)
+
+		e.Set("key", "value")
+		e.Set("key", "longer value")
+		if want := entrySize("key", "longer value"); e.UsedMemory() != want {
+			t.Errorf("UsedMemory() = %d, want %d", e.UsedMemory(), want)
+		}
+
+		e.Delete("key")
+		if e.UsedMemory() != 0 {
+			t.Errorf("UsedMemory() after Delete() = %d, want 0", e.UsedMemory())
+		}
+	})
+}
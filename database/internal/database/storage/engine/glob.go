@@ -0,0 +1,99 @@
+package engine
+
+// matchPattern проверяет ключ на соответствие glob-шаблону в стиле Redis:
+// * - любая последовательность, ? - любой символ, [abc], [a-z] и [^a] - классы символов,
+// \ экранирует следующий символ. В отличие от path.Match, символ / не особенный
+func matchPattern(pattern, key string) bool {
+	p, k := 0, 0
+	// Позиции для возврата к последней звездочке
+	starP, starK := -1, 0
+
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starK = p, k
+				p++
+				continue
+			case '?':
+				p++
+				k++
+				continue
+			case '[':
+				if next, ok := matchClass(pattern, p, key[k]); ok {
+					p = next
+					k++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == key[k] {
+					p += 2
+					k++
+					continue
+				}
+			default:
+				if pattern[p] == key[k] {
+					p++
+					k++
+					continue
+				}
+			}
+		}
+
+		// Несовпадение: пробуем поглотить еще один символ последней звездочкой
+		if starP < 0 {
+			return false
+		}
+		starK++
+		p, k = starP+1, starK
+	}
+
+	// Оставшиеся в шаблоне звездочки совпадают с пустой строкой
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass проверяет символ c на принадлежность классу, начинающемуся в pattern[start] == '['.
+// Возвращает позицию после класса и признак совпадения
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	i := start + 1
+	negate := false
+	if i < len(pattern) && pattern[i] == '^' {
+		negate = true
+		i++
+	}
+
+	matched := false
+	for i < len(pattern) && pattern[i] != ']' {
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		i++
+
+		hi := lo
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			hi = pattern[i+1]
+			if hi == '\\' && i+2 < len(pattern) {
+				i++
+				hi = pattern[i+1]
+			}
+			i += 2
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+
+	// Незакрытый класс ничему не соответствует
+	if i >= len(pattern) {
+		return i, false
+	}
+	return i + 1, matched != negate
+}
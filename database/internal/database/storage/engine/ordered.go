@@ -0,0 +1,380 @@
+package engine
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Максимальная высота списка с пропусками, достаточная для ~2^32 ключей
+	skipListMaxLevel = 32
+	// Вероятность перехода узла на следующий уровень
+	skipListP = 0.25
+)
+
+// KeyValue представляет пару ключ-значение в результатах упорядоченных запросов
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// OrderedEngine реализуется движками, которые хранят ключи в порядке сортировки
+type OrderedEngine interface {
+	Engine
+
+	// Range возвращает пары с ключами из полуинтервала [start, end) по возрастанию.
+	// Пустой end означает отсутствие верхней границы, limit <= 0 - без ограничения
+	Range(start, end string, limit int) ([]KeyValue, error)
+	// Prefix возвращает пары, ключи которых начинаются с prefix, по возрастанию
+	Prefix(prefix string) ([]KeyValue, error)
+}
+
+// skipNode представляет узел списка с пропусками
+type skipNode struct {
+	key   string
+	entry *entry
+	next  []*skipNode
+}
+
+// OrderedMemoryEngine реализует движок на списке с пропусками, который хранит ключи упорядоченно
+type OrderedMemoryEngine struct {
+	head     *skipNode
+	level    int
+	expiring map[string]struct{}    // ключи, у которых установлен срок жизни
+	versions [versionBuckets]uint64 // счетчики изменений ключей для WATCH
+	index    *scanIndex             // порядок обхода ключей для SCAN
+	rnd      *rand.Rand
+	mu       sync.RWMutex
+	now      func() time.Time
+	loading  atomic.Bool
+}
+
+// NewOrderedEngine создает новый упорядоченный in-memory движок
+func NewOrderedEngine() OrderedEngine {
+	return &OrderedMemoryEngine{
+		head:     &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level:    1,
+		expiring: make(map[string]struct{}),
+		index:    newScanIndex(),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:      time.Now,
+	}
+}
+
+// clock возвращает текущее время в наносекундах, в режиме загрузки - 0
+func (e *OrderedMemoryEngine) clock() int64 {
+	if e.loading.Load() {
+		return 0
+	}
+	return e.now().UnixNano()
+}
+
+// SetLoading включает или выключает режим загрузки данных из WAL
+func (e *OrderedMemoryEngine) SetLoading(loading bool) {
+	e.loading.Store(loading)
+}
+
+// randomLevel выбирает высоту нового узла, вызывается под блокировкой на запись
+func (e *OrderedMemoryEngine) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && e.rnd.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual возвращает первый узел с ключом >= key.
+// Если update не nil, в него записываются предшественники на каждом уровне
+func (e *OrderedMemoryEngine) findGreaterOrEqual(key string, update []*skipNode) *skipNode {
+	node := e.head
+	for i := e.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// find возвращает узел с точно таким ключом или nil
+func (e *OrderedMemoryEngine) find(key string) *skipNode {
+	node := e.findGreaterOrEqual(key, nil)
+	if node != nil && node.key == key {
+		return node
+	}
+	return nil
+}
+
+// put вставляет или заменяет запись, вызывается под блокировкой на запись
+func (e *OrderedMemoryEngine) put(key string, item *entry) {
+	update := make([]*skipNode, skipListMaxLevel)
+	node := e.findGreaterOrEqual(key, update)
+	if node != nil && node.key == key {
+		node.entry = item
+	} else {
+		level := e.randomLevel()
+		if level > e.level {
+			for i := e.level; i < level; i++ {
+				update[i] = e.head
+			}
+			e.level = level
+		}
+
+		node = &skipNode{key: key, entry: item, next: make([]*skipNode, level)}
+		for i := 0; i < level; i++ {
+			node.next[i] = update[i].next[i]
+			update[i].next[i] = node
+		}
+		e.index.insert(key)
+	}
+
+	e.versions[versionBucket(key)]++
+	if item.expiresAt != 0 {
+		e.expiring[key] = struct{}{}
+	} else {
+		delete(e.expiring, key)
+	}
+}
+
+// remove удаляет ключ и возвращает удаленную запись, вызывается под блокировкой на запись
+func (e *OrderedMemoryEngine) remove(key string) *entry {
+	update := make([]*skipNode, skipListMaxLevel)
+	node := e.findGreaterOrEqual(key, update)
+	if node == nil || node.key != key {
+		return nil
+	}
+
+	for i := 0; i < e.level; i++ {
+		if update[i].next[i] != node {
+			break
+		}
+		update[i].next[i] = node.next[i]
+	}
+	for e.level > 1 && e.head.next[e.level-1] == nil {
+		e.level--
+	}
+
+	delete(e.expiring, key)
+	e.versions[versionBucket(key)]++
+	e.index.delete(key)
+	return node.entry
+}
+
+// Set сохраняет пару ключ-значение
+func (e *OrderedMemoryEngine) Set(key, value string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.put(key, &entry{value: value})
+	return nil
+}
+
+// SetWithExpiration сохраняет пару ключ-значение со сроком жизни
+func (e *OrderedMemoryEngine) SetWithExpiration(key, value string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		return ErrInvalidExpiry
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if expiresAt.UnixNano() <= e.clock() {
+		e.remove(key)
+		return nil
+	}
+
+	e.put(key, &entry{value: value, expiresAt: expiresAt.UnixNano()})
+	return nil
+}
+
+// Get получает значение по ключу
+func (e *OrderedMemoryEngine) Get(key string) (string, error) {
+	e.mu.RLock()
+	node := e.find(key)
+	if node == nil {
+		e.mu.RUnlock()
+		return "", ErrKeyNotFound
+	}
+
+	if !node.entry.expired(e.clock()) {
+		value := node.entry.value
+		e.mu.RUnlock()
+		return value, nil
+	}
+	e.mu.RUnlock()
+
+	// Ленивое удаление истекшего ключа
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if node := e.find(key); node != nil && node.entry.expired(e.clock()) {
+		e.remove(key)
+	}
+	return "", ErrKeyNotFound
+}
+
+// Delete удаляет пару ключ-значение
+func (e *OrderedMemoryEngine) Delete(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	item := e.remove(key)
+	if item == nil || item.expired(e.clock()) {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// Expire устанавливает абсолютный срок жизни существующего ключа
+func (e *OrderedMemoryEngine) Expire(key string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		return ErrInvalidExpiry
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.clock()
+	node := e.find(key)
+	if node == nil || node.entry.expired(now) {
+		e.remove(key)
+		return ErrKeyNotFound
+	}
+
+	if expiresAt.UnixNano() <= now {
+		e.remove(key)
+		return nil
+	}
+
+	node.entry.expiresAt = expiresAt.UnixNano()
+	e.expiring[key] = struct{}{}
+	e.versions[versionBucket(key)]++
+	return nil
+}
+
+// Persist снимает срок жизни с ключа
+func (e *OrderedMemoryEngine) Persist(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	node := e.find(key)
+	if node == nil || node.entry.expired(e.clock()) {
+		e.remove(key)
+		return ErrKeyNotFound
+	}
+
+	if node.entry.expiresAt == 0 {
+		return ErrNoExpiration
+	}
+
+	node.entry.expiresAt = 0
+	delete(e.expiring, key)
+	e.versions[versionBucket(key)]++
+	return nil
+}
+
+// TTL возвращает оставшееся время жизни ключа
+func (e *OrderedMemoryEngine) TTL(key string) (time.Duration, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	node := e.find(key)
+	if node == nil || node.entry.expired(e.clock()) {
+		return 0, ErrKeyNotFound
+	}
+
+	if node.entry.expiresAt == 0 {
+		return 0, ErrNoExpiration
+	}
+
+	return time.Duration(node.entry.expiresAt - e.now().UnixNano()), nil
+}
+
+// Range возвращает пары с ключами из полуинтервала [start, end) по возрастанию
+func (e *OrderedMemoryEngine) Range(start, end string, limit int) ([]KeyValue, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	now := e.clock()
+	var result []KeyValue
+	for node := e.findGreaterOrEqual(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		if node.entry.expired(now) {
+			continue
+		}
+		result = append(result, KeyValue{Key: node.key, Value: node.entry.value})
+	}
+
+	return result, nil
+}
+
+// Prefix возвращает пары, ключи которых начинаются с prefix, по возрастанию
+func (e *OrderedMemoryEngine) Prefix(prefix string) ([]KeyValue, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	now := e.clock()
+	var result []KeyValue
+	for node := e.findGreaterOrEqual(prefix, nil); node != nil; node = node.next[0] {
+		if !strings.HasPrefix(node.key, prefix) {
+			break
+		}
+		if node.entry.expired(now) {
+			continue
+		}
+		result = append(result, KeyValue{Key: node.key, Value: node.entry.value})
+	}
+
+	return result, nil
+}
+
+// Start запускает фоновую очистку истекших ключей
+func (e *OrderedMemoryEngine) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for e.sweep(e.clock()) > sweepSampleSize/4 {
+				}
+			}
+		}
+	}()
+}
+
+// sweep проверяет выборку ключей с TTL и удаляет истекшие, возвращает количество удаленных
+func (e *OrderedMemoryEngine) sweep(now int64) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	checked, removed := 0, 0
+	for key := range e.expiring {
+		if checked >= sweepSampleSize {
+			break
+		}
+		checked++
+
+		if node := e.find(key); node == nil || node.entry.expired(now) {
+			e.remove(key)
+			delete(e.expiring, key)
+			removed++
+		}
+	}
+
+	return removed
+}
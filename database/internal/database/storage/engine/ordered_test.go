@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOrderedEngine(t *testing.T) {
+	t.Run("Set, Get and Delete", func(t *testing.T) {
+		e := NewOrderedEngine()
+
+		if err := e.Set("test_key", "test_value"); err != nil {
+			t.Errorf("Set() error: %v", err)
+		}
+
+		val, err := e.Get("test_key")
+		if err != nil {
+			t.Errorf("Get() error: %v", err)
+		}
+		if val != "test_value" {
+			t.Errorf("Get() = %v, want %v", val, "test_value")
+		}
+
+		if err := e.Delete("test_key"); err != nil {
+			t.Errorf("Delete() error: %v", err)
+		}
+		if _, err := e.Get("test_key"); err != ErrKeyNotFound {
+			t.Errorf("Get() after Delete() should return ErrKeyNotFound")
+		}
+		if err := e.Delete("test_key"); err != ErrKeyNotFound {
+			t.Errorf("Delete() of a non-existent key should return ErrKeyNotFound")
+		}
+	})
+
+	t.Run("Range returns keys in order", func(t *testing.T) {
+		e := NewOrderedEngine()
+
+		// Вставляем ключи в обратном порядке
+		for i := 99; i >= 0; i-- {
+			e.Set(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i))
+		}
+
+		pairs, err := e.Range("key10", "key20", 0)
+		if err != nil {
+			t.Fatalf("Range() error: %v", err)
+		}
+		if len(pairs) != 10 {
+			t.Fatalf("Range() returned %d pairs, want 10", len(pairs))
+		}
+		for i, pair := range pairs {
+			if want := fmt.Sprintf("key%02d", i+10); pair.Key != want {
+				t.Errorf("Range()[%d].Key = %s, want %s", i, pair.Key, want)
+			}
+		}
+
+		pairs, _ = e.Range("key95", "", 3)
+		if len(pairs) != 3 || pairs[0].Key != "key95" || pairs[2].Key != "key97" {
+			t.Errorf("Range() with limit and open end = %v", pairs)
+		}
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		e := NewOrderedEngine()
+		e.Set("user:2", "b")
+		e.Set("user:1", "a")
+		e.Set("order:1", "x")
+		e.Set("user", "root")
+		e.Set("users", "all")
+
+		pairs, err := e.Prefix("user:")
+		if err != nil {
+			t.Fatalf("Prefix() error: %v", err)
+		}
+		if len(pairs) != 2 || pairs[0].Key != "user:1" || pairs[1].Key != "user:2" {
+			t.Errorf("Prefix() = %v", pairs)
+		}
+	})
+
+	t.Run("Expired keys are skipped", func(t *testing.T) {
+		e := NewOrderedEngine()
+		e.Set("a", "1")
+		e.SetWithExpiration("b", "2", time.Now().Add(10*time.Millisecond))
+		e.Set("c", "3")
+
+		time.Sleep(20 * time.Millisecond)
+
+		pairs, _ := e.Range("a", "", 0)
+		if len(pairs) != 2 || pairs[0].Key != "a" || pairs[1].Key != "c" {
+			t.Errorf("Range() should skip expired keys, got %v", pairs)
+		}
+		if _, err := e.TTL("b"); err != ErrKeyNotFound {
+			t.Errorf("TTL() of an expired key should return ErrKeyNotFound, got %v", err)
+		}
+	})
+}
+
+func TestNew(t *testing.T) {
+	if eng, err := New(TypeInMemory); err != nil {
+		t.Errorf("New(in_memory) error: %v", err)
+	} else if _, ok := eng.(*InMemoryEngine); !ok {
+		t.Errorf("New(in_memory) returned %T", eng)
+	}
+
+	if eng, err := New(TypeOrdered); err != nil {
+		t.Errorf("New(ordered) error: %v", err)
+	} else if _, ok := eng.(OrderedEngine); !ok {
+		t.Errorf("New(ordered) returned %T", eng)
+	}
+
+	if _, err := New("btree"); err == nil {
+		t.Errorf("New() with an unknown type should fail")
+	}
+}
@@ -0,0 +1,243 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+)
+
+const (
+	// Количество ключей, просматриваемых за один вызов Scan по умолчанию
+	defaultScanCount = 10
+
+	// Параметры хеша FNV-1a
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// ErrInvalidCursor возвращается, если курсор не был выдан движком
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Курсор SCAN состоит из номера партиции в старших 32 битах и хеша ключа,
+// с которого продолжается обход, в младших. Внутри партиции ключи обходятся
+// в порядке хеша, поэтому ключи, добавленные или удаленные во время обхода,
+// не сбивают его: каждый ключ, существующий все время обхода, будет возвращен
+// ровно один раз, а блокировка партиции держится только на время одного вызова.
+// Порядок обхода хранится в индексе scanIndex, который обновляется при записи,
+// поэтому шаг обхода стоит O(log n + count), а не сортировку всей партиции
+
+// scanHash возвращает хеш ключа (FNV-1a), задающий порядок обхода внутри партиции
+func scanHash(key string) uint32 {
+	hash := uint32(fnvOffset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= fnvPrime32
+	}
+	return hash
+}
+
+// makeCursor собирает курсор из номера партиции и начального хеша
+func makeCursor(partition int, from uint32) uint64 {
+	return uint64(partition)<<32 | uint64(from)
+}
+
+// splitCursor разбирает курсор на номер партиции и начальный хеш
+func splitCursor(cursor uint64) (int, uint32) {
+	return int(cursor >> 32), uint32(cursor)
+}
+
+// scanCandidate представляет ключ вместе с его хешем обхода
+type scanCandidate struct {
+	hash uint32
+	key  string
+}
+
+// scanNode - узел индекса обхода
+type scanNode struct {
+	scanCandidate
+	next []*scanNode
+}
+
+// scanIndex хранит ключи в порядке обхода SCAN - по хешу, затем по ключу - списком
+// с пропусками. Изменяется под блокировкой на запись владельца, читается под блокировкой на чтение
+type scanIndex struct {
+	head  *scanNode
+	level int
+}
+
+// newScanIndex создает пустой индекс обхода
+func newScanIndex() *scanIndex {
+	return &scanIndex{
+		head:  &scanNode{next: make([]*scanNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+// less сообщает, идет ли кандидат раньше other в порядке обхода
+func (c scanCandidate) less(other scanCandidate) bool {
+	if c.hash != other.hash {
+		return c.hash < other.hash
+	}
+	return c.key < other.key
+}
+
+// seek возвращает первый узел не раньше c. Если update не nil, в него записываются
+// предшественники на каждом уровне
+func (x *scanIndex) seek(c scanCandidate, update []*scanNode) *scanNode {
+	node := x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].less(c) {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// insert добавляет ключ, которого еще нет в индексе
+func (x *scanIndex) insert(key string) {
+	c := scanCandidate{hash: scanHash(key), key: key}
+	update := make([]*scanNode, skipListMaxLevel)
+	x.seek(c, update)
+
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	if level > x.level {
+		for i := x.level; i < level; i++ {
+			update[i] = x.head
+		}
+		x.level = level
+	}
+
+	node := &scanNode{scanCandidate: c, next: make([]*scanNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// delete удаляет ключ из индекса
+func (x *scanIndex) delete(key string) {
+	c := scanCandidate{hash: scanHash(key), key: key}
+	update := make([]*scanNode, skipListMaxLevel)
+	node := x.seek(c, update)
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < x.level; i++ {
+		if update[i].next[i] != node {
+			break
+		}
+		update[i].next[i] = node.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+}
+
+// scan выбирает не меньше count живых ключей с хешем не меньше from в порядке обхода.
+// Ключи с одинаковым хешем не разделяются между вызовами, иначе часть из них потерялась бы.
+// Возвращает выбранные ключи и признак того, что ключи исчерпаны
+func (x *scanIndex) scan(from uint32, count int, alive func(key string) bool) ([]scanCandidate, bool) {
+	batch := make([]scanCandidate, 0, count)
+	for node := x.seek(scanCandidate{hash: from}, nil); node != nil; node = node.next[0] {
+		if len(batch) >= count && node.hash != batch[len(batch)-1].hash {
+			return batch, false
+		}
+		if alive(node.key) {
+			batch = append(batch, node.scanCandidate)
+		}
+	}
+	return batch, true
+}
+
+// nextCursor вычисляет курсор, следующий за последним выбранным ключом партиции
+func nextCursor(partition int, batch []scanCandidate, exhausted bool, partitions int) uint64 {
+	if !exhausted {
+		last := batch[len(batch)-1].hash
+		if last < math.MaxUint32 {
+			return makeCursor(partition, last+1)
+		}
+	}
+
+	// Партиция пройдена, переходим к следующей; 0 означает конец обхода
+	if partition+1 >= partitions {
+		return 0
+	}
+	return makeCursor(partition+1, 0)
+}
+
+// filterKeys оставляет ключи, подходящие под шаблон. Пустой шаблон подходит всем
+func filterKeys(batch []scanCandidate, pattern string, keys []string) []string {
+	for _, candidate := range batch {
+		if pattern == "" || matchPattern(pattern, candidate.key) {
+			keys = append(keys, candidate.key)
+		}
+	}
+	return keys
+}
+
+// Scan просматривает до count ключей начиная с cursor и возвращает подходящие под pattern
+// и курсор для продолжения. Нулевой возвращенный курсор означает завершение обхода
+func (e *InMemoryEngine) Scan(cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	partIdx, from := splitCursor(cursor)
+	if partIdx >= numPartitions {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	keys := []string{}
+	for partIdx < numPartitions && count > 0 {
+		batch, exhausted := e.partitions[partIdx].scan(from, count, e.clock())
+		keys = filterKeys(batch, pattern, keys)
+		count -= len(batch)
+
+		cursor = nextCursor(partIdx, batch, exhausted, numPartitions)
+		if cursor == 0 {
+			break
+		}
+		partIdx, from = splitCursor(cursor)
+	}
+
+	return keys, cursor, nil
+}
+
+// scan выбирает из партиции до count живых ключей с хешем не меньше from
+func (p *Partition) scan(from uint32, count int, now int64) ([]scanCandidate, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.index.scan(from, count, func(key string) bool {
+		return !p.data[key].expired(now)
+	})
+}
+
+// Scan просматривает до count ключей начиная с cursor. Упорядоченный движок
+// обходится как единственная партиция, поэтому гарантии те же, что у InMemoryEngine
+func (e *OrderedMemoryEngine) Scan(cursor uint64, count int, pattern string) ([]string, uint64, error) {
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	partIdx, from := splitCursor(cursor)
+	if partIdx != 0 {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	e.mu.RLock()
+	now := e.clock()
+	batch, exhausted := e.index.scan(from, count, func(key string) bool {
+		return !e.find(key).entry.expired(now)
+	})
+	e.mu.RUnlock()
+
+	return filterKeys(batch, pattern, []string{}), nextCursor(0, batch, exhausted, 1), nil
+}
@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestScan(t *testing.T) {
+	engines := map[string]func() Engine{
+		"in_memory": func() Engine { return NewInMemoryEngine() },
+		"ordered":   func() Engine { return NewOrderedEngine() },
+	}
+
+	for name, newEngine := range engines {
+		t.Run(name+"/full iteration", func(t *testing.T) {
+			e := newEngine()
+			for i := 0; i < 500; i++ {
+				e.Set(fmt.Sprintf("key%d", i), "value")
+			}
+
+			seen := scanAll(t, e, 7, "")
+			if len(seen) != 500 {
+				t.Errorf("Scan() returned %d distinct keys, want 500", len(seen))
+			}
+			for key, n := range seen {
+				if n != 1 {
+					t.Errorf("key %s returned %d times", key, n)
+				}
+			}
+		})
+
+		t.Run(name+"/match", func(t *testing.T) {
+			e := newEngine()
+			for i := 0; i < 50; i++ {
+				e.Set(fmt.Sprintf("user:%d", i), "value")
+				e.Set(fmt.Sprintf("order:%d", i), "value")
+			}
+
+			seen := scanAll(t, e, 10, "user:*")
+			if len(seen) != 50 {
+				t.Errorf("Scan() with MATCH returned %d keys, want 50", len(seen))
+			}
+		})
+
+		t.Run(name+"/writes during scan", func(t *testing.T) {
+			e := newEngine()
+			for i := 0; i < 200; i++ {
+				e.Set(fmt.Sprintf("stable%d", i), "value")
+			}
+
+			seen := make(map[string]int)
+			var cursor uint64
+			for step := 0; ; step++ {
+				keys, next, err := e.Scan(cursor, 5, "")
+				if err != nil {
+					t.Fatalf("Scan() error: %v", err)
+				}
+				for _, key := range keys {
+					seen[key]++
+				}
+
+				// Между шагами добавляем и удаляем другие ключи
+				e.Set(fmt.Sprintf("new%d", step), "value")
+				e.Delete(fmt.Sprintf("new%d", step-1))
+
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+
+			for i := 0; i < 200; i++ {
+				if n := seen[fmt.Sprintf("stable%d", i)]; n != 1 {
+					t.Errorf("stable%d returned %d times, want 1", i, n)
+				}
+			}
+		})
+	}
+
+	for name, newEngine := range engines {
+		t.Run(name+"/index follows writes", func(t *testing.T) {
+			e := newEngine()
+			for i := 0; i < 300; i++ {
+				e.Set(fmt.Sprintf("key%d", i), "value")
+			}
+			// Перезапись не добавляет ключ в индекс повторно, удаление и истечение убирают его
+			for i := 0; i < 300; i++ {
+				switch i % 3 {
+				case 0:
+					e.Set(fmt.Sprintf("key%d", i), "other")
+				case 1:
+					e.Delete(fmt.Sprintf("key%d", i))
+				case 2:
+					e.SetWithExpiration(fmt.Sprintf("key%d", i), "value", time.Now().Add(-time.Second))
+				}
+			}
+
+			seen := scanAll(t, e, 10, "")
+			if len(seen) != 100 {
+				t.Errorf("Scan() returned %d keys, want 100", len(seen))
+			}
+			for i := 0; i < 300; i += 3 {
+				if n := seen[fmt.Sprintf("key%d", i)]; n != 1 {
+					t.Errorf("key%d returned %d times, want 1", i, n)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid cursor", func(t *testing.T) {
+		if _, _, err := NewInMemoryEngine().Scan(uint64(numPartitions)<<32, 10, ""); err != ErrInvalidCursor {
+			t.Errorf("Scan() with invalid cursor should return ErrInvalidCursor, got %v", err)
+		}
+	})
+}
+
+// scanAll обходит все ключи движка и считает, сколько раз вернулся каждый
+func scanAll(t *testing.T, e Engine, count int, pattern string) map[string]int {
+	t.Helper()
+
+	seen := make(map[string]int)
+	var cursor uint64
+	for {
+		keys, next, err := e.Scan(cursor, count, pattern)
+		if err != nil {
+			t.Fatalf("Scan() error: %v", err)
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+		if next == 0 {
+			return seen
+		}
+		cursor = next
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"*", "anything", true},
+		{"*", "", true},
+		{"user:*", "user:42", true},
+		{"user:*", "order:42", false},
+		{"*/profile", "users/1/profile", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{"key[0-9]", "keyx", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"h[el", "hello", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	e := NewInMemoryEngine()
+	for i := 0; i < 100000; i++ {
+		e.Set(fmt.Sprintf("key%d", i), "value")
+	}
+
+	// Полный обход шагами по 10 ключей: шаг не должен зависеть от размера партиции
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		var cursor uint64
+		for {
+			_, next, err := e.Scan(cursor, 10, "")
+			if err != nil {
+				b.Fatalf("Scan() error: %v", err)
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Количество счетчиков версий в партиции. Ключи с одинаковым хешем делят счетчик,
+// поэтому WATCH может сработать ложно, но никогда не пропустит изменение
+const versionBuckets = 256
+
+// Tx предоставляет доступ к ключам, заблокированным в Update. Изменения видны последующим
+// чтениям внутри fn и применяются к движку, только если fn завершилась без ошибки
+type Tx interface {
+	// Lookup возвращает значение ключа и срок его истечения, нулевой срок - бессрочно
+	Lookup(key string) (value string, expiresAt time.Time, ok bool)
+	// Put сохраняет значение ключа, нулевой expiresAt - бессрочно
+	Put(key, value string, expiresAt time.Time)
+	// Remove удаляет ключ
+	Remove(key string)
+	// Version возвращает версию ключа, как Engine.Version
+	Version(key string) uint64
+	// Size возвращает, на сколько байт изменится занятая память после применения изменений
+	Size() int64
+}
+
+// versionBucket возвращает номер счетчика версий для ключа
+func versionBucket(key string) uint32 {
+	return scanHash(key) % versionBuckets
+}
+
+// txState накапливает изменения транзакции поверх заблокированных данных движка
+type txState struct {
+	now     int64
+	lookup  func(key string) (*entry, bool)
+	version func(key string) uint64
+	locked  func(key string) bool
+	writes  map[string]*entry // nil - ключ удален
+	order   []string          // порядок первого изменения ключей
+}
+
+// newTxState создает пустую транзакцию
+func newTxState(now int64, lookup func(string) (*entry, bool), version func(string) uint64, locked func(string) bool) *txState {
+	return &txState{
+		now:     now,
+		lookup:  lookup,
+		version: version,
+		locked:  locked,
+		writes:  make(map[string]*entry),
+	}
+}
+
+// check проверяет, что партиция ключа заблокирована. Обращение к другим ключам - ошибка вызывающего кода
+func (t *txState) check(key string) {
+	if !t.locked(key) {
+		panic(fmt.Sprintf("engine: key %q is not locked by Update", key))
+	}
+}
+
+// Lookup возвращает значение с учетом изменений транзакции
+func (t *txState) Lookup(key string) (string, time.Time, bool) {
+	t.check(key)
+
+	item, written := t.writes[key]
+	if !written {
+		item, _ = t.lookup(key)
+	}
+	if item == nil || item.expired(t.now) {
+		return "", time.Time{}, false
+	}
+
+	var expiresAt time.Time
+	if item.expiresAt != 0 {
+		expiresAt = time.Unix(0, item.expiresAt)
+	}
+	return item.value, expiresAt, true
+}
+
+// Put сохраняет значение. Уже истекший срок означает удаление ключа
+func (t *txState) Put(key, value string, expiresAt time.Time) {
+	t.check(key)
+
+	if !expiresAt.IsZero() && expiresAt.UnixNano() <= t.now {
+		t.Remove(key)
+		return
+	}
+
+	item := &entry{value: value}
+	if !expiresAt.IsZero() {
+		item.expiresAt = expiresAt.UnixNano()
+	}
+	t.write(key, item)
+}
+
+// Remove удаляет ключ
+func (t *txState) Remove(key string) {
+	t.check(key)
+	t.write(key, nil)
+}
+
+// Version возвращает версию ключа до применения транзакции
+func (t *txState) Version(key string) uint64 {
+	t.check(key)
+	return t.version(key)
+}
+
+// Size возвращает разницу размеров измененных записей после и до транзакции
+func (t *txState) Size() int64 {
+	var size int64
+	for _, key := range t.order {
+		if item := t.writes[key]; item != nil {
+			size += entrySize(key, item.value)
+		}
+		if old, exists := t.lookup(key); exists {
+			size -= entrySize(key, old.value)
+		}
+	}
+	return size
+}
+
+// write запоминает изменение ключа
+func (t *txState) write(key string, item *entry) {
+	if _, exists := t.writes[key]; !exists {
+		t.order = append(t.order, key)
+	}
+	t.writes[key] = item
+}
+
+// lockOrder возвращает отсортированные номера партиций ключей без повторов.
+// Блокировка в одном порядке исключает взаимную блокировку параллельных транзакций
+func lockOrder(keys []string) []int {
+	var seen [numPartitions]bool
+	order := make([]int, 0, numPartitions)
+	for _, key := range keys {
+		if idx := getPartition(key); !seen[idx] {
+			seen[idx] = true
+			order = append(order, idx)
+		}
+	}
+	sort.Ints(order)
+	return order
+}
+
+// Version возвращает счетчик изменений ключа
+func (e *InMemoryEngine) Version(key string) uint64 {
+	partition := &e.partitions[getPartition(key)]
+
+	partition.mu.RLock()
+	defer partition.mu.RUnlock()
+
+	return partition.versions[versionBucket(key)]
+}
+
+// Update атомарно выполняет fn над ключами keys, блокируя их партиции по возрастанию номера
+func (e *InMemoryEngine) Update(keys []string, fn func(tx Tx) error) error {
+	order := lockOrder(keys)
+	var locked [numPartitions]bool
+	for _, idx := range order {
+		e.partitions[idx].mu.Lock()
+		locked[idx] = true
+	}
+	defer func() {
+		for i := len(order) - 1; i >= 0; i-- {
+			e.partitions[order[i]].mu.Unlock()
+		}
+	}()
+
+	tx := newTxState(
+		e.clock(),
+		func(key string) (*entry, bool) {
+			item, exists := e.partitions[getPartition(key)].data[key]
+			return item, exists
+		},
+		func(key string) uint64 {
+			return e.partitions[getPartition(key)].versions[versionBucket(key)]
+		},
+		func(key string) bool {
+			return locked[getPartition(key)]
+		},
+	)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for _, key := range tx.order {
+		partition := &e.partitions[getPartition(key)]
+		if item := tx.writes[key]; item != nil {
+			partition.store(key, e.newEntry(item.value, item.expiresAt))
+		} else {
+			partition.remove(key)
+		}
+	}
+	return nil
+}
+
+// Version возвращает счетчик изменений ключа
+func (e *OrderedMemoryEngine) Version(key string) uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.versions[versionBucket(key)]
+}
+
+// Update атомарно выполняет fn. Упорядоченный движок защищен одной блокировкой,
+// поэтому доступны любые ключи
+func (e *OrderedMemoryEngine) Update(keys []string, fn func(tx Tx) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tx := newTxState(
+		e.clock(),
+		func(key string) (*entry, bool) {
+			if node := e.find(key); node != nil {
+				return node.entry, true
+			}
+			return nil, false
+		},
+		func(key string) uint64 {
+			return e.versions[versionBucket(key)]
+		},
+		func(string) bool { return true },
+	)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for _, key := range tx.order {
+		if item := tx.writes[key]; item != nil {
+			e.put(key, item)
+		} else {
+			e.remove(key)
+		}
+	}
+	return nil
+}
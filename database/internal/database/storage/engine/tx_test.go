@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	engines := map[string]func() Engine{
+		"in_memory": func() Engine { return NewInMemoryEngine() },
+		"ordered":   func() Engine { return NewOrderedEngine() },
+	}
+
+	for name, newEngine := range engines {
+		t.Run(name, func(t *testing.T) {
+			e := newEngine()
+			e.Set("a", "1")
+			e.Set("b", "2")
+
+			t.Run("changes are visible inside and applied after", func(t *testing.T) {
+				deadline := time.Now().Add(time.Hour)
+				err := e.Update([]string{"a", "b", "c"}, func(tx Tx) error {
+					tx.Put("c", "3", deadline)
+					tx.Remove("a")
+					if _, _, ok := tx.Lookup("a"); ok {
+						t.Errorf("Lookup() of removed key should fail")
+					}
+					if value, expiresAt, ok := tx.Lookup("c"); !ok || value != "3" || !expiresAt.Equal(time.Unix(0, deadline.UnixNano())) {
+						t.Errorf("Lookup(c) = %q, %v, %v", value, expiresAt, ok)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("Update() error: %v", err)
+				}
+
+				if _, err := e.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("Get(a) after Update() error = %v, want ErrKeyNotFound", err)
+				}
+				if value, _ := e.Get("c"); value != "3" {
+					t.Errorf("Get(c) = %q, want %q", value, "3")
+				}
+				if _, err := e.TTL("c"); err != nil {
+					t.Errorf("TTL(c) error: %v", err)
+				}
+			})
+
+			t.Run("error discards all changes", func(t *testing.T) {
+				failure := errors.New("failure")
+				err := e.Update([]string{"b"}, func(tx Tx) error {
+					tx.Put("b", "changed", time.Time{})
+					return failure
+				})
+				if !errors.Is(err, failure) {
+					t.Fatalf("Update() error = %v, want %v", err, failure)
+				}
+				if value, _ := e.Get("b"); value != "2" {
+					t.Errorf("Get(b) = %q, want %q", value, "2")
+				}
+			})
+
+			t.Run("size counts changed entries", func(t *testing.T) {
+				e.Set("s", "old")
+				e.Update([]string{"s", "new", "missing"}, func(tx Tx) error {
+					tx.Put("s", "longer", time.Time{})
+					tx.Put("new", "v", time.Time{})
+					tx.Remove("missing")
+					want := entrySize("s", "longer") - entrySize("s", "old") + entrySize("new", "v")
+					if size := tx.Size(); size != want {
+						t.Errorf("Size() = %d, want %d", size, want)
+					}
+
+					tx.Remove("s")
+					want -= entrySize("s", "longer")
+					if size := tx.Size(); size != want {
+						t.Errorf("Size() after Remove() = %d, want %d", size, want)
+					}
+					return nil
+				})
+			})
+
+			t.Run("version changes on every modification", func(t *testing.T) {
+				version := e.Version("b")
+				e.Set("b", "3")
+				if e.Version("b") == version {
+					t.Errorf("Version() did not change after Set()")
+				}
+
+				version = e.Version("b")
+				e.Update([]string{"b"}, func(tx Tx) error {
+					if tx.Version("b") != version {
+						t.Errorf("tx.Version() = %d, want %d", tx.Version("b"), version)
+					}
+					tx.Remove("b")
+					return nil
+				})
+				if e.Version("b") == version {
+					t.Errorf("Version() did not change after Update()")
+				}
+			})
+		})
+	}
+}
+
+func TestUpdateConcurrentTransfers(t *testing.T) {
+	e := NewInMemoryEngine()
+
+	const accounts = 20
+	for i := 0; i < accounts; i++ {
+		e.Set(fmt.Sprintf("account:%d", i), "100")
+	}
+
+	// Переводы между ключами разных партиций в разном порядке не должны взаимно блокироваться
+	// и не должны терять деньги
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				from := fmt.Sprintf("account:%d", (worker+i)%accounts)
+				to := fmt.Sprintf("account:%d", (worker*7+i*3+1)%accounts)
+				if from == to {
+					continue
+				}
+				e.Update([]string{from, to}, func(tx Tx) error {
+					var a, b int
+					va, _, _ := tx.Lookup(from)
+					vb, _, _ := tx.Lookup(to)
+					fmt.Sscan(va, &a)
+					fmt.Sscan(vb, &b)
+					tx.Put(from, fmt.Sprint(a-1), time.Time{})
+					tx.Put(to, fmt.Sprint(b+1), time.Time{})
+					return nil
+				})
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	total := 0
+	for i := 0; i < accounts; i++ {
+		value, _ := e.Get(fmt.Sprintf("account:%d", i))
+		var n int
+		fmt.Sscan(value, &n)
+		total += n
+	}
+	if total != accounts*100 {
+		t.Errorf("total = %d, want %d", total, accounts*100)
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+)
+
+// Операции над несколькими ключами выполняются как транзакция Atomic: партиции ключей
+// блокируются в фиксированном порядке, а изменения записываются в WAL одной записью BATCH
+
+// MGet возвращает значения найденных ключей согласованным срезом: ни один ключ
+// не меняется между чтениями. Отсутствующих ключей нет в результате
+func (s *SimpleStorage) MGet(keys []string) (map[string]string, error) {
+	return s.MGetCtx(context.Background(), keys)
+}
+
+// MGetCtx - MGet с контекстом, как SetCtx
+func (s *SimpleStorage) MGetCtx(ctx context.Context, keys []string) (map[string]string, error) {
+	var values map[string]string
+	err := s.AtomicCtx(ctx, keys, nil, func(tx Operations) error {
+		var err error
+		values, err = tx.MGet(keys)
+		return err
+	})
+	return values, err
+}
+
+// MSet атомарно сохраняет пары ключ-значение. При повторе ключа сохраняется последнее значение
+func (s *SimpleStorage) MSet(pairs []engine.KeyValue) error {
+	return s.MSetCtx(context.Background(), pairs)
+}
+
+// MSetCtx - MSet с контекстом, как SetCtx
+func (s *SimpleStorage) MSetCtx(ctx context.Context, pairs []engine.KeyValue) error {
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if err := s.reserveMemory(pair.Key, pair.Value); err != nil {
+			return err
+		}
+		keys = append(keys, pair.Key)
+	}
+
+	return s.AtomicCtx(ctx, keys, nil, func(tx Operations) error {
+		return tx.MSet(pairs)
+	})
+}
+
+// MDelete атомарно удаляет ключи и возвращает количество удаленных
+func (s *SimpleStorage) MDelete(keys []string) (int, error) {
+	return s.MDeleteCtx(context.Background(), keys)
+}
+
+// MDeleteCtx - MDelete с контекстом, как SetCtx
+func (s *SimpleStorage) MDeleteCtx(ctx context.Context, keys []string) (int, error) {
+	var deleted int
+	err := s.AtomicCtx(ctx, keys, nil, func(tx Operations) error {
+		var err error
+		deleted, err = tx.MDelete(keys)
+		return err
+	})
+	return deleted, err
+}
+
+// MGet возвращает значения найденных ключей с учетом изменений транзакции
+func (t *storageTx) MGet(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if value, _, ok := t.tx.Lookup(key); ok {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// MSet сохраняет пары ключ-значение без срока жизни
+func (t *storageTx) MSet(pairs []engine.KeyValue) error {
+	if t.readOnly != nil {
+		return t.readOnly
+	}
+
+	for _, pair := range pairs {
+		t.put(pair.Key, pair.Value, time.Time{})
+	}
+	return nil
+}
+
+// MDelete удаляет существующие ключи
+func (t *storageTx) MDelete(keys []string) (int, error) {
+	if t.readOnly != nil {
+		return 0, t.readOnly
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if _, _, ok := t.tx.Lookup(key); !ok {
+			continue
+		}
+		t.tx.Remove(key)
+		t.record(wal.OperationDel, key)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// MGetCtx возвращает значения ключей. Транзакция записывается в WAL целиком в Atomic,
+// поэтому контекст отдельной операции не используется
+func (t *storageTx) MGetCtx(_ context.Context, keys []string) (map[string]string, error) {
+	return t.MGet(keys)
+}
+
+// MSetCtx сохраняет пары ключ-значение
+func (t *storageTx) MSetCtx(_ context.Context, pairs []engine.KeyValue) error {
+	return t.MSet(pairs)
+}
+
+// MDeleteCtx удаляет существующие ключи
+func (t *storageTx) MDeleteCtx(_ context.Context, keys []string) (int, error) {
+	return t.MDelete(keys)
+}
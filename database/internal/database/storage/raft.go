@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/replication"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+	"github.com/keij-sama/Concurrency/database/internal/network"
+	"go.uber.org/zap"
+)
+
+// Ошибки режима raft
+var (
+	// ErrWriteNotCommitted возвращается, если лидер потерял лидерство до фиксации записи.
+	// Запись не применена, но новый лидер может ее как зафиксировать, так и отбросить
+	ErrWriteNotCommitted = errors.New("write was not committed by the raft group, it may still be applied")
+	// ErrRaftRoleFixed возвращается командами, меняющими роль узла вручную: в режиме raft
+	// лидера выбирает группа
+	ErrRaftRoleFixed = errors.New("node role is managed by raft election")
+)
+
+// raftMachine применяет к хранилищу записи лога Raft
+type raftMachine struct {
+	s *SimpleStorage
+}
+
+// Apply применяет зафиксированные записи, которые узел не применил как лидер. Записи уже в WAL узла
+func (m raftMachine) Apply(logs []wal.Log) error {
+	m.s.writes.RLock()
+	defer m.s.writes.RUnlock()
+
+	return m.s.applyLogs(logs)
+}
+
+// SetLeader разрешает или запрещает запись. Блокировка на запись дожидается начатых записей:
+// они держат s.writes, пока группа не зафиксирует их или узел не потеряет лидерство
+func (m raftMachine) SetLeader(leader bool) {
+	m.s.writes.Lock()
+	m.s.isMaster.Store(leader)
+	m.s.writes.Unlock()
+
+	if leader {
+		m.s.logger.Info("Became raft leader, accepting writes",
+			zap.Uint64("next_lsn", m.s.wal.NextLSN()))
+	} else {
+		m.s.logger.Info("Lost raft leadership, writes are rejected",
+			zap.String("leader", m.s.raft.Leader()))
+	}
+}
+
+// startRaft запускает узел группы raft. Узел слушает cfg.ListenAddress, этот адрес
+// служит его идентификатором; запись разрешается, когда группа выберет узел лидером
+func (s *SimpleStorage) startRaft(cfg replication.ReplicationConfig) (*replication.Raft, error) {
+	if cfg.ListenAddress == "" {
+		return nil, errors.New("replication.listen_address is required in raft mode")
+	}
+	// Лог Raft не сжимается: отставший узел догоняет лидера только по его WAL
+	if s.snapshots != nil {
+		return nil, errors.New("snapshots are not supported in raft mode, the raft log is never compacted")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = time.Second
+	}
+
+	newZapLogger, err := zap.NewProduction()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zap logger: %w", err)
+	}
+
+	s.logger.Info("Initializing raft node",
+		zap.String("listen_address", cfg.ListenAddress),
+		zap.Strings("peers", cfg.Peers))
+
+	// Соединения с узлами простаивают не дольше heartbeat лидера, таймаут берем с запасом
+	server, err := network.NewTCPServer(
+		cfg.ListenAddress,
+		newZapLogger,
+		network.WithMaxConnections(100),
+		network.WithIdleTimeout(10*cfg.ElectionTimeout),
+		network.WithBufferSize(4096),
+		network.WithMaxMessageSize(replicationMessageSizeLimit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replication server: %w", err)
+	}
+
+	dial := func(address string) (*network.TCPClient, error) {
+		return network.NewTCPClient(
+			address,
+			network.WithClientIdleTimeout(cfg.ElectionTimeout),
+			network.WithClientMaxMessageSize(replicationMessageSizeLimit),
+		)
+	}
+
+	raftConfig := replication.RaftConfig{
+		ID:              cfg.ListenAddress,
+		Peers:           cfg.Peers,
+		ElectionTimeout: cfg.ElectionTimeout,
+		Dial:            dial,
+	}
+	node, err := replication.NewRaft(server, s.wal, raftConfig, raftMachine{s: s}, s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raft node: %w", err)
+	}
+
+	// Запись запрещена, пока узел не станет лидером
+	s.isMaster.Store(false)
+	s.raft = node
+	if err := node.Start(s.ctx); err != nil {
+		return nil, fmt.Errorf("failed to start raft node: %w", err)
+	}
+	return node, nil
+}
+
+// notLeader возвращает ошибку записи на последователе с адресом лидера, если он известен
+func (s *SimpleStorage) notLeader() error {
+	if leader := s.raft.Leader(); leader != "" {
+		return fmt.Errorf("%w: leader is %s", replication.ErrNotLeader, leader)
+	}
+	return fmt.Errorf("%w: leader is not elected yet", replication.ErrNotLeader)
+}
+
+// awaitCommit ждет, пока группа зафиксирует запись lsn. Вызывается под блокировками
+// партиций записи: ее изменения применяются к движку только после фиксации
+func (s *SimpleStorage) awaitCommit(lsn uint64) error {
+	if err := s.raft.WaitCommitted(s.ctx, lsn+1); err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteNotCommitted, err)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrPointInTimeRecovery возвращается при попытке записи в хранилище, восстановленное на момент времени
+	ErrPointInTimeRecovery = errors.New("write operations not allowed after point-in-time recovery")
+	// ErrRecoveryTargetUnavailable возвращается, если нужные для точки восстановления записи WAL удалены
+	ErrRecoveryTargetUnavailable = errors.New("recovery target is not covered by WAL")
+)
+
+// RecoveryTarget задает точку восстановления на момент времени. WAL повторяется до нее
+// включительно, после чего хранилище работает только на чтение, а файлы WAL не изменяются
+type RecoveryTarget struct {
+	LSN  uint64    // последняя применяемая запись WAL
+	Time time.Time // если задано, применяются записи, сделанные не позже Time, а LSN не используется
+}
+
+// String описывает точку восстановления для логов
+func (t RecoveryTarget) String() string {
+	if !t.Time.IsZero() {
+		return "time " + t.Time.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("lsn %d", t.LSN)
+}
+
+// resolve возвращает LSN последней применяемой записи. Если точка раньше первой записи WAL,
+// возвращается false: восстанавливать нечего
+func (t RecoveryTarget) resolve(logs []wal.Log) (uint64, bool, error) {
+	if t.Time.IsZero() {
+		if len(logs) > 0 && t.LSN > logs[len(logs)-1].LSN {
+			return 0, false, fmt.Errorf("%w: lsn %d is beyond the last record %d",
+				ErrRecoveryTargetUnavailable, t.LSN, logs[len(logs)-1].LSN)
+		}
+		return t.LSN, true, nil
+	}
+
+	// Записи упорядочены по LSN, время записи растет вместе с ним
+	target := t.Time.UnixNano()
+	found := false
+	var lsn uint64
+	for _, log := range logs {
+		if log.Timestamp > target {
+			break
+		}
+		lsn, found = log.LSN, true
+	}
+	if found {
+		return lsn, true, nil
+	}
+
+	// Ни одна запись не сделана раньше Time: это начало истории, только если WAL не сжимался
+	if len(logs) == 0 || logs[0].LSN != 0 {
+		return 0, false, fmt.Errorf("%w: %s precedes the first retained record", ErrRecoveryTargetUnavailable, t)
+	}
+	return 0, false, nil
+}
+
+// writable проверяет, что в хранилище можно писать
+func (s *SimpleStorage) writable() error {
+	if s.recoveryTarget != nil {
+		return ErrPointInTimeRecovery
+	}
+	if !s.isMaster.Load() {
+		if s.raft != nil {
+			return s.notLeader()
+		}
+		return ErrReadOnlyReplica
+	}
+	return nil
+}
+
+// recover восстанавливает данные: загружает снимок и повторяет записи WAL после него.
+// Если задана точка восстановления, повторяются только записи до нее. Записи с LSN от
+// applyBefore не повторяются: в режиме raft их еще может отбросить группа
+func (s *SimpleStorage) recover(applyBefore uint64) error {
+	logs, err := s.wal.Recover()
+	if err != nil {
+		return fmt.Errorf("failed to recover logs from WAL: %w", err)
+	}
+
+	targetLSN := uint64(math.MaxUint64)
+	if s.recoveryTarget != nil {
+		lsn, ok, err := s.recoveryTarget.resolve(logs)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			s.logger.Info("Recovery target precedes the first write, starting empty",
+				zap.Stringer("target", s.recoveryTarget),
+			)
+			return nil
+		}
+		targetLSN = lsn
+	}
+
+	var (
+		snapshotLSN uint64
+		loaded      bool
+	)
+	if s.snapshots != nil {
+		snapshotLSN, loaded, err = s.loadSnapshot(targetLSN)
+		if err != nil {
+			return err
+		}
+	}
+
+	if loaded {
+		// Счетчик LSN продолжается после снимка, даже если все сегменты удалены
+		s.wal.AdvanceLSN(snapshotLSN + 1)
+	}
+
+	selected := logs[:0]
+	for _, log := range logs {
+		if (!loaded || log.LSN > snapshotLSN) && log.LSN <= targetLSN && log.LSN < applyBefore {
+			selected = append(selected, log)
+		}
+	}
+
+	if s.recoveryTarget != nil {
+		// Записи между снимком и точкой восстановления должны сохраниться в WAL полностью
+		first := uint64(0)
+		if loaded {
+			first = snapshotLSN + 1
+		}
+		if first <= targetLSN && (len(selected) == 0 || selected[0].LSN != first) {
+			return fmt.Errorf("%w: records from lsn %d were compacted, no consistent snapshot before %s",
+				ErrRecoveryTargetUnavailable, first, s.recoveryTarget)
+		}
+		s.logger.Info("Point-in-time recovery",
+			zap.Stringer("target", s.recoveryTarget),
+			zap.Uint64("target_lsn", targetLSN),
+			zap.Int("records", len(selected)),
+		)
+	}
+
+	return s.applyLogs(selected)
+}
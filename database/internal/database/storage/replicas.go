@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/replication"
+	"go.uber.org/zap"
+)
+
+// Ошибки репликации
+var (
+	// ErrWaitOnReplica возвращается при вызове WAIT на слейве
+	ErrWaitOnReplica = errors.New("WAIT cannot be used with replica instances")
+	// ErrListenAddressRequired возвращается, если слейв нельзя сделать мастером: не задан
+	// адрес сервера репликации
+	ErrListenAddressRequired = errors.New("replication.listen_address is required to promote a replica")
+)
+
+// defaultSyncInterval - интервал синхронизации узла, запущенного без настроек репликации
+const defaultSyncInterval = time.Second
+
+// ReplicaOf переключает роль работающего узла. С пустым masterAddress слейв становится
+// мастером и начинает принимать слейвов на replication.listen_address (REPLICAOF NO ONE),
+// иначе узел становится слейвом мастера, сервер репликации которого слушает masterAddress.
+// LSN продолжаются с последней записи в WAL узла, поэтому новый мастер продолжает
+// последовательность старого, а бывший мастер - с того же места, если у него нет записей,
+// которых нет у нового мастера
+func (s *SimpleStorage) ReplicaOf(masterAddress string) error {
+	if s.recoveryTarget != nil {
+		return ErrPointInTimeRecovery
+	}
+	if s.wal == nil {
+		return errors.New("WAL must be enabled for replication")
+	}
+	if s.raft != nil {
+		return ErrRaftRoleFixed
+	}
+
+	s.replicationMutex.Lock()
+	defer s.replicationMutex.Unlock()
+
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	cfg := s.replicationConfig
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = defaultSyncInterval
+	}
+
+	if masterAddress == "" {
+		return s.promote(cfg)
+	}
+	return s.follow(cfg, masterAddress)
+}
+
+// promote делает узел мастером. Вызывается под replicationMutex
+func (s *SimpleStorage) promote(cfg replication.ReplicationConfig) error {
+	if s.isMaster.Load() {
+		return nil
+	}
+
+	// Узел, запущенный без репликации, становится мастером без сервера репликации
+	address := cfg.ListenAddressOrDefault()
+	if address == "" && cfg.Enabled {
+		return ErrListenAddressRequired
+	}
+
+	// Сначала занимаем порт: если это не удастся, узел останется слейвом
+	var master *replication.Master
+	if address != "" {
+		var err error
+		if master, err = s.startMaster(cfg, address); err != nil {
+			return err
+		}
+	}
+
+	if s.replication != nil {
+		if err := s.replication.Close(); err != nil {
+			s.logger.Error("Failed to close replication slave", zap.Error(err))
+		}
+		s.replication = nil
+	}
+	if master != nil {
+		s.replication = master
+	}
+
+	// Дожидаемся применения последних полученных от мастера записей
+	s.writes.Lock()
+	s.isMaster.Store(true)
+	s.syncDegraded.Store(false)
+	s.writes.Unlock()
+
+	s.logger.Info("Promoted to replication master",
+		zap.String("listen_address", address),
+		zap.Uint64("next_lsn", s.wal.NextLSN()))
+	return nil
+}
+
+// follow делает узел слейвом мастера masterAddress. Вызывается под replicationMutex
+func (s *SimpleStorage) follow(cfg replication.ReplicationConfig, masterAddress string) error {
+	// Новые записи отклоняются, начатые успевают попасть в WAL до отключения слейвов
+	s.writes.Lock()
+	s.isMaster.Store(false)
+	s.writes.Unlock()
+
+	if s.replication != nil {
+		if err := s.replication.Close(); err != nil {
+			s.logger.Error("Failed to close replication", zap.Error(err))
+		}
+		s.replication = nil
+	}
+
+	slave, err := s.startSlave(cfg, masterAddress)
+	if err != nil {
+		return err
+	}
+	s.replication = slave
+
+	s.logger.Info("Replicating from master",
+		zap.String("master_address", masterAddress),
+		zap.Uint64("next_lsn", s.wal.NextLSN()))
+	return nil
+}
+
+// master возвращает мастер репликации или nil, если узел не мастер или репликация выключена
+func (s *SimpleStorage) master() *replication.Master {
+	s.replicationMutex.RLock()
+	defer s.replicationMutex.RUnlock()
+
+	master, _ := s.replication.(*replication.Master)
+	return master
+}
+
+// WaitReplicas ждет, пока хотя бы replicas слейвов подтвердят все записи, сделанные до вызова,
+// но не дольше timeout; timeout == 0 - до завершения ctx. Возвращает количество подтвердивших
+// слейвов. Без репликации возвращает 0 сразу
+func (s *SimpleStorage) WaitReplicas(ctx context.Context, replicas int, timeout time.Duration) (int, error) {
+	if !s.isMaster.Load() {
+		return 0, ErrWaitOnReplica
+	}
+	master := s.master()
+	if master == nil {
+		return 0, nil
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return master.WaitForReplicas(ctx, s.wal.NextLSN(), replicas), nil
+}
+
+// awaitReplicas реализует полусинхронную репликацию: если задан replication.sync_replicas,
+// ждет, пока столько слейвов подтвердят запись в свой WAL всех записей, сделанных до вызова.
+// Если подтверждения не пришли за sync_timeout, мастер переходит на асинхронную репликацию
+// и не ждет слейвов, пока нужное их количество не догонит его
+func (s *SimpleStorage) awaitReplicas(ctx context.Context) error {
+	// В режиме raft запись уже зафиксирована группой до применения (см. run)
+	if s.raft != nil {
+		return nil
+	}
+
+	master := s.master()
+	if master == nil || s.syncReplicas <= 0 {
+		return nil
+	}
+	nextLSN := s.wal.NextLSN()
+
+	if s.syncDegraded.Load() {
+		// Слейвы догнали мастер, если подтвердили все записи, кроме последней: тогда
+		// эта запись снова ждет подтверждений, иначе возвращаемся без ожидания
+		if master.Acknowledged(nextLSN-1) < s.syncReplicas {
+			return nil
+		}
+		if s.syncDegraded.CompareAndSwap(true, false) {
+			s.logger.Info("Replicas caught up, semi-synchronous replication resumed",
+				zap.Int("sync_replicas", s.syncReplicas))
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, s.syncTimeout)
+	defer cancel()
+	acked := master.WaitForReplicas(waitCtx, nextLSN, s.syncReplicas)
+	if acked >= s.syncReplicas {
+		return nil
+	}
+
+	// Запрос отменен: запись уже применена на мастере, но слейвы ее не подтвердили
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteUnconfirmed, err)
+	}
+
+	if s.syncDegraded.CompareAndSwap(false, true) {
+		s.logger.Error("Replicas did not acknowledge write in time, falling back to asynchronous replication",
+			zap.Int("sync_replicas", s.syncReplicas),
+			zap.Int("acknowledged", acked),
+			zap.Duration("sync_timeout", s.syncTimeout))
+	}
+	return nil
+}
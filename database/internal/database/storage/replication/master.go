@@ -3,80 +3,117 @@ package replication
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
-	"path/filepath"
 	"sort"
-	"strings"
+	"sync"
+	"time"
 
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/snapshot"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
 	"github.com/keij-sama/Concurrency/database/internal/network"
 	"github.com/keij-sama/Concurrency/pkg/logger"
 	"go.uber.org/zap"
 )
 
+const (
+	// Предел количества записей в одном ответе слейву
+	maxResponseLogs = 10000
+	// Предел суммарного размера аргументов записей в одном ответе слейву
+	maxResponseBytes = 16 << 20
+	// Сколько батчей WAL может ждать отправки одному слейву. Если слейв отстает сильнее,
+	// подписка отменяется и он дочитывает записи с диска
+	streamBuffer = 1024
+	// Размер одной части снимка, отправляемого слейву
+	snapshotChunkSize = 1 << 20
+)
+
+// errNoSnapshot возвращается sendSnapshot, если у мастера нет снимка, покрывающего нужные слейву записи
+var errNoSnapshot = errors.New("no snapshot covers the compacted records")
+
 // Master представляет ведущий узел репликации
 type Master struct {
-	server       *network.TCPServer
-	walDirectory string
-	logger       logger.Logger
-	ctx          context.Context
-	cancel       context.CancelFunc
+	server    *network.TCPServer
+	wal       *wal.WAL
+	logger    logger.Logger
+	heartbeat time.Duration // Как часто мастер напоминает о себе слейву, если новых записей нет
+	snapshots string        // Директория снимков, которыми заполняются отставшие слейвы
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{} // Закрывается, когда сервер репликации остановлен
+
+	replicasMutex sync.Mutex
+	replicas      map[int64]*ReplicaState
+	acked         chan struct{} // Закрывается и заменяется при каждом подтверждении слейва
 }
 
-// NewMaster создает новый экземпляр Master
-func NewMaster(server *network.TCPServer, walDirectory string, logger logger.Logger) (*Master, error) {
+// ReplicaState - состояние слейва, подключенного к мастеру
+type ReplicaState struct {
+	ID       int64     // Идентификатор соединения слейва
+	NextLSN  uint64    // Слейв подтвердил запись в свой WAL всех записей до этого LSN
+	LastSeen time.Time // Время последнего подтверждения слейва
+}
+
+// Опция для конфигурации мастера
+type MasterOption func(*Master)
+
+// WithSnapshotDirectory задает директорию снимков мастера. Если нужные слейву записи уже удалены
+// сжатием WAL, мастер отправляет ему самый новый снимок из нее. Без нее такой слейв получает ошибку
+func WithSnapshotDirectory(dir string) MasterOption {
+	return func(m *Master) {
+		m.snapshots = dir
+	}
+}
+
+// NewMaster создает новый экземпляр Master, передающий слейвам записи из w. Если новых записей
+// нет, мастер отправляет слейву пустое сообщение каждые полпериода syncInterval, поэтому таймаут
+// соединений server должен быть не меньше syncInterval
+func NewMaster(server *network.TCPServer, w *wal.WAL, syncInterval time.Duration, logger logger.Logger,
+	options ...MasterOption) (*Master, error) {
+
 	if server == nil {
 		return nil, errors.New("server is invalid")
 	}
+	if w == nil {
+		return nil, errors.New("WAL is invalid")
+	}
+
+	heartbeat := syncInterval / 2
+	if heartbeat <= 0 {
+		heartbeat = time.Second
+	}
 
 	// Создаем свой контекст, который будет отменен при закрытии мастера
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Master{
-		server:       server,
-		walDirectory: walDirectory,
-		logger:       logger,
-		ctx:          ctx,
-		cancel:       cancel,
-	}, nil
+	master := &Master{
+		server:    server,
+		wal:       w,
+		logger:    logger,
+		heartbeat: heartbeat,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		replicas:  make(map[int64]*ReplicaState),
+		acked:     make(chan struct{}),
+	}
+	for _, option := range options {
+		option(master)
+	}
+	return master, nil
 }
 
-// Start запускает обработку запросов репликации
+// Start запускает прием слейвов
 func (m *Master) Start(ctx context.Context) error {
 	m.logger.Info("Starting replication master",
-		zap.String("wal_directory", m.walDirectory))
-
-	// Обработчик запросов от слейвов
-	handler := func(ctx context.Context, requestData []byte) []byte {
-		// Проверяем контекст
-		select {
-		case <-ctx.Done():
-			// Контекст отменен, возвращаем пустой ответ
-			return nil
-		default:
-			// Продолжаем выполнение
-		}
-
-		var request Request
-		if err := Decode(&request, requestData); err != nil {
-			m.logger.Error("Failed to decode replication request", zap.Error(err))
-			return encodeErrorResponse(errors.New("invalid request format"))
-		}
-
-		m.logger.Info("Received replication request",
-			zap.String("last_segment", request.LastSegmentName))
-
-		response := m.synchronize(request)
-		responseData, err := Encode(response)
-		if err != nil {
-			m.logger.Error("Failed to encode replication response", zap.Error(err))
-			return encodeErrorResponse(errors.New("failed to encode response"))
-		}
+		zap.String("wal_directory", m.wal.GetDirectory()))
 
-		return responseData
-	}
-
-	// Запускаем обработку запросов с контекстом мастера, а не с переданным контекстом
-	go m.server.HandleQueries(m.ctx, handler)
+	// Обслуживаем слейвов с контекстом мастера, а не с переданным контекстом
+	go func() {
+		defer close(m.done)
+		m.server.HandleStreams(m.ctx, m.serveReplica)
+	}()
 	return nil
 }
 
@@ -89,122 +126,362 @@ func (m *Master) IsMaster() bool {
 func (m *Master) Close() error {
 	m.logger.Info("Closing replication master")
 
-	// Отменяем контекст, что остановит обработку запросов
+	// Отменяем контекст, что остановит обработку запросов и закроет порт репликации
 	m.cancel()
 
+	// Ждем, пока слейвы отключатся, чтобы порт можно было занять снова
+	select {
+	case <-m.done:
+		m.logger.Info("Replication server stopped gracefully")
+	case <-time.After(time.Second):
+		m.logger.Info("Timeout waiting for replication server to stop")
+	}
+
 	return nil
 }
 
-// synchronize обрабатывает запрос репликации
-func (m *Master) synchronize(request Request) *Response {
-	response := &Response{
-		Succeed: false,
-	}
+// Replicas возвращает подключенных слейвов в порядке подключения
+func (m *Master) Replicas() []ReplicaState {
+	m.replicasMutex.Lock()
+	defer m.replicasMutex.Unlock()
 
-	// Получаем следующий сегмент после lastSegmentName
-	segmentName, err := findNextSegment(m.walDirectory, request.LastSegmentName)
-	if err != nil {
-		m.logger.Error("Failed to find next WAL segment",
-			zap.String("last_segment", request.LastSegmentName),
-			zap.Error(err))
-		return response
+	replicas := make([]ReplicaState, 0, len(m.replicas))
+	for _, replica := range m.replicas {
+		replicas = append(replicas, *replica)
 	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].ID < replicas[j].ID })
+	return replicas
+}
+
+// acknowledge запоминает LSN, подтвержденный слейвом соединения id
+func (m *Master) acknowledge(id int64, nextLSN uint64) {
+	m.replicasMutex.Lock()
+	defer m.replicasMutex.Unlock()
 
-	if segmentName == "" {
-		// Нет новых сегментов, все актуально
-		response.Succeed = true
-		m.logger.Info("No new WAL segments to send")
-		return response
+	replica, ok := m.replicas[id]
+	if !ok {
+		replica = &ReplicaState{ID: id}
+		m.replicas[id] = replica
 	}
+	replica.NextLSN = nextLSN
+	replica.LastSeen = time.Now()
 
-	// Читаем данные сегмента
-	segmentPath := filepath.Join(m.walDirectory, segmentName)
-	data, err := os.ReadFile(segmentPath)
-	if err != nil {
-		m.logger.Error("Failed to read WAL segment",
-			zap.String("segment", segmentName),
-			zap.Error(err))
-		return response
+	close(m.acked)
+	m.acked = make(chan struct{})
+}
+
+// forget удаляет слейва отключившегося соединения id
+func (m *Master) forget(id int64) {
+	m.replicasMutex.Lock()
+	defer m.replicasMutex.Unlock()
+
+	delete(m.replicas, id)
+}
+
+// Acknowledged возвращает количество слейвов, подтвердивших все записи до nextLSN, не включая его
+func (m *Master) Acknowledged(nextLSN uint64) int {
+	count, _ := m.acknowledged(nextLSN)
+	return count
+}
+
+// WaitForReplicas ждет, пока хотя бы replicas слейвов подтвердят все записи до nextLSN,
+// не включая его, или завершения ctx. Возвращает количество подтвердивших слейвов
+func (m *Master) WaitForReplicas(ctx context.Context, nextLSN uint64, replicas int) int {
+	for {
+		count, acked := m.acknowledged(nextLSN)
+		if count >= replicas {
+			return count
+		}
+
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			return count
+		}
 	}
+}
 
-	m.logger.Info("Sending WAL segment to slave",
-		zap.String("segment", segmentName),
-		zap.Int("size", len(data)))
+// acknowledged возвращает количество слейвов, подтвердивших записи до nextLSN, и канал,
+// который закроется при следующем подтверждении
+func (m *Master) acknowledged(nextLSN uint64) (int, chan struct{}) {
+	m.replicasMutex.Lock()
+	defer m.replicasMutex.Unlock()
 
-	response.Succeed = true
-	response.SegmentName = segmentName
-	response.SegmentData = data
-	return response
+	count := 0
+	for _, replica := range m.replicas {
+		if replica.NextLSN >= nextLSN {
+			count++
+		}
+	}
+	return count, m.acked
 }
 
-// findNextSegment находит следующий сегмент WAL после lastSegmentName
-func findNextSegment(directory string, lastSegmentName string) (string, error) {
-	segments, err := listWALSegments(directory)
+// serveReplica передает слейву записи WAL, пока соединение открыто. Первое сообщение слейва
+// сообщает LSN, с которого продолжить; следующие подтверждают примененные записи. Записи
+// отправляются, не дожидаясь подтверждений
+func (m *Master) serveReplica(ctx context.Context, stream *network.Stream) {
+	request, err := readRequest(stream)
 	if err != nil {
-		return "", err
+		m.logger.Error("Failed to read replication request",
+			zap.String("address", stream.RemoteAddr()),
+			zap.Error(err))
+		return
 	}
 
-	if len(segments) == 0 {
-		return "", nil
+	if next := m.wal.NextLSN(); request.NextLSN > next {
+		m.logger.Error("Replica is ahead of master",
+			zap.Uint64("replica_next_lsn", request.NextLSN),
+			zap.Uint64("master_next_lsn", next))
+		m.send(stream, &Response{
+			Error: fmt.Sprintf("replica expects lsn %d, but master has not reached it yet (next lsn %d)",
+				request.NextLSN, next),
+		})
+		return
 	}
 
-	if lastSegmentName == "" {
-		// Если это первый запрос, возвращаем первый сегмент
-		return segments[0], nil
+	m.acknowledge(stream.ID, request.NextLSN)
+	defer m.forget(stream.ID)
+
+	// Подтверждения читаются параллельно с отправкой записей. Отключение слейва
+	// останавливает отправку
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			request, err := readRequest(stream)
+			if err != nil {
+				if ctx.Err() == nil {
+					m.logger.Info("Replica disconnected",
+						zap.String("address", stream.RemoteAddr()),
+						zap.Error(err))
+				}
+				return
+			}
+			m.acknowledge(stream.ID, request.NextLSN)
+		}
+	}()
+
+	if err := m.push(ctx, stream, request.NextLSN); err != nil && ctx.Err() == nil {
+		m.logger.Error("Replication stream failed",
+			zap.String("address", stream.RemoteAddr()),
+			zap.Error(err))
 	}
+}
 
-	// Ищем следующий сегмент после lastSegmentName
-	for i, segment := range segments {
-		if segment == lastSegmentName && i < len(segments)-1 {
-			return segments[i+1], nil
+// push отправляет слейву записи начиная с next: сначала дочитывает их с диска, затем передает
+// батчи из подписки на WAL сразу после их записи. Подписка создается до чтения с диска, поэтому
+// записи, появившиеся после него, придут через подписку. Если слейв не успевает забирать записи
+// и WAL отменил подписку, записи снова дочитываются с диска
+func (m *Master) push(ctx context.Context, stream *network.Stream, next uint64) error {
+	heartbeat := time.NewTicker(m.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		sub := m.wal.Subscribe(streamBuffer)
+		var err error
+		if next, err = m.catchUp(stream, next); err == nil {
+			next, err = m.forward(ctx, stream, sub, next, heartbeat.C)
 		}
-	}
+		sub.Close()
 
-	// Если lastSegmentName не найден, возвращаем первый сегмент
-	if !contains(segments, lastSegmentName) {
-		return segments[0], nil
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
 	}
+}
 
-	// Все сегменты уже получены
-	return "", nil
+// catchUp отправляет слейву записи с диска начиная с next, пока не дойдет до конца WAL.
+// Если записи уже удалены сжатием WAL, сначала отправляет снимок. Возвращает LSN следующей
+// неотправленной записи
+func (m *Master) catchUp(stream *network.Stream, next uint64) (uint64, error) {
+	for {
+		logs, err := m.wal.ReadFrom(next, maxResponseLogs)
+		if errors.Is(err, wal.ErrLSNUnavailable) && m.snapshots != "" {
+			lsn, snapshotErr := m.sendSnapshot(stream, next)
+			if snapshotErr == nil {
+				next = lsn + 1
+				continue
+			}
+			if !errors.Is(snapshotErr, errNoSnapshot) {
+				return next, snapshotErr
+			}
+		}
+		if err != nil {
+			response := &Response{Error: err.Error()}
+			if errors.Is(err, wal.ErrLSNUnavailable) {
+				response.Error = fmt.Sprintf("records from lsn %d were compacted on master "+
+					"and no master snapshot covers them", next)
+			}
+			m.logger.Error("Failed to read WAL records",
+				zap.Uint64("next_lsn", next),
+				zap.Error(err))
+			m.send(stream, response)
+			return next, err
+		}
+		if len(logs) == 0 {
+			return next, nil
+		}
+
+		response := &Response{Succeed: true}
+		response.Logs, response.More = limitResponse(logs)
+		if err := m.send(stream, response); err != nil {
+			return next, err
+		}
+		next = response.Logs[len(response.Logs)-1].LSN + 1
+
+		m.logger.Info("Sending WAL records to slave",
+			zap.Uint64("from_lsn", response.Logs[0].LSN),
+			zap.Uint64("to_lsn", next-1),
+			zap.Int("count", len(response.Logs)))
+	}
 }
 
-// listWALSegments возвращает отсортированный список всех сегментов WAL
-func listWALSegments(directory string) ([]string, error) {
-	entries, err := os.ReadDir(directory)
+// sendSnapshot отправляет слейву частями самый новый снимок мастера, если он покрывает записи
+// начиная с next. Возвращает LSN снимка или errNoSnapshot, если такого снимка нет
+func (m *Master) sendSnapshot(stream *network.Stream, next uint64) (uint64, error) {
+	snapshots, err := snapshot.List(m.snapshots)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	if len(snapshots) == 0 || snapshots[len(snapshots)-1].LSN < next {
+		return 0, errNoSnapshot
+	}
+	info := snapshots[len(snapshots)-1]
+
+	// Открытый файл дочитывается, даже если новый снимок удалит его во время передачи
+	file, err := os.Open(info.Path)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("failed to open snapshot: %w", err)
 	}
+	defer file.Close()
+
+	m.logger.Info("Sending snapshot to slave",
+		zap.String("address", stream.RemoteAddr()),
+		zap.String("path", info.Path),
+		zap.Uint64("lsn", info.LSN),
+		zap.Uint64("next_lsn", next))
+
+	buf := make([]byte, snapshotChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(file, buf)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return 0, fmt.Errorf("failed to read snapshot: %w", err)
+		}
 
-	var segments []string
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasPrefix(entry.Name(), "wal_") &&
-			strings.HasSuffix(entry.Name(), ".log") {
-			segments = append(segments, entry.Name())
+		chunk := &SnapshotChunk{LSN: info.LSN, Offset: offset, Data: buf[:n], Last: last}
+		if err := m.send(stream, &Response{Succeed: true, Snapshot: chunk}); err != nil {
+			return 0, err
 		}
-	}
+		offset += int64(n)
 
-	// Сортируем сегменты по имени
-	sort.Strings(segments)
-	return segments, nil
+		if last {
+			return info.LSN, nil
+		}
+	}
 }
 
-// contains проверяет, содержит ли срез значение
-func contains(slice []string, value string) bool {
-	for _, item := range slice {
-		if item == value {
-			return true
+// forward отправляет слейву записи из подписки, начиная с next, пока ctx не завершится или
+// WAL не отменит подписку. Батчи, уже ожидающие в подписке, отправляются одним сообщением.
+// Пока новых записей нет, по каждому сигналу heartbeat отправляется пустое сообщение
+func (m *Master) forward(ctx context.Context, stream *network.Stream, sub *wal.Subscription,
+	next uint64, heartbeat <-chan time.Time) (uint64, error) {
+
+	for {
+		var (
+			logs []wal.Log
+			open = true
+		)
+		take := func(batch []wal.Log) {
+			for _, log := range batch {
+				// Записи до next уже отправлены с диска
+				if log.LSN >= next {
+					logs = append(logs, log)
+				}
+			}
+		}
+
+		select {
+		case batch, ok := <-sub.C:
+			if !ok {
+				return next, nil
+			}
+			take(batch)
+		case <-heartbeat:
+			if err := m.send(stream, &Response{Succeed: true}); err != nil {
+				return next, err
+			}
+			continue
+		case <-ctx.Done():
+			return next, nil
+		}
+
+	drain:
+		for open && len(logs) < maxResponseLogs {
+			select {
+			case batch, ok := <-sub.C:
+				open = ok
+				take(batch)
+			default:
+				break drain
+			}
+		}
+
+		// Записи уже вычитаны из подписки, поэтому отправляются все, частями по пределу ответа
+		for len(logs) > 0 {
+			response := &Response{Succeed: true}
+			response.Logs, response.More = limitResponse(logs)
+			if err := m.send(stream, response); err != nil {
+				return next, err
+			}
+			logs = logs[len(response.Logs):]
+			next = response.Logs[len(response.Logs)-1].LSN + 1
 		}
+
+		if !open {
+			return next, nil
+		}
+	}
+}
+
+// send кодирует и отправляет сообщение слейву
+func (m *Master) send(stream *network.Stream, response *Response) error {
+	data, err := Encode(response)
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+	if err := stream.Write(data); err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	return nil
+}
+
+// readRequest читает и декодирует следующее сообщение слейва
+func readRequest(stream *network.Stream) (Request, error) {
+	var request Request
+	data, err := stream.Read()
+	if err != nil {
+		return request, err
 	}
-	return false
+	if err := Decode(&request, data); err != nil {
+		return request, fmt.Errorf("invalid request format: %w", err)
+	}
+	return request, nil
 }
 
-// encodeErrorResponse кодирует ответ с ошибкой
-func encodeErrorResponse(err error) []byte {
-	response := &Response{
-		Succeed: false,
-		Error:   err.Error(),
+// limitResponse ограничивает количество и размер записей одного ответа. Возвращает true,
+// если часть записей не поместилась
+func limitResponse(logs []wal.Log) ([]wal.Log, bool) {
+	size := 0
+	for i, log := range logs {
+		for _, arg := range log.Args {
+			size += len(arg)
+		}
+		if (size > maxResponseBytes && i > 0) || i == maxResponseLogs {
+			return logs[:i], true
+		}
 	}
-	data, _ := Encode(response)
-	return data
+	return logs, len(logs) == maxResponseLogs
 }
@@ -0,0 +1,1039 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+	"github.com/keij-sama/Concurrency/database/internal/network"
+	"github.com/keij-sama/Concurrency/pkg/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// Предел количества записей в одном запросе AppendEntries
+	maxAppendLogs = 1000
+	// Таймаут выборов по умолчанию
+	defaultElectionTimeout = time.Second
+)
+
+// Ошибки Raft
+var (
+	// ErrNotLeader возвращается, если узел не является лидером группы
+	ErrNotLeader = errors.New("node is not the raft leader")
+	// ErrLeadershipLost возвращается, если узел перестал быть лидером до фиксации записи.
+	// Запись не применена на узле, но может быть как зафиксирована новым лидером, так и отброшена
+	ErrLeadershipLost = errors.New("raft leadership lost before the write was committed")
+)
+
+// StateMachine - данные узла, к которым применяются записи лога Raft. Методы вызываются
+// из одной горутины узла
+type StateMachine interface {
+	// Apply применяет зафиксированные записи лога в порядке LSN
+	Apply(logs []wal.Log) error
+	// SetLeader разрешает запись на лидере и запрещает на остальных узлах. Записи лидера
+	// применяет сам узел после WaitCommitted. Когда метод возвращается, начатые записи
+	// уже применены или отклонены, а новые видят новую роль
+	SetLeader(leader bool)
+}
+
+// RaftConfig содержит настройки узла Raft
+type RaftConfig struct {
+	ID    string   // Идентификатор узла - адрес его сервера репликации
+	Peers []string // Адреса серверов репликации остальных узлов группы
+	// ElectionTimeout - сколько последователь ждет лидера, прежде чем начать выборы.
+	// Фактический таймаут выбирается случайно от ElectionTimeout до 2*ElectionTimeout,
+	// лидер отправляет heartbeat каждые ElectionTimeout/5
+	ElectionTimeout time.Duration
+	// Dial подключается к серверу репликации узла группы
+	Dial func(address string) (*network.TCPClient, error)
+}
+
+// raftRole - роль узла в текущем терме
+type raftRole int
+
+const (
+	roleFollower raftRole = iota
+	roleCandidate
+	roleLeader
+)
+
+// String возвращает название роли для логов и статуса
+func (r raftRole) String() string {
+	switch r {
+	case roleCandidate:
+		return "candidate"
+	case roleLeader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// RaftStatus - состояние узла Raft
+type RaftStatus struct {
+	ID     string
+	Role   string // follower, candidate или leader
+	Term   uint64
+	Leader string // Адрес лидера текущего терма, если он известен
+	Commit uint64 // Записи до этого LSN зафиксированы
+}
+
+// Raft - узел группы репликации с автоматическим выбором лидера по алгоритму Raft.
+// Логом служит WAL узла: записи добавляет лидер, а последователи получают их через
+// AppendEntries. Машина состояний содержит только зафиксированные записи, то есть
+// сохраненные большинством узлов: лидер применяет свою запись и отвечает клиенту после
+// фиксации (см. WaitCommitted), последователи применяют записи по индексу фиксации лидера.
+// Снимки и сжатие WAL не поддерживаются: отставший узел догоняет лидера по его WAL,
+// поэтому лог растет без ограничений
+type Raft struct {
+	server          *network.TCPServer
+	wal             *wal.WAL
+	machine         StateMachine
+	logger          logger.Logger
+	id              string
+	peers           []*raftPeer
+	dial            func(address string) (*network.TCPClient, error)
+	electionTimeout time.Duration
+	heartbeat       time.Duration
+	ctx             context.Context
+	cancel          context.CancelFunc
+	done            chan struct{}  // Закрывается, когда сервер репликации остановлен
+	wg              sync.WaitGroup // Горутины узла, кроме сервера
+
+	mutex       sync.Mutex
+	role        raftRole
+	term        uint64
+	votedFor    string
+	terms       []TermStart
+	leader      string
+	commit      uint64    // Записи с LSN меньше commit зафиксированы
+	savedCommit uint64    // Значение commit в файле состояния
+	deadline    time.Time // Когда последователь начнет выборы, если не услышит лидера
+	leaderSince time.Time // Когда узел стал лидером
+
+	// Состояние машины состояний. Пока узел лидер и машина принимает запись, записи
+	// применяет хранилище, дождавшись их фиксации, и applied не меняется
+	applied     uint64 // Записи с LSN меньше applied применены
+	machineTerm uint64 // Терм, в котором машина принимает запись через SetLeader, 0 - не принимает
+	noopTerm    uint64 // Терм, в котором лидер записал пустую запись
+	noopNext    uint64 // LSN после пустой записи терма noopTerm
+	// Индекс фиксации на момент потери лидерства в терме steppedTerm: записи машины
+	// с меньшим LSN применены, остальные отклонены (см. WaitCommitted)
+	steppedTerm   uint64
+	steppedCommit uint64
+
+	changed chan struct{} // Закрывается и заменяется при смене роли, терма или commit
+	kick    chan struct{} // Закрывается и заменяется, чтобы лидер сразу отправил новые записи
+}
+
+// raftPeer - другой узел группы с точки зрения этого узла
+type raftPeer struct {
+	address string
+
+	clientMutex sync.Mutex
+	client      *network.TCPClient // Соединение для AppendEntries, nil до подключения
+
+	// Состояние репликации на лидере, под mutex узла
+	next      uint64    // LSN следующей записи для отправки
+	match     uint64    // Все записи до match есть в логе узла
+	lastAck   time.Time // Время последнего ответа
+	reachable bool
+}
+
+// raftRequest - запрос между узлами Raft: голосование или добавление записей
+type raftRequest struct {
+	Vote   *VoteRequest   `json:"vote,omitempty"`
+	Append *AppendRequest `json:"append,omitempty"`
+}
+
+// VoteRequest - запрос голоса кандидатом
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	NextLSN   uint64 `json:"next_lsn"`  // Длина лога кандидата
+	LastTerm  uint64 `json:"last_term"` // Терм последней записи лога кандидата
+}
+
+// AppendRequest - записи лога лидера. Запрос без записей служит heartbeat
+type AppendRequest struct {
+	Term     uint64      `json:"term"`
+	Leader   string      `json:"leader"`
+	NextLSN  uint64      `json:"next_lsn"`  // LSN первой записи Logs: записи до него должны совпадать с лидером
+	PrevTerm uint64      `json:"prev_term"` // Терм записи NextLSN-1 у лидера
+	Logs     []wal.Log   `json:"logs"`
+	Terms    []TermStart `json:"terms"`  // Границы термов, покрывающие Logs
+	Commit   uint64      `json:"commit"` // Записи лидера до этого LSN зафиксированы
+}
+
+// RaftResponse - ответ узла на запрос Raft
+type RaftResponse struct {
+	Term    uint64 `json:"term"`
+	Succeed bool   `json:"succeed"`  // Голос отдан или записи добавлены
+	NextLSN uint64 `json:"next_lsn"` // Для AppendEntries: с какого LSN лидеру продолжать
+	Error   string `json:"error"`
+}
+
+// NewRaft создает узел Raft. Состояние узла читается из директории WAL. machine должна
+// уже содержать записи WAL до сохраненного индекса фиксации (см. LoadRaftCommit) и ни
+// одной после него. Сервер должен слушать адрес cfg.ID
+func NewRaft(server *network.TCPServer, w *wal.WAL, cfg RaftConfig, machine StateMachine, logger logger.Logger) (*Raft, error) {
+	if server == nil {
+		return nil, errors.New("server is invalid")
+	}
+	if w == nil {
+		return nil, errors.New("WAL is invalid")
+	}
+	if machine == nil || cfg.Dial == nil {
+		return nil, errors.New("state machine and dial function are required")
+	}
+	if cfg.ID == "" {
+		return nil, errors.New("raft node address is required")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+
+	state, err := loadRaftState(w.GetDirectory())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Raft{
+		server:          server,
+		wal:             w,
+		machine:         machine,
+		logger:          logger,
+		id:              cfg.ID,
+		dial:            cfg.Dial,
+		electionTimeout: cfg.ElectionTimeout,
+		heartbeat:       cfg.ElectionTimeout / 5,
+		ctx:             ctx,
+		cancel:          cancel,
+		done:            make(chan struct{}),
+		term:            state.Term,
+		votedFor:        state.VotedFor,
+		terms:           state.Terms,
+		commit:          min(state.Commit, w.NextLSN()),
+		savedCommit:     state.Commit,
+		applied:         min(state.Commit, w.NextLSN()),
+		changed:         make(chan struct{}),
+		kick:            make(chan struct{}),
+	}
+	for _, address := range cfg.Peers {
+		if address != cfg.ID {
+			r.peers = append(r.peers, &raftPeer{address: address, reachable: true})
+		}
+	}
+	r.resetElectionTimer()
+	return r, nil
+}
+
+// Start запускает сервер репликации, таймер выборов и применение записей
+func (r *Raft) Start(ctx context.Context) error {
+	r.logger.Info("Starting raft node",
+		zap.String("id", r.id),
+		zap.Int("peers", len(r.peers)),
+		zap.Uint64("term", r.term),
+		zap.Uint64("next_lsn", r.wal.NextLSN()),
+		zap.Duration("election_timeout", r.electionTimeout))
+
+	go func() {
+		defer close(r.done)
+		r.server.HandleQueries(r.ctx, r.handle)
+	}()
+
+	r.wg.Add(2)
+	go r.tickLoop()
+	go r.applyLoop()
+	return nil
+}
+
+// IsMaster возвращает true, если узел - лидер группы
+func (r *Raft) IsMaster() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.role == roleLeader
+}
+
+// Leader возвращает адрес лидера текущего терма или пустую строку, если он неизвестен
+func (r *Raft) Leader() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.leader
+}
+
+// Status возвращает роль, терм и индекс фиксации узла
+func (r *Raft) Status() RaftStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return RaftStatus{
+		ID:     r.id,
+		Role:   r.role.String(),
+		Term:   r.term,
+		Leader: r.leader,
+		Commit: r.commit,
+	}
+}
+
+// WaitCommitted ждет, пока будут зафиксированы все записи до next, не включая его, или
+// завершения ctx. Вызывается лидером после записи в WAL, пока машина принимает запись:
+// после возврата nil запись нужно применить. Если узел перестанет быть лидером раньше
+// фиксации, возвращает ErrLeadershipLost. Решение зависит только от next: применяются все
+// записи до индекса фиксации на момент потери лидерства и ни одной после него, поэтому
+// машина бывшего лидера продолжает применять лог с этого индекса. Запись, ожидание которой
+// прервано ctx, тоже может оказаться зафиксированной, поэтому ctx должен завершаться
+// только вместе с узлом
+func (r *Raft) WaitCommitted(ctx context.Context, next uint64) error {
+	r.mutex.Lock()
+	term := r.machineTerm
+	if term == 0 {
+		r.mutex.Unlock()
+		return ErrLeadershipLost
+	}
+	r.notifyPeers()
+	r.mutex.Unlock()
+
+	for {
+		r.mutex.Lock()
+		var commit uint64
+		switch {
+		case r.role == roleLeader && r.term == term:
+			r.advanceCommit()
+			commit = r.commit
+		case r.steppedTerm == term:
+			commit = r.steppedCommit
+		}
+		if commit >= next {
+			r.mutex.Unlock()
+			return nil
+		}
+		if r.role != roleLeader || r.term != term {
+			r.mutex.Unlock()
+			return ErrLeadershipLost
+		}
+		changed := r.changed
+		r.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close останавливает узел и сохраняет его состояние
+func (r *Raft) Close() error {
+	r.logger.Info("Closing raft node", zap.String("id", r.id))
+
+	r.cancel()
+	for _, peer := range r.peers {
+		peer.disconnect()
+	}
+
+	select {
+	case <-r.done:
+		r.logger.Info("Raft server stopped gracefully")
+	case <-time.After(time.Second):
+		r.logger.Info("Timeout waiting for raft server to stop")
+	}
+	r.wg.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.save()
+}
+
+// handle обрабатывает запрос другого узла группы
+func (r *Raft) handle(ctx context.Context, requestData []byte) []byte {
+	var request raftRequest
+	var response *RaftResponse
+	if err := Decode(&request, requestData); err != nil {
+		r.logger.Error("Failed to decode raft request", zap.Error(err))
+		response = &RaftResponse{Error: "invalid request format"}
+	} else if request.Vote != nil {
+		response = r.handleVote(*request.Vote)
+	} else if request.Append != nil {
+		response = r.handleAppend(*request.Append)
+	} else {
+		response = &RaftResponse{Error: "empty raft request"}
+	}
+
+	responseData, err := Encode(response)
+	if err != nil {
+		r.logger.Error("Failed to encode raft response", zap.Error(err))
+		return nil
+	}
+	return responseData
+}
+
+// handleVote отдает голос кандидату, если узел еще не голосовал в его терме, а лог
+// кандидата не отстает от лога узла
+func (r *Raft) handleVote(request VoteRequest) *RaftResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if request.Term > r.term {
+		r.becomeFollower(request.Term, "")
+	}
+	response := &RaftResponse{Term: r.term}
+	if request.Term < r.term {
+		return response
+	}
+	if r.votedFor != "" && r.votedFor != request.Candidate {
+		return response
+	}
+
+	next := r.wal.NextLSN()
+	lastTerm := r.lastTerm(next)
+	if request.LastTerm < lastTerm || (request.LastTerm == lastTerm && request.NextLSN < next) {
+		return response
+	}
+
+	r.votedFor = request.Candidate
+	if err := r.save(); err != nil {
+		r.logger.Error("Failed to persist raft vote", zap.Error(err))
+		r.votedFor = ""
+		return response
+	}
+	r.resetElectionTimer()
+
+	r.logger.Info("Voted for raft candidate",
+		zap.String("candidate", request.Candidate),
+		zap.Uint64("term", r.term))
+	response.Succeed = true
+	return response
+}
+
+// handleAppend добавляет в лог записи лидера. Записи, которых нет у лидера, отбрасываются:
+// они не зафиксированы, поэтому еще не применены
+func (r *Raft) handleAppend(request AppendRequest) *RaftResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if request.Term < r.term {
+		return &RaftResponse{Term: r.term, NextLSN: r.wal.NextLSN()}
+	}
+	if request.Term > r.term || r.role != roleFollower || r.leader != request.Leader {
+		r.becomeFollower(request.Term, request.Leader)
+	}
+	r.resetElectionTimer()
+	response := &RaftResponse{Term: r.term, NextLSN: request.NextLSN}
+
+	// Пока машина состояний принимает записи прошлого лидерства, лог менять нельзя
+	if r.machineTerm != 0 {
+		response.Error = "node is stepping down"
+		return response
+	}
+
+	end := r.wal.NextLSN()
+	if request.NextLSN > end {
+		response.NextLSN = end
+		return response
+	}
+	if request.NextLSN > 0 && termOf(r.terms, request.NextLSN-1) != request.PrevTerm {
+		// Пропускаем расходящийся терм целиком. Зафиксированные записи совпадают на всех узлах
+		response.NextLSN = max(termBegin(r.terms, request.NextLSN-1), r.commit)
+		return response
+	}
+
+	matched := request.NextLSN
+	if len(request.Logs) > 0 {
+		matched = request.Logs[len(request.Logs)-1].LSN + 1
+	}
+
+	// Записи, которые уже есть в логе с тем же термом, не переписываются
+	logs := request.Logs
+	for len(logs) > 0 && logs[0].LSN < end && termOf(r.terms, logs[0].LSN) == termOf(request.Terms, logs[0].LSN) {
+		logs = logs[1:]
+	}
+	if len(logs) > 0 {
+		if err := r.appendLogs(logs, request.Terms); err != nil {
+			r.logger.Error("Failed to append raft log records",
+				zap.Uint64("from_lsn", logs[0].LSN),
+				zap.Int("count", len(logs)),
+				zap.Error(err))
+			response.NextLSN = min(r.wal.NextLSN(), logs[0].LSN)
+			response.Error = err.Error()
+			return response
+		}
+	}
+
+	if commit := min(request.Commit, matched); commit > r.commit {
+		r.commit = commit
+		r.notify()
+	}
+	response.Succeed = true
+	response.NextLSN = matched
+	return response
+}
+
+// appendLogs записывает записи лидера в WAL, отбрасывая расходящийся хвост лога.
+// Вызывается под mutex
+func (r *Raft) appendLogs(logs []wal.Log, terms []TermStart) error {
+	first := logs[0].LSN
+	if first < r.wal.NextLSN() {
+		if first < r.commit {
+			return fmt.Errorf("leader tried to overwrite committed record %d", first)
+		}
+		if err := r.wal.Rewind(first); err != nil {
+			return err
+		}
+		r.logger.Info("Discarded raft log records missing on leader", zap.Uint64("from_lsn", first))
+	}
+
+	// Границы термов сохраняются раньше записей: граница после конца лога ни на что не влияет
+	for _, log := range logs {
+		r.terms = setTerm(r.terms, log.LSN, termOf(terms, log.LSN))
+	}
+	if err := r.save(); err != nil {
+		return err
+	}
+
+	_, err := r.wal.Append(r.ctx, logs)
+	return err
+}
+
+// tickLoop запускает выборы, если последователь не слышит лидера, и снимает лидерство,
+// если лидер не слышит большинство
+func (r *Raft) tickLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.heartbeat / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mutex.Lock()
+		now := time.Now()
+		if r.role == roleLeader {
+			r.checkQuorum(now)
+		} else if now.After(r.deadline) {
+			r.startElection()
+		}
+
+		// Индекс фиксации сохраняется периодически: он нужен только как нижняя граница
+		if r.commit > r.savedCommit {
+			if err := r.save(); err != nil {
+				r.logger.Error("Failed to persist raft state", zap.Error(err))
+			}
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// checkQuorum снимает лидерство, если большинство узлов не отвечало дольше таймаута выборов:
+// так лидер в меньшей части разделенной сети перестает принимать записи. Вызывается под mutex
+func (r *Raft) checkQuorum(now time.Time) {
+	if now.Sub(r.leaderSince) < r.electionTimeout {
+		return
+	}
+	reachable := 1
+	for _, peer := range r.peers {
+		if now.Sub(peer.lastAck) < r.electionTimeout {
+			reachable++
+		}
+	}
+	if reachable >= r.quorum() {
+		return
+	}
+
+	r.logger.Error("Raft leader lost contact with the majority, stepping down",
+		zap.Uint64("term", r.term),
+		zap.Int("reachable", reachable))
+	r.becomeFollower(r.term, "")
+	r.resetElectionTimer()
+}
+
+// startElection начинает выборы в следующем терме. Вызывается под mutex
+func (r *Raft) startElection() {
+	r.role = roleCandidate
+	r.term++
+	r.votedFor = r.id
+	r.leader = ""
+	r.resetElectionTimer()
+	r.notify()
+	if err := r.save(); err != nil {
+		r.logger.Error("Failed to persist raft state, election postponed", zap.Error(err))
+		return
+	}
+
+	next := r.wal.NextLSN()
+	request := VoteRequest{
+		Term:      r.term,
+		Candidate: r.id,
+		NextLSN:   next,
+		LastTerm:  r.lastTerm(next),
+	}
+	r.logger.Info("Starting raft election",
+		zap.Uint64("term", request.Term),
+		zap.Uint64("next_lsn", next))
+
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeader()
+		return
+	}
+
+	for _, peer := range r.peers {
+		r.wg.Add(1)
+		go func(peer *raftPeer) {
+			defer r.wg.Done()
+
+			response, err := r.call(peer.address, &raftRequest{Vote: &request})
+			if err != nil {
+				return
+			}
+
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if response.Term > r.term {
+				r.becomeFollower(response.Term, "")
+				return
+			}
+			if !response.Succeed || r.role != roleCandidate || r.term != request.Term {
+				return
+			}
+			votes++
+			if votes == r.quorum() {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader делает кандидата лидером и запускает репликацию на остальные узлы.
+// Вызывается под mutex
+func (r *Raft) becomeLeader() {
+	next := r.wal.NextLSN()
+	r.terms = setTerm(r.terms, next, r.term)
+	if err := r.save(); err != nil {
+		r.logger.Error("Failed to persist raft state, leadership declined", zap.Error(err))
+		r.becomeFollower(r.term, "")
+		return
+	}
+
+	r.role = roleLeader
+	r.leader = r.id
+	r.leaderSince = time.Now()
+	for _, peer := range r.peers {
+		peer.next = next
+		peer.match = 0
+		peer.lastAck = time.Time{}
+		r.wg.Add(1)
+		go r.replicate(peer, r.term)
+	}
+	r.notify()
+
+	r.logger.Info("Elected raft leader",
+		zap.Uint64("term", r.term),
+		zap.Uint64("next_lsn", next))
+}
+
+// becomeFollower переводит узел в последователи терма term с лидером leader.
+// Вызывается под mutex
+func (r *Raft) becomeFollower(term uint64, leader string) {
+	// Записи, которые машина приняла в этом терме, применяются, только если зафиксированы
+	// до потери лидерства. Терм меняется ниже, поэтому запоминаем индекс фиксации сейчас
+	if r.role == roleLeader && r.machineTerm == r.term {
+		r.steppedTerm = r.term
+		r.steppedCommit = r.commit
+	}
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		if err := r.save(); err != nil {
+			r.logger.Error("Failed to persist raft state", zap.Error(err))
+		}
+	}
+	if r.role == roleLeader {
+		r.logger.Info("Raft leader stepped down", zap.Uint64("term", r.term))
+	}
+	if leader != "" && leader != r.leader {
+		r.logger.Info("Following raft leader",
+			zap.String("leader", leader),
+			zap.Uint64("term", r.term))
+	}
+
+	r.role = roleFollower
+	r.leader = leader
+	r.notify()
+}
+
+// replicate отправляет узлу peer записи лога и heartbeat, пока узел остается лидером терма term
+func (r *Raft) replicate(peer *raftPeer, term uint64) {
+	defer r.wg.Done()
+	defer peer.disconnect()
+
+	for {
+		r.mutex.Lock()
+		if r.role != roleLeader || r.term != term {
+			r.mutex.Unlock()
+			return
+		}
+		next := peer.next
+		request := &AppendRequest{
+			Term:    term,
+			Leader:  r.id,
+			NextLSN: next,
+			Terms:   termsFrom(r.terms, next),
+			Commit:  r.commit,
+		}
+		if next > 0 {
+			request.PrevTerm = termOf(r.terms, next-1)
+		}
+		kick := r.kick
+		r.mutex.Unlock()
+
+		more := false
+		logs, err := r.wal.ReadFrom(next, maxAppendLogs)
+		if err == nil {
+			request.Logs, _ = limitResponse(logs)
+			more = r.sendAppend(peer, request)
+		} else {
+			r.logger.Error("Failed to read raft log records",
+				zap.Uint64("next_lsn", next),
+				zap.Error(err))
+		}
+		if more {
+			continue
+		}
+
+		select {
+		case <-kick:
+		case <-time.After(r.heartbeat):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// sendAppend отправляет запрос AppendEntries и обновляет состояние узла peer по ответу.
+// Возвращает true, если следующий запрос нужно отправить сразу
+func (r *Raft) sendAppend(peer *raftPeer, request *AppendRequest) bool {
+	response, err := peer.send(r, &raftRequest{Append: request})
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err != nil {
+		if peer.reachable {
+			peer.reachable = false
+			r.logger.Error("Raft peer is unreachable",
+				zap.String("peer", peer.address),
+				zap.Error(err))
+		}
+		return false
+	}
+	if !peer.reachable {
+		peer.reachable = true
+		r.logger.Info("Raft peer is reachable again", zap.String("peer", peer.address))
+	}
+
+	if response.Term > r.term {
+		r.becomeFollower(response.Term, "")
+		return false
+	}
+	if r.role != roleLeader || r.term != request.Term {
+		return false
+	}
+	peer.lastAck = time.Now()
+
+	if response.Succeed {
+		peer.match = response.NextLSN
+		peer.next = response.NextLSN
+		r.advanceCommit()
+		return len(request.Logs) > 0 && peer.next < r.wal.WrittenLSN()
+	}
+
+	// Узел не может принять записи сейчас, например сам заканчивает лидерство: повторяем позже
+	if response.Error != "" || request.NextLSN == 0 {
+		return false
+	}
+	peer.next = min(response.NextLSN, request.NextLSN-1)
+	return true
+}
+
+// advanceCommit фиксирует записи, сохраненные большинством узлов. Записи предыдущих
+// термов фиксируются только вместе с записью текущего. Вызывается под mutex
+func (r *Raft) advanceCommit() {
+	matches := []uint64{r.wal.WrittenLSN()}
+	for _, peer := range r.peers {
+		matches = append(matches, peer.match)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+
+	commit := matches[r.quorum()-1]
+	if commit > r.commit && termOf(r.terms, commit-1) == r.term {
+		r.commit = commit
+		r.notify()
+	}
+}
+
+// applyLoop согласует машину состояний с ролью узла и применяет зафиксированные записи.
+// Все вызовы machine выполняются здесь
+func (r *Raft) applyLoop() {
+	defer r.wg.Done()
+
+	for {
+		r.mutex.Lock()
+		changed := r.changed
+		leader := r.role == roleLeader
+		term := r.term
+		machineTerm := r.machineTerm
+		noopWritten := r.noopTerm == term
+		applied, commit, noopNext := r.applied, r.commit, r.noopNext
+		r.mutex.Unlock()
+
+		var err error
+		switch {
+		case machineTerm != 0 && (!leader || term != machineTerm):
+			r.follow()
+		case machineTerm != 0:
+			// Записи лидера применяет хранилище
+			select {
+			case <-changed:
+			case <-r.ctx.Done():
+				return
+			}
+			continue
+		case leader && !noopWritten:
+			err = r.writeNoop(term)
+		case applied < commit:
+			err = r.applyRange(applied, commit)
+		case leader && applied >= noopNext:
+			r.lead(term)
+		default:
+			select {
+			case <-changed:
+			case <-r.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if err != nil {
+			r.logger.Error("Failed to apply raft log", zap.Error(err))
+			select {
+			case <-time.After(r.heartbeat):
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// writeNoop начинает лидерство терма term пустой записью: записи предыдущих термов
+// фиксируются только вместе с ней. Запись клиентов еще запрещена, поэтому лог после
+// пустой записи не меняется
+func (r *Raft) writeNoop(term uint64) error {
+	select {
+	case result := <-r.wal.Noop():
+		if result.Err != nil {
+			return fmt.Errorf("failed to write leader noop record: %w", result.Err)
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.noopTerm = term
+		r.noopNext = result.LSN + 1
+		if r.role == roleLeader && r.term == term {
+			r.advanceCommit()
+		}
+		r.notifyPeers()
+		return nil
+	case <-r.ctx.Done():
+		return nil
+	}
+}
+
+// lead разрешает запись, когда весь лог лидера терма term вместе с его пустой записью
+// зафиксирован и применен: новые записи видят все записи предыдущих лидеров
+func (r *Raft) lead(term uint64) {
+	r.mutex.Lock()
+	current := r.role == roleLeader && r.term == term
+	if current {
+		r.machineTerm = term
+	}
+	r.mutex.Unlock()
+	if !current {
+		return
+	}
+
+	r.machine.SetLeader(true)
+}
+
+// follow запрещает запись после потери лидерства. Машина бывшего лидера содержит записи
+// до индекса фиксации на момент потери лидерства, дальше она применяет лог как последователь
+func (r *Raft) follow() {
+	r.machine.SetLeader(false)
+
+	r.mutex.Lock()
+	r.applied = r.steppedCommit
+	r.machineTerm = 0
+	r.mutex.Unlock()
+}
+
+// applyRange применяет записи лога с LSN от applied до commit, не включая его,
+// не больше одного пакета за вызов
+func (r *Raft) applyRange(applied, commit uint64) error {
+	if applied >= commit {
+		return nil
+	}
+	logs, err := r.wal.ReadFrom(applied, int(min(commit-applied, maxAppendLogs)))
+	if err != nil {
+		return err
+	}
+	for len(logs) > 0 && logs[len(logs)-1].LSN >= commit {
+		logs = logs[:len(logs)-1]
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+
+	if err := r.machine.Apply(logs); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.applied == applied {
+		r.applied = logs[len(logs)-1].LSN + 1
+	}
+	return nil
+}
+
+// appliedLSN возвращает LSN, до которого записи применены к машине состояний
+func (r *Raft) appliedLSN() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.applied
+}
+
+// lastTerm возвращает терм последней записи лога длины next. Вызывается под mutex
+func (r *Raft) lastTerm(next uint64) uint64 {
+	if next == 0 {
+		return 0
+	}
+	return termOf(r.terms, next-1)
+}
+
+// quorum возвращает количество узлов, составляющих большинство группы
+func (r *Raft) quorum() int {
+	return (len(r.peers)+1)/2 + 1
+}
+
+// resetElectionTimer откладывает выборы на случайный таймаут. Вызывается под mutex
+func (r *Raft) resetElectionTimer() {
+	timeout := r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout)))
+	r.deadline = time.Now().Add(timeout)
+}
+
+// notify будит ожидающих изменений роли, терма и commit. Вызывается под mutex
+func (r *Raft) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// notifyPeers будит горутины репликации лидера. Вызывается под mutex
+func (r *Raft) notifyPeers() {
+	close(r.kick)
+	r.kick = make(chan struct{})
+}
+
+// save сохраняет состояние узла. Вызывается под mutex
+func (r *Raft) save() error {
+	state := raftState{
+		Term:     r.term,
+		VotedFor: r.votedFor,
+		Terms:    r.terms,
+		Commit:   r.commit,
+	}
+	if err := saveRaftState(r.wal.GetDirectory(), state); err != nil {
+		return err
+	}
+	r.savedCommit = r.commit
+	return nil
+}
+
+// call отправляет запрос узлу по отдельному соединению. Используется для голосования
+func (r *Raft) call(address string, request *raftRequest) (*RaftResponse, error) {
+	client, err := r.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return roundTrip(client, request)
+}
+
+// send отправляет запрос по постоянному соединению с узлом и переподключается после ошибок
+func (p *raftPeer) send(r *Raft, request *raftRequest) (*RaftResponse, error) {
+	p.clientMutex.Lock()
+	client := p.client
+	p.clientMutex.Unlock()
+
+	if client == nil {
+		var err error
+		if client, err = r.dial(p.address); err != nil {
+			return nil, err
+		}
+		p.clientMutex.Lock()
+		if r.ctx.Err() != nil {
+			p.clientMutex.Unlock()
+			client.Close()
+			return nil, r.ctx.Err()
+		}
+		p.client = client
+		p.clientMutex.Unlock()
+	}
+
+	response, err := roundTrip(client, request)
+	if err != nil {
+		p.disconnect()
+	}
+	return response, err
+}
+
+// disconnect закрывает соединение с узлом
+func (p *raftPeer) disconnect() {
+	p.clientMutex.Lock()
+	defer p.clientMutex.Unlock()
+
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+}
+
+// roundTrip кодирует запрос, отправляет его и декодирует ответ
+func roundTrip(client *network.TCPClient, request *raftRequest) (*RaftResponse, error) {
+	requestData, err := Encode(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode raft request: %w", err)
+	}
+	responseData, err := client.Send(requestData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send raft request: %w", err)
+	}
+
+	var response RaftResponse
+	if err := Decode(&response, responseData); err != nil {
+		return nil, fmt.Errorf("failed to decode raft response: %w", err)
+	}
+	return &response, nil
+}
@@ -0,0 +1,145 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Лог Raft хранится в WAL узла: индекс записи - ее LSN. Терм записи в WAL не хранится,
+// вместо этого в файле состояния узла записаны границы термов: записи от LSN границы
+// до следующей границы добавлены лидером ее терма
+
+// raftStateFile - имя файла состояния узла Raft в директории WAL
+const raftStateFile = "raft.state"
+
+// TermStart - граница терма в логе: первая запись терма Term имеет LSN LSN
+type TermStart struct {
+	Term uint64 `json:"term"`
+	LSN  uint64 `json:"lsn"`
+}
+
+// raftState - состояние узла, которое должно пережить перезапуск
+type raftState struct {
+	Term     uint64      `json:"term"`      // Текущий терм
+	VotedFor string      `json:"voted_for"` // За кого узел голосовал в текущем терме
+	Terms    []TermStart `json:"terms"`     // Границы термов в логе по возрастанию LSN
+	// Commit - нижняя граница зафиксированных записей: записи до этого LSN зафиксированы.
+	// Сохраняется не при каждом изменении, а периодически
+	Commit uint64 `json:"commit"`
+}
+
+// termOf возвращает терм записи lsn или 0, если запись раньше первой границы
+func termOf(terms []TermStart, lsn uint64) uint64 {
+	term := uint64(0)
+	for _, start := range terms {
+		if start.LSN > lsn {
+			break
+		}
+		term = start.Term
+	}
+	return term
+}
+
+// termBegin возвращает LSN первой записи терма, которому принадлежит запись lsn
+func termBegin(terms []TermStart, lsn uint64) uint64 {
+	begin := uint64(0)
+	for _, start := range terms {
+		if start.LSN > lsn {
+			break
+		}
+		begin = start.LSN
+	}
+	return begin
+}
+
+// setTerm отмечает, что записи начиная с lsn принадлежат терму term. Границы после lsn
+// отбрасываются вместе с записями, к которым они относились
+func setTerm(terms []TermStart, lsn, term uint64) []TermStart {
+	i := len(terms)
+	for i > 0 && terms[i-1].LSN >= lsn {
+		i--
+	}
+	terms = terms[:i]
+	if termOf(terms, lsn) != term {
+		terms = append(terms, TermStart{Term: term, LSN: lsn})
+	}
+	return terms
+}
+
+// termsFrom возвращает копию границ, по которым определяются термы записей начиная с lsn
+func termsFrom(terms []TermStart, lsn uint64) []TermStart {
+	i := 0
+	for i+1 < len(terms) && terms[i+1].LSN <= lsn {
+		i++
+	}
+	return append([]TermStart(nil), terms[i:]...)
+}
+
+// loadRaftState читает состояние узла из директории WAL. Если файла нет, узел
+// запускается впервые и начинает с нулевого терма
+func loadRaftState(directory string) (raftState, error) {
+	var state raftState
+	data, err := os.ReadFile(filepath.Join(directory, raftStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read raft state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to decode raft state: %w", err)
+	}
+	return state, nil
+}
+
+// LoadRaftCommit возвращает сохраненный индекс фиксации узла Raft, WAL которого лежит
+// в directory: записи до него зафиксированы. Хранилище применяет при запуске только их,
+// остальные записи группа может отбросить
+func LoadRaftCommit(directory string) (uint64, error) {
+	state, err := loadRaftState(directory)
+	if err != nil {
+		return 0, err
+	}
+	return state.Commit, nil
+}
+
+// saveRaftState атомарно заменяет файл состояния узла: новое состояние записывается
+// во временный файл, синхронизируется с диском и переименовывается
+func saveRaftState(directory string, state raftState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode raft state: %w", err)
+	}
+
+	path := filepath.Join(directory, raftStateFile)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create raft state: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write raft state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace raft state: %w", err)
+	}
+
+	// Переименование попадает на диск вместе с директорией
+	if dir, err := os.Open(directory); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
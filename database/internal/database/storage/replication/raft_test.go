@@ -0,0 +1,468 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+	"github.com/keij-sama/Concurrency/database/internal/network"
+	"github.com/keij-sama/Concurrency/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Таймаут выборов в тестах: heartbeat отправляется каждые 30ms
+const testElectionTimeout = 150 * time.Millisecond
+
+// linkProxy пропускает соединения одного узла к другому через loopback. Разрыв связи
+// закрывает открытые соединения и отклоняет новые, пока связь не восстановлена
+type linkProxy struct {
+	listener net.Listener
+	target   string
+
+	mutex sync.Mutex
+	cut   bool
+	conns []net.Conn
+}
+
+func newLinkProxy(t *testing.T, target string) *linkProxy {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := &linkProxy{listener: listener, target: target}
+	go p.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		p.setCut(true)
+	})
+	return p
+}
+
+func (p *linkProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.mutex.Lock()
+		if p.cut {
+			p.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			p.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		p.conns = append(p.conns, conn, upstream)
+		p.mutex.Unlock()
+
+		go pipe(conn, upstream)
+		go pipe(upstream, conn)
+	}
+}
+
+func pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+}
+
+func (p *linkProxy) setCut(cut bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.cut = cut
+	if cut {
+		for _, conn := range p.conns {
+			conn.Close()
+		}
+		p.conns = nil
+	}
+}
+
+// testMachine - машина состояний узла в тестах: ключи и значения операций SET и DEL
+type testMachine struct {
+	writes sync.RWMutex // Запись удерживает на чтение, SetLeader ждет ее на запись
+
+	mutex  sync.Mutex
+	leader bool
+	data   map[string]string
+}
+
+func (m *testMachine) Apply(logs []wal.Log) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, log := range logs {
+		switch log.Operation {
+		case wal.OperationSet:
+			m.data[log.Args[0]] = log.Args[1]
+		case wal.OperationDel:
+			delete(m.data, log.Args[0])
+		}
+	}
+	return nil
+}
+
+func (m *testMachine) SetLeader(leader bool) {
+	m.writes.Lock()
+	defer m.writes.Unlock()
+
+	m.mutex.Lock()
+	m.leader = leader
+	m.mutex.Unlock()
+}
+
+func (m *testMachine) get(key string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	value, ok := m.data[key]
+	return value, ok
+}
+
+func (m *testMachine) isLeader() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.leader
+}
+
+// raftNode - узел тестовой группы
+type raftNode struct {
+	wal     *wal.WAL
+	raft    *Raft
+	machine *testMachine
+}
+
+// set записывает значение, как это делает хранилище: ждет фиксации записи на лидере
+// и только после нее применяет запись
+func (n *raftNode) set(ctx context.Context, key, value string) error {
+	n.machine.writes.RLock()
+	defer n.machine.writes.RUnlock()
+
+	if !n.machine.isLeader() {
+		return ErrNotLeader
+	}
+	result := <-n.wal.Set(key, value)
+	if result.Err != nil {
+		return result.Err
+	}
+	if err := n.raft.WaitCommitted(ctx, result.LSN+1); err != nil {
+		return err
+	}
+	return n.machine.Apply([]wal.Log{{Operation: wal.OperationSet, Args: []string{key, value}}})
+}
+
+// raftCluster - группа узлов Raft в одном процессе. Узлы связаны попарно через linkProxy,
+// поэтому сеть между ними можно разделять
+type raftCluster struct {
+	t     *testing.T
+	nodes []*raftNode
+	links map[[2]int]*linkProxy // Соединения от узла [0] к узлу [1]
+}
+
+func newRaftCluster(t *testing.T, size int) *raftCluster {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	l := logger.NewLoggerWithZap(zap.NewNop())
+
+	servers := make([]*network.TCPServer, size)
+	for i := range servers {
+		server, err := network.NewTCPServer("127.0.0.1:0", zap.NewNop(), network.WithIdleTimeout(5*time.Second))
+		if err != nil {
+			t.Fatalf("Failed to create TCP server: %v", err)
+		}
+		servers[i] = server
+	}
+
+	c := &raftCluster{t: t, links: make(map[[2]int]*linkProxy)}
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			if i != j {
+				c.links[[2]int{i, j}] = newLinkProxy(t, servers[j].Addr())
+			}
+		}
+	}
+
+	dial := func(address string) (*network.TCPClient, error) {
+		return network.NewTCPClient(address, network.WithClientIdleTimeout(testElectionTimeout))
+	}
+	for i, server := range servers {
+		var peers []string
+		for j := 0; j < size; j++ {
+			if i != j {
+				peers = append(peers, c.links[[2]int{i, j}].listener.Addr().String())
+			}
+		}
+
+		node := &raftNode{
+			wal:     newTestWAL(t, ctx, l),
+			machine: &testMachine{data: make(map[string]string)},
+		}
+		raft, err := NewRaft(server, node.wal, RaftConfig{
+			ID:              server.Addr(),
+			Peers:           peers,
+			ElectionTimeout: testElectionTimeout,
+			Dial:            dial,
+		}, node.machine, l)
+		if err != nil {
+			t.Fatalf("NewRaft() error: %v", err)
+		}
+		if err := raft.Start(ctx); err != nil {
+			t.Fatalf("Start() error: %v", err)
+		}
+		t.Cleanup(func() { raft.Close() })
+		node.raft = raft
+		c.nodes = append(c.nodes, node)
+	}
+	return c
+}
+
+// partition разделяет сеть: узлы разных групп не видят друг друга. Узлы, не попавшие
+// ни в одну группу, образуют отдельную группу
+func (c *raftCluster) partition(groups ...[]int) {
+	group := make(map[int]int)
+	for g, nodes := range groups {
+		for _, node := range nodes {
+			group[node] = g + 1
+		}
+	}
+	for link, proxy := range c.links {
+		proxy.setCut(group[link[0]] != group[link[1]])
+	}
+}
+
+// heal восстанавливает связь между всеми узлами
+func (c *raftCluster) heal() {
+	c.partition()
+}
+
+// leader ждет, пока среди узлов nodes будет ровно один лидер, принимающий запись
+func (c *raftCluster) leader(nodes ...int) int {
+	c.t.Helper()
+
+	if len(nodes) == 0 {
+		for i := range c.nodes {
+			nodes = append(nodes, i)
+		}
+	}
+
+	var leader int
+	waitFor(c.t, 5*time.Second, "single raft leader", func() bool {
+		leaders := 0
+		for _, i := range nodes {
+			if c.nodes[i].raft.IsMaster() && c.nodes[i].machine.isLeader() {
+				leader = i
+				leaders++
+			}
+		}
+		return leaders == 1
+	})
+	return leader
+}
+
+// waitValues ждет, пока на всех узлах nodes значение key станет равным want
+func (c *raftCluster) waitValues(key, want string, nodes ...int) {
+	c.t.Helper()
+
+	waitFor(c.t, 5*time.Second, fmt.Sprintf("%s=%q on nodes %v", key, want, nodes), func() bool {
+		for _, i := range nodes {
+			if value, ok := c.nodes[i].machine.get(key); !ok || value != want {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftElectionAndReplication(t *testing.T) {
+	c := newRaftCluster(t, 3)
+	leader := c.leader()
+
+	// Все узлы знают лидера и находятся в его терме
+	status := c.nodes[leader].raft.Status()
+	waitFor(t, 5*time.Second, "followers to learn the leader", func() bool {
+		for _, node := range c.nodes {
+			if s := node.raft.Status(); s.Leader != status.ID || s.Term != status.Term {
+				return false
+			}
+		}
+		return true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		if err := c.nodes[leader].set(ctx, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("set() on leader error: %v", err)
+		}
+	}
+	c.waitValues("key4", "value4", 0, 1, 2)
+
+	// Последователи не принимают запись
+	follower := (leader + 1) % 3
+	if err := c.nodes[follower].set(ctx, "key", "value"); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("set() on follower error = %v, want ErrNotLeader", err)
+	}
+
+	// Логи узлов совпадают: пустая запись лидера и пять записей SET
+	want, err := c.nodes[leader].wal.ReadFrom(0, 100)
+	if err != nil || len(want) != 6 || want[0].Operation != wal.OperationNoop {
+		t.Fatalf("Leader log = %+v, %v, want NOOP and 5 SET records", want, err)
+	}
+	for i, node := range c.nodes {
+		logs, err := node.wal.ReadFrom(0, 100)
+		if err != nil || len(logs) != len(want) {
+			t.Fatalf("Node %d log = %+v, %v, want %d records", i, logs, err, len(want))
+		}
+		for j := range logs {
+			if logs[j].LSN != want[j].LSN || logs[j].Timestamp != want[j].Timestamp {
+				t.Errorf("Node %d record %d = %+v, want %+v", i, j, logs[j], want[j])
+			}
+		}
+	}
+}
+
+func TestRaftPartition(t *testing.T) {
+	c := newRaftCluster(t, 5)
+	old := c.leader()
+	oldTerm := c.nodes[old].raft.Status().Term
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.nodes[old].set(ctx, "key", "before"); err != nil {
+		t.Fatalf("set() before partition error: %v", err)
+	}
+	c.waitValues("key", "before", 0, 1, 2, 3, 4)
+
+	// Лидер и еще один узел оказываются в меньшинстве
+	var minority, majority []int
+	minority = append(minority, old)
+	for i := range c.nodes {
+		if i == old {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, i)
+		} else {
+			majority = append(majority, i)
+		}
+	}
+	c.partition(minority, majority)
+
+	// Запись в меньшинстве не фиксируется: лидер слагает полномочия, не услышав большинство
+	if err := c.nodes[old].set(ctx, "key", "lost"); !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("set() on partitioned leader error = %v, want ErrLeadershipLost", err)
+	}
+	waitFor(t, 5*time.Second, "partitioned leader to step down", func() bool {
+		return !c.nodes[old].raft.IsMaster() && !c.nodes[old].machine.isLeader()
+	})
+
+	// Большинство выбирает нового лидера в следующем терме и продолжает запись
+	leader := c.leader(majority...)
+	if term := c.nodes[leader].raft.Status().Term; term <= oldTerm {
+		t.Errorf("New leader term = %d, want greater than %d", term, oldTerm)
+	}
+	if err := c.nodes[leader].set(ctx, "key", "after"); err != nil {
+		t.Fatalf("set() on new leader error: %v", err)
+	}
+	c.waitValues("key", "after", majority...)
+	if value, _ := c.nodes[old].machine.get("key"); value != "before" {
+		t.Errorf("Partitioned leader value = %q, want its uncommitted write not applied", value)
+	}
+
+	// После восстановления связи бывший лидер отбрасывает незафиксированную запись
+	// и получает записи нового лидера
+	c.heal()
+	c.waitValues("key", "after", 0, 1, 2, 3, 4)
+	c.leader()
+
+	// Логи всех узлов совпадают
+	want, err := c.nodes[c.leader()].wal.ReadFrom(0, 100)
+	if err != nil {
+		t.Fatalf("ReadFrom() error: %v", err)
+	}
+	waitFor(t, 5*time.Second, "logs to converge", func() bool {
+		for _, node := range c.nodes {
+			logs, err := node.wal.ReadFrom(0, 100)
+			if err != nil || len(logs) < len(want) {
+				return false
+			}
+			for j := range want {
+				if logs[j].Timestamp != want[j].Timestamp {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+func TestTermBoundaries(t *testing.T) {
+	var terms []TermStart
+	terms = setTerm(terms, 0, 1)
+	terms = setTerm(terms, 3, 1) // тот же терм не добавляет границу
+	terms = setTerm(terms, 5, 2)
+	terms = setTerm(terms, 8, 4)
+
+	for _, tc := range []struct {
+		lsn, term, begin uint64
+	}{
+		{0, 1, 0}, {4, 1, 0}, {5, 2, 5}, {7, 2, 5}, {8, 4, 8}, {100, 4, 8},
+	} {
+		if term := termOf(terms, tc.lsn); term != tc.term {
+			t.Errorf("termOf(%d) = %d, want %d", tc.lsn, term, tc.term)
+		}
+		if begin := termBegin(terms, tc.lsn); begin != tc.begin {
+			t.Errorf("termBegin(%d) = %d, want %d", tc.lsn, begin, tc.begin)
+		}
+	}
+
+	if from := termsFrom(terms, 6); len(from) != 2 || from[0].Term != 2 {
+		t.Errorf("termsFrom(6) = %+v, want boundaries of terms 2 and 4", from)
+	}
+
+	// Запись другого терма на месте существующих отбрасывает границы после нее
+	terms = setTerm(terms, 6, 3)
+	if len(terms) != 3 || termOf(terms, 9) != 3 || termOf(terms, 5) != 2 {
+		t.Errorf("setTerm(6, 3) = %+v, want terms 1, 2, 3", terms)
+	}
+
+	// Состояние узла переживает перезапуск
+	dir := t.TempDir()
+	state := raftState{Term: 3, VotedFor: "node", Terms: terms, Commit: 6}
+	if err := saveRaftState(dir, state); err != nil {
+		t.Fatalf("saveRaftState() error: %v", err)
+	}
+	loaded, err := loadRaftState(dir)
+	if err != nil || loaded.Term != 3 || loaded.VotedFor != "node" || len(loaded.Terms) != 3 || loaded.Commit != 6 {
+		t.Errorf("loadRaftState() = %+v, %v, want saved state", loaded, err)
+	}
+}
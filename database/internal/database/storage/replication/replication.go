@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
 )
 
 // ReplicationType определяет тип репликации
@@ -14,14 +16,41 @@ const (
 	TypeMaster ReplicationType = "master"
 	// TypeSlave - ведомый узел
 	TypeSlave ReplicationType = "slave"
+	// TypeRaft - узел группы, которая сама выбирает лидера по протоколу Raft
+	TypeRaft ReplicationType = "raft"
 )
 
 // ReplicationConfig содержит настройки репликации
 type ReplicationConfig struct {
 	Enabled       bool            `yaml:"enabled"`        // Включена ли репликация
-	ReplicaType   ReplicationType `yaml:"replica_type"`   // Тип реплики (master/slave)
+	ReplicaType   ReplicationType `yaml:"replica_type"`   // Тип реплики (master/slave/raft)
 	MasterAddress string          `yaml:"master_address"` // Адрес мастера для подключения
 	SyncInterval  time.Duration   `yaml:"sync_interval"`  // Интервал синхронизации
+	// ListenAddress - адрес сервера репликации мастера. Если не задан, мастер слушает
+	// MasterAddress; слейву он нужен, чтобы стать мастером по команде REPLICAOF NO ONE
+	ListenAddress string `yaml:"listen_address"`
+	// SyncReplicas - сколько слейвов должны подтвердить запись, прежде чем мастер ответит
+	// клиенту; 0 - асинхронная репликация
+	SyncReplicas int `yaml:"sync_replicas"`
+	// SyncTimeout - сколько запись ждет подтверждений, после чего мастер переходит
+	// на асинхронную репликацию, пока слейвы не догонят его
+	SyncTimeout time.Duration `yaml:"sync_timeout"`
+	// Peers - адреса серверов репликации остальных узлов группы raft. Узел raft
+	// слушает ListenAddress, этот же адрес служит его идентификатором в группе
+	Peers []string `yaml:"peers"`
+	// ElectionTimeout - сколько узел raft ждет сообщений лидера, прежде чем начать выборы
+	ElectionTimeout time.Duration `yaml:"election_timeout"`
+}
+
+// ListenAddressOrDefault возвращает адрес, на котором мастер принимает слейвов
+func (c ReplicationConfig) ListenAddressOrDefault() string {
+	if c.ListenAddress != "" {
+		return c.ListenAddress
+	}
+	if c.ReplicaType == TypeMaster {
+		return c.MasterAddress
+	}
+	return ""
 }
 
 // Replication определяет интерфейс для репликации
@@ -31,17 +60,31 @@ type Replication interface {
 	Close() error
 }
 
-// Request представляет запрос от slave к master
+// Request представляет сообщение от slave к master. Первое сообщение соединения открывает
+// поток записей, следующие подтверждают записи, примененные слейвом
 type Request struct {
-	LastSegmentName string `json:"last_segment_name"` // Имя последнего полученного сегмента
+	NextLSN uint64 `json:"next_lsn"` // LSN первой записи, которой еще нет у слейва; подтверждает все предыдущие
 }
 
-// Response представляет ответ от master к slave
+// Response представляет сообщение от master к slave. Сообщение без записей мастер отправляет,
+// когда новых записей нет, чтобы соединение не закрылось по таймауту
 type Response struct {
-	Succeed     bool   `json:"succeed"`      // Успешность операции
-	Error       string `json:"error"`        // Сообщение об ошибке (если есть)
-	SegmentName string `json:"segment_name"` // Имя сегмента
-	SegmentData []byte `json:"segment_data"` // Данные сегмента
+	Succeed bool      `json:"succeed"` // Успешность операции
+	Error   string    `json:"error"`   // Сообщение об ошибке (если есть)
+	Logs    []wal.Log `json:"logs"`    // Следующие записи WAL
+	More    bool      `json:"more"`    // У мастера есть еще записи, не поместившиеся в сообщение
+	// Snapshot - часть снимка мастера. Мастер отправляет снимок вместо записей, если нужные
+	// слейву записи уже удалены сжатием WAL
+	Snapshot *SnapshotChunk `json:"snapshot,omitempty"`
+}
+
+// SnapshotChunk - часть файла снимка мастера. Получив снимок целиком, слейв заменяет им свои
+// данные и продолжает с записи после LSN снимка
+type SnapshotChunk struct {
+	LSN    uint64 `json:"lsn"`    // LSN последней записи WAL, включенной в снимок
+	Offset int64  `json:"offset"` // Смещение части в файле снимка
+	Data   []byte `json:"data"`   // Данные части
+	Last   bool   `json:"last"`   // Последняя часть снимка
 }
 
 // Encode кодирует объект в JSON
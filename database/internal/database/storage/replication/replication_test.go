@@ -1,205 +1,399 @@
 package replication
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 	"os"
-	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/snapshot"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
 	"github.com/keij-sama/Concurrency/database/internal/network"
 	"github.com/keij-sama/Concurrency/pkg/logger"
 	"go.uber.org/zap"
 )
 
-func TestMasterSlave(t *testing.T) {
-	// Создаем временные директории для WAL
-	masterDir, err := os.MkdirTemp("", "master_wal")
+// newTestWAL создает и запускает WAL во временной директории
+func newTestWAL(t *testing.T, ctx context.Context, l logger.Logger) *wal.WAL {
+	t.Helper()
+
+	w, err := wal.NewWAL(wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 5 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        t.TempDir(),
+	}, l)
 	if err != nil {
-		t.Fatalf("Failed to create master WAL directory: %v", err)
+		t.Fatalf("NewWAL() error: %v", err)
 	}
-	defer os.RemoveAll(masterDir)
+	w.Start(ctx)
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func TestMasterSlave(t *testing.T) {
+	zapLogger := zap.NewNop()
+	l := logger.NewLoggerWithZap(zapLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	slaveDir, err := os.MkdirTemp("", "slave_wal")
+	masterWAL := newTestWAL(t, ctx, l)
+	slaveWAL := newTestWAL(t, ctx, l)
+
+	for _, done := range []chan wal.Result{
+		masterWAL.Set("key1", "value1"),
+		masterWAL.Set("key2", "value2"),
+		masterWAL.Del("key1"),
+	} {
+		if err := (<-done).Err; err != nil {
+			t.Fatalf("Failed to write to master WAL: %v", err)
+		}
+	}
+
+	// Создаем TCP сервер на свободном порту
+	server, err := network.NewTCPServer(
+		"127.0.0.1:0",
+		zapLogger,
+		network.WithMaxConnections(10),
+		network.WithIdleTimeout(5*time.Second),
+		network.WithBufferSize(4096),
+	)
 	if err != nil {
-		t.Fatalf("Failed to create slave WAL directory: %v", err)
+		t.Fatalf("Failed to create TCP server: %v", err)
 	}
-	defer os.RemoveAll(slaveDir)
 
-	// Используем порт 0 для автоматического выбора системой
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	master, err := NewMaster(server, masterWAL, 5*time.Second, l)
 	if err != nil {
-		t.Fatalf("Failed to create listener: %v", err)
+		t.Fatalf("Failed to create master: %v", err)
+	}
+	if err := master.Start(ctx); err != nil {
+		t.Fatalf("Failed to start master: %v", err)
 	}
+	defer master.Close()
 
-	masterAddr := listener.Addr().String()
-	listener.Close() // Закрываем слушатель, чтобы сервер мог использовать этот порт
+	dial := func() (*network.TCPClient, error) {
+		return network.NewTCPClient(server.Addr(), network.WithClientIdleTimeout(5*time.Second))
+	}
 
-	// Создаем тестовый WAL сегмент
-	testWALContent := []wal.Log{
-		{LSN: 1, Operation: "SET", Args: []string{"key1", "value1"}},
-		{LSN: 2, Operation: "SET", Args: []string{"key2", "value2"}},
-		{LSN: 3, Operation: "DEL", Args: []string{"key1"}},
+	// Слейв записывает полученные записи в свой WAL с LSN мастера
+	var (
+		applied   []wal.Log
+		appliedMu sync.Mutex
+	)
+	apply := func(logs []wal.Log) error {
+		written, err := slaveWAL.Append(ctx, logs)
+		appliedMu.Lock()
+		applied = append(applied, logs[:written]...)
+		appliedMu.Unlock()
+		return err
 	}
 
-	testWALData, err := json.Marshal(testWALContent)
+	// Интервал синхронизации большой: новые записи должны приходить без его ожидания
+	slave, err := NewSlave(dial, 2*time.Second, l, slaveWAL.NextLSN, apply)
 	if err != nil {
-		t.Fatalf("Failed to marshal test WAL content: %v", err)
+		t.Fatalf("Failed to create slave: %v", err)
+	}
+	if err := slave.Start(ctx); err != nil {
+		t.Fatalf("Failed to start slave: %v", err)
 	}
+	defer slave.Close()
+
+	waitApplied := func(count int) []wal.Log {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			appliedMu.Lock()
+			logs := append([]wal.Log(nil), applied...)
+			appliedMu.Unlock()
+			if len(logs) >= count {
+				return logs
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Slave applied %d records, want %d", len(logs), count)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitApplied(3)
 
-	walFilePath := filepath.Join(masterDir, "wal_0.log")
-	if err := os.WriteFile(walFilePath, testWALData, 0644); err != nil {
-		t.Fatalf("Failed to write test WAL file: %v", err)
+	// Записи, дописанные после первой синхронизации, приходят через открытый поток
+	start := time.Now()
+	if err := (<-masterWAL.Set("key3", "value3")).Err; err != nil {
+		t.Fatalf("Failed to write to master WAL: %v", err)
+	}
+	waitApplied(4)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Record reached slave after %v, want well under sync interval", elapsed)
+	}
+	if err := (<-masterWAL.Set("key1", "again")).Err; err != nil {
+		t.Fatalf("Failed to write to master WAL: %v", err)
+	}
+	logs := waitApplied(5)
+	if lag := slave.Lag(); lag <= 0 || lag > 500*time.Millisecond {
+		t.Errorf("Slave Lag() = %v, want small positive lag", lag)
 	}
 
-	// Создаем логгер
-	zapLogger, _ := zap.NewDevelopment()
-	l := logger.NewLoggerWithZap(zapLogger)
+	// Мастер знает, до какого LSN слейв подтвердил записи
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		replicas := master.Replicas()
+		if len(replicas) == 1 && replicas[0].NextLSN == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Master Replicas() = %+v, want one replica acknowledging LSN 5", replicas)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 
-	// Используем канал для синхронизации между мастером и слейвом
-	syncCompleted := make(chan struct{})
-	var appliedLogs []wal.Log
-	var appliedLogsMu sync.Mutex
-
-	// Функция для проверки применения логов
-	walRecovery := func(logs []wal.Log) error {
-		appliedLogsMu.Lock()
-		appliedLogs = append(appliedLogs, logs...)
-		appliedLogsMu.Unlock()
-
-		// Если получили достаточно логов, сигнализируем о завершении
-		if len(appliedLogs) >= 3 {
-			select {
-			case syncCompleted <- struct{}{}:
-				// Сигнал отправлен
-			default:
-				// Канал уже закрыт или сигнал уже отправлен
-			}
+	for i, log := range logs {
+		if log.LSN != uint64(i) {
+			t.Errorf("Applied record %d has LSN %d, want %d", i, log.LSN, i)
 		}
-		return nil
+	}
+	if len(logs) != 5 || logs[4].Args[1] != "again" {
+		t.Errorf("Unexpected applied records: %+v", logs)
 	}
 
-	// Создаем контекст с отменой
+	// Локальный WAL слейва продолжает последовательность LSN мастера
+	if next := slaveWAL.NextLSN(); next != 5 {
+		t.Errorf("Slave NextLSN() = %d, want 5", next)
+	}
+	local, err := slaveWAL.ReadFrom(0, 100)
+	if err != nil || len(local) != 5 || local[3].Timestamp != logs[3].Timestamp {
+		t.Errorf("Slave WAL records = %+v, %v, want master records", local, err)
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	zapLogger := zap.NewNop()
+	l := logger.NewLoggerWithZap(zapLogger)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Создаем TCP сервер
-	server, err := network.NewTCPServer(
-		masterAddr,
-		zapLogger,
-		network.WithMaxConnections(10),
-		network.WithIdleTimeout(5*time.Second),
-		network.WithBufferSize(4096),
-	)
+	masterWAL := newTestWAL(t, ctx, l)
+
+	// Таймауты соединений короткие: без записей поток держится сообщениями мастера и подтверждениями
+	const syncInterval = 100 * time.Millisecond
+	server, err := network.NewTCPServer("127.0.0.1:0", zapLogger, network.WithIdleTimeout(syncInterval))
 	if err != nil {
 		t.Fatalf("Failed to create TCP server: %v", err)
 	}
-
-	// Создаем мастер
-	master, err := NewMaster(server, masterDir, l)
+	master, err := NewMaster(server, masterWAL, syncInterval, l)
 	if err != nil {
 		t.Fatalf("Failed to create master: %v", err)
 	}
-
-	// Запускаем мастер
 	if err := master.Start(ctx); err != nil {
 		t.Fatalf("Failed to start master: %v", err)
 	}
-
-	// Небольшая задержка, чтобы мастер успел запуститься
-	time.Sleep(100 * time.Millisecond)
-
-	// Создаем TCP клиент
-	client, err := network.NewTCPClient(
-		masterAddr,
-		network.WithClientIdleTimeout(5*time.Second),
-	)
-	if err != nil {
-		t.Fatalf("Failed to create TCP client: %v", err)
+	defer master.Close()
+
+	// Слейв сообщает о каждой примененной записи
+	var next atomic.Uint64
+	applied := make(chan uint64, 100)
+	apply := func(logs []wal.Log) error {
+		for _, log := range logs {
+			next.Store(log.LSN + 1)
+			applied <- log.LSN
+		}
+		return nil
+	}
+	dial := func() (*network.TCPClient, error) {
+		return network.NewTCPClient(server.Addr(), network.WithClientIdleTimeout(syncInterval))
 	}
 
-	// Создаем слейв
-	slave, err := NewSlave(client, slaveDir, 100*time.Millisecond, l, walRecovery)
+	slave, err := NewSlave(dial, syncInterval, l, next.Load, apply)
 	if err != nil {
 		t.Fatalf("Failed to create slave: %v", err)
 	}
-
-	// Запускаем слейв
 	if err := slave.Start(ctx); err != nil {
 		t.Fatalf("Failed to start slave: %v", err)
 	}
+	defer slave.Close()
 
-	// Ждем завершения синхронизации с таймаутом
-	syncTimeout := time.After(5 * time.Second)
-	select {
-	case <-syncCompleted:
-		t.Log("Synchronization completed successfully")
-	case <-syncTimeout:
-		t.Log("Synchronization timeout, checking partial results")
+	// Ждем, пока слейв подключится
+	deadline := time.Now().Add(5 * time.Second)
+	for len(master.Replicas()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Slave did not connect to master")
+		}
+		time.Sleep(time.Millisecond)
 	}
 
-	// Проверяем созданные файлы на стороне слейва
-	slaveFiles, err := os.ReadDir(slaveDir)
-	if err != nil {
-		t.Fatalf("Failed to read slave directory: %v", err)
+	// Простой дольше таймаута не обрывает соединение
+	connected := master.Replicas()[0].ID
+	time.Sleep(3 * syncInterval)
+	if replicas := master.Replicas(); len(replicas) != 1 || replicas[0].ID != connected {
+		t.Fatalf("Master Replicas() = %+v after idle period, want replica %d still connected", replicas, connected)
 	}
 
-	// Выводим информацию о файлах для отладки
-	t.Logf("Found %d files in slave directory:", len(slaveFiles))
-	for _, file := range slaveFiles {
-		t.Logf("- %s (%d bytes)", file.Name(), getFileSize(filepath.Join(slaveDir, file.Name())))
+	const writes = 50
+	lags := make([]time.Duration, 0, writes)
+	for i := 0; i < writes; i++ {
+		start := time.Now()
+		done := masterWAL.Set(fmt.Sprintf("key%d", i), "value")
+
+		select {
+		case lsn := <-applied:
+			if lsn != uint64(i) {
+				t.Fatalf("Slave applied LSN %d, want %d", lsn, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Record %d did not reach slave", i)
+		}
+		lags = append(lags, time.Since(start))
+
+		if err := (<-done).Err; err != nil {
+			t.Fatalf("Failed to write to master WAL: %v", err)
+		}
 	}
 
-	// Проверяем примененные логи
-	appliedLogsMu.Lock()
-	appliedLogsCount := len(appliedLogs)
-	appliedLogsMu.Unlock()
+	// Медиана устойчива к редким паузам планировщика на нагруженной машине
+	sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+	if median := lags[writes/2]; median >= 10*time.Millisecond {
+		t.Errorf("Median replication lag = %v, want under 10ms (max %v)", median, lags[writes-1])
+	}
+
+	// Подтверждения приходят по тому же соединению
+	deadline = time.Now().Add(5 * time.Second)
+	for master.Acknowledged(writes) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Master Replicas() = %+v, want one replica acknowledging LSN %d", master.Replicas(), writes)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSlaveSeededFromSnapshot(t *testing.T) {
+	zapLogger := zap.NewNop()
+	l := logger.NewLoggerWithZap(zapLogger)
 
-	t.Logf("Applied %d logs", appliedLogsCount)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// Даже если не все логи были применены, мы хотя бы проверим те, которые были
-	if appliedLogsCount > 0 {
-		// Создаем карту для проверки
-		foundOps := make(map[uint64]bool)
-		appliedLogsMu.Lock()
-		for _, log := range appliedLogs {
-			t.Logf("Applied log: LSN=%d, Operation=%s", log.LSN, log.Operation)
-			foundOps[log.LSN] = true
+	masterDir := t.TempDir()
+	masterWAL, err := wal.NewWAL(wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 5 * time.Millisecond,
+		MaxSegmentSize:       64, // по сегменту на одну-две записи
+		DataDirectory:        masterDir,
+	}, l)
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	masterWAL.Start(ctx)
+	defer masterWAL.Close()
+
+	for i := 0; i < 6; i++ {
+		if err := (<-masterWAL.Set(fmt.Sprintf("key%d", i), "value")).Err; err != nil {
+			t.Fatalf("Failed to write to master WAL: %v", err)
 		}
-		appliedLogsMu.Unlock()
-
-		// Проверяем, что хотя бы некоторые ожидаемые логи были применены
-		for _, log := range testWALContent {
-			if foundOps[log.LSN] {
-				t.Logf("Verified log LSN %d was applied", log.LSN)
-			} else {
-				t.Logf("Log LSN %d was not applied", log.LSN)
+	}
+
+	// Снимок больше одной части передачи, записи до него удалены сжатием
+	value := strings.Repeat("v", 1<<20)
+	path, err := snapshot.Write(masterDir, 3, func(add func(snapshot.Entry) error) (uint64, error) {
+		for i := 0; i < 3; i++ {
+			if err := add(snapshot.Entry{Key: fmt.Sprintf("big%d", i), Value: value}); err != nil {
+				return 0, err
 			}
 		}
-	} else {
-		t.Log("No logs were applied")
+		return 3, nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	if _, err := masterWAL.Compact(3, ""); err != nil {
+		t.Fatalf("Compact() error: %v", err)
+	}
+	if _, err := masterWAL.ReadFrom(0, 1); !errors.Is(err, wal.ErrLSNUnavailable) {
+		t.Fatalf("ReadFrom(0) after Compact() error = %v, want ErrLSNUnavailable", err)
 	}
 
-	// Завершаем тест
-	cancel() // Отменяем контекст
+	server, err := network.NewTCPServer("127.0.0.1:0", zapLogger, network.WithIdleTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to create TCP server: %v", err)
+	}
+	master, err := NewMaster(server, masterWAL, 5*time.Second, l, WithSnapshotDirectory(masterDir))
+	if err != nil {
+		t.Fatalf("Failed to create master: %v", err)
+	}
+	if err := master.Start(ctx); err != nil {
+		t.Fatalf("Failed to start master: %v", err)
+	}
+	defer master.Close()
+
+	// Слейв без записей получает снимок, а затем записи после него
+	var (
+		mu      sync.Mutex
+		next    uint64
+		seeded  []byte
+		applied []wal.Log
+	)
+	nextLSN := func() uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return next
+	}
+	apply := func(logs []wal.Log) error {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, logs...)
+		next = logs[len(logs)-1].LSN + 1
+		return nil
+	}
+	seed := func(lsn uint64, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		mu.Lock()
+		defer mu.Unlock()
+		seeded, next = data, lsn+1
+		return err
+	}
+	dial := func() (*network.TCPClient, error) {
+		return network.NewTCPClient(server.Addr(), network.WithClientIdleTimeout(5*time.Second))
+	}
+	slave, err := NewSlave(dial, 5*time.Second, l, nextLSN, apply, WithSeed(seed))
+	if err != nil {
+		t.Fatalf("Failed to create slave: %v", err)
+	}
+	if err := slave.Start(ctx); err != nil {
+		t.Fatalf("Failed to start slave: %v", err)
+	}
+	defer slave.Close()
 
-	// Даем время на закрытие всех горутин
-	time.Sleep(100 * time.Millisecond)
-}
+	deadline := time.Now().Add(5 * time.Second)
+	for nextLSN() != 6 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Slave next LSN = %d, want 6", nextLSN())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 
-// getFileSize возвращает размер файла в байтах
-func getFileSize(path string) int64 {
-	info, err := os.Stat(path)
+	want, err := os.ReadFile(path)
 	if err != nil {
-		return -1
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.Equal(seeded, want) {
+		t.Errorf("Slave received %d snapshot bytes, want %d", len(seeded), len(want))
+	}
+	if len(applied) != 2 || applied[0].LSN != 4 || applied[1].LSN != 5 {
+		t.Errorf("Slave applied %+v, want records 4 and 5 after the snapshot", applied)
 	}
-	return info.Size()
 }
 
 // Тест на партицирование хеш-таблицы
@@ -4,8 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
@@ -16,57 +17,74 @@ import (
 
 // Slave представляет ведомый узел репликации
 type Slave struct {
-	client       *network.TCPClient
-	walDirectory string
+	dial         func() (*network.TCPClient, error)
 	syncInterval time.Duration
 	logger       logger.Logger
-	lastSegment  string
-	walRecovery  func([]wal.Log) error // Функция для восстановления из WAL
+	nextLSN      func() uint64         // LSN первой записи, которой еще нет у слейва
+	apply        func([]wal.Log) error // Записывает полученные записи в локальный WAL и применяет их
 	ctx          context.Context
 	cancel       context.CancelFunc
 	done         chan struct{} // Канал для сигнализации о завершении
+
+	seed func(lsn uint64, snapshot io.Reader) error // Заменяет данные слейва снимком мастера
+
+	clientMutex sync.Mutex
+	client      *network.TCPClient // Соединение с мастером, nil до подключения
+
+	lag atomic.Int64 // Задержка последних примененных записей относительно их записи на мастере
+}
+
+// Опция для конфигурации слейва
+type SlaveOption func(*Slave)
+
+// WithSeed задает функцию, которая заменяет данные слейва снимком мастера с LSN lsn, читая снимок
+// из snapshot. Мастер отправляет снимок, если нужные слейву записи уже удалены сжатием WAL; после
+// seed слейв должен ожидать запись lsn+1. Без нее такой слейв получает ошибку
+func WithSeed(seed func(lsn uint64, snapshot io.Reader) error) SlaveOption {
+	return func(s *Slave) {
+		s.seed = seed
+	}
 }
 
-// NewSlave создает новый экземпляр Slave
-func NewSlave(client *network.TCPClient, walDirectory string, syncInterval time.Duration,
-	logger logger.Logger, walRecovery func([]wal.Log) error) (*Slave, error) {
+// NewSlave создает новый экземпляр Slave. dial подключается к мастеру; соединение держится
+// открытым и переподключается после ошибок. nextLSN возвращает LSN следующей ожидаемой записи
+// по локальному WAL, apply сохраняет полученные записи в локальный WAL с их LSN и применяет
+// их: так после перезапуска слейв продолжает с того же места
+func NewSlave(dial func() (*network.TCPClient, error), syncInterval time.Duration, logger logger.Logger,
+	nextLSN func() uint64, apply func([]wal.Log) error, options ...SlaveOption) (*Slave, error) {
 
-	if client == nil {
-		return nil, errors.New("client is invalid")
+	if dial == nil {
+		return nil, errors.New("dial function is required")
+	}
+	if nextLSN == nil || apply == nil {
+		return nil, errors.New("replica callbacks are required")
 	}
 
 	// Создаем свой контекст, который будет отменен при закрытии слейва
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Slave{
-		client:       client,
-		walDirectory: walDirectory,
+	slave := &Slave{
+		dial:         dial,
 		syncInterval: syncInterval,
 		logger:       logger,
-		walRecovery:  walRecovery,
+		nextLSN:      nextLSN,
+		apply:        apply,
 		ctx:          ctx,
 		cancel:       cancel,
 		done:         make(chan struct{}),
-	}, nil
+	}
+	for _, option := range options {
+		option(slave)
+	}
+	return slave, nil
 }
 
 // Start запускает процесс синхронизации с мастером
 func (s *Slave) Start(ctx context.Context) error {
 	s.logger.Info("Starting replication slave",
-		zap.String("wal_directory", s.walDirectory),
+		zap.Uint64("next_lsn", s.nextLSN()),
 		zap.Duration("sync_interval", s.syncInterval))
 
-	// Определяем последний полученный сегмент
-	segments, err := listWALSegments(s.walDirectory)
-	if err != nil {
-		return fmt.Errorf("failed to list WAL segments: %w", err)
-	}
-
-	if len(segments) > 0 {
-		s.lastSegment = segments[len(segments)-1]
-		s.logger.Info("Found last WAL segment", zap.String("segment", s.lastSegment))
-	}
-
 	// Запускаем процесс синхронизации
 	go s.syncLoop()
 
@@ -78,12 +96,19 @@ func (s *Slave) IsMaster() bool {
 	return false
 }
 
+// Lag возвращает, на сколько последние примененные записи отстали от их записи на мастере.
+// Время считается по часам мастера и слейва, поэтому зависит от их расхождения
+func (s *Slave) Lag() time.Duration {
+	return time.Duration(s.lag.Load())
+}
+
 // Close закрывает Slave
 func (s *Slave) Close() error {
 	s.logger.Info("Closing replication slave")
 
-	// Отменяем контекст, что остановит syncLoop
+	// Отменяем контекст и закрываем соединение, что прервет ожидание сообщений мастера
 	s.cancel()
+	s.disconnect()
 
 	// Ждем завершения syncLoop
 	select {
@@ -93,123 +118,238 @@ func (s *Slave) Close() error {
 		s.logger.Info("Timeout waiting for slave sync loop to stop")
 	}
 
-	// Закрываем клиент
-	s.client.Close()
-
 	return nil
 }
 
-// syncLoop периодически синхронизируется с мастером
+// syncLoop держит поток записей от мастера. Мастер отправляет записи сразу после записи в свой WAL,
+// поэтому слейв не опрашивает его. После ошибки соединение переоткрывается через интервал
+// синхронизации
 func (s *Slave) syncLoop() {
 	defer close(s.done) // Сигнализируем о завершении при выходе
-
-	ticker := time.NewTicker(s.syncInterval)
-	defer ticker.Stop()
+	defer s.disconnect()
 
 	s.logger.Info("Starting sync loop")
 
-	// Выполняем первую синхронизацию немедленно
-	if err := s.sync(); err != nil {
-		s.logger.Error("Initial sync failed", zap.Error(err))
-	}
-
 	for {
+		err := s.replicate()
+		if s.ctx.Err() != nil {
+			s.logger.Info("Sync loop terminated due to context cancellation")
+			return
+		}
+
+		// Продолжаем работу даже при ошибках
+		s.logger.Error("Sync failed", zap.Error(err))
+		s.disconnect()
+
 		select {
 		case <-s.ctx.Done():
 			s.logger.Info("Sync loop terminated due to context cancellation")
 			return
-		case <-ticker.C:
-			if err := s.sync(); err != nil {
-				s.logger.Error("Sync failed", zap.Error(err))
-				// Продолжаем работу даже при ошибках
-			}
+		case <-time.After(s.syncInterval):
 		}
 	}
 }
 
-// sync выполняет одну синхронизацию с мастером
-func (s *Slave) sync() error {
-	// Проверка контекста на завершение
-	select {
-	case <-s.ctx.Done():
-		return s.ctx.Err()
-	default:
-		// Продолжаем выполнение
+// connect возвращает соединение с мастером, подключаясь при необходимости
+func (s *Slave) connect() (*network.TCPClient, error) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	s.logger.Info("Starting sync with master",
-		zap.String("last_segment", s.lastSegment))
+	client, err := s.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to master: %w", err)
+	}
+	s.client = client
+
+	s.logger.Info("Connected to replication master", zap.Uint64("next_lsn", s.nextLSN()))
+	return client, nil
+}
+
+// disconnect закрывает соединение с мастером
+func (s *Slave) disconnect() {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
 
-	request := Request{
-		LastSegmentName: s.lastSegment,
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
 	}
+}
 
-	requestData, err := Encode(request)
+// replicate открывает поток записей с LSN после последней полученной записи и применяет записи,
+// пока соединение не оборвется. После каждого сообщения мастера слейв подтверждает по тому же
+// соединению все записи, сохраненные в локальный WAL
+func (s *Slave) replicate() error {
+	client, err := s.connect()
 	if err != nil {
-		return fmt.Errorf("failed to encode request: %w", err)
+		return err
 	}
+	stream := client.Stream()
 
-	// Отправляем запрос мастеру
-	responseData, err := s.client.Send(requestData)
-	if err != nil {
-		return fmt.Errorf("failed to send request to master: %w", err)
+	if err := s.acknowledge(stream); err != nil {
+		return err
 	}
 
-	var response Response
-	if err := Decode(&response, responseData); err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+	for {
+		responseData, err := stream.Read()
+		if err != nil {
+			return fmt.Errorf("failed to receive records from master: %w", err)
+		}
+
+		var response Response
+		if err := Decode(&response, responseData); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		if !response.Succeed {
+			return fmt.Errorf("master reported sync failure: %s", response.Error)
+		}
+
+		if response.Snapshot != nil {
+			err = s.receiveSnapshot(stream, response.Snapshot)
+		} else {
+			err = s.applyResponse(&response)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.acknowledge(stream); err != nil {
+			return err
+		}
 	}
+}
 
-	if !response.Succeed {
-		return fmt.Errorf("master reported sync failure: %s", response.Error)
+// acknowledge сообщает мастеру LSN следующей ожидаемой записи
+func (s *Slave) acknowledge(stream *network.Stream) error {
+	requestData, err := Encode(Request{NextLSN: s.nextLSN()})
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	if err := stream.Write(requestData); err != nil {
+		return fmt.Errorf("failed to send request to master: %w", err)
 	}
+	return nil
+}
 
-	// Если мастер не вернул новый сегмент, все в порядке
-	if response.SegmentName == "" {
-		s.logger.Info("No new WAL segments from master")
+// applyResponse записывает в локальный WAL и применяет записи из сообщения мастера
+func (s *Slave) applyResponse(response *Response) error {
+	// Сообщение без записей только поддерживает соединение
+	if len(response.Logs) == 0 {
 		return nil
 	}
 
-	s.logger.Info("Received WAL segment from master",
-		zap.String("segment", response.SegmentName),
-		zap.Int("size", len(response.SegmentData)))
-
-	// Сохраняем полученный сегмент на диск
-	segmentPath := filepath.Join(s.walDirectory, response.SegmentName)
-	if err := os.WriteFile(segmentPath, response.SegmentData, 0644); err != nil {
-		return fmt.Errorf("failed to write WAL segment: %w", err)
+	next := s.nextLSN()
+	first, last := response.Logs[0].LSN, response.Logs[len(response.Logs)-1].LSN
+	if first < next {
+		return fmt.Errorf("master sent lsn %d, expected at least %d", first, next)
 	}
 
-	// Обновляем последний полученный сегмент
-	s.lastSegment = response.SegmentName
+	if err := s.apply(response.Logs); err != nil {
+		return fmt.Errorf("failed to apply WAL records %d..%d: %w", first, last, err)
+	}
 
-	// Применяем изменения из WAL
-	if err := s.applyWALSegment(segmentPath); err != nil {
-		return fmt.Errorf("failed to apply WAL segment: %w", err)
+	if at := response.Logs[len(response.Logs)-1].Time(); !at.IsZero() {
+		s.lag.Store(int64(time.Since(at)))
 	}
 
-	s.logger.Info("Successfully applied WAL segment",
-		zap.String("segment", response.SegmentName))
+	// Догоняющие сообщения логируем, потоковые записи по одной - нет
+	if response.More {
+		s.logger.Info("Applied WAL records from master",
+			zap.Uint64("from_lsn", first),
+			zap.Uint64("to_lsn", last),
+			zap.Int("count", len(response.Logs)))
+	}
 
 	return nil
 }
 
-// applyWALSegment применяет изменения из сегмента WAL
-func (s *Slave) applyWALSegment(segmentPath string) error {
-	// Читаем записи WAL из сегмента
-	logs, err := wal.ReadLogsFromFile(segmentPath)
-	if err != nil {
-		return fmt.Errorf("failed to read logs from WAL segment: %w", err)
+// receiveSnapshot принимает снимок мастера, начиная с части first, и передает его seed по мере
+// получения. Пока снимок принимается и загружается, слейв подтверждает прежний LSN, чтобы мастер
+// не закрыл соединение по таймауту
+func (s *Slave) receiveSnapshot(stream *network.Stream, first *SnapshotChunk) error {
+	if s.seed == nil {
+		return fmt.Errorf("records before lsn %d were compacted on master and the replica cannot load "+
+			"a master snapshot", first.LSN+1)
 	}
 
-	s.logger.Info("Applying WAL segment",
-		zap.String("path", segmentPath),
-		zap.Int("logs_count", len(logs)))
+	s.logger.Info("Receiving snapshot from master",
+		zap.Uint64("lsn", first.LSN),
+		zap.Uint64("next_lsn", s.nextLSN()))
+
+	reader, writer := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := s.seed(first.LSN, reader)
+		// Если seed завершился раньше, прием оставшихся частей прерывается
+		reader.CloseWithError(errors.Join(err, io.ErrClosedPipe))
+		result <- err
+	}()
+
+	fail := func(err error) error {
+		writer.CloseWithError(err)
+		<-result
+		return err
+	}
+
+	chunk := first
+	var offset int64
+	for {
+		if chunk.LSN != first.LSN || chunk.Offset != offset {
+			return fail(fmt.Errorf("unexpected snapshot chunk: lsn %d offset %d, expected lsn %d offset %d",
+				chunk.LSN, chunk.Offset, first.LSN, offset))
+		}
+		if _, err := writer.Write(chunk.Data); err != nil {
+			return fail(fmt.Errorf("failed to load snapshot: %w", err))
+		}
+		offset += int64(len(chunk.Data))
+		if chunk.Last {
+			break
+		}
 
-	// Применяем изменения
-	if s.walRecovery != nil {
-		return s.walRecovery(logs)
+		if err := s.acknowledge(stream); err != nil {
+			return fail(err)
+		}
+		responseData, err := stream.Read()
+		if err != nil {
+			return fail(fmt.Errorf("failed to receive snapshot from master: %w", err))
+		}
+		var response Response
+		if err := Decode(&response, responseData); err != nil {
+			return fail(fmt.Errorf("failed to decode response: %w", err))
+		}
+		if !response.Succeed || response.Snapshot == nil {
+			return fail(fmt.Errorf("master interrupted snapshot transfer: %s", response.Error))
+		}
+		chunk = response.Snapshot
 	}
+	writer.Close()
 
-	return nil
+	keepalive := time.NewTicker(max(s.syncInterval/2, time.Millisecond))
+	defer keepalive.Stop()
+	for {
+		select {
+		case err := <-result:
+			if err != nil {
+				return fmt.Errorf("failed to load snapshot %d: %w", first.LSN, err)
+			}
+			s.logger.Info("Loaded snapshot from master",
+				zap.Uint64("lsn", first.LSN),
+				zap.Int64("bytes", offset),
+				zap.Uint64("next_lsn", s.nextLSN()))
+			return nil
+		case <-keepalive.C:
+			if err := s.acknowledge(stream); err != nil {
+				// Соединение переоткроется после загрузки снимка
+				s.logger.Error("Failed to acknowledge master while loading snapshot", zap.Error(err))
+			}
+		}
+	}
 }
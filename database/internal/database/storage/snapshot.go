@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/snapshot"
+	"go.uber.org/zap"
+)
+
+// Количество хранимых снимков по умолчанию. Предыдущий снимок остается на случай
+// повреждения последнего, сегменты WAL удаляются только после самого старого из них
+const defaultSnapshotRetain = 2
+
+// ErrSnapshotsDisabled возвращается командой SNAPSHOT, если снимки не настроены
+var ErrSnapshotsDisabled = errors.New("snapshots are disabled: enable WAL and snapshot in config")
+
+// Snapshot записывает снимок движка, удаляет старые снимки и покрытые сегменты WAL.
+// Возвращает LSN последней записи WAL, включенной в снимок. Снимки делает и слейв:
+// полученные от мастера записи добавляются в его WAL и применяются под той же блокировкой,
+// что и локальные записи мастера, поэтому LSN снимка - последняя примененная запись
+func (s *SimpleStorage) Snapshot() (uint64, error) {
+	if s.snapshots == nil || s.wal == nil {
+		return 0, ErrSnapshotsDisabled
+	}
+	// При восстановлении на момент времени WAL открыт только для чтения
+	if s.recoveryTarget != nil {
+		return 0, ErrPointInTimeRecovery
+	}
+
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	// Дожидаемся начатых записей: все записи WAL до next уже применены к движку.
+	// Записи после next могут попасть в снимок, но при восстановлении они повторяются
+	// поверх него, и результат не меняется: в WAL хранятся итоговые значения. Для
+	// восстановления на момент времени снимок хранит последний LSN, который мог в него попасть
+	s.writes.Lock()
+	next := s.wal.NextLSN()
+	s.writes.Unlock()
+
+	if next == 0 {
+		s.logger.Info("Nothing to snapshot: WAL is empty")
+		return 0, nil
+	}
+	lsn := next - 1
+
+	started := time.Now()
+	entries := 0
+	path, err := snapshot.Write(s.snapshots.Directory, lsn, func(add func(snapshot.Entry) error) (uint64, error) {
+		err := s.engine.Dump(func(key, value string, expiresAt time.Time) error {
+			entries++
+			return add(snapshot.Entry{Key: key, Value: value, ExpiresAt: expiresAt})
+		})
+		// Запись получает LSN раньше, чем применяется к движку, поэтому все записи,
+		// попавшие в снимок во время обхода, меньше следующего LSN
+		return s.wal.NextLSN() - 1, err
+	})
+	if err != nil {
+		s.logger.Error("Failed to write snapshot", zap.Error(err))
+		return 0, err
+	}
+
+	retain := s.snapshots.Retain
+	if retain <= 0 {
+		retain = defaultSnapshotRetain
+	}
+	retained, err := snapshot.Prune(s.snapshots.Directory, retain)
+	if err != nil {
+		s.logger.Error("Failed to remove old snapshots", zap.Error(err))
+		return lsn, err
+	}
+
+	// Сегменты нужны для восстановления с любого из хранимых снимков
+	removed, err := s.wal.Compact(retained[0].LSN, s.snapshots.ArchiveDirectory)
+	if err != nil {
+		s.logger.Error("Failed to compact WAL", zap.Error(err))
+		return lsn, err
+	}
+
+	s.logger.Info("Snapshot created",
+		zap.String("path", path),
+		zap.Uint64("lsn", lsn),
+		zap.Int("keys", entries),
+		zap.Int("compacted_segments", removed),
+		zap.Duration("duration", time.Since(started)),
+	)
+	return lsn, nil
+}
+
+// loadSnapshot загружает в движок самый новый корректный снимок с LSN не больше maxLSN.
+// Поврежденные снимки пропускаются. При восстановлении на момент времени пропускаются и
+// снимки, в которые могли попасть записи после maxLSN: их данные новее точки восстановления.
+// Возвращает LSN снимка и false, если подходящих снимков нет
+func (s *SimpleStorage) loadSnapshot(maxLSN uint64) (uint64, bool, error) {
+	all, err := snapshot.List(s.snapshots.Directory)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	if len(all) == 0 {
+		return 0, false, nil
+	}
+
+	// Снимки после точки восстановления не подходят
+	snapshots := all[:0:0]
+	for _, info := range all {
+		if info.LSN <= maxLSN {
+			snapshots = append(snapshots, info)
+		}
+	}
+	if len(snapshots) == 0 {
+		return 0, false, nil
+	}
+
+	// Пока загружается снимок и повторяется WAL, ключи не истекают: PERSIST из WAL
+	// может снять срок с ключа, который по часам уже истек
+	s.engine.SetLoading(true)
+	defer s.engine.SetLoading(false)
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		info := snapshots[i]
+		if s.recoveryTarget != nil {
+			meta, err := snapshot.ReadMeta(info.Path)
+			if err == nil && meta.MaxLSN > maxLSN {
+				s.logger.Info("Skipping snapshot that may contain writes after the recovery target",
+					zap.String("path", info.Path),
+					zap.Uint64("lsn", meta.LSN),
+					zap.Uint64("max_lsn", meta.MaxLSN),
+				)
+				continue
+			}
+		}
+
+		meta, keys, err := s.loadSnapshotFile(info.Path)
+		if errors.Is(err, snapshot.ErrCorruptSnapshot) {
+			s.logger.Error("Skipping corrupt snapshot",
+				zap.String("path", info.Path),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to load snapshot %s: %w", info.Path, err)
+		}
+
+		s.logger.Info("Snapshot loaded",
+			zap.String("path", info.Path),
+			zap.Uint64("lsn", meta.LSN),
+			zap.Int("keys", keys),
+		)
+		return meta.LSN, true, nil
+	}
+
+	// Восстановление на момент времени само проверяет, что WAL сохранился с начала
+	if s.recoveryTarget != nil {
+		return 0, false, nil
+	}
+	// Сегменты, покрытые снимками, уже удалены, поэтому одного WAL недостаточно
+	return 0, false, fmt.Errorf("no valid snapshot among %d in %s", len(snapshots), s.snapshots.Directory)
+}
+
+// loadSnapshotFile загружает в движок снимок path. Возвращает метаданные снимка и количество ключей
+func (s *SimpleStorage) loadSnapshotFile(path string) (snapshot.Meta, int, error) {
+	keys := 0
+	meta, err := snapshot.Load(path, func(entry snapshot.Entry) error {
+		keys++
+		if entry.ExpiresAt.IsZero() {
+			return s.engine.Set(entry.Key, entry.Value)
+		}
+		return s.engine.SetWithExpiration(entry.Key, entry.Value, entry.ExpiresAt)
+	})
+	return meta, keys, err
+}
+
+// seedFromSnapshot заменяет данные слейва снимком мастера с LSN lsn, прочитанным из r. Мастер
+// отправляет снимок, если нужные слейву записи уже удалены сжатием WAL. Снимок сохраняется в
+// директорию снимков слейва, поэтому после перезапуска слейв загружает его и продолжает с той
+// же записи; WAL слейва начинается заново с записи после снимка
+func (s *SimpleStorage) seedFromSnapshot(lsn uint64, r io.Reader) error {
+	if s.snapshots == nil || s.wal == nil {
+		return errors.New("snapshots must be enabled on the replica to load a master snapshot")
+	}
+
+	path, err := snapshot.Save(s.snapshots.Directory, lsn, r)
+	if err != nil {
+		return fmt.Errorf("failed to save master snapshot: %w", err)
+	}
+
+	// Локальный снимок не должен записаться поверх данных мастера со старым содержимым
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	// Полученные записи не применяются, пока данные заменяются
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	// Ключи, удаленные на мастере в сжатых записях, не должны остаться на слейве
+	var keys []string
+	if err := s.engine.Dump(func(key, _ string, _ time.Time) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to clear data before loading snapshot: %w", err)
+	}
+	for _, key := range keys {
+		if err := s.engine.Delete(key); err != nil && !errors.Is(err, engine.ErrKeyNotFound) {
+			return fmt.Errorf("failed to clear data before loading snapshot: %w", err)
+		}
+	}
+
+	s.engine.SetLoading(true)
+	_, loaded, err := s.loadSnapshotFile(path)
+	s.engine.SetLoading(false)
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot %s: %w", path, err)
+	}
+
+	if err := s.wal.Reset(lsn + 1); err != nil {
+		return fmt.Errorf("failed to reset WAL after loading snapshot: %w", err)
+	}
+
+	// Остальные снимки описывают прежнюю историю слейва: при запуске нужен только этот
+	all, err := snapshot.List(s.snapshots.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for _, info := range all {
+		if info.Path != path {
+			if err := os.Remove(info.Path); err != nil {
+				return fmt.Errorf("failed to remove old snapshot: %w", err)
+			}
+		}
+	}
+
+	s.logger.Info("Replica seeded from master snapshot",
+		zap.String("path", path),
+		zap.Uint64("lsn", lsn),
+		zap.Int("keys", loaded),
+		zap.Int("removed_keys", len(keys)),
+	)
+	return nil
+}
+
+// runSnapshots периодически записывает снимки до остановки хранилища
+func (s *SimpleStorage) runSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			// Ошибка уже записана в лог, следующая попытка будет через interval
+			s.Snapshot()
+		}
+	}
+}
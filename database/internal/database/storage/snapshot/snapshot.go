@@ -0,0 +1,436 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Формат файла снимка версии 2:
+//
+//	заголовок:  "CSNP" | версия (uint32) | LSN последней включенной записи WAL (uint64)
+//	запись:     длина данных (uint32) | CRC32-C данных (uint32) | данные
+//	данные:     длина ключа (uvarint) | ключ | длина значения (uvarint) | значение | срок (varint, unix ms, 0 - бессрочно)
+//	окончание:  "CEND" | количество записей (uint64) | LSN последней записи, которая могла попасть в снимок (uint64)
+//
+// В версии 1 окончание не содержит последнего LSN. Снимок пишется во временный файл
+// и переименовывается после fsync, поэтому недописанный снимок никогда не заменяет корректный
+const (
+	fileMagic       = "CSNP"
+	footerMagic     = "CEND"
+	formatVersion   = 2
+	formatVersionV1 = 1
+	headerSize      = len(fileMagic) + 4 + 8
+	footerSize      = len(footerMagic) + 8 + 8
+	recordHeader    = 8
+	maxRecordSize   = 1 << 30
+
+	filePrefix = "snapshot_"
+	fileSuffix = ".snap"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Ошибки снимков
+var (
+	ErrNoSnapshot      = errors.New("снимок не найден")
+	ErrCorruptSnapshot = errors.New("поврежденный снимок")
+)
+
+// Config содержит настройки снимков
+type Config struct {
+	Enabled          bool          // включены ли снимки
+	Directory        string        // директория снимков
+	Interval         time.Duration // период автоматических снимков, 0 - только по команде SNAPSHOT
+	Retain           int           // сколько последних снимков хранить
+	ArchiveDirectory string        // куда переносить покрытые снимком сегменты WAL, пусто - удалять
+}
+
+// Entry - ключ снимка вместе со сроком жизни
+type Entry struct {
+	Key       string
+	Value     string
+	ExpiresAt time.Time // нулевое время - бессрочно
+}
+
+// Info описывает файл снимка
+type Info struct {
+	Path string
+	LSN  uint64
+}
+
+// Meta описывает, какие записи WAL содержит снимок. Снимок пишется без остановки записи,
+// поэтому кроме всех записей до LSN в него могут попасть записи до MaxLSN включительно.
+// Данные снимка совпадают с состоянием на момент LSN, только если MaxLSN == LSN
+type Meta struct {
+	LSN    uint64
+	MaxLSN uint64 // для снимков версии 1 неизвестен и равен math.MaxUint64
+}
+
+// FileName возвращает имя файла снимка для LSN. Номер дополнен нулями, чтобы имена сортировались по LSN
+func FileName(lsn uint64) string {
+	return fmt.Sprintf("%s%020d%s", filePrefix, lsn, fileSuffix)
+}
+
+// Write записывает снимок, включающий записи WAL до lsn. dump передает функции add
+// все ключи снимка и возвращает LSN последней записи WAL, которая могла попасть в снимок,
+// пока он записывался (см. Meta). Возвращает путь к созданному файлу
+func Write(dir string, lsn uint64, dump func(add func(Entry) error) (uint64, error)) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("не удалось создать директорию снимков: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filePrefix+"*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("не удалось создать файл снимка: %w", err)
+	}
+	defer func() {
+		// При ошибке временный файл удаляется, после переименования Remove ничего не делает
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	writer := bufio.NewWriterSize(tmp, 64<<10)
+
+	header := append([]byte(fileMagic), make([]byte, 12)...)
+	binary.LittleEndian.PutUint32(header[len(fileMagic):], formatVersion)
+	binary.LittleEndian.PutUint64(header[len(fileMagic)+4:], lsn)
+	if _, err := writer.Write(header); err != nil {
+		return "", fmt.Errorf("не удалось записать снимок: %w", err)
+	}
+
+	var (
+		count uint64
+		buf   []byte
+	)
+	maxLSN, err := dump(func(entry Entry) error {
+		buf = appendEntry(buf[:0], entry)
+		count++
+		_, err := writer.Write(buf)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("не удалось записать снимок: %w", err)
+	}
+
+	footer := binary.LittleEndian.AppendUint64([]byte(footerMagic), count)
+	footer = binary.LittleEndian.AppendUint64(footer, max(maxLSN, lsn))
+	if _, err := writer.Write(footer); err != nil {
+		return "", fmt.Errorf("не удалось записать снимок: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return "", fmt.Errorf("не удалось записать снимок: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", fmt.Errorf("не удалось синхронизировать снимок с диском: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("не удалось закрыть файл снимка: %w", err)
+	}
+
+	path := filepath.Join(dir, FileName(lsn))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("не удалось переименовать снимок: %w", err)
+	}
+	syncDir(dir)
+
+	return path, nil
+}
+
+// Save сохраняет в dir снимок, полученный из r, например от мастера репликации. Снимок
+// проверяется целиком до переименования, поэтому поврежденный при передаче снимок не
+// сохраняется. Возвращает путь к файлу снимка
+func Save(dir string, lsn uint64, r io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("не удалось создать директорию снимков: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filePrefix+"*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("не удалось создать файл снимка: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return "", fmt.Errorf("не удалось записать снимок: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", fmt.Errorf("не удалось синхронизировать снимок с диском: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("не удалось закрыть файл снимка: %w", err)
+	}
+
+	meta, err := read(tmp.Name(), nil)
+	if err != nil {
+		return "", err
+	}
+	if meta.LSN != lsn {
+		return "", fmt.Errorf("%w: LSN снимка %d, ожидался %d", ErrCorruptSnapshot, meta.LSN, lsn)
+	}
+
+	path := filepath.Join(dir, FileName(lsn))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("не удалось переименовать снимок: %w", err)
+	}
+	syncDir(dir)
+
+	return path, nil
+}
+
+// Load проверяет снимок целиком и только затем передает его записи fn, поэтому
+// поврежденный снимок не применяется частично. Истекшие ключи передаются как есть
+func Load(path string, fn func(Entry) error) (Meta, error) {
+	meta, err := read(path, nil)
+	if err != nil {
+		return Meta{}, err
+	}
+	if _, err := read(path, fn); err != nil {
+		return Meta{}, err
+	}
+	return meta, nil
+}
+
+// ReadMeta читает заголовок и окончание снимка, не проверяя записи
+func ReadMeta(path string) (Meta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Meta{}, err
+	}
+	defer file.Close()
+
+	corrupt := func(reason string) error {
+		return fmt.Errorf("%w %s: %s", ErrCorruptSnapshot, path, reason)
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.HasPrefix(header, []byte(fileMagic)) {
+		return Meta{}, corrupt("некорректный заголовок")
+	}
+	version := binary.LittleEndian.Uint32(header[len(fileMagic):])
+	meta := Meta{LSN: binary.LittleEndian.Uint64(header[len(fileMagic)+4:]), MaxLSN: math.MaxUint64}
+	switch version {
+	case formatVersionV1:
+		return meta, nil
+	case formatVersion:
+	default:
+		return Meta{}, corrupt(fmt.Sprintf("неподдерживаемая версия %d", version))
+	}
+
+	footer := make([]byte, footerSize)
+	info, err := file.Stat()
+	if err != nil {
+		return Meta{}, err
+	}
+	if info.Size() < int64(headerSize+footerSize) {
+		return Meta{}, corrupt("нет окончания снимка")
+	}
+	if _, err := file.ReadAt(footer, info.Size()-int64(footerSize)); err != nil || !bytes.HasPrefix(footer, []byte(footerMagic)) {
+		return Meta{}, corrupt("нет окончания снимка")
+	}
+	meta.MaxLSN = binary.LittleEndian.Uint64(footer[len(footerMagic)+8:])
+	return meta, nil
+}
+
+// List возвращает снимки директории по возрастанию LSN
+func List(dir string) ([]Info, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Info
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		lsn, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Info{Path: filepath.Join(dir, name), LSN: lsn})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].LSN < snapshots[j].LSN })
+	return snapshots, nil
+}
+
+// Prune удаляет старые снимки, оставляя retain последних, и возвращает оставшиеся
+func Prune(dir string, retain int) ([]Info, error) {
+	snapshots, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	if retain < 1 {
+		retain = 1
+	}
+
+	for len(snapshots) > retain {
+		if err := os.Remove(snapshots[0].Path); err != nil {
+			return snapshots, fmt.Errorf("не удалось удалить старый снимок: %w", err)
+		}
+		snapshots = snapshots[1:]
+	}
+	return snapshots, nil
+}
+
+// appendEntry добавляет запись снимка
+func appendEntry(buf []byte, entry Entry) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeader)...)
+
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Key)))
+	buf = append(buf, entry.Key...)
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Value)))
+	buf = append(buf, entry.Value...)
+	var deadline int64
+	if !entry.ExpiresAt.IsZero() {
+		deadline = entry.ExpiresAt.UnixMilli()
+	}
+	buf = binary.AppendVarint(buf, deadline)
+
+	payload := buf[start+recordHeader:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+// read читает снимок и проверяет все контрольные суммы. Если fn == nil, записи только проверяются
+func read(path string, fn func(Entry) error) (Meta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Meta{}, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64<<10)
+	corrupt := func(reason string) error {
+		return fmt.Errorf("%w %s: %s", ErrCorruptSnapshot, path, reason)
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.HasPrefix(header, []byte(fileMagic)) {
+		return Meta{}, corrupt("некорректный заголовок")
+	}
+	version := binary.LittleEndian.Uint32(header[len(fileMagic):])
+	if version != formatVersion && version != formatVersionV1 {
+		return Meta{}, corrupt(fmt.Sprintf("неподдерживаемая версия %d", version))
+	}
+	meta := Meta{LSN: binary.LittleEndian.Uint64(header[len(fileMagic)+4:]), MaxLSN: math.MaxUint64}
+	footerRest := footerSize - len(footerMagic)
+	if version == formatVersionV1 {
+		footerRest -= 8
+	}
+
+	var (
+		count uint64
+		head  = make([]byte, recordHeader)
+		buf   []byte
+	)
+	for {
+		if _, err := io.ReadFull(reader, head[:len(footerMagic)]); err != nil {
+			return Meta{}, corrupt("нет окончания снимка")
+		}
+
+		// Окончание снимка: количество записей должно совпасть с прочитанным
+		if string(head[:len(footerMagic)]) == footerMagic {
+			footer := make([]byte, footerRest)
+			if _, err := io.ReadFull(reader, footer); err != nil {
+				return Meta{}, corrupt("неполное окончание снимка")
+			}
+			if expected := binary.LittleEndian.Uint64(footer); expected != count {
+				return Meta{}, corrupt(fmt.Sprintf("ожидалось %d записей, прочитано %d", expected, count))
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				return Meta{}, corrupt("данные после окончания снимка")
+			}
+			if version == formatVersion {
+				meta.MaxLSN = binary.LittleEndian.Uint64(footer[8:])
+			}
+			return meta, nil
+		}
+
+		if _, err := io.ReadFull(reader, head[len(footerMagic):]); err != nil {
+			return Meta{}, corrupt(fmt.Sprintf("неполный заголовок записи %d", count))
+		}
+		size := binary.LittleEndian.Uint32(head)
+		if size > maxRecordSize {
+			return Meta{}, corrupt(fmt.Sprintf("недопустимая длина записи %d", count))
+		}
+		if cap(buf) < int(size) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return Meta{}, corrupt(fmt.Sprintf("неполная запись %d", count))
+		}
+		if crc32.Checksum(buf, crcTable) != binary.LittleEndian.Uint32(head[4:]) {
+			return Meta{}, corrupt(fmt.Sprintf("контрольная сумма записи %d не совпадает", count))
+		}
+
+		if fn != nil {
+			entry, err := decodeEntry(buf)
+			if err != nil {
+				return Meta{}, corrupt(fmt.Sprintf("запись %d: %v", count, err))
+			}
+			if err := fn(entry); err != nil {
+				return Meta{}, err
+			}
+		}
+		count++
+	}
+}
+
+// decodeEntry разбирает данные записи снимка
+func decodeEntry(payload []byte) (Entry, error) {
+	var entry Entry
+
+	size, n := binary.Uvarint(payload)
+	if n <= 0 || size > uint64(len(payload)-n) {
+		return entry, errors.New("некорректная длина ключа")
+	}
+	entry.Key = string(payload[n : n+int(size)])
+	payload = payload[n+int(size):]
+
+	size, n = binary.Uvarint(payload)
+	if n <= 0 || size > uint64(len(payload)-n) {
+		return entry, errors.New("некорректная длина значения")
+	}
+	entry.Value = string(payload[n : n+int(size)])
+	payload = payload[n+int(size):]
+
+	deadline, n := binary.Varint(payload)
+	if n <= 0 || n != len(payload) {
+		return entry, errors.New("некорректный срок жизни")
+	}
+	if deadline != 0 {
+		entry.ExpiresAt = time.UnixMilli(deadline)
+	}
+	return entry, nil
+}
+
+// syncDir синхронизирует директорию, чтобы переименование файла пережило сбой питания
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,229 @@
+// database/storage/snapshot/snapshot_test.go
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeEntries записывает снимок с переданными записями, в который не попали записи после lsn
+func writeEntries(t *testing.T, dir string, lsn uint64, entries []Entry) string {
+	t.Helper()
+
+	path, err := Write(dir, lsn, func(add func(Entry) error) (uint64, error) {
+		for _, entry := range entries {
+			if err := add(entry); err != nil {
+				return 0, err
+			}
+		}
+		return lsn, nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	return path
+}
+
+func TestWriteLoad(t *testing.T) {
+	dir := t.TempDir()
+	deadline := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+
+	entries := []Entry{
+		{Key: "plain", Value: "value"},
+		{Key: "ttl", Value: "expiring", ExpiresAt: deadline},
+		{Key: "binary\x00key", Value: "\xff\xfe"},
+		{Key: "empty", Value: ""},
+	}
+	path := writeEntries(t, dir, 42, entries)
+
+	if filepath.Base(path) != FileName(42) {
+		t.Errorf("Expected file %s, got %s", FileName(42), filepath.Base(path))
+	}
+
+	var loaded []Entry
+	meta, err := Load(path, func(entry Entry) error {
+		loaded = append(loaded, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	if meta != (Meta{LSN: 42, MaxLSN: 42}) {
+		t.Errorf("Expected LSN 42, got %+v", meta)
+	}
+	if len(loaded) != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), len(loaded))
+	}
+	for i, entry := range entries {
+		got := loaded[i]
+		if got.Key != entry.Key || got.Value != entry.Value || !got.ExpiresAt.Equal(entry.ExpiresAt) {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, entry, got)
+		}
+	}
+
+	// Временные файлы не остаются в директории
+	tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(tmp) != 0 {
+		t.Errorf("Expected no temporary files, got %v", tmp)
+	}
+}
+
+func TestSnapshotMeta(t *testing.T) {
+	dir := t.TempDir()
+
+	// Во время записи снимка с LSN 10 в него попали записи до 15
+	path, err := Write(dir, 10, func(add func(Entry) error) (uint64, error) {
+		return 15, add(Entry{Key: "key", Value: "value"})
+	})
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	want := Meta{LSN: 10, MaxLSN: 15}
+	if meta, err := ReadMeta(path); err != nil || meta != want {
+		t.Errorf("ReadMeta() = %+v, %v, want %+v", meta, err, want)
+	}
+	if meta, err := Load(path, func(Entry) error { return nil }); err != nil || meta != want {
+		t.Errorf("Load() = %+v, %v, want %+v", meta, err, want)
+	}
+
+	// В снимке версии 1 последний LSN неизвестен
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	data[len(fileMagic)] = formatVersionV1
+	v1 := filepath.Join(dir, FileName(11))
+	if err := os.WriteFile(v1, data[:len(data)-8], 0644); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	want = Meta{LSN: 10, MaxLSN: math.MaxUint64}
+	if meta, err := ReadMeta(v1); err != nil || meta != want {
+		t.Errorf("ReadMeta() of version 1 = %+v, %v, want %+v", meta, err, want)
+	}
+	if meta, err := Load(v1, func(Entry) error { return nil }); err != nil || meta != want {
+		t.Errorf("Load() of version 1 = %+v, %v, want %+v", meta, err, want)
+	}
+}
+
+func TestCorruptSnapshot(t *testing.T) {
+	entries := []Entry{{Key: "key1", Value: "value1"}, {Key: "key2", Value: "value2"}}
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+	}{
+		{"flipped byte", func(data []byte) []byte {
+			data[headerSize+recordHeader] ^= 0xff
+			return data
+		}},
+		{"truncated", func(data []byte) []byte {
+			return data[:len(data)-footerSize-3]
+		}},
+		{"missing footer", func(data []byte) []byte {
+			return data[:len(data)-footerSize]
+		}},
+		{"bad magic", func(data []byte) []byte {
+			data[0] = 'X'
+			return data
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEntries(t, t.TempDir(), 7, entries)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read snapshot: %v", err)
+			}
+			if err := os.WriteFile(path, tt.corrupt(data), 0644); err != nil {
+				t.Fatalf("Failed to write snapshot: %v", err)
+			}
+
+			applied := 0
+			_, err = Load(path, func(Entry) error {
+				applied++
+				return nil
+			})
+			if !errors.Is(err, ErrCorruptSnapshot) {
+				t.Fatalf("Expected ErrCorruptSnapshot, got %v", err)
+			}
+			// Поврежденный снимок не применяется даже частично
+			if applied != 0 {
+				t.Errorf("Expected no entries applied, got %d", applied)
+			}
+		})
+	}
+}
+
+func TestSave(t *testing.T) {
+	entries := []Entry{{Key: "key1", Value: "value1"}, {Key: "key2", Value: "value2"}}
+	data, err := os.ReadFile(writeEntries(t, t.TempDir(), 7, entries))
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+
+	dir := t.TempDir()
+	path, err := Save(dir, 7, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	if filepath.Base(path) != FileName(7) {
+		t.Errorf("Expected file %s, got %s", FileName(7), filepath.Base(path))
+	}
+	loaded := 0
+	if _, err := Load(path, func(Entry) error { loaded++; return nil }); err != nil || loaded != len(entries) {
+		t.Errorf("Load() of saved snapshot = %d entries, %v, want %d", loaded, err, len(entries))
+	}
+
+	// Поврежденный или чужой снимок не сохраняется
+	truncated := data[:len(data)-footerSize-3]
+	if _, err := Save(dir, 8, bytes.NewReader(truncated)); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("Save() of truncated snapshot error = %v, want ErrCorruptSnapshot", err)
+	}
+	if _, err := Save(dir, 9, bytes.NewReader(data)); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("Save() with wrong LSN error = %v, want ErrCorruptSnapshot", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Errorf("Directory after failed saves has %d files, %v, want only the saved snapshot", len(files), err)
+	}
+}
+
+func TestListPrune(t *testing.T) {
+	dir := t.TempDir()
+
+	if snapshots, err := List(filepath.Join(dir, "missing")); err != nil || len(snapshots) != 0 {
+		t.Fatalf("Expected no snapshots in missing directory, got %v, %v", snapshots, err)
+	}
+
+	for _, lsn := range []uint64{100, 5, 20} {
+		writeEntries(t, dir, lsn, nil)
+	}
+	// Посторонние файлы не считаются снимками
+	os.WriteFile(filepath.Join(dir, "wal_1.log"), nil, 0644)
+
+	snapshots, err := List(dir)
+	if err != nil {
+		t.Fatalf("Failed to list snapshots: %v", err)
+	}
+	if len(snapshots) != 3 || snapshots[0].LSN != 5 || snapshots[1].LSN != 20 || snapshots[2].LSN != 100 {
+		t.Fatalf("Expected snapshots sorted by LSN, got %+v", snapshots)
+	}
+
+	retained, err := Prune(dir, 2)
+	if err != nil {
+		t.Fatalf("Failed to prune snapshots: %v", err)
+	}
+	if len(retained) != 2 || retained[0].LSN != 20 || retained[1].LSN != 100 {
+		t.Fatalf("Expected snapshots 20 and 100 to remain, got %+v", retained)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName(5))); !os.IsNotExist(err) {
+		t.Errorf("Expected oldest snapshot to be removed, got %v", err)
+	}
+}
@@ -4,38 +4,149 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/replication"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/snapshot"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
 	"github.com/keij-sama/Concurrency/database/internal/network"
 	"github.com/keij-sama/Concurrency/pkg/logger"
 	"go.uber.org/zap"
 )
 
-// Storage определяет интерфейс для хранилища
-type Storage interface {
+// Operations определяет операции над отдельными ключами, доступные как хранилищу,
+// так и транзакции в Atomic
+type Operations interface {
 	Set(key, value string) error
 	Get(key string) (string, error)
 	Delete(key string) error
+	SetWithTTL(key, value string, ttl time.Duration) error
+	Expire(key string, ttl time.Duration) error
+	TTL(key string) (time.Duration, error)
+	Persist(key string) error
+
+	// Варианты с контекстом: запрос прерывается, если ctx завершится раньше, в том числе
+	// во время ожидания места в очереди WAL и подтверждения записи
+	SetCtx(ctx context.Context, key, value string) error
+	GetCtx(ctx context.Context, key string) (string, error)
+	DeleteCtx(ctx context.Context, key string) error
+	SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error
+	ExpireCtx(ctx context.Context, key string, ttl time.Duration) error
+	PersistCtx(ctx context.Context, key string) error
+
+	// Атомарные операции чтения-изменения-записи над одним ключом
+	IncrBy(key string, delta int64) (int64, error)
+	SetNX(key, value string) (bool, error)
+	GetSet(key, value string) (string, bool, error)
+	CompareAndSwap(key, expected, value string) (bool, error)
+
+	// Атомарные операции над несколькими ключами
+	MGet(keys []string) (map[string]string, error)
+	MSet(pairs []engine.KeyValue) error
+	MDelete(keys []string) (int, error)
+
+	// Варианты атомарных операций с контекстом, как SetCtx
+	IncrByCtx(ctx context.Context, key string, delta int64) (int64, error)
+	SetNXCtx(ctx context.Context, key, value string) (bool, error)
+	GetSetCtx(ctx context.Context, key, value string) (string, bool, error)
+	CompareAndSwapCtx(ctx context.Context, key, expected, value string) (bool, error)
+	MGetCtx(ctx context.Context, keys []string) (map[string]string, error)
+	MSetCtx(ctx context.Context, pairs []engine.KeyValue) error
+	MDeleteCtx(ctx context.Context, keys []string) (int, error)
+}
+
+// Storage определяет интерфейс для хранилища
+type Storage interface {
+	Operations
+
+	// Version возвращает версию ключа для WATCH
+	Version(key string) uint64
+	// Atomic выполняет fn над ключами keys как одну транзакцию. Изменения записываются в WAL
+	// одной записью BATCH и применяются целиком. Если версия хотя бы одного ключа из watched
+	// изменилась, возвращается ErrWatchConflict и ничего не применяется
+	Atomic(keys []string, watched map[string]uint64, fn func(tx Operations) error) error
+	// AtomicCtx - Atomic, ожидание записи которого в WAL прерывается, как в SetCtx
+	AtomicCtx(ctx context.Context, keys []string, watched map[string]uint64, fn func(tx Operations) error) error
+
+	Range(start, end string, limit int) ([]engine.KeyValue, error)
+	Prefix(prefix string) ([]engine.KeyValue, error)
+	Scan(cursor uint64, pattern string, count int) ([]string, uint64, error)
+	Keys(pattern string) ([]string, error)
+	// Snapshot записывает снимок данных и удаляет покрытые им сегменты WAL
+	Snapshot() (uint64, error)
+	// WALStats возвращает состояние очереди записи WAL, false - WAL выключен
+	WALStats() (wal.QueueStats, bool)
+	// WaitReplicas ждет, пока replicas слейвов подтвердят сделанные записи, не дольше timeout
+	WaitReplicas(ctx context.Context, replicas int, timeout time.Duration) (int, error)
+	// ReplicaOf делает узел слейвом masterAddress, а с пустым адресом - мастером
+	ReplicaOf(masterAddress string) error
 	Close() error
 }
 
+const (
+	// Количество ключей, просматриваемых за один шаг обхода в Keys
+	keysScanBatch = 1000
+
+	// Предел размера сообщения репликации: ответ содержит до 16MB аргументов записей WAL
+	replicationMessageSizeLimit = 64 << 20
+)
+
+// Ошибки
+var (
+	// ErrOrderedScanNotSupported возвращается, если движок не хранит ключи упорядоченно
+	ErrOrderedScanNotSupported = errors.New("ordered scans require engine type \"ordered\"")
+	// ErrReadOnlyReplica возвращается при попытке записи на слейв
+	ErrReadOnlyReplica = errors.New("write operations not allowed on slave replica")
+	// ErrWriteUnconfirmed возвращается, если запрос отменен до подтверждения записи WAL.
+	// Запись уже принята в очередь WAL и будет применена
+	ErrWriteUnconfirmed = errors.New("request cancelled before the write was confirmed, it may still be applied")
+)
+
 // SimpleStorage реализует интерфейс Storage
 type SimpleStorage struct {
 	engine      engine.Engine
 	logger      logger.Logger
 	wal         *wal.WAL
-	replication replication.Replication
-	isMaster    bool
 	ctx         context.Context
 	cancel      context.CancelFunc
+
+	// Роль узла меняется командой REPLICAOF: replicationMutex защищает replication
+	// и сериализует переключения, isMaster читается без блокировки
+	replicationMutex  sync.RWMutex
+	replication       replication.Replication
+	replicationConfig replication.ReplicationConfig
+	isMaster          atomic.Bool
+	// raft задан в режиме raft: узел пишет, пока группа считает его лидером
+	raft *replication.Raft
+
+	// Полусинхронная репликация: сколько слейвов подтверждают запись и сколько ее ждать.
+	// syncDegraded установлен, пока мастер после таймаута не ждет слейвов
+	syncReplicas int
+	syncTimeout  time.Duration
+	syncDegraded atomic.Bool
+
+	// writes удерживается на чтение от записи в WAL до применения к движку,
+	// снимок берет его на запись, чтобы дождаться начатых записей
+	writes        sync.RWMutex
+	snapshots     *snapshot.Config
+	snapshotMutex sync.Mutex
+
+	// recoveryTarget задан, если хранилище восстановлено на момент времени и работает только на чтение
+	recoveryTarget *RecoveryTarget
 }
 
 // StorageOptions содержит опции для создания хранилища
 type StorageOptions struct {
 	WALConfig         *wal.WALConfig
 	ReplicationConfig *replication.ReplicationConfig
+	SnapshotConfig    *snapshot.Config
+	// RecoveryTarget восстанавливает данные на момент времени из того же WAL без его изменения.
+	// Хранилище запускается только на чтение, репликация и снимки не запускаются
+	RecoveryTarget *RecoveryTarget
 }
 
 // NewStorage создает новое хранилище
@@ -43,31 +154,77 @@ func NewStorage(eng engine.Engine, log logger.Logger, options StorageOptions) (S
 	ctx, cancel := context.WithCancel(context.Background())
 
 	storage := &SimpleStorage{
-		engine:   eng,
-		logger:   log,
-		ctx:      ctx,
-		cancel:   cancel,
-		isMaster: true, // По умолчанию считаем, что это мастер
+		engine: eng,
+		logger: log,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	storage.isMaster.Store(true) // По умолчанию считаем, что это мастер
+
+	if options.RecoveryTarget != nil {
+		if options.WALConfig == nil || !options.WALConfig.Enabled {
+			cancel()
+			return nil, errors.New("WAL must be enabled for point-in-time recovery")
+		}
+		storage.recoveryTarget = options.RecoveryTarget
 	}
 
 	// Инициализируем WAL, если он включен
 	if options.WALConfig != nil && options.WALConfig.Enabled {
-		walInstance, err := wal.NewWAL(*options.WALConfig, log)
+		walConfig := *options.WALConfig
+		walConfig.ReadOnly = walConfig.ReadOnly || storage.recoveryTarget != nil
+		walInstance, err := wal.NewWAL(walConfig, log)
 		if err != nil {
 			cancel()
 			return nil, fmt.Errorf("failed to initialize WAL: %w", err)
 		}
 
 		storage.wal = walInstance
+		if options.SnapshotConfig != nil && options.SnapshotConfig.Enabled {
+			snapshots := *options.SnapshotConfig
+			if snapshots.Directory == "" {
+				snapshots.Directory = options.WALConfig.DataDirectory
+			}
+			storage.snapshots = &snapshots
+		}
 
-		// Восстанавливаем данные из WAL
-		if err := storage.recoverFromWAL(); err != nil {
+		// Узел raft применяет только зафиксированные записи, остальные применит, когда
+		// узнает индекс фиксации от лидера
+		applyBefore := uint64(math.MaxUint64)
+		if cfg := options.ReplicationConfig; cfg != nil && cfg.Enabled && cfg.ReplicaType == replication.TypeRaft && storage.recoveryTarget == nil {
+			commit, err := replication.LoadRaftCommit(walConfig.DataDirectory)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("failed to load raft state: %w", err)
+			}
+			applyBefore = commit
+		}
+
+		// Восстанавливаем данные из снимка и WAL
+		if err := storage.recover(applyBefore); err != nil {
 			cancel()
 			return nil, fmt.Errorf("failed to recover from WAL: %w", err)
 		}
 
-		// Запускаем WAL
-		walInstance.Start(ctx)
+		// Запускаем WAL, в режиме только для чтения писать в него нечего
+		if !walConfig.ReadOnly {
+			walInstance.Start(ctx)
+		}
+	}
+
+	// Вытесненные из-за лимита памяти ключи записываем в WAL как удаления
+	if evictor, ok := eng.(engine.Evictor); ok {
+		evictor.SetEvictionHandler(storage.onEvict)
+	}
+
+	// Запускаем фоновую очистку истекших ключей
+	eng.Start(ctx)
+
+	if storage.recoveryTarget != nil {
+		log.Info("Storage recovered to a point in time and is read-only",
+			zap.Stringer("target", storage.recoveryTarget),
+		)
+		return storage, nil
 	}
 
 	// Инициализируем репликацию, если она включена
@@ -85,47 +242,107 @@ func NewStorage(eng engine.Engine, log logger.Logger, options StorageOptions) (S
 		}
 
 		storage.replication = repl
-		storage.isMaster = repl.IsMaster()
+		storage.replicationConfig = *options.ReplicationConfig
+		// В режиме raft роль переключает сам узел, когда его выбирают лидером
+		if storage.raft == nil {
+			storage.isMaster.Store(repl.IsMaster())
+		}
+		storage.syncReplicas = options.ReplicationConfig.SyncReplicas
+		storage.syncTimeout = options.ReplicationConfig.SyncTimeout
+	}
+
+	// Запускаем периодические снимки
+	if storage.snapshots != nil && storage.snapshots.Interval > 0 {
+		go storage.runSnapshots(storage.snapshots.Interval)
 	}
 
 	return storage, nil
 }
 
-// recoverFromWAL восстанавливает данные из WAL
-func (s *SimpleStorage) recoverFromWAL() error {
-	// Получаем логи из WAL
-	logs, err := s.wal.Recover()
-	if err != nil {
-		return fmt.Errorf("failed to recover logs from WAL: %w", err)
-	}
+// applyLogs применяет записи WAL к движку. Используется при восстановлении и на слейве
+func (s *SimpleStorage) applyLogs(logs []wal.Log) error {
+	s.engine.SetLoading(true)
+	defer s.engine.SetLoading(false)
 
-	// Применяем логи к движку
 	for _, log := range logs {
-		switch log.Operation {
-		case wal.OperationSet:
-			if len(log.Args) >= 2 {
-				key := log.Args[0]
-				value := log.Args[1]
-				if err := s.engine.Set(key, value); err != nil {
-					s.logger.Error("Failed to apply SET operation from WAL",
-						zap.Uint64("lsn", log.LSN),
-						zap.String("key", key),
-						zap.Error(err),
-					)
-				}
-			}
-		case wal.OperationDel:
-			if len(log.Args) >= 1 {
-				key := log.Args[0]
-				if err := s.engine.Delete(key); err != nil && !errors.Is(err, engine.ErrKeyNotFound) {
-					s.logger.Error("Failed to apply DEL operation from WAL",
-						zap.Uint64("lsn", log.LSN),
-						zap.String("key", key),
-						zap.Error(err),
-					)
-				}
+		if err := s.applyLog(log); err != nil {
+			s.logger.Error("Failed to apply operation from WAL",
+				zap.Uint64("lsn", log.LSN),
+				zap.String("operation", log.Operation),
+				zap.Strings("args", log.Args),
+				zap.Error(err),
+			)
+		}
+	}
+	return nil
+}
+
+// applyReplicated записывает полученные слейвом от мастера записи в локальный WAL с их LSN
+// и применяет к движку. Снимок не начнется между записью в WAL и применением
+func (s *SimpleStorage) applyReplicated(logs []wal.Log) error {
+	s.writes.RLock()
+	defer s.writes.RUnlock()
+
+	// Применяются только записи, попавшие в локальный WAL, остальные будут запрошены снова
+	written, err := s.wal.Append(s.ctx, logs)
+	if written > 0 {
+		s.applyLogs(logs[:written])
+	}
+	return err
+}
+
+// applyLog применяет к движку одну запись WAL
+func (s *SimpleStorage) applyLog(log wal.Log) error {
+	switch log.Operation {
+	case wal.OperationSet:
+		if len(log.Args) < 2 {
+			return nil
+		}
+		// Третий аргумент - абсолютный срок истечения, истекшие ключи не воскрешаются
+		if len(log.Args) >= 3 {
+			expiresAt, err := wal.ParseDeadline(log.Args[2])
+			if err != nil {
+				return err
 			}
+			return s.engine.SetWithExpiration(log.Args[0], log.Args[1], expiresAt)
+		}
+		return s.engine.Set(log.Args[0], log.Args[1])
+
+	case wal.OperationDel:
+		if len(log.Args) < 1 {
+			return nil
 		}
+		if err := s.engine.Delete(log.Args[0]); err != nil && !errors.Is(err, engine.ErrKeyNotFound) {
+			return err
+		}
+
+	case wal.OperationExpire:
+		if len(log.Args) < 2 {
+			return nil
+		}
+		expiresAt, err := wal.ParseDeadline(log.Args[1])
+		if err != nil {
+			return err
+		}
+		if err := s.engine.Expire(log.Args[0], expiresAt); err != nil && !errors.Is(err, engine.ErrKeyNotFound) {
+			return err
+		}
+
+	case wal.OperationPersist:
+		if len(log.Args) < 1 {
+			return nil
+		}
+		err := s.engine.Persist(log.Args[0])
+		if err != nil && !errors.Is(err, engine.ErrKeyNotFound) && !errors.Is(err, engine.ErrNoExpiration) {
+			return err
+		}
+
+	case wal.OperationBatch:
+		ops, err := wal.DecodeBatch(log.Args)
+		if err != nil {
+			return err
+		}
+		return s.applyBatch(ops)
 	}
 
 	return nil
@@ -133,6 +350,17 @@ func (s *SimpleStorage) recoverFromWAL() error {
 
 // initializeReplication инициализирует репликацию
 func (s *SimpleStorage) initializeReplication(cfg replication.ReplicationConfig) (replication.Replication, error) {
+	switch cfg.ReplicaType {
+	case replication.TypeMaster:
+		return s.startMaster(cfg, cfg.ListenAddressOrDefault())
+	case replication.TypeRaft:
+		return s.startRaft(cfg)
+	}
+	return s.startSlave(cfg, cfg.MasterAddress)
+}
+
+// startMaster запускает сервер репликации на address
+func (s *SimpleStorage) startMaster(cfg replication.ReplicationConfig, address string) (*replication.Master, error) {
 	// Создаем новый zap logger для репликации
 	// Вместо опасного приведения типов используем напрямую zap.NewProduction()
 	newZapLogger, err := zap.NewProduction()
@@ -140,118 +368,176 @@ func (s *SimpleStorage) initializeReplication(cfg replication.ReplicationConfig)
 		return nil, fmt.Errorf("failed to create zap logger: %w", err)
 	}
 
-	if cfg.ReplicaType == replication.TypeMaster {
-		s.logger.Info("Initializing replication master",
-			zap.String("master_address", cfg.MasterAddress))
+	s.logger.Info("Initializing replication master",
+		zap.String("listen_address", address))
 
-		server, err := network.NewTCPServer(
-			cfg.MasterAddress,
-			newZapLogger,
-			network.WithMaxConnections(100),
-			network.WithIdleTimeout(cfg.SyncInterval),
-			network.WithBufferSize(4096),
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create replication server: %w", err)
-		}
+	server, err := network.NewTCPServer(
+		address,
+		newZapLogger,
+		network.WithMaxConnections(100),
+		network.WithIdleTimeout(cfg.SyncInterval),
+		network.WithBufferSize(4096),
+		network.WithMaxMessageSize(replicationMessageSizeLimit),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replication server: %w", err)
+	}
 
-		s.logger.Info("Replication server created successfully")
+	s.logger.Info("Replication server created successfully")
 
-		master, err := replication.NewMaster(server, s.wal.GetDirectory(), s.logger)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create replication master: %w", err)
-		}
+	// Отставшим слейвам, чьи записи уже удалены сжатием WAL, мастер отправляет снимок
+	var options []replication.MasterOption
+	if s.snapshots != nil {
+		options = append(options, replication.WithSnapshotDirectory(s.snapshots.Directory))
+	}
 
-		s.logger.Info("Starting replication master")
-		if err := master.Start(s.ctx); err != nil {
-			return nil, fmt.Errorf("failed to start replication master: %w", err)
-		}
+	master, err := replication.NewMaster(server, s.wal, cfg.SyncInterval, s.logger, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replication master: %w", err)
+	}
 
-		s.logger.Info("Replication master started successfully")
-		return master, nil
-	} else {
-		// Настраиваем слейв
-		client, err := network.NewTCPClient(
-			cfg.MasterAddress,
+	s.logger.Info("Starting replication master")
+	if err := master.Start(s.ctx); err != nil {
+		return nil, fmt.Errorf("failed to start replication master: %w", err)
+	}
+
+	s.logger.Info("Replication master started successfully")
+	return master, nil
+}
+
+// startSlave запускает репликацию с мастера, сервер репликации которого слушает masterAddress
+func (s *SimpleStorage) startSlave(cfg replication.ReplicationConfig, masterAddress string) (*replication.Slave, error) {
+	// Соединение с мастером открывается в цикле синхронизации и переоткрывается после ошибок
+	dial := func() (*network.TCPClient, error) {
+		return network.NewTCPClient(
+			masterAddress,
 			network.WithClientIdleTimeout(cfg.SyncInterval),
+			network.WithClientMaxMessageSize(replicationMessageSizeLimit),
 		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create replication client: %w", err)
-		}
+	}
 
-		// Функция для восстановления из WAL
-		walRecovery := func(logs []wal.Log) error {
-			for _, log := range logs {
-				switch log.Operation {
-				case wal.OperationSet:
-					if len(log.Args) >= 2 {
-						if err := s.engine.Set(log.Args[0], log.Args[1]); err != nil {
-							s.logger.Error("Failed to apply SET operation from WAL",
-								zap.Uint64("lsn", log.LSN),
-								zap.String("key", log.Args[0]),
-								zap.Error(err),
-							)
-						}
-					}
-				case wal.OperationDel:
-					if len(log.Args) >= 1 {
-						if err := s.engine.Delete(log.Args[0]); err != nil && !errors.Is(err, engine.ErrKeyNotFound) {
-							s.logger.Error("Failed to apply DEL operation from WAL",
-								zap.Uint64("lsn", log.LSN),
-								zap.String("key", log.Args[0]),
-								zap.Error(err),
-							)
-						}
-					}
-				}
-			}
-			return nil
-		}
+	slave, err := replication.NewSlave(dial, cfg.SyncInterval, s.logger, s.wal.NextLSN, s.applyReplicated,
+		replication.WithSeed(s.seedFromSnapshot))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replication slave: %w", err)
+	}
 
-		slave, err := replication.NewSlave(client, s.wal.GetDirectory(), cfg.SyncInterval, s.logger, walRecovery)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create replication slave: %w", err)
-		}
+	// Запускаем слейв
+	if err := slave.Start(s.ctx); err != nil {
+		return nil, fmt.Errorf("failed to start replication slave: %w", err)
+	}
 
-		// Запускаем слейв
-		if err := slave.Start(s.ctx); err != nil {
-			return nil, fmt.Errorf("failed to start replication slave: %w", err)
-		}
+	return slave, nil
+}
 
-		return slave, nil
+// reserveMemory освобождает память под запись, если движок ограничен по памяти.
+// Вызывается до записи в WAL, чтобы удаления вытесненных ключей попали в лог раньше
+func (s *SimpleStorage) reserveMemory(key, value string) error {
+	evictor, ok := s.engine.(engine.Evictor)
+	if !ok {
+		return nil
+	}
+
+	if err := evictor.Reserve(key, value); err != nil {
+		s.logger.Error("Failed to reserve memory",
+			zap.String("key", key),
+			zap.Int64("used_memory", evictor.UsedMemory()),
+			zap.Error(err),
+		)
+		return err
 	}
+	return nil
 }
 
-// Set сохраняет пару ключ-значение
-func (s *SimpleStorage) Set(key, value string) error {
-	// Проверка, что это мастер (писать можно только в мастер)
-	if !s.isMaster {
-		return errors.New("write operations not allowed on slave replica")
+// reserveSize освобождает память под изменения транзакции размером size байт
+func (s *SimpleStorage) reserveSize(size int64) error {
+	evictor, ok := s.engine.(engine.Evictor)
+	if !ok {
+		return nil
 	}
 
-	// Если WAL включен, сначала записываем в WAL
-	if s.wal != nil {
-		// Ждем подтверждения записи в WAL
-		done := s.wal.Set(key, value)
+	if err := evictor.ReserveSize(size); err != nil {
+		s.logger.Error("Failed to reserve memory for transaction",
+			zap.Int64("size", size),
+			zap.Int64("used_memory", evictor.UsedMemory()),
+			zap.Error(err),
+		)
+		return err
+	}
+	return nil
+}
 
-		// Ждем завершения операции WAL
-		if err := <-done; err != nil {
-			s.logger.Error("Failed to write to WAL",
-				zap.String("operation", "SET"),
-				zap.String("key", key),
-				zap.Error(err),
-			)
+// fits сообщает, помещаются ли еще size байт в лимит памяти без вытеснения
+func (s *SimpleStorage) fits(size int64) bool {
+	evictor, ok := s.engine.(engine.Evictor)
+	if !ok || size <= 0 || evictor.MaxMemory() <= 0 {
+		return true
+	}
+	return evictor.UsedMemory()+size <= evictor.MaxMemory()
+}
+
+// WALStats возвращает состояние очереди записи WAL: глубину очереди и время ожидания места.
+// Второй результат false, если WAL выключен
+func (s *SimpleStorage) WALStats() (wal.QueueStats, bool) {
+	if s.wal == nil {
+		return wal.QueueStats{}, false
+	}
+	return s.wal.Stats(), true
+}
+
+// onEvict вытесняет выбранный движком ключ. На мастере удаление записывается в WAL тем же
+// путем, что и DEL, под блокировкой партиции ключа, поэтому не обгоняет параллельную запись
+// этого ключа, а из памяти ключ удаляется только после записи. Если WAL отказал, ключ
+// остается, а ошибка возвращается записи, для которой освобождалась память
+func (s *SimpleStorage) onEvict(key string) error {
+	if s.wal == nil || s.writable() != nil {
+		if err := s.engine.Delete(key); err != nil {
 			return err
 		}
+	} else {
+		_, err := s.run(context.Background(), []string{key}, nil, func(tx Operations) error {
+			return tx.Delete(key)
+		}, 0, make(chan struct{}))
+		if err != nil {
+			if !errors.Is(err, engine.ErrKeyNotFound) {
+				s.logger.Error("Failed to write eviction to WAL",
+					zap.String("key", key),
+					zap.Error(err),
+				)
+			}
+			return err
+		}
+	}
+
+	s.logger.Info("Key evicted from storage",
+		zap.String("key", key),
+	)
+	return nil
+}
+
+// Set сохраняет пару ключ-значение
+func (s *SimpleStorage) Set(key, value string) error {
+	return s.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx сохраняет пару ключ-значение. Если ctx завершится раньше подтверждения записи WAL,
+// возвращается ErrWriteUnconfirmed, а запись завершается в фоне (см. commit).
+// Запись выполняется как транзакция над одним ключом: LSN назначается под блокировкой
+// партиции ключа вместе с INCR, SETNX и другими атомарными операциями, поэтому порядок
+// записей в WAL совпадает с порядком их применения к движку
+func (s *SimpleStorage) SetCtx(ctx context.Context, key, value string) error {
+	// Реплика не должна вытеснять ключи под запись, которую все равно отклонит
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if err := s.reserveMemory(key, value); err != nil {
+		return err
 	}
 
-	// Затем записываем в движок
-	err := s.engine.Set(key, value)
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		return tx.Set(key, value)
+	})
 	if err != nil {
-		s.logger.Error("Failed to set value in storage",
-			zap.String("key", key),
-			zap.Error(err),
-		)
 		return err
 	}
 
@@ -259,12 +545,20 @@ func (s *SimpleStorage) Set(key, value string) error {
 		zap.String("key", key),
 		zap.Int("value_length", len(value)),
 	)
-
 	return nil
 }
 
 // Get получает значение по ключу
 func (s *SimpleStorage) Get(key string) (string, error) {
+	return s.GetCtx(context.Background(), key)
+}
+
+// GetCtx получает значение по ключу, если ctx еще не завершен
+func (s *SimpleStorage) GetCtx(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	value, err := s.engine.Get(key)
 	if err != nil {
 		if errors.Is(err, engine.ErrKeyNotFound) {
@@ -289,49 +583,156 @@ func (s *SimpleStorage) Get(key string) (string, error) {
 
 // Delete удаляет пару ключ-значение
 func (s *SimpleStorage) Delete(key string) error {
-	// Проверка, что это мастер (писать можно только в мастер)
-	if !s.isMaster {
-		return errors.New("write operations not allowed on slave replica")
+	return s.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx удаляет пару ключ-значение. Запись и отмена ctx обрабатываются так же, как в SetCtx
+func (s *SimpleStorage) DeleteCtx(ctx context.Context, key string) error {
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		return tx.Delete(key)
+	})
+	if err != nil {
+		return err
 	}
 
-	// Если WAL включен, сначала записываем в WAL
-	if s.wal != nil {
-		// Ждем подтверждения записи в WAL
-		done := s.wal.Del(key)
+	s.logger.Info("Key deleted from storage",
+		zap.String("key", key),
+	)
+	return nil
+}
 
-		// Ждем завершения операции WAL
-		if err := <-done; err != nil {
-			s.logger.Error("Failed to write to WAL",
-				zap.String("operation", "DEL"),
-				zap.String("key", key),
-				zap.Error(err),
-			)
-			return err
-		}
+// SetWithTTL сохраняет пару ключ-значение, которая истечет через ttl
+func (s *SimpleStorage) SetWithTTL(key, value string, ttl time.Duration) error {
+	return s.SetWithTTLCtx(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLCtx сохраняет пару ключ-значение со сроком жизни. Запись и отмена ctx
+// обрабатываются так же, как в SetCtx
+func (s *SimpleStorage) SetWithTTLCtx(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if err := s.reserveMemory(key, value); err != nil {
+		return err
 	}
 
-	// Затем удаляем из движка
-	err := s.engine.Delete(key)
+	// Срок переводится в абсолютный в транзакции, чтобы повтор WAL не продлевал жизнь ключа
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		return tx.SetWithTTL(key, value, ttl)
+	})
 	if err != nil {
-		s.logger.Error("Failed to delete key from storage",
-			zap.String("key", key),
-			zap.Error(err),
-		)
 		return err
 	}
 
-	s.logger.Info("Key deleted from storage",
+	s.logger.Info("Value with TTL set in storage",
+		zap.String("key", key),
+		zap.Int("value_length", len(value)),
+		zap.Duration("ttl", ttl),
+	)
+	return nil
+}
+
+// Expire устанавливает время жизни существующего ключа
+func (s *SimpleStorage) Expire(key string, ttl time.Duration) error {
+	return s.ExpireCtx(context.Background(), key, ttl)
+}
+
+// ExpireCtx устанавливает время жизни существующего ключа. Запись и отмена ctx
+// обрабатываются так же, как в SetCtx
+func (s *SimpleStorage) ExpireCtx(ctx context.Context, key string, ttl time.Duration) error {
+	// Операции над отсутствующими ключами не пишутся в WAL: транзакция возвращает ErrKeyNotFound
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		return tx.Expire(key, ttl)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Key expiration set",
 		zap.String("key", key),
+		zap.Duration("ttl", ttl),
 	)
+	return nil
+}
+
+// TTL возвращает оставшееся время жизни ключа
+func (s *SimpleStorage) TTL(key string) (time.Duration, error) {
+	return s.engine.TTL(key)
+}
+
+// Persist снимает срок жизни с ключа
+func (s *SimpleStorage) Persist(key string) error {
+	return s.PersistCtx(context.Background(), key)
+}
 
+// PersistCtx снимает срок жизни с ключа. Запись и отмена ctx обрабатываются так же, как в SetCtx
+func (s *SimpleStorage) PersistCtx(ctx context.Context, key string) error {
+	// Без срока жизни писать в WAL нечего: транзакция возвращает ErrNoExpiration
+	err := s.AtomicCtx(ctx, []string{key}, nil, func(tx Operations) error {
+		return tx.Persist(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Key expiration removed",
+		zap.String("key", key),
+	)
 	return nil
 }
 
+// Range возвращает пары с ключами из полуинтервала [start, end) в порядке сортировки
+func (s *SimpleStorage) Range(start, end string, limit int) ([]engine.KeyValue, error) {
+	ordered, ok := s.engine.(engine.OrderedEngine)
+	if !ok {
+		return nil, ErrOrderedScanNotSupported
+	}
+	return ordered.Range(start, end, limit)
+}
+
+// Prefix возвращает пары с ключами, начинающимися с prefix, в порядке сортировки
+func (s *SimpleStorage) Prefix(prefix string) ([]engine.KeyValue, error) {
+	ordered, ok := s.engine.(engine.OrderedEngine)
+	if !ok {
+		return nil, ErrOrderedScanNotSupported
+	}
+	return ordered.Prefix(prefix)
+}
+
+// Scan выполняет один шаг обхода ключей, подходящих под glob-шаблон
+func (s *SimpleStorage) Scan(cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	return s.engine.Scan(cursor, count, pattern)
+}
+
+// Keys возвращает все ключи, подходящие под glob-шаблон. Обход идет шагами,
+// поэтому партиции не блокируются на все время выполнения
+func (s *SimpleStorage) Keys(pattern string) ([]string, error) {
+	keys := []string{}
+	var cursor uint64
+	for {
+		batch, next, err := s.engine.Scan(cursor, keysScanBatch, pattern)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
 // Close закрывает хранилище
 func (s *SimpleStorage) Close() error {
 	// Отменяем контекст для остановки всех фоновых горутин
 	s.cancel()
 
+	// Узел raft пишет в WAL из своих горутин, поэтому останавливается раньше WAL
+	if s.raft != nil {
+		s.closeReplication()
+	}
+
 	// Закрываем WAL, если он включен
 	if s.wal != nil {
 		if err := s.wal.Close(); err != nil {
@@ -340,11 +741,18 @@ func (s *SimpleStorage) Close() error {
 	}
 
 	// Закрываем репликацию, если она включена
+	s.closeReplication()
+	return nil
+}
+
+// closeReplication останавливает репликацию, если она запущена
+func (s *SimpleStorage) closeReplication() {
+	s.replicationMutex.Lock()
+	defer s.replicationMutex.Unlock()
 	if s.replication != nil {
 		if err := s.replication.Close(); err != nil {
 			s.logger.Error("Failed to close replication", zap.Error(err))
 		}
+		s.replication = nil
 	}
-
-	return nil
 }
@@ -2,16 +2,26 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/replication"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/snapshot"
 	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
 	"github.com/keij-sama/Concurrency/pkg/logger"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestStorageWithWAL(t *testing.T) {
@@ -166,3 +176,1548 @@ func TestStorageWithoutWAL(t *testing.T) {
 		t.Fatalf("Failed to close storage: %v", err)
 	}
 }
+
+func TestStorageExpirationRecovery(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "storage_ttl_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1024,
+		DataDirectory:        tempDir,
+	}
+
+	zapLogger, _ := zap.NewDevelopment()
+	customLogger := logger.NewLoggerWithZap(zapLogger)
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	// Ключ с коротким сроком жизни, ключ с длинным сроком и ключ, с которого срок снят
+	if err := storage.SetWithTTL("short", "value", 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to set value with TTL: %v", err)
+	}
+	if err := storage.SetWithTTL("long", "value", time.Hour); err != nil {
+		t.Fatalf("Failed to set value with TTL: %v", err)
+	}
+	if err := storage.Set("persisted", "value"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := storage.Expire("persisted", 50*time.Millisecond); err != nil {
+		t.Fatalf("Failed to expire key: %v", err)
+	}
+	if err := storage.Persist("persisted"); err != nil {
+		t.Fatalf("Failed to persist key: %v", err)
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	// Ждем истечения короткого срока, после чего восстанавливаемся из WAL
+	time.Sleep(100 * time.Millisecond)
+
+	newStorage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create new storage: %v", err)
+	}
+	defer newStorage.Close()
+
+	if _, err := newStorage.Get("short"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Expected expired key to stay deleted after recovery, got %v", err)
+	}
+
+	ttl, err := newStorage.TTL("long")
+	if err != nil {
+		t.Fatalf("Failed to get TTL after recovery: %v", err)
+	}
+	if ttl <= 59*time.Minute {
+		t.Errorf("Expected recovered TTL to keep the original deadline, got %v", ttl)
+	}
+
+	if _, err := newStorage.TTL("persisted"); !errors.Is(err, engine.ErrNoExpiration) {
+		t.Errorf("Expected persisted key to have no expiration, got %v", err)
+	}
+}
+
+func TestStorageEvictionIsLogged(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "storage_eviction_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+	}
+
+	zapLogger, _ := zap.NewDevelopment()
+	customLogger := logger.NewLoggerWithZap(zapLogger)
+
+	// Лимит примерно на 10 ключей
+	newEngine := func() engine.Engine {
+		return engine.NewInMemoryEngine(
+			engine.WithMaxMemory(10*100),
+			engine.WithEvictionPolicy(engine.PolicyAllKeysLRU),
+		)
+	}
+
+	storage, err := NewStorage(newEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	for i := 0; i < 30; i++ {
+		if err := storage.Set(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+
+	before, err := storage.Keys("*")
+	if err != nil {
+		t.Fatalf("Failed to list keys: %v", err)
+	}
+	if len(before) >= 30 {
+		t.Fatalf("Expected some keys to be evicted, got %d keys", len(before))
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	// Восстановление без лимита памяти должно дать тот же набор ключей
+	recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create new storage: %v", err)
+	}
+	defer recovered.Close()
+
+	after, err := recovered.Keys("*")
+	if err != nil {
+		t.Fatalf("Failed to list keys: %v", err)
+	}
+	sort.Strings(before)
+	sort.Strings(after)
+	if strings.Join(before, ",") != strings.Join(after, ",") {
+		t.Errorf("Recovered keys differ from master keys:\n before: %v\n after:  %v", before, after)
+	}
+}
+
+func TestStorageAtomic(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "storage_atomic_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+	}
+
+	zapLogger, _ := zap.NewDevelopment()
+	customLogger := logger.NewLoggerWithZap(zapLogger)
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	storage.Set("balance:a", "100")
+	storage.Set("stale", "value")
+
+	// Транзакция видит собственные изменения и записывается одной записью BATCH
+	err = storage.Atomic([]string{"balance:a", "balance:b", "stale", "missing"}, nil, func(tx Operations) error {
+		tx.Set("balance:a", "70")
+		tx.SetWithTTL("balance:b", "30", time.Hour)
+		if value, err := tx.Get("balance:b"); err != nil || value != "30" {
+			t.Errorf("Get() inside transaction = %q, %v", value, err)
+		}
+		if err := tx.Delete("missing"); !errors.Is(err, engine.ErrKeyNotFound) {
+			t.Errorf("Delete() of missing key error = %v, want ErrKeyNotFound", err)
+		}
+		return tx.Delete("stale")
+	})
+	if err != nil {
+		t.Fatalf("Atomic() error: %v", err)
+	}
+
+	// Изменение отслеживаемого ключа отменяет транзакцию
+	version := storage.Version("balance:a")
+	storage.Set("balance:a", "0")
+	err = storage.Atomic([]string{"balance:b"}, map[string]uint64{"balance:a": version}, func(tx Operations) error {
+		return tx.Set("balance:b", "1000")
+	})
+	if !errors.Is(err, ErrWatchConflict) {
+		t.Fatalf("Atomic() after watched key changed error = %v, want ErrWatchConflict", err)
+	}
+	storage.Set("balance:a", "70")
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	// В WAL транзакция записана одной записью
+	reader, err := wal.NewWAL(*walConfig, customLogger)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	logs, err := reader.Recover()
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	batches := 0
+	for _, log := range logs {
+		if log.Operation == wal.OperationBatch {
+			batches++
+		}
+	}
+	if batches != 1 {
+		t.Errorf("Expected 1 BATCH record in WAL, got %d", batches)
+	}
+
+	recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create new storage: %v", err)
+	}
+	defer recovered.Close()
+
+	for key, want := range map[string]string{"balance:a": "70", "balance:b": "30"} {
+		if value, err := recovered.Get(key); err != nil || value != want {
+			t.Errorf("Get(%s) after recovery = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	if _, err := recovered.TTL("balance:b"); err != nil {
+		t.Errorf("Expected balance:b to keep its TTL, got %v", err)
+	}
+	if _, err := recovered.Get("stale"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Expected stale to stay deleted, got %v", err)
+	}
+}
+
+func TestStorageAtomicOperations(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "storage_atomic_ops_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    100,
+		FlushingBatchTimeout: 5 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+	}
+
+	zapLogger, _ := zap.NewDevelopment()
+	customLogger := logger.NewLoggerWithZap(zapLogger)
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	// Параллельные инкременты не теряют обновлений
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := storage.IncrBy("counter", 2); err != nil {
+				t.Errorf("IncrBy() error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := storage.IncrBy("counter", -1); err != nil || n != 99 {
+		t.Errorf("IncrBy(-1) = %d, %v, want 99", n, err)
+	}
+
+	storage.Set("text", "abc")
+	if _, err := storage.IncrBy("text", 1); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("IncrBy() of non-integer error = %v, want ErrNotInteger", err)
+	}
+	storage.Set("max", "9223372036854775807")
+	if _, err := storage.IncrBy("max", 1); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("IncrBy() overflow error = %v, want ErrNotInteger", err)
+	}
+
+	if ok, _ := storage.SetNX("lock", "owner1"); !ok {
+		t.Errorf("SetNX() of missing key = false, want true")
+	}
+	if ok, _ := storage.SetNX("lock", "owner2"); ok {
+		t.Errorf("SetNX() of existing key = true, want false")
+	}
+	storage.Expire("lock", time.Hour)
+	if ok, _ := storage.CompareAndSwap("lock", "owner2", "owner3"); ok {
+		t.Errorf("CompareAndSwap() with wrong expected value = true, want false")
+	}
+	if ok, _ := storage.CompareAndSwap("lock", "owner1", "owner3"); !ok {
+		t.Errorf("CompareAndSwap() with matching value = false, want true")
+	}
+
+	if old, existed, _ := storage.GetSet("name", "first"); existed {
+		t.Errorf("GetSet() of missing key returned %q", old)
+	}
+	if old, existed, _ := storage.GetSet("name", "second"); !existed || old != "first" {
+		t.Errorf("GetSet() = %q, %v, want %q", old, existed, "first")
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	// В WAL попадают только итоговые значения
+	reader, err := wal.NewWAL(*walConfig, customLogger)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	logs, err := reader.Recover()
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	for _, log := range logs {
+		if log.Operation != wal.OperationSet && log.Operation != wal.OperationExpire {
+			t.Errorf("Unexpected %s record in WAL", log.Operation)
+		}
+	}
+
+	recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create new storage: %v", err)
+	}
+	defer recovered.Close()
+
+	for key, want := range map[string]string{"counter": "99", "lock": "owner3", "name": "second"} {
+		if value, err := recovered.Get(key); err != nil || value != want {
+			t.Errorf("Get(%s) after recovery = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	// CAS сохраняет срок жизни блокировки
+	if _, err := recovered.TTL("lock"); err != nil {
+		t.Errorf("Expected lock to keep its TTL, got %v", err)
+	}
+}
+
+func TestStorageSetAndIncrOrder(t *testing.T) {
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    100,
+		FlushingBatchTimeout: time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        t.TempDir(),
+	}
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	// SET и INCR над одними ключами идут параллельно: порядок их записей в WAL
+	// должен совпасть с порядком применения, иначе повтор лога даст другое значение
+	keys := []string{"a", "b", "c", "d"}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := keys[j%len(keys)]
+				if (i+j)%2 == 0 {
+					if err := storage.Set(key, strconv.Itoa(j)); err != nil {
+						t.Errorf("Set() error: %v", err)
+						return
+					}
+				} else if _, err := storage.IncrBy(key, 1); err != nil {
+					t.Errorf("IncrBy() error: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	live := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := storage.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%s) error: %v", key, err)
+		}
+		live[key] = value
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to recover storage: %v", err)
+	}
+	defer recovered.Close()
+
+	for key, want := range live {
+		if value, err := recovered.Get(key); err != nil || value != want {
+			t.Errorf("Get(%s) after WAL replay = %q, %v, live value was %q", key, value, err, want)
+		}
+	}
+}
+
+func TestStorageAtomicMemoryLimit(t *testing.T) {
+	// Лимит вмещает одну запись и короткое число, но не самое длинное
+	value := strings.Repeat("v", 100)
+	eng := engine.NewInMemoryEngine(
+		engine.WithMaxMemory(int64(len("big")+len(value)+64)+int64(len("n")+len("1")+64)),
+		engine.WithEvictionPolicy(engine.PolicyNoEviction),
+	)
+
+	storage, err := NewStorage(eng, logger.NewLoggerWithZap(zap.NewNop()), StorageOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+
+	if err := storage.Set("big", value); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+
+	// Как и SET, INCR нового ключа отклоняется до записи, если под результат нет памяти
+	if _, err := storage.IncrBy("n", 1); !errors.Is(err, engine.ErrOutOfMemory) {
+		t.Fatalf("IncrBy() error = %v, want ErrOutOfMemory", err)
+	}
+	if _, err := storage.Get("n"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Expected rejected INCR to leave no key, got %v", err)
+	}
+
+	// После освобождения памяти INCR проходит
+	if err := storage.Delete("big"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+	if n, err := storage.IncrBy("n", 1); err != nil || n != 1 {
+		t.Errorf("IncrBy() = %d, %v, want 1", n, err)
+	}
+
+	// Записи транзакции, как у EXEC, тоже не выходят за лимит
+	err = storage.Atomic([]string{"big"}, nil, func(tx Operations) error {
+		return tx.Set("big", value+"v")
+	})
+	if !errors.Is(err, engine.ErrOutOfMemory) {
+		t.Fatalf("Atomic() error = %v, want ErrOutOfMemory", err)
+	}
+	if _, err := storage.Get("big"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Expected rejected transaction to leave no key, got %v", err)
+	}
+
+	// С политикой вытеснения транзакция освобождает память и выполняется
+	lru := engine.NewInMemoryEngine(
+		engine.WithMaxMemory(eng.(engine.Evictor).MaxMemory()),
+		engine.WithEvictionPolicy(engine.PolicyAllKeysLRU),
+	)
+	evicting, err := NewStorage(lru, logger.NewLoggerWithZap(zap.NewNop()), StorageOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer evicting.Close()
+
+	if err := evicting.Set("big", value); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	err = evicting.Atomic([]string{"other"}, nil, func(tx Operations) error {
+		return tx.Set("other", value+"v")
+	})
+	if err != nil {
+		t.Fatalf("Atomic() error: %v", err)
+	}
+	if _, err := evicting.Get("big"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Expected big to be evicted, got %v", err)
+	}
+	if used, limit := lru.(engine.Evictor).UsedMemory(), lru.(engine.Evictor).MaxMemory(); used > limit {
+		t.Errorf("UsedMemory() = %d, exceeds limit %d", used, limit)
+	}
+}
+
+func TestStorageAtomicHidesUnconfirmedWrites(t *testing.T) {
+	// Батч записывается на диск только по таймауту
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    100,
+		FlushingBatchTimeout: 300 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        t.TempDir(),
+	}
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), logger.NewLoggerWithZap(zap.NewNop()), StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+	s := storage.(*SimpleStorage)
+
+	lsn := s.wal.NextLSN()
+	committed := make(chan error, 1)
+	go func() {
+		committed <- storage.MSet([]engine.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}})
+	}()
+	for s.wal.Stats().Pending == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Изменения транзакции видны только после записи в WAL
+	value, err := storage.Get("a")
+	if err != nil || value != "1" {
+		t.Fatalf("Get(a) = %q, %v, want 1", value, err)
+	}
+	if written := s.wal.WrittenLSN(); written <= lsn {
+		t.Errorf("Transaction became visible before WAL write: written LSN %d, transaction LSN %d", written, lsn)
+	}
+
+	if err := <-committed; err != nil {
+		t.Fatalf("MSet() error: %v", err)
+	}
+}
+
+func TestStorageMultiKey(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "storage_multikey_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+	}
+
+	zapLogger, _ := zap.NewDevelopment()
+	customLogger := logger.NewLoggerWithZap(zapLogger)
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	pairs := make([]engine.KeyValue, 0, 100)
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, engine.KeyValue{Key: fmt.Sprintf("key%d", i), Value: fmt.Sprintf("value%d", i)})
+	}
+	if err := storage.MSet(pairs); err != nil {
+		t.Fatalf("MSet() error: %v", err)
+	}
+
+	values, err := storage.MGet([]string{"key0", "missing", "key99"})
+	if err != nil {
+		t.Fatalf("MGet() error: %v", err)
+	}
+	if len(values) != 2 || values["key0"] != "value0" || values["key99"] != "value99" {
+		t.Errorf("MGet() = %v", values)
+	}
+
+	if deleted, err := storage.MDelete([]string{"key0", "key1", "missing"}); err != nil || deleted != 2 {
+		t.Errorf("MDelete() = %d, %v, want 2", deleted, err)
+	}
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	// Каждая операция над несколькими ключами записана в WAL одной записью
+	reader, err := wal.NewWAL(*walConfig, customLogger)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	logs, err := reader.Recover()
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	if len(logs) != 2 || logs[0].Operation != wal.OperationBatch || logs[1].Operation != wal.OperationBatch {
+		t.Fatalf("Expected 2 BATCH records in WAL, got %+v", logs)
+	}
+
+	recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create new storage: %v", err)
+	}
+	defer recovered.Close()
+
+	values, _ = recovered.MGet([]string{"key0", "key1", "key2", "key99"})
+	if len(values) != 2 || values["key2"] != "value2" || values["key99"] != "value99" {
+		t.Errorf("MGet() after recovery = %v", values)
+	}
+}
+
+func TestStorageSnapshot(t *testing.T) {
+	tempDir := t.TempDir()
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       256, // несколько сегментов для проверки сжатия
+		DataDirectory:        tempDir,
+	}
+	options := StorageOptions{
+		WALConfig:      walConfig,
+		SnapshotConfig: &snapshot.Config{Enabled: true},
+	}
+
+	zapLogger, _ := zap.NewDevelopment()
+	customLogger := logger.NewLoggerWithZap(zapLogger)
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, options)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	for i := 0; i < 30; i++ {
+		if err := storage.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Failed to set value: %v", err)
+		}
+	}
+	if err := storage.SetWithTTL("ttl", "value", time.Hour); err != nil {
+		t.Fatalf("Failed to set value with TTL: %v", err)
+	}
+
+	before, _ := filepath.Glob(filepath.Join(tempDir, "wal_*.log"))
+	lsn, err := storage.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error: %v", err)
+	}
+	if lsn != 30 {
+		t.Errorf("Expected snapshot LSN 30, got %d", lsn)
+	}
+
+	// Все сегменты, кроме текущего, покрыты снимком
+	after, _ := filepath.Glob(filepath.Join(tempDir, "wal_*.log"))
+	if len(before) < 2 || len(after) != 1 {
+		t.Errorf("Expected WAL to be compacted to 1 segment, had %d, left %d", len(before), len(after))
+	}
+
+	// Записи после снимка повторяются из WAL
+	if err := storage.Set("after", "snapshot"); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if err := storage.Delete("key0"); err != nil {
+		t.Fatalf("Failed to delete value: %v", err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	check := func(s Storage) {
+		t.Helper()
+		for key, expected := range map[string]string{"key1": "value1", "key29": "value29", "ttl": "value", "after": "snapshot"} {
+			if value, err := s.Get(key); err != nil || value != expected {
+				t.Errorf("Get(%s) = %q, %v, want %q", key, value, err, expected)
+			}
+		}
+		if _, err := s.Get("key0"); !errors.Is(err, engine.ErrKeyNotFound) {
+			t.Errorf("Expected key0 to remain deleted, got %v", err)
+		}
+		if ttl, err := s.TTL("ttl"); err != nil || ttl <= 0 {
+			t.Errorf("Expected TTL to survive snapshot, got %v, %v", ttl, err)
+		}
+	}
+
+	recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, options)
+	if err != nil {
+		t.Fatalf("Failed to create new storage: %v", err)
+	}
+	check(recovered)
+
+	// LSN продолжается после снимка, хотя покрытые сегменты удалены
+	second, err := recovered.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error: %v", err)
+	}
+	if second != lsn+2 {
+		t.Errorf("Expected second snapshot LSN %d, got %d", lsn+2, second)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	// Поврежденный последний снимок пропускается, данные восстанавливаются из предыдущего и WAL
+	latest := filepath.Join(tempDir, snapshot.FileName(second))
+	if err := os.WriteFile(latest, []byte("garbage"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt snapshot: %v", err)
+	}
+
+	fallback, err := NewStorage(engine.NewInMemoryEngine(), customLogger, options)
+	if err != nil {
+		t.Fatalf("Failed to create storage from previous snapshot: %v", err)
+	}
+	defer fallback.Close()
+	check(fallback)
+}
+
+func TestStorageSnapshotDisabled(t *testing.T) {
+	storage, err := NewStorage(engine.NewInMemoryEngine(), logger.NewLoggerWithZap(zap.NewNop()), StorageOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+
+	if _, err := storage.Snapshot(); !errors.Is(err, ErrSnapshotsDisabled) {
+		t.Errorf("Expected ErrSnapshotsDisabled, got %v", err)
+	}
+}
+
+func TestStoragePointInTimeRecovery(t *testing.T) {
+	tempDir := t.TempDir()
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: time.Millisecond,
+		DataDirectory:        tempDir,
+	}
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage.Set("a", "1") // LSN 0
+	storage.Set("b", "2") // LSN 1
+	time.Sleep(5 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	storage.Delete("a")   // LSN 2, ошибочное удаление
+	storage.Set("c", "3") // LSN 3
+	storage.Close()
+
+	// Содержимое директории WAL до восстановления
+	snapshotDir := func() map[string]int64 {
+		entries, _ := os.ReadDir(tempDir)
+		files := make(map[string]int64, len(entries))
+		for _, entry := range entries {
+			info, _ := entry.Info()
+			files[entry.Name()] = info.Size()
+		}
+		return files
+	}
+	before := snapshotDir()
+
+	for _, target := range []*RecoveryTarget{{LSN: 1}, {Time: beforeDelete}} {
+		t.Run(target.String(), func(t *testing.T) {
+			recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+				WALConfig:      walConfig,
+				RecoveryTarget: target,
+			})
+			if err != nil {
+				t.Fatalf("Failed to recover to %s: %v", target, err)
+			}
+			defer recovered.Close()
+
+			if value, err := recovered.Get("a"); err != nil || value != "1" {
+				t.Errorf("Get(a) = %q, %v, want 1", value, err)
+			}
+			if _, err := recovered.Get("c"); !errors.Is(err, engine.ErrKeyNotFound) {
+				t.Errorf("Expected c to be absent before the target, got %v", err)
+			}
+
+			// Восстановленное хранилище работает только на чтение
+			if err := recovered.Set("d", "4"); !errors.Is(err, ErrPointInTimeRecovery) {
+				t.Errorf("Set() error = %v, want ErrPointInTimeRecovery", err)
+			}
+			if _, err := recovered.IncrBy("n", 1); !errors.Is(err, ErrPointInTimeRecovery) {
+				t.Errorf("IncrBy() error = %v, want ErrPointInTimeRecovery", err)
+			}
+		})
+	}
+
+	// Файлы WAL не изменились
+	if after := snapshotDir(); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("WAL directory changed during point-in-time recovery: %v, was %v", after, before)
+	}
+
+	// Точка за концом WAL - ошибка
+	_, err = NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig:      walConfig,
+		RecoveryTarget: &RecoveryTarget{LSN: 100},
+	})
+	if !errors.Is(err, ErrRecoveryTargetUnavailable) {
+		t.Errorf("Expected ErrRecoveryTargetUnavailable, got %v", err)
+	}
+}
+
+// dumpHookEngine вызывает beforeDump перед обходом ключей для снимка
+type dumpHookEngine struct {
+	engine.Engine
+	beforeDump func()
+}
+
+func (e *dumpHookEngine) Dump(fn func(key, value string, expiresAt time.Time) error) error {
+	if e.beforeDump != nil {
+		e.beforeDump()
+	}
+	return e.Engine.Dump(fn)
+}
+
+func TestStoragePointInTimeRecoveryFuzzySnapshot(t *testing.T) {
+	tempDir := t.TempDir()
+	options := StorageOptions{
+		WALConfig:      newWALConfig(tempDir),
+		SnapshotConfig: &snapshot.Config{Enabled: true},
+	}
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	eng := &dumpHookEngine{Engine: engine.NewInMemoryEngine()}
+	storage, err := NewStorage(eng, customLogger, options)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	storage.Set("a", "1") // LSN 0
+	storage.Set("b", "2") // LSN 1
+	if lsn, err := storage.Snapshot(); err != nil || lsn != 1 {
+		t.Fatalf("Snapshot() = %d, %v, want 1", lsn, err)
+	}
+	storage.Set("c", "3") // LSN 2
+
+	// Ошибочное удаление с LSN 3 попадает в снимок с LSN 2, пока он записывается
+	eng.beforeDump = func() {
+		if err := storage.Delete("a"); err != nil {
+			t.Errorf("Delete() during snapshot error: %v", err)
+		}
+	}
+	if lsn, err := storage.Snapshot(); err != nil || lsn != 2 {
+		t.Fatalf("Snapshot() = %d, %v, want 2", lsn, err)
+	}
+	storage.Close()
+
+	recover := func(lsn uint64) Storage {
+		t.Helper()
+		options := options
+		options.RecoveryTarget = &RecoveryTarget{LSN: lsn}
+		recovered, err := NewStorage(engine.NewInMemoryEngine(), customLogger, options)
+		if err != nil {
+			t.Fatalf("Failed to recover to lsn %d: %v", lsn, err)
+		}
+		t.Cleanup(func() { recovered.Close() })
+		return recovered
+	}
+
+	// Точка перед удалением: снимок с LSN 2 новее нее, используется предыдущий и WAL
+	beforeDelete := recover(2)
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if value, err := beforeDelete.Get(key); err != nil || value != want {
+			t.Errorf("Get(%s) before delete = %q, %v, want %q", key, value, err, want)
+		}
+	}
+
+	// С точки удаления снимок уже подходит
+	afterDelete := recover(3)
+	if _, err := afterDelete.Get("a"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Get(a) after delete error = %v, want ErrKeyNotFound", err)
+	}
+	if value, err := afterDelete.Get("c"); err != nil || value != "3" {
+		t.Errorf("Get(c) after delete = %q, %v, want 3", value, err)
+	}
+}
+
+func TestStorageReportsDurability(t *testing.T) {
+	tests := []struct {
+		name  string
+		fsync wal.FsyncPolicy
+		want  wal.Durability
+	}{
+		{name: "without WAL", want: wal.DurabilityNone},
+		{name: "fsync never", fsync: wal.FsyncNever, want: wal.DurabilityOS},
+		{name: "fsync batch", fsync: wal.FsyncBatch, want: wal.DurabilityFsync},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.InfoLevel)
+			options := StorageOptions{}
+			if tt.fsync != "" {
+				config := newWALConfig(t.TempDir())
+				config.Fsync = tt.fsync
+				options.WALConfig = config
+			}
+
+			storage, err := NewStorage(engine.NewInMemoryEngine(), logger.NewLoggerWithZap(zap.New(core)), options)
+			if err != nil {
+				t.Fatalf("Failed to create storage: %v", err)
+			}
+			defer storage.Close()
+
+			if err := storage.Set("a", "1"); err != nil {
+				t.Fatalf("Set() error: %v", err)
+			}
+			if err := storage.SetWithTTL("b", "2", time.Hour); err != nil {
+				t.Fatalf("SetWithTTL() error: %v", err)
+			}
+			if err := storage.MSet([]engine.KeyValue{{Key: "c", Value: "3"}, {Key: "d", Value: "4"}}); err != nil {
+				t.Fatalf("MSet() error: %v", err)
+			}
+
+			// Гарантия указывается для каждой подтвержденной записи
+			reported := 0
+			for _, entry := range logs.All() {
+				durability, ok := entry.ContextMap()["durability"]
+				if !ok {
+					continue
+				}
+				reported++
+				if durability != string(tt.want) {
+					t.Errorf("%q reported durability %v, want %s", entry.Message, durability, tt.want)
+				}
+			}
+			if reported != 3 {
+				t.Errorf("Durability reported for %d writes, want 3", reported)
+			}
+		})
+	}
+}
+
+func TestStorageContextCancellation(t *testing.T) {
+	// Батч не заполняется и записывается только по таймауту, запись ждет его дольше дедлайна
+	walConfig := &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    100,
+		FlushingBatchTimeout: 200 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        t.TempDir(),
+	}
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	storage, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{WALConfig: walConfig})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+
+	// Отмененный запрос не попадает в WAL
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := storage.SetCtx(cancelled, "rejected", "value"); !errors.Is(err, context.Canceled) || errors.Is(err, wal.ErrWALOverloaded) {
+		t.Errorf("SetCtx() with cancelled context error = %v, want context.Canceled", err)
+	}
+	if _, err := storage.IncrByCtx(cancelled, "rejected", 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("IncrByCtx() with cancelled context error = %v, want context.Canceled", err)
+	}
+	if err := storage.MSetCtx(cancelled, []engine.KeyValue{{Key: "rejected", Value: "value"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("MSetCtx() with cancelled context error = %v, want context.Canceled", err)
+	}
+	if _, err := storage.GetCtx(cancelled, "rejected"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetCtx() with cancelled context error = %v, want context.Canceled", err)
+	}
+
+	// Дедлайн истекает после приема записи: ответ возвращается сразу, запись завершается в фоне
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := storage.SetCtx(ctx, "key", "value"); !errors.Is(err, ErrWriteUnconfirmed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetCtx() past deadline error = %v, want ErrWriteUnconfirmed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("SetCtx() returned after %v, should not wait for WAL past the deadline", elapsed)
+	}
+
+	// Следующая запись ждет подтверждения вместе с предыдущей
+	if err := storage.DeleteCtx(context.Background(), "other"); err != nil && !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Fatalf("DeleteCtx() error: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if value, err := storage.Get("key"); err == nil && value == "value" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Write cancelled by deadline was not applied in background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := storage.Get("rejected"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Rejected write was applied: %v", err)
+	}
+
+	// Остальные записи тоже не ждут WAL дольше дедлайна
+	if err := storage.SetWithTTL("persisted", "value", time.Hour); err != nil {
+		t.Fatalf("SetWithTTL() error: %v", err)
+	}
+	writes := []struct {
+		name  string
+		write func(ctx context.Context) error
+	}{
+		{"SetWithTTLCtx", func(ctx context.Context) error {
+			return storage.SetWithTTLCtx(ctx, "ttl", "value", time.Hour)
+		}},
+		{"ExpireCtx", func(ctx context.Context) error {
+			return storage.ExpireCtx(ctx, "key", time.Hour)
+		}},
+		{"PersistCtx", func(ctx context.Context) error {
+			return storage.PersistCtx(ctx, "persisted")
+		}},
+		{"AtomicCtx", func(ctx context.Context) error {
+			return storage.AtomicCtx(ctx, []string{"a", "b"}, nil, func(tx Operations) error {
+				return tx.MSet([]engine.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}})
+			})
+		}},
+	}
+	for _, tt := range writes {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		if err := tt.write(ctx); !errors.Is(err, ErrWriteUnconfirmed) {
+			t.Errorf("%s() past deadline error = %v, want ErrWriteUnconfirmed", tt.name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Errorf("%s() returned after %v, should not wait for WAL past the deadline", tt.name, elapsed)
+		}
+		cancel()
+	}
+
+	// Записи завершаются в фоне
+	deadline = time.Now().Add(time.Second)
+	for {
+		_, ttlErr := storage.TTL("key")
+		_, persistErr := storage.TTL("persisted")
+		value, getErr := storage.Get("ttl")
+		if ttlErr == nil && errors.Is(persistErr, engine.ErrNoExpiration) && getErr == nil && value == "value" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Writes cancelled by deadline were not applied in background: %v, %v, %v", ttlErr, persistErr, getErr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// freeAddress возвращает адрес со свободным портом для сервера репликации
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// newWALConfig возвращает конфигурацию WAL для тестов репликации
+func newWALConfig(dir string) *wal.WALConfig {
+	return &wal.WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 5 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        dir,
+	}
+}
+
+// waitValue ждет, пока значение ключа на реплике станет равным want
+func waitValue(t *testing.T, s Storage, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if value, err := s.Get(key); err == nil && value == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica did not receive %s=%s", key, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStorageReplication(t *testing.T) {
+	address := freeAddress(t)
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	master, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig: newWALConfig(t.TempDir()),
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeMaster,
+			MasterAddress: address,
+			SyncInterval:  time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create master: %v", err)
+	}
+	defer master.Close()
+
+	master.Set("a", "1")
+	master.Set("b", "2")
+
+	slaveDir := t.TempDir()
+	slaveOptions := StorageOptions{
+		WALConfig: newWALConfig(slaveDir),
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeSlave,
+			MasterAddress: address,
+			SyncInterval:  20 * time.Millisecond,
+		},
+	}
+	slave, err := NewStorage(engine.NewInMemoryEngine(), customLogger, slaveOptions)
+	if err != nil {
+		t.Fatalf("Failed to create slave: %v", err)
+	}
+
+	waitValue(t, slave, "b", "2")
+
+	if err := slave.Set("c", "3"); !errors.Is(err, ErrReadOnlyReplica) {
+		t.Errorf("Set() on slave error = %v, want ErrReadOnlyReplica", err)
+	}
+
+	// Записи в текущий сегмент мастера доходят до уже синхронизированного слейва
+	master.Delete("a")
+	master.Set("b", "updated")
+	waitValue(t, slave, "b", "updated")
+	if _, err := slave.Get("a"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Deleted key is still on slave: %v", err)
+	}
+	slave.Close()
+
+	// После перезапуска слейв восстанавливается из своего WAL и продолжает с того же LSN
+	master.Set("d", "4")
+	restarted, err := NewStorage(engine.NewInMemoryEngine(), customLogger, slaveOptions)
+	if err != nil {
+		t.Fatalf("Failed to restart slave: %v", err)
+	}
+	defer restarted.Close()
+	waitValue(t, restarted, "d", "4")
+	if value, err := restarted.Get("b"); err != nil || value != "updated" {
+		t.Errorf("Restarted slave Get(b) = %q, %v, want updated", value, err)
+	}
+}
+
+func TestStorageReplicationFromSnapshot(t *testing.T) {
+	address := freeAddress(t)
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	masterWAL := newWALConfig(t.TempDir())
+	masterWAL.MaxSegmentSize = 256 // несколько сегментов для проверки сжатия
+	master, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig:      masterWAL,
+		SnapshotConfig: &snapshot.Config{Enabled: true},
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeMaster,
+			MasterAddress: address,
+			SyncInterval:  time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create master: %v", err)
+	}
+	defer master.Close()
+
+	master.Set("a", "1")
+	master.Set("b", "2")
+
+	slaveDir := t.TempDir()
+	slaveOptions := StorageOptions{
+		WALConfig:      newWALConfig(slaveDir),
+		SnapshotConfig: &snapshot.Config{Enabled: true},
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeSlave,
+			MasterAddress: address,
+			SyncInterval:  20 * time.Millisecond,
+		},
+	}
+	slave, err := NewStorage(engine.NewInMemoryEngine(), customLogger, slaveOptions)
+	if err != nil {
+		t.Fatalf("Failed to create slave: %v", err)
+	}
+	waitValue(t, slave, "b", "2")
+	slave.Close()
+
+	// Пока слейв отключен, мастер удаляет ключ и сжимает WAL снимком
+	master.Delete("a")
+	for i := 0; i < 30; i++ {
+		master.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	lsn, err := master.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error: %v", err)
+	}
+
+	// Нужных слейву записей на мастере уже нет: слейв получает снимок и продолжает после него
+	slave, err = NewStorage(engine.NewInMemoryEngine(), customLogger, slaveOptions)
+	if err != nil {
+		t.Fatalf("Failed to restart slave: %v", err)
+	}
+	waitValue(t, slave, "key29", "value29")
+	if _, err := slave.Get("a"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Key deleted in compacted records is still on slave: %v", err)
+	}
+	master.Set("after", "snapshot")
+	waitValue(t, slave, "after", "snapshot")
+	slave.Close()
+
+	snapshots, err := snapshot.List(slaveDir)
+	if err != nil || len(snapshots) != 1 || snapshots[0].LSN != lsn {
+		t.Errorf("Slave snapshots = %+v, %v, want master snapshot with LSN %d", snapshots, err, lsn)
+	}
+
+	// После перезапуска слейв загружает полученный снимок и свой WAL после него
+	master.Set("b", "updated")
+	restarted, err := NewStorage(engine.NewInMemoryEngine(), customLogger, slaveOptions)
+	if err != nil {
+		t.Fatalf("Failed to restart slave: %v", err)
+	}
+	defer restarted.Close()
+	waitValue(t, restarted, "b", "updated")
+	for key, want := range map[string]string{"key0": "value0", "after": "snapshot"} {
+		if value, err := restarted.Get(key); err != nil || value != want {
+			t.Errorf("Restarted slave Get(%s) = %q, %v, want %q", key, value, err, want)
+		}
+	}
+}
+
+func TestStorageReplicaSnapshot(t *testing.T) {
+	address := freeAddress(t)
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	master, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig: newWALConfig(t.TempDir()),
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeMaster,
+			MasterAddress: address,
+			SyncInterval:  time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create master: %v", err)
+	}
+	defer master.Close()
+
+	slaveDir := t.TempDir()
+	slaveWAL := newWALConfig(slaveDir)
+	slaveWAL.MaxSegmentSize = 256 // несколько сегментов для проверки сжатия
+	slaveOptions := StorageOptions{
+		WALConfig:      slaveWAL,
+		SnapshotConfig: &snapshot.Config{Enabled: true},
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeSlave,
+			MasterAddress: address,
+			SyncInterval:  20 * time.Millisecond,
+		},
+	}
+	slave, err := NewStorage(engine.NewInMemoryEngine(), customLogger, slaveOptions)
+	if err != nil {
+		t.Fatalf("Failed to create slave: %v", err)
+	}
+
+	for i := 0; i < 30; i++ {
+		master.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	waitValue(t, slave, "key29", "value29")
+
+	// Слейв пишет снимок по последней примененной записи и сжимает свой WAL
+	before, _ := filepath.Glob(filepath.Join(slaveDir, "wal_*.log"))
+	lsn, err := slave.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() on slave error: %v", err)
+	}
+	if lsn != 29 {
+		t.Errorf("Expected slave snapshot LSN 29, got %d", lsn)
+	}
+	after, _ := filepath.Glob(filepath.Join(slaveDir, "wal_*.log"))
+	if len(before) < 2 || len(after) != 1 {
+		t.Errorf("Expected slave WAL to be compacted to 1 segment, had %d, left %d", len(before), len(after))
+	}
+
+	// Записи мастера после снимка продолжают применяться и переживают перезапуск слейва
+	master.Set("after", "snapshot")
+	waitValue(t, slave, "after", "snapshot")
+	slave.Close()
+
+	restarted, err := NewStorage(engine.NewInMemoryEngine(), customLogger, slaveOptions)
+	if err != nil {
+		t.Fatalf("Failed to restart slave: %v", err)
+	}
+	defer restarted.Close()
+	for key, want := range map[string]string{"key0": "value0", "key29": "value29", "after": "snapshot"} {
+		if value, err := restarted.Get(key); err != nil || value != want {
+			t.Errorf("Restarted slave Get(%s) = %q, %v, want %q", key, value, err, want)
+		}
+	}
+}
+
+func TestSemiSyncReplication(t *testing.T) {
+	address := freeAddress(t)
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+	syncTimeout := 300 * time.Millisecond
+
+	master, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig: newWALConfig(t.TempDir()),
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeMaster,
+			MasterAddress: address,
+			SyncInterval:  time.Second,
+			SyncReplicas:  1,
+			SyncTimeout:   syncTimeout,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create master: %v", err)
+	}
+	defer master.Close()
+	ctx := context.Background()
+
+	// Без слейвов запись ждет подтверждения до таймаута и переходит на асинхронную репликацию
+	start := time.Now()
+	if err := master.Set("a", "1"); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < syncTimeout {
+		t.Errorf("Set() without replicas returned after %v, want at least sync timeout", elapsed)
+	}
+	start = time.Now()
+	if err := master.Set("b", "2"); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= syncTimeout {
+		t.Errorf("Set() in asynchronous fallback took %v, want no wait", elapsed)
+	}
+	if acked, err := master.WaitReplicas(ctx, 1, 50*time.Millisecond); err != nil || acked != 0 {
+		t.Errorf("WaitReplicas() without replicas = %d, %v, want 0", acked, err)
+	}
+
+	slave, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig: newWALConfig(t.TempDir()),
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeSlave,
+			MasterAddress: address,
+			SyncInterval:  time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create slave: %v", err)
+	}
+	defer slave.Close()
+
+	if acked, err := master.WaitReplicas(ctx, 1, 5*time.Second); err != nil || acked != 1 {
+		t.Fatalf("WaitReplicas() = %d, %v, want 1 replica", acked, err)
+	}
+	if _, err := slave.WaitReplicas(ctx, 1, 0); !errors.Is(err, ErrWaitOnReplica) {
+		t.Errorf("WaitReplicas() on slave error = %v, want ErrWaitOnReplica", err)
+	}
+
+	// Слейв догнал мастер: подтвержденная запись уже есть на слейве
+	for _, key := range []string{"c", "d"} {
+		if err := master.Set(key, "sync"); err != nil {
+			t.Fatalf("Set() error: %v", err)
+		}
+		if value, err := slave.Get(key); err != nil || value != "sync" {
+			t.Errorf("Slave Get(%s) right after acknowledged Set() = %q, %v, want sync", key, value, err)
+		}
+	}
+	if _, err := master.IncrBy("counter", 5); err != nil {
+		t.Fatalf("IncrBy() error: %v", err)
+	}
+	if value, err := slave.Get("counter"); err != nil || value != "5" {
+		t.Errorf("Slave Get(counter) right after acknowledged IncrBy() = %q, %v, want 5", value, err)
+	}
+}
+
+func TestReplicaOfFailover(t *testing.T) {
+	oldAddress, newAddress := freeAddress(t), freeAddress(t)
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+
+	oldMaster, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig: newWALConfig(t.TempDir()),
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeMaster,
+			MasterAddress: oldAddress,
+			SyncInterval:  time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create master: %v", err)
+	}
+	defer oldMaster.Close()
+
+	replica, err := NewStorage(engine.NewInMemoryEngine(), customLogger, StorageOptions{
+		WALConfig: newWALConfig(t.TempDir()),
+		ReplicationConfig: &replication.ReplicationConfig{
+			Enabled:       true,
+			ReplicaType:   replication.TypeSlave,
+			MasterAddress: oldAddress,
+			ListenAddress: newAddress,
+			SyncInterval:  time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create slave: %v", err)
+	}
+	defer replica.Close()
+
+	oldMaster.Set("a", "1")
+	oldMaster.Set("b", "2")
+	waitValue(t, replica, "b", "2")
+
+	// REPLICAOF NO ONE: слейв становится мастером и продолжает последовательность LSN
+	if err := replica.ReplicaOf(""); err != nil {
+		t.Fatalf("ReplicaOf(NO ONE) error: %v", err)
+	}
+	promotedWAL := replica.(*SimpleStorage).wal
+	if next := promotedWAL.NextLSN(); next != 2 {
+		t.Errorf("Promoted NextLSN() = %d, want 2", next)
+	}
+	if err := replica.Set("c", "3"); err != nil {
+		t.Fatalf("Set() on promoted replica error: %v", err)
+	}
+	if logs, err := promotedWAL.ReadFrom(2, 10); err != nil || len(logs) != 1 || logs[0].LSN != 2 {
+		t.Errorf("Promoted WAL records from LSN 2 = %+v, %v, want LSN 2", logs, err)
+	}
+
+	// Бывший мастер становится слейвом нового и получает его записи
+	if err := oldMaster.ReplicaOf(newAddress); err != nil {
+		t.Fatalf("ReplicaOf(%s) error: %v", newAddress, err)
+	}
+	if err := oldMaster.Set("d", "4"); !errors.Is(err, ErrReadOnlyReplica) {
+		t.Errorf("Set() on demoted master error = %v, want ErrReadOnlyReplica", err)
+	}
+	waitValue(t, oldMaster, "c", "3")
+	if next := oldMaster.(*SimpleStorage).wal.NextLSN(); next != 3 {
+		t.Errorf("Demoted NextLSN() = %d, want 3", next)
+	}
+	if acked, err := replica.WaitReplicas(context.Background(), 1, 5*time.Second); err != nil || acked != 1 {
+		t.Errorf("WaitReplicas() on promoted replica = %d, %v, want 1", acked, err)
+	}
+
+	// Порт бывшего мастера освобожден: он может снова стать мастером
+	if err := oldMaster.ReplicaOf(""); err != nil {
+		t.Fatalf("ReplicaOf(NO ONE) on demoted master error: %v", err)
+	}
+	if err := oldMaster.Set("d", "4"); err != nil {
+		t.Errorf("Set() after second promotion error: %v", err)
+	}
+}
+
+func TestRaftReplication(t *testing.T) {
+	customLogger := logger.NewLoggerWithZap(zap.NewNop())
+	addresses := []string{freeAddress(t), freeAddress(t), freeAddress(t)}
+
+	nodes := make([]Storage, len(addresses))
+	options := make([]StorageOptions, len(addresses))
+	for i, address := range addresses {
+		options[i] = StorageOptions{
+			WALConfig: newWALConfig(t.TempDir()),
+			ReplicationConfig: &replication.ReplicationConfig{
+				Enabled:         true,
+				ReplicaType:     replication.TypeRaft,
+				ListenAddress:   address,
+				Peers:           addresses,
+				ElectionTimeout: 200 * time.Millisecond,
+			},
+		}
+		node, err := NewStorage(engine.NewInMemoryEngine(), customLogger, options[i])
+		if err != nil {
+			t.Fatalf("Failed to create raft node %d: %v", i, err)
+		}
+		defer node.Close()
+		nodes[i] = node
+	}
+
+	// leader ждет, пока одна из работающих нод начнет принимать запись
+	leader := func(alive []Storage) Storage {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, node := range alive {
+				if node.(*SimpleStorage).isMaster.Load() {
+					return node
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("No raft leader elected")
+		return nil
+	}
+
+	first := leader(nodes)
+	if err := first.Set("a", "1"); err != nil {
+		t.Fatalf("Set() on leader error: %v", err)
+	}
+	var followers []Storage
+	for _, node := range nodes {
+		if node != first {
+			followers = append(followers, node)
+			waitValue(t, node, "a", "1")
+		}
+	}
+
+	if err := followers[0].Set("b", "2"); !errors.Is(err, replication.ErrNotLeader) {
+		t.Errorf("Set() on follower error = %v, want ErrNotLeader", err)
+	}
+	if err := followers[0].ReplicaOf(""); !errors.Is(err, ErrRaftRoleFixed) {
+		t.Errorf("ReplicaOf() in raft mode error = %v, want ErrRaftRoleFixed", err)
+	}
+
+	// После остановки лидера оставшиеся ноды выбирают нового и сохраняют его записи
+	first.Close()
+	second := leader(followers)
+	if err := second.Set("b", "2"); err != nil {
+		t.Fatalf("Set() on new leader error: %v", err)
+	}
+	for _, node := range followers {
+		waitValue(t, node, "a", "1")
+		waitValue(t, node, "b", "2")
+	}
+
+	// Без большинства запись не фиксируется и не применяется даже на лидере
+	for _, node := range followers {
+		if node != second {
+			node.Close()
+		}
+	}
+	if err := second.Set("c", "3"); !errors.Is(err, ErrWriteNotCommitted) {
+		t.Errorf("Set() without majority error = %v, want ErrWriteNotCommitted", err)
+	}
+	if _, err := second.Get("c"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Uncommitted write is visible on leader: %v", err)
+	}
+
+	// После перезапуска узел повторяет из WAL только зафиксированные записи
+	second.Close()
+	var secondOptions StorageOptions
+	for i, node := range nodes {
+		if node == second {
+			secondOptions = options[i]
+		}
+	}
+	restarted, err := NewStorage(engine.NewInMemoryEngine(), customLogger, secondOptions)
+	if err != nil {
+		t.Fatalf("Failed to restart raft node: %v", err)
+	}
+	defer restarted.Close()
+	if value, err := restarted.Get("b"); err != nil || value != "2" {
+		t.Errorf("Restarted node Get(b) = %q, %v, want 2", value, err)
+	}
+	if _, err := restarted.Get("c"); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Errorf("Uncommitted write was replayed after restart: %v", err)
+	}
+}
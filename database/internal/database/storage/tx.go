@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/engine"
+	"github.com/keij-sama/Concurrency/database/internal/database/storage/wal"
+	"go.uber.org/zap"
+)
+
+// ErrWatchConflict возвращается, если отслеживаемый через WATCH ключ изменился до EXEC
+var ErrWatchConflict = errors.New("transaction aborted: watched key changed")
+
+// storageTx выполняет операции над заблокированными ключами и накапливает записи для WAL
+type storageTx struct {
+	tx       engine.Tx
+	now      time.Time
+	readOnly error // ошибка для операций записи, если писать нельзя
+	logs     []wal.Log
+}
+
+// Version возвращает версию ключа для WATCH
+func (s *SimpleStorage) Version(key string) uint64 {
+	return s.engine.Version(key)
+}
+
+// Atomic выполняет fn над ключами keys как одну транзакцию. LSN записи BATCH назначается
+// под блокировками партиций ключей, поэтому порядок транзакций в логе совпадает с порядком
+// их применения. Блокировки удерживаются до ответа WAL, а изменения применяются к движку
+// только после подтверждения записи: ни чтения, ни снимок не видят данных, которых может
+// не оказаться в логе, и откатывать ничего не нужно. Места в очереди WAL транзакция
+// под блокировками не ждет: при переполнении сразу возвращается ErrWALOverloaded.
+// Если изменениям не хватает памяти, транзакция отменяется, память освобождается без
+// блокировок партиций и транзакция выполняется заново
+func (s *SimpleStorage) Atomic(keys []string, watched map[string]uint64, fn func(tx Operations) error) error {
+	return s.AtomicCtx(context.Background(), keys, watched, fn)
+}
+
+// AtomicCtx выполняет транзакцию, как Atomic. Если ctx завершится раньше подтверждения
+// записи WAL, возвращается ErrWriteUnconfirmed, а транзакция завершается в фоне (см. commit)
+func (s *SimpleStorage) AtomicCtx(ctx context.Context, keys []string, watched map[string]uint64, fn func(tx Operations) error) error {
+	locked := make([]string, 0, len(keys)+len(watched))
+	locked = append(locked, keys...)
+	for key := range watched {
+		locked = append(locked, key)
+	}
+
+	var reserved int64
+	for {
+		written, err := s.commit(ctx, locked, watched, fn, reserved)
+
+		var shortage *memoryShortage
+		if errors.As(err, &shortage) {
+			if err := s.reserveSize(shortage.size); err != nil {
+				return err
+			}
+			reserved = shortage.size
+			continue
+		}
+
+		// Слейвов ждем после снятия блокировок, если транзакция что-то записала
+		if err != nil || !written {
+			return err
+		}
+		return s.awaitReplicas(ctx)
+	}
+}
+
+// memoryShortage отменяет транзакцию, изменениям которой нужно size байт сверх свободной памяти
+type memoryShortage struct {
+	size int64
+}
+
+func (m *memoryShortage) Error() string {
+	return fmt.Sprintf("transaction needs %d bytes of memory", m.size)
+}
+
+// commitResult - итог транзакции, выполненной в фоне
+type commitResult struct {
+	written bool
+	err     error
+}
+
+// commit выполняет транзакцию и сообщает, записала ли она что-нибудь. reserved - память,
+// уже освобожденная под изменения транзакции. Если ctx завершится после постановки записи
+// в очередь WAL, возвращается ErrWriteUnconfirmed, а транзакция завершается в фоне
+func (s *SimpleStorage) commit(ctx context.Context, locked []string, watched map[string]uint64, fn func(tx Operations) error, reserved int64) (bool, error) {
+	// Транзакция выполняется в отдельной горутине: она держит блокировки партиций до ответа
+	// WAL, а вызывающий при отмене ctx возвращается, не дожидаясь его
+	queued := make(chan struct{})
+	finished := make(chan commitResult, 1)
+	go func() {
+		written, err := s.run(ctx, locked, watched, fn, reserved, queued)
+		finished <- commitResult{written: written, err: err}
+	}()
+
+	select {
+	case result := <-finished:
+		return result.written, result.err
+	case <-queued:
+	}
+
+	select {
+	case result := <-finished:
+		return result.written, result.err
+	case <-ctx.Done():
+	}
+
+	// Ответ WAL мог прийти одновременно с отменой
+	select {
+	case result := <-finished:
+		return result.written, result.err
+	default:
+	}
+
+	s.logger.Info("Request cancelled while waiting for WAL, write continues in background",
+		zap.Strings("keys", locked),
+		zap.Error(ctx.Err()),
+	)
+	return false, fmt.Errorf("%w: %w", ErrWriteUnconfirmed, ctx.Err())
+}
+
+// run выполняет транзакцию под блокировками партиций и закрывает queued, когда ее записи
+// назначен LSN. Блокировки партиций и s.writes освобождаются после ответа WAL, а в режиме
+// raft - после фиксации записи группой, поэтому снимок не сохранит изменений, запись
+// которых не удалась, а чтения не увидят записей, которые новый лидер может отбросить
+func (s *SimpleStorage) run(ctx context.Context, locked []string, watched map[string]uint64, fn func(tx Operations) error, reserved int64, queued chan struct{}) (bool, error) {
+	s.writes.RLock()
+	defer s.writes.RUnlock()
+
+	var (
+		logs       []wal.Log
+		durability = wal.DurabilityNone
+	)
+	err := s.engine.Update(locked, func(etx engine.Tx) error {
+		for key, version := range watched {
+			if etx.Version(key) != version {
+				s.logger.Info("Transaction aborted by WATCH",
+					zap.String("key", key),
+				)
+				return ErrWatchConflict
+			}
+		}
+
+		tx := &storageTx{tx: etx, now: time.Now(), readOnly: s.writable()}
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		if len(tx.logs) == 0 {
+			return nil
+		}
+		if size := etx.Size(); size > reserved && !s.fits(size) {
+			return &memoryShortage{size: size}
+		}
+		if s.wal == nil {
+			logs = tx.logs
+			return nil
+		}
+
+		// Отмененный запрос не попадает в WAL
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Изменения применяются движком после возврата без ошибки, то есть только
+		// после подтверждения записи. При отказе WAL они просто отбрасываются
+		done := s.wal.TryBatch(tx.logs)
+		close(queued)
+		result := <-done
+		if result.Err != nil {
+			s.logger.Error("Failed to write to WAL, transaction discarded",
+				zap.Int("operations", len(tx.logs)),
+				zap.Error(result.Err),
+			)
+			return result.Err
+		}
+
+		// В режиме raft запись применяется, только когда ее зафиксирует группа
+		if s.raft != nil {
+			if err := s.awaitCommit(result.LSN); err != nil {
+				s.logger.Error("Transaction was not committed by raft group, discarded",
+					zap.Uint64("lsn", result.LSN),
+					zap.Error(err),
+				)
+				return err
+			}
+		}
+		logs = tx.logs
+		durability = result.Durability
+		return nil
+	})
+	if err != nil || len(logs) == 0 {
+		return false, err
+	}
+
+	s.logger.Info("Transaction committed",
+		zap.Int("operations", len(logs)),
+		zap.String("durability", string(durability)),
+	)
+	return true, nil
+}
+
+// applyBatch применяет операции записи BATCH к движку целиком
+func (s *SimpleStorage) applyBatch(logs []wal.Log) error {
+	keys := make([]string, 0, len(logs))
+	for _, log := range logs {
+		if len(log.Args) == 0 {
+			return wal.ErrInvalidBatch
+		}
+		keys = append(keys, log.Args[0])
+	}
+
+	return s.engine.Update(keys, func(tx engine.Tx) error {
+		for _, log := range logs {
+			if err := applyTxLog(tx, log); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// applyTxLog применяет одну операцию записи BATCH внутри транзакции движка
+func applyTxLog(tx engine.Tx, log wal.Log) error {
+	key := log.Args[0]
+
+	switch log.Operation {
+	case wal.OperationSet:
+		if len(log.Args) < 2 {
+			return wal.ErrInvalidBatch
+		}
+		var expiresAt time.Time
+		if len(log.Args) >= 3 {
+			deadline, err := wal.ParseDeadline(log.Args[2])
+			if err != nil {
+				return err
+			}
+			expiresAt = deadline
+		}
+		tx.Put(key, log.Args[1], expiresAt)
+
+	case wal.OperationDel:
+		tx.Remove(key)
+
+	case wal.OperationExpire:
+		if len(log.Args) < 2 {
+			return wal.ErrInvalidBatch
+		}
+		expiresAt, err := wal.ParseDeadline(log.Args[1])
+		if err != nil {
+			return err
+		}
+		if value, _, ok := tx.Lookup(key); ok {
+			tx.Put(key, value, expiresAt)
+		}
+
+	case wal.OperationPersist:
+		if value, _, ok := tx.Lookup(key); ok {
+			tx.Put(key, value, time.Time{})
+		}
+
+	default:
+		return wal.ErrInvalidBatch
+	}
+
+	return nil
+}
+
+// record запоминает операцию для записи в WAL
+func (t *storageTx) record(operation string, args ...string) {
+	t.logs = append(t.logs, wal.Log{Operation: operation, Args: args})
+}
+
+// Set сохраняет пару ключ-значение
+func (t *storageTx) Set(key, value string) error {
+	if t.readOnly != nil {
+		return t.readOnly
+	}
+
+	t.tx.Put(key, value, time.Time{})
+	t.record(wal.OperationSet, key, value)
+	return nil
+}
+
+// SetCtx сохраняет пару ключ-значение. Транзакция записывается в WAL целиком в Atomic,
+// поэтому контекст отдельной операции не используется
+func (t *storageTx) SetCtx(_ context.Context, key, value string) error {
+	return t.Set(key, value)
+}
+
+// SetWithTTLCtx сохраняет пару ключ-значение со сроком жизни, контекст не используется, как в SetCtx
+func (t *storageTx) SetWithTTLCtx(_ context.Context, key, value string, ttl time.Duration) error {
+	return t.SetWithTTL(key, value, ttl)
+}
+
+// ExpireCtx устанавливает время жизни существующего ключа
+func (t *storageTx) ExpireCtx(_ context.Context, key string, ttl time.Duration) error {
+	return t.Expire(key, ttl)
+}
+
+// PersistCtx снимает срок жизни с ключа
+func (t *storageTx) PersistCtx(_ context.Context, key string) error {
+	return t.Persist(key)
+}
+
+// GetCtx получает значение по ключу с учетом изменений транзакции
+func (t *storageTx) GetCtx(_ context.Context, key string) (string, error) {
+	return t.Get(key)
+}
+
+// DeleteCtx удаляет ключ
+func (t *storageTx) DeleteCtx(_ context.Context, key string) error {
+	return t.Delete(key)
+}
+
+// Get получает значение по ключу с учетом изменений транзакции
+func (t *storageTx) Get(key string) (string, error) {
+	value, _, ok := t.tx.Lookup(key)
+	if !ok {
+		return "", engine.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// Delete удаляет ключ
+func (t *storageTx) Delete(key string) error {
+	if t.readOnly != nil {
+		return t.readOnly
+	}
+
+	if _, _, ok := t.tx.Lookup(key); !ok {
+		return engine.ErrKeyNotFound
+	}
+
+	t.tx.Remove(key)
+	t.record(wal.OperationDel, key)
+	return nil
+}
+
+// SetWithTTL сохраняет пару ключ-значение, которая истечет через ttl
+func (t *storageTx) SetWithTTL(key, value string, ttl time.Duration) error {
+	if t.readOnly != nil {
+		return t.readOnly
+	}
+
+	expiresAt := t.now.Add(ttl)
+	t.tx.Put(key, value, expiresAt)
+	t.record(wal.OperationSet, key, value, wal.FormatDeadline(expiresAt))
+	return nil
+}
+
+// Expire устанавливает время жизни существующего ключа
+func (t *storageTx) Expire(key string, ttl time.Duration) error {
+	if t.readOnly != nil {
+		return t.readOnly
+	}
+
+	value, _, ok := t.tx.Lookup(key)
+	if !ok {
+		return engine.ErrKeyNotFound
+	}
+
+	expiresAt := t.now.Add(ttl)
+	t.tx.Put(key, value, expiresAt)
+	t.record(wal.OperationExpire, key, wal.FormatDeadline(expiresAt))
+	return nil
+}
+
+// TTL возвращает оставшееся время жизни ключа
+func (t *storageTx) TTL(key string) (time.Duration, error) {
+	_, expiresAt, ok := t.tx.Lookup(key)
+	if !ok {
+		return 0, engine.ErrKeyNotFound
+	}
+	if expiresAt.IsZero() {
+		return 0, engine.ErrNoExpiration
+	}
+	return expiresAt.Sub(t.now), nil
+}
+
+// Persist снимает срок жизни с ключа
+func (t *storageTx) Persist(key string) error {
+	if t.readOnly != nil {
+		return t.readOnly
+	}
+
+	value, expiresAt, ok := t.tx.Lookup(key)
+	if !ok {
+		return engine.ErrKeyNotFound
+	}
+	if expiresAt.IsZero() {
+		return engine.ErrNoExpiration
+	}
+
+	t.tx.Put(key, value, time.Time{})
+	t.record(wal.OperationPersist, key)
+	return nil
+}
@@ -0,0 +1,305 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Формат сегмента WAL версии 2:
+//
+//	заголовок:  "CWAL" | версия (uint32)
+//	запись:     длина данных (uint32) | CRC32-C данных (uint32) | данные
+//	данные:     LSN (uint64) | время (int64, unix-наносекунды) | код операции (uint8) |
+//	            число аргументов (uvarint) | { длина (uvarint) | байты }...
+//
+// В версии 1 поля времени нет, такие сегменты читаются с нулевым временем записей.
+// Числа фиксированной длины записываются в little-endian. Контрольная сумма каждой записи
+// позволяет найти недописанную или поврежденную запись и не потерять записи до нее.
+// Сегменты старого формата (JSON-массив записей на строку) читаются без изменений
+const (
+	segmentMagic   = "CWAL"
+	segmentVersion = 2
+	// segmentVersionV1 - версия без времени записи, поддерживается только для чтения
+	segmentVersionV1  = 1
+	segmentHeaderSize = len(segmentMagic) + 4
+	recordHeaderSize  = 8
+	// maxRecordSize ограничивает длину записи при чтении, чтобы поврежденная длина
+	// не приводила к выделению огромного буфера
+	maxRecordSize = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Коды операций в двоичном формате. Коды записываются на диск и не должны меняться
+var operationCodes = map[string]byte{
+	OperationSet:     1,
+	OperationDel:     2,
+	OperationExpire:  3,
+	OperationPersist: 4,
+	OperationBatch:   5,
+	OperationNoop:    6,
+}
+
+// operationNames - обратное отображение operationCodes
+var operationNames = func() map[byte]string {
+	names := make(map[byte]string, len(operationCodes))
+	for name, code := range operationCodes {
+		names[code] = name
+	}
+	return names
+}()
+
+// Ошибки формата сегментов
+var (
+	ErrCorruptRecord      = errors.New("поврежденная запись WAL")
+	ErrUnsupportedVersion = errors.New("неподдерживаемая версия формата WAL")
+	ErrUnknownOperation   = errors.New("неизвестная операция WAL")
+)
+
+// CorruptionError описывает поврежденную запись: сегмент, смещение начала записи от начала файла
+// и причину. Записи сегмента до Offset прочитаны успешно
+type CorruptionError struct {
+	Segment string
+	Offset  int64
+	Reason  string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: сегмент %s, смещение %d: %s", ErrCorruptRecord, e.Segment, e.Offset, e.Reason)
+}
+
+// Unwrap позволяет проверять ошибку через errors.Is(err, ErrCorruptRecord)
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorruptRecord
+}
+
+// appendSegmentHeader добавляет заголовок нового сегмента
+func appendSegmentHeader(buf []byte) []byte {
+	buf = append(buf, segmentMagic...)
+	return binary.LittleEndian.AppendUint32(buf, segmentVersion)
+}
+
+// appendRecord добавляет запись в двоичном формате
+func appendRecord(buf []byte, log Log) ([]byte, error) {
+	code, ok := operationCodes[log.Operation]
+	if !ok {
+		return buf, fmt.Errorf("%w: %s", ErrUnknownOperation, log.Operation)
+	}
+
+	// Оставляем место под длину и контрольную сумму, они известны после записи данных
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+
+	buf = binary.LittleEndian.AppendUint64(buf, log.LSN)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(log.Timestamp))
+	buf = append(buf, code)
+	buf = binary.AppendUvarint(buf, uint64(len(log.Args)))
+	for _, arg := range log.Args {
+		buf = binary.AppendUvarint(buf, uint64(len(arg)))
+		buf = append(buf, arg...)
+	}
+
+	payload := buf[start+recordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+	return buf, nil
+}
+
+// decodeSegment читает записи сегмента в любом из форматов. Если skip == false, чтение
+// останавливается на первой поврежденной записи: возвращаются записи до нее и *CorruptionError.
+// Если skip == true, поврежденные записи пропускаются и возвращаются вторым результатом
+func decodeSegment(name string, data []byte, skip bool) ([]Log, []*CorruptionError, error) {
+	if bytes.HasPrefix(data, []byte(segmentMagic)) {
+		return decodeBinarySegment(name, data, skip)
+	}
+	return decodeJSONSegment(name, data, skip)
+}
+
+// decodeBinarySegment читает сегмент двоичного формата. Запись с неверной контрольной суммой
+// пропускается по ее длине; если неверна сама длина, пропускается остаток сегмента
+func decodeBinarySegment(name string, data []byte, skip bool) ([]Log, []*CorruptionError, error) {
+	if len(data) < segmentHeaderSize {
+		return nil, nil, &CorruptionError{Segment: name, Offset: 0, Reason: "неполный заголовок сегмента"}
+	}
+	version := binary.LittleEndian.Uint32(data[len(segmentMagic):])
+	if version != segmentVersion && version != segmentVersionV1 {
+		return nil, nil, fmt.Errorf("%w: %d в сегменте %s", ErrUnsupportedVersion, version, name)
+	}
+
+	var (
+		logs    []Log
+		skipped []*CorruptionError
+	)
+	offset := segmentHeaderSize
+	for offset < len(data) {
+		// corrupt фиксирует поврежденную запись и сообщает, можно ли продолжать чтение
+		corrupt := func(reason string) error {
+			corruption := &CorruptionError{Segment: name, Offset: int64(offset), Reason: reason}
+			if !skip {
+				return corruption
+			}
+			skipped = append(skipped, corruption)
+			return nil
+		}
+
+		if len(data)-offset < recordHeaderSize {
+			return logs, skipped, corrupt("неполный заголовок записи")
+		}
+		size := binary.LittleEndian.Uint32(data[offset:])
+		checksum := binary.LittleEndian.Uint32(data[offset+4:])
+		if size > maxRecordSize {
+			return logs, skipped, corrupt(fmt.Sprintf("недопустимая длина записи %d", size))
+		}
+		if int64(len(data)-offset-recordHeaderSize) < int64(size) {
+			return logs, skipped, corrupt(fmt.Sprintf("запись длиной %d обрывается на конце файла", size))
+		}
+
+		next := offset + recordHeaderSize + int(size)
+		payload := data[offset+recordHeaderSize : next]
+		if crc32.Checksum(payload, crcTable) != checksum {
+			if err := corrupt("контрольная сумма не совпадает"); err != nil {
+				return logs, skipped, err
+			}
+			offset = next
+			continue
+		}
+
+		log, err := decodeRecord(payload, version)
+		if err != nil {
+			if err := corrupt(err.Error()); err != nil {
+				return logs, skipped, err
+			}
+			offset = next
+			continue
+		}
+
+		logs = append(logs, log)
+		offset = next
+	}
+
+	return logs, skipped, nil
+}
+
+// hasRecordAfter сообщает, есть ли в сегменте после поврежденной записи по offset целая
+// запись. Длине поврежденной записи верить нельзя, поэтому запись ищется с каждого смещения.
+// Чтобы случайные байты не сошлись с контрольной суммой, LSN записи должен продолжать
+// последовательность сегмента: быть не меньше next и отстоять от него не больше чем на
+// размер сегмента
+func hasRecordAfter(data []byte, offset int, next uint64) bool {
+	if !bytes.HasPrefix(data, []byte(segmentMagic)) {
+		// В старом формате запись - строка, следующая начинается после перевода строки
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			return false
+		}
+		logs, _, _ := decodeJSONSegment("", data[offset+end+1:], true)
+		return len(logs) > 0
+	}
+	if len(data) < segmentHeaderSize {
+		return false
+	}
+	version := binary.LittleEndian.Uint32(data[len(segmentMagic):])
+
+	for pos := max(offset+1, segmentHeaderSize); pos+recordHeaderSize+8 <= len(data); pos++ {
+		size := binary.LittleEndian.Uint32(data[pos:])
+		if size < 8 || int64(size) > int64(len(data)-pos-recordHeaderSize) {
+			continue
+		}
+		payload := data[pos+recordHeaderSize : pos+recordHeaderSize+int(size)]
+		lsn := binary.LittleEndian.Uint64(payload)
+		if lsn < next || lsn-next > uint64(len(data)) {
+			continue
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[pos+4:]) {
+			continue
+		}
+		if _, err := decodeRecord(payload, version); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeRecord разбирает данные записи с проверенной контрольной суммой
+func decodeRecord(payload []byte, version uint32) (Log, error) {
+	var log Log
+	fixed := 8
+	if version >= segmentVersion {
+		fixed += 8
+	}
+	if len(payload) < fixed+1 {
+		return log, errors.New("запись короче заголовка записи")
+	}
+
+	log.LSN = binary.LittleEndian.Uint64(payload)
+	if version >= segmentVersion {
+		log.Timestamp = int64(binary.LittleEndian.Uint64(payload[8:]))
+	}
+	name, ok := operationNames[payload[fixed]]
+	if !ok {
+		return log, fmt.Errorf("%w: код %d", ErrUnknownOperation, payload[fixed])
+	}
+	log.Operation = name
+
+	rest := payload[fixed+1:]
+	count, n := binary.Uvarint(rest)
+	if n <= 0 || count > uint64(len(rest)) {
+		return log, errors.New("некорректное число аргументов")
+	}
+	rest = rest[n:]
+
+	log.Args = make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || size > uint64(len(rest)-n) {
+			return log, fmt.Errorf("некорректная длина аргумента %d", i)
+		}
+		log.Args = append(log.Args, string(rest[n:n+int(size)]))
+		rest = rest[n+int(size):]
+	}
+
+	if len(rest) != 0 {
+		return log, errors.New("лишние байты после аргументов")
+	}
+	return log, nil
+}
+
+// decodeJSONSegment читает сегмент старого формата: JSON-массив записей на строку.
+// При пропуске поврежденной записи чтение продолжается со следующей строки
+func decodeJSONSegment(name string, data []byte, skip bool) ([]Log, []*CorruptionError, error) {
+	var (
+		allLogs []Log
+		skipped []*CorruptionError
+	)
+
+	for offset := 0; offset < len(data); {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += offset
+		}
+
+		line := bytes.TrimSpace(data[offset:end])
+		if len(line) > 0 {
+			var logs []Log
+			if err := json.Unmarshal(line, &logs); err != nil {
+				corruption := &CorruptionError{Segment: name, Offset: int64(offset), Reason: err.Error()}
+				if !skip {
+					return allLogs, skipped, corruption
+				}
+				skipped = append(skipped, corruption)
+			} else {
+				allLogs = append(allLogs, logs...)
+			}
+		}
+
+		offset = end + 1
+	}
+
+	return allLogs, skipped, nil
+}
@@ -0,0 +1,66 @@
+package wal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FsyncPolicy определяет, когда записи WAL синхронизируются с диском
+type FsyncPolicy string
+
+const (
+	// FsyncAlways - каждая запись синхронизируется с диском отдельно до подтверждения
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncBatch - батч записей синхронизируется с диском одним вызовом fsync до подтверждения
+	FsyncBatch FsyncPolicy = "batch"
+	// FsyncInterval - запись подтверждается после передачи ОС, fsync выполняется раз в интервал.
+	// Задается как "interval:<длительность>", например "interval:100ms"
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever - запись подтверждается после передачи ОС, WAL не вызывает fsync
+	FsyncNever FsyncPolicy = "never"
+)
+
+// Durability - гарантия, которую получила подтвержденная запись
+type Durability string
+
+const (
+	// DurabilityFsync - запись синхронизирована с диском и переживет сбой питания
+	DurabilityFsync Durability = "fsync"
+	// DurabilityOS - запись передана ОС и переживет падение процесса, но не сбой питания
+	DurabilityOS Durability = "os"
+	// DurabilityNone - WAL выключен, запись хранится только в памяти
+	DurabilityNone Durability = "none"
+)
+
+// ParseFsyncPolicy разбирает политику fsync и возвращает ее вид и интервал для interval:<dur>.
+// Пустая строка означает batch
+func ParseFsyncPolicy(value string) (FsyncPolicy, time.Duration, error) {
+	switch policy := FsyncPolicy(value); policy {
+	case "":
+		return FsyncBatch, 0, nil
+	case FsyncAlways, FsyncBatch, FsyncNever:
+		return policy, 0, nil
+	}
+
+	if rest, ok := strings.CutPrefix(value, string(FsyncInterval)+":"); ok {
+		interval, err := time.ParseDuration(rest)
+		if err != nil || interval <= 0 {
+			return "", 0, fmt.Errorf("некорректный интервал fsync: %s", value)
+		}
+		return FsyncInterval, interval, nil
+	}
+
+	return "", 0, fmt.Errorf("неизвестная политика fsync WAL: %s", value)
+}
+
+// Durability возвращает гарантию для политики: до подтверждения запись синхронизируется
+// с диском только в режимах always и batch
+func (p FsyncPolicy) Durability() Durability {
+	switch p {
+	case FsyncAlways, FsyncBatch:
+		return DurabilityFsync
+	default:
+		return DurabilityOS
+	}
+}
@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ReadSegments читает записи сегментов в любом формате. Если skip == true, поврежденные записи
+// пропускаются и возвращаются вторым результатом, иначе первая из них возвращается как ошибка
+func ReadSegments(segments []string, skip bool) ([]Log, []*CorruptionError, error) {
+	return readLogs(segments, skip)
+}
+
+// TruncateResult описывает изменения, сделанные TruncateAfter
+type TruncateResult struct {
+	Removed   []string // удаленные сегменты, все записи которых новее точки обрезки
+	Rewritten string   // сегмент, перезаписанный без записей новее точки обрезки
+	Dropped   int      // количество отброшенных записей
+}
+
+// TruncateAfter удаляет из WAL в directory все записи с LSN больше lsn. Сегменты после точки
+// обрезки удаляются, сегмент с ней перезаписывается через временный файл. WAL не должен быть
+// открыт на запись во время обрезки
+func TruncateAfter(directory string, lsn uint64) (TruncateResult, error) {
+	var result TruncateResult
+
+	legacy, err := legacySegments(directory)
+	if err != nil {
+		return result, err
+	}
+	if len(legacy) > 0 {
+		return result, fmt.Errorf("сегменты старого формата нужно сначала переименовать, запустив WAL: %s", legacy[0])
+	}
+	names, err := ListSegments(directory)
+	if err != nil {
+		return result, fmt.Errorf("не удалось найти сегменты WAL: %w", err)
+	}
+	return truncateSegments(directory, names, lsn+1)
+}
+
+// truncateSegments удаляет из сегментов names директории directory все записи с LSN
+// не меньше next. Сегменты должны быть упорядочены по LSN
+func truncateSegments(directory string, names []string, next uint64) (TruncateResult, error) {
+	var result TruncateResult
+
+	// Сегменты обрабатываются с конца, чтобы прерванная обрезка оставила непрерывный префикс
+	for i := len(names) - 1; i >= 0; i-- {
+		path := filepath.Join(directory, names[i])
+		first, _ := SegmentLSN(names[i])
+
+		logs, _, err := readLogs([]string{path}, false)
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) {
+			// Поврежденная запись допустима только после точки обрезки
+			logs, err = readLogsBefore([]string{path}, corruption)
+			if err == nil && (len(logs) == 0 || logs[len(logs)-1].LSN+1 < next) && first < next {
+				return result, fmt.Errorf("запись до LSN %d повреждена: %w", next, corruption)
+			}
+		}
+		if err != nil {
+			return result, err
+		}
+
+		if first >= next {
+			if err := os.Remove(path); err != nil {
+				return result, fmt.Errorf("не удалось удалить сегмент WAL: %w", err)
+			}
+			result.Removed = append(result.Removed, path)
+			result.Dropped += len(logs)
+			continue
+		}
+
+		kept := logs[:0:0]
+		for _, log := range logs {
+			if log.LSN < next {
+				kept = append(kept, log)
+			}
+		}
+		if len(kept) < len(logs) || corruption != nil {
+			if err := rewriteSegment(path, kept); err != nil {
+				return result, err
+			}
+			result.Rewritten = path
+			result.Dropped += len(logs) - len(kept)
+		}
+		break
+	}
+
+	syncDir(directory)
+	return result, nil
+}
+
+// rewriteSegment атомарно заменяет содержимое сегмента записями logs в текущем формате
+func rewriteSegment(path string, logs []Log) error {
+	data := appendSegmentHeader(nil)
+	for _, log := range logs {
+		var err error
+		if data, err = appendRecord(data, log); err != nil {
+			return err
+		}
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("не удалось создать временный сегмент: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("не удалось записать сегмент: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("не удалось синхронизировать сегмент с диском: %w", err)
+	}
+	file.Close()
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("не удалось заменить сегмент: %w", err)
+	}
+	return nil
+}
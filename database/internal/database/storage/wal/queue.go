@@ -0,0 +1,121 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrWALOverloaded возвращается, если запись не дождалась места в очереди WAL:
+// диск не успевает за потоком записей
+var ErrWALOverloaded = errors.New("WAL перегружен: очередь записи заполнена")
+
+// QueueStats - состояние очереди записи WAL
+type QueueStats struct {
+	Pending    int           // записи, принятые, но еще не записанные на диск
+	MaxPending int           // предел очереди
+	Accepted   uint64        // всего принято записей
+	Waited     uint64        // сколько из них ждали места в очереди
+	Rejected   uint64        // сколько записей отклонено с ErrWALOverloaded
+	WaitTotal  time.Duration // суммарное время ожидания места
+	WaitMax    time.Duration // наибольшее время ожидания места
+}
+
+// Stats возвращает состояние очереди записи
+func (w *WAL) Stats() QueueStats {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return QueueStats{
+		Pending:    w.pending,
+		MaxPending: w.config.MaxPendingWrites,
+		Accepted:   w.accepted,
+		Waited:     w.waited,
+		Rejected:   w.rejected,
+		WaitTotal:  w.waitTotal,
+		WaitMax:    w.waitMax,
+	}
+}
+
+// admit занимает место в очереди для одной записи. Если очередь заполнена, ждет освобождения
+// не дольше QueueTimeout и времени жизни ctx. При успехе возвращается с захваченным w.mutex,
+// при ошибке - без него. Завершение ctx возвращается как ctx.Err(): это отмена запроса,
+// а не перегрузка, и в Rejected она не учитывается
+func (w *WAL) admit(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	if w.pending < w.config.MaxPendingWrites {
+		w.pending++
+		w.accepted++
+		return nil
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(w.config.QueueTimeout)
+	defer timer.Stop()
+
+	for w.pending >= w.config.MaxPendingWrites {
+		freed := w.freed
+		w.mutex.Unlock()
+
+		var err error
+		select {
+		case <-freed:
+		case <-timer.C:
+			err = ErrWALOverloaded
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		w.mutex.Lock()
+		if err != nil {
+			if errors.Is(err, ErrWALOverloaded) {
+				w.rejected++
+			}
+			w.recordWait(time.Since(start))
+			w.mutex.Unlock()
+			return err
+		}
+	}
+
+	w.pending++
+	w.accepted++
+	w.recordWait(time.Since(start))
+	return nil
+}
+
+// tryAdmit занимает место в очереди, не дожидаясь его освобождения: если очередь заполнена,
+// сразу возвращает ErrWALOverloaded. При успехе возвращается с захваченным w.mutex
+func (w *WAL) tryAdmit() error {
+	w.mutex.Lock()
+	if w.pending < w.config.MaxPendingWrites {
+		w.pending++
+		w.accepted++
+		return nil
+	}
+	w.rejected++
+	w.mutex.Unlock()
+	return ErrWALOverloaded
+}
+
+// recordWait учитывает время ожидания места в очереди. Вызывается под w.mutex
+func (w *WAL) recordWait(wait time.Duration) {
+	w.waited++
+	w.waitTotal += wait
+	if wait > w.waitMax {
+		w.waitMax = wait
+	}
+}
+
+// release освобождает место в очереди после записи n записей и будит ожидающих
+func (w *WAL) release(n int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.pending -= n
+	close(w.freed)
+	w.freed = make(chan struct{})
+}
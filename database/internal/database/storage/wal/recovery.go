@@ -0,0 +1,165 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/keij-sama/Concurrency/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// RecoveryMode определяет, как NewWAL обрабатывает поврежденные записи при запуске
+type RecoveryMode string
+
+const (
+	// RecoveryStrict - любая поврежденная запись останавливает запуск
+	RecoveryStrict RecoveryMode = "strict"
+	// RecoveryTruncateTail - последний сегмент обрезается по первой поврежденной записи
+	// (недописанный при сбое хвост). Повреждение в остальных сегментах или запись, за которой
+	// в последнем сегменте есть целые записи, останавливает запуск
+	RecoveryTruncateTail RecoveryMode = "truncate_tail"
+	// RecoverySkipCorrupt - поврежденные записи пропускаются во всех сегментах, файлы не меняются
+	RecoverySkipCorrupt RecoveryMode = "skip_corrupt"
+)
+
+// ParseRecoveryMode разбирает название режима восстановления. Пустая строка означает truncate_tail
+func ParseRecoveryMode(name string) (RecoveryMode, error) {
+	switch mode := RecoveryMode(name); mode {
+	case "":
+		return RecoveryTruncateTail, nil
+	case RecoveryStrict, RecoveryTruncateTail, RecoverySkipCorrupt:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("неизвестный режим восстановления WAL: %s", name)
+	}
+}
+
+// recoverSegments читает записи сегментов при запуске с учетом режима восстановления:
+// обрезает недописанный хвост последнего сегмента или пропускает поврежденные записи.
+// Если readOnly == true, хвост отбрасывается только при чтении, файл не изменяется
+func recoverSegments(segments []string, mode RecoveryMode, readOnly bool, log logger.Logger) ([]Log, error) {
+	logs, skipped, err := readLogs(segments, mode == RecoverySkipCorrupt)
+
+	var corruption *CorruptionError
+	truncatable := errors.As(err, &corruption) && mode == RecoveryTruncateTail &&
+		corruption.Segment == tailSegment(segments)
+	if truncatable {
+		// Обрезается только недописанный хвост, иначе вместе с поврежденной записью
+		// пропали бы все целые записи после нее
+		if tornErr := checkTornTail(corruption); tornErr != nil {
+			return nil, tornErr
+		}
+
+		if readOnly {
+			logs, err = readLogsBefore(segments, corruption)
+			if err == nil {
+				log.Error("Пропущен поврежденный хвост WAL, файл не изменен",
+					zap.String("segment", corruption.Segment),
+					zap.Int64("offset", corruption.Offset),
+					zap.String("reason", corruption.Reason),
+				)
+			}
+		} else {
+			dropped, truncateErr := truncateSegment(corruption.Segment, corruption.Offset)
+			if truncateErr != nil {
+				return nil, fmt.Errorf("не удалось обрезать сегмент WAL: %w", truncateErr)
+			}
+			log.Error("Обрезан поврежденный хвост WAL",
+				zap.String("segment", corruption.Segment),
+				zap.Int64("offset", corruption.Offset),
+				zap.Int64("dropped_bytes", dropped),
+				zap.String("reason", corruption.Reason),
+			)
+			logs, _, err = readLogs(segments, false)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, corruption := range skipped {
+		log.Error("Пропущена поврежденная запись WAL",
+			zap.String("segment", corruption.Segment),
+			zap.Int64("offset", corruption.Offset),
+			zap.String("reason", corruption.Reason),
+		)
+	}
+
+	return logs, nil
+}
+
+// checkTornTail проверяет, что поврежденная запись - недописанный при сбое хвост сегмента:
+// после нее нет целых записей. Иначе возвращает ошибку с corruption
+func checkTornTail(corruption *CorruptionError) error {
+	data, err := os.ReadFile(corruption.Segment)
+	if err != nil {
+		return fmt.Errorf("не удалось открыть сегмент WAL: %w", err)
+	}
+	if corruption.Offset > int64(len(data)) {
+		return nil
+	}
+
+	// Записи после поврежденной продолжают последовательность LSN сегмента
+	var next uint64
+	if before, _, err := decodeSegment(corruption.Segment, data[:corruption.Offset], false); err == nil && len(before) > 0 {
+		next = before[len(before)-1].LSN + 1
+	} else if lsn, ok := SegmentLSN(filepath.Base(corruption.Segment)); ok {
+		next = lsn
+	}
+
+	if hasRecordAfter(data, int(corruption.Offset), next) {
+		return fmt.Errorf("повреждена запись в середине последнего сегмента, после нее есть целые записи: %w", corruption)
+	}
+	return nil
+}
+
+// readLogsBefore читает записи сегментов до поврежденной записи, не изменяя файлы
+func readLogsBefore(segments []string, corruption *CorruptionError) ([]Log, error) {
+	var logs []Log
+	for _, segment := range segments {
+		data, err := os.ReadFile(segment)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось открыть сегмент WAL: %w", err)
+		}
+		if segment == corruption.Segment {
+			data = data[:corruption.Offset]
+		}
+
+		decoded, _, err := decodeSegment(segment, data, false)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось декодировать логи: %w", err)
+		}
+		logs = append(logs, decoded...)
+		if segment == corruption.Segment {
+			break
+		}
+	}
+	return logs, nil
+}
+
+// tailSegment возвращает последний сегмент с записями. Пустые сегменты, созданные
+// при перезапусках после сбоя, не считаются, чтобы хвост можно было обрезать и после них
+func tailSegment(segments []string) string {
+	for i := len(segments) - 1; i >= 0; i-- {
+		info, err := os.Stat(segments[i])
+		if err == nil && info.Size() != 0 && info.Size() != int64(segmentHeaderSize) {
+			return segments[i]
+		}
+	}
+	return ""
+}
+
+// truncateSegment обрезает сегмент до offset и возвращает количество удаленных байт
+func truncateSegment(path string, offset int64) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Truncate(path, offset); err != nil {
+		return 0, err
+	}
+	return info.Size() - offset, nil
+}
@@ -0,0 +1,234 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrLSNUnavailable возвращается ReadFrom, если записи с запрошенным LSN уже удалены сжатием
+	ErrLSNUnavailable = errors.New("записи WAL с запрошенным LSN удалены")
+	// ErrLSNOutOfOrder возвращается Append, если LSN записи не больше последнего записанного
+	ErrLSNOutOfOrder = errors.New("LSN записи не продолжает WAL")
+	// ErrWritesPending возвращается Rewind и Reset, если в WAL есть принятые, но еще не записанные записи
+	ErrWritesPending = errors.New("в WAL есть незаписанные записи")
+)
+
+// ReadFrom возвращает не больше limit записей с LSN не меньше lsn, включая уже записанные
+// в текущий сегмент. Запись, которую WAL еще дописывает в конец текущего сегмента, не возвращается.
+// Если записи с lsn удалены сжатием WAL, возвращается ErrLSNUnavailable
+func (w *WAL) ReadFrom(lsn uint64, limit int) ([]Log, error) {
+	w.segmentMutex.Lock()
+	segments := append([]string(nil), w.segments...)
+	w.segmentMutex.Unlock()
+
+	if len(segments) == 0 {
+		return nil, nil
+	}
+	if first, _ := SegmentLSN(filepath.Base(segments[0])); first > lsn {
+		return nil, fmt.Errorf("%w: первая доступная запись %d", ErrLSNUnavailable, first)
+	}
+
+	// Сегмент с lsn - последний, начинающийся не позже него
+	start := 0
+	for i, segment := range segments {
+		if first, _ := SegmentLSN(filepath.Base(segment)); first <= lsn {
+			start = i
+		}
+	}
+
+	var result []Log
+	for i := start; i < len(segments) && len(result) < limit; i++ {
+		logs, _, err := readLogs(segments[i:i+1], false)
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) && i == len(segments)-1 {
+			// Чтение совпало с записью в текущий сегмент: отдаем записи до недописанной
+			logs, err = readLogsBefore(segments[i:i+1], corruption)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, log := range logs {
+			if log.LSN >= lsn && len(result) < limit {
+				result = append(result, log)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Append записывает на реплике записи мастера с их LSN и временем и ждет подтверждения.
+// LSN должны возрастать и быть не меньше NextLSN; пропуски допустимы, если их нет у мастера.
+// Возвращает количество записей, записанных подряд с начала logs: при ошибке применять
+// можно только их
+func (w *WAL) Append(ctx context.Context, logs []Log) (int, error) {
+	dones := make([]chan Result, 0, len(logs))
+	var err error
+	for _, log := range logs {
+		if err = w.admit(ctx); err != nil {
+			break
+		}
+		if log.LSN < w.nextLSN {
+			err = fmt.Errorf("%w: получена запись %d, ожидалась %d", ErrLSNOutOfOrder, log.LSN, w.nextLSN)
+			w.pending--
+			w.accepted--
+			w.mutex.Unlock()
+			break
+		}
+
+		req := WriteRequest{Log: log, Done: make(chan Result, 1)}
+		w.nextLSN = log.LSN + 1
+		w.enqueue(req)
+		w.mutex.Unlock()
+		dones = append(dones, req.Done)
+	}
+
+	// Записи мастера уже ждали своего батча, поэтому пишутся сразу, без таймаута батча
+	w.mutex.Lock()
+	w.queueBatch()
+	w.mutex.Unlock()
+
+	// Принятые записи будут записаны в любом случае, дожидаемся их
+	written := 0
+	for _, done := range dones {
+		if result := <-done; result.Err != nil {
+			return written, result.Err
+		}
+		written++
+	}
+	return written, err
+}
+
+// Rewind удаляет из WAL все записи с LSN не меньше lsn: следующая запись получит LSN lsn.
+// Нужен узлу Raft, чтобы отбросить записи, которых нет у лидера. В отличие от TruncateAfter
+// работает с открытым WAL, но только пока в нем нет принятых и еще не записанных записей,
+// иначе возвращает ErrWritesPending. Записи до lsn должны быть доступны
+func (w *WAL) Rewind(lsn uint64) error {
+	w.flushMutex.Lock()
+	defer w.flushMutex.Unlock()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if lsn >= w.nextLSN {
+		return nil
+	}
+	if w.pending > 0 {
+		return ErrWritesPending
+	}
+
+	w.segmentMutex.Lock()
+	defer w.segmentMutex.Unlock()
+
+	names := make([]string, len(w.segments))
+	for i, segment := range w.segments {
+		names[i] = filepath.Base(segment)
+	}
+	if first, _ := SegmentLSN(names[0]); first > lsn {
+		return fmt.Errorf("%w: первая доступная запись %d", ErrLSNUnavailable, first)
+	}
+
+	// Текущий сегмент закрывается: его могут перезаписать или удалить
+	if w.fsync == FsyncInterval {
+		w.syncPendingLocked()
+	}
+	w.currentFile.Close()
+	w.dirty = false
+
+	result, truncateErr := truncateSegments(w.config.DataDirectory, names, lsn)
+	for _, removed := range result.Removed {
+		for i, segment := range w.segments {
+			if segment == removed {
+				w.segments = append(w.segments[:i], w.segments[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// Дописываем в последний оставшийся сегмент или начинаем новый с lsn
+	path := filepath.Join(w.config.DataDirectory, SegmentName(lsn))
+	if len(w.segments) > 0 {
+		path = w.segments[len(w.segments)-1]
+	}
+	file, size, err := createSegment(path)
+	if err != nil {
+		return fmt.Errorf("не удалось открыть сегмент WAL после обрезки: %w", err)
+	}
+	if len(w.segments) == 0 {
+		w.segments = append(w.segments, path)
+	}
+	w.currentFile = file
+	w.currentSize = size
+	if truncateErr != nil {
+		return truncateErr
+	}
+
+	w.logger.Info("Хвост WAL отброшен",
+		zap.Uint64("next_lsn", lsn),
+		zap.Int("dropped", result.Dropped))
+	w.nextLSN = lsn
+	w.written.Store(lsn)
+	return nil
+}
+
+// Reset удаляет все сегменты WAL и начинает новый сегмент с LSN next. Нужен слейву, которого
+// мастер заполняет снимком: записи до next покрыты снимком, а остальных у слейва нет. Как и
+// Rewind, работает с открытым WAL, только пока в нем нет принятых и еще не записанных записей
+func (w *WAL) Reset(next uint64) error {
+	w.flushMutex.Lock()
+	defer w.flushMutex.Unlock()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.pending > 0 {
+		return ErrWritesPending
+	}
+
+	w.segmentMutex.Lock()
+	defer w.segmentMutex.Unlock()
+
+	// Текущий сегмент закрывается: он будет удален
+	if w.fsync == FsyncInterval {
+		w.syncPendingLocked()
+	}
+	w.currentFile.Close()
+	w.dirty = false
+
+	// Новый сегмент создается до удаления старых: если удаление прервется, оставшиеся
+	// сегменты при запуске окажутся покрыты снимком
+	path := filepath.Join(w.config.DataDirectory, SegmentName(next))
+	file, size, err := createSegment(path)
+	if err != nil {
+		return fmt.Errorf("не удалось создать сегмент WAL: %w", err)
+	}
+	syncDir(w.config.DataDirectory)
+
+	removed := 0
+	var removeErr error
+	for _, segment := range w.segments {
+		if segment == path {
+			continue
+		}
+		if err := os.Remove(segment); err != nil && !errors.Is(err, os.ErrNotExist) {
+			removeErr = fmt.Errorf("не удалось удалить сегмент WAL: %w", err)
+			continue
+		}
+		removed++
+	}
+
+	w.segments = []string{path}
+	w.currentFile = file
+	w.currentSize = size
+	w.nextLSN = next
+	w.written.Store(next)
+
+	w.logger.Info("WAL начат заново",
+		zap.Uint64("next_lsn", next),
+		zap.Int("removed_segments", removed))
+	return removeErr
+}
@@ -0,0 +1,165 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/keij-sama/Concurrency/pkg/logger"
+	"go.uber.org/zap"
+)
+
+// Сегмент называется по LSN своей первой записи: wal_<LSN, 20 цифр>.log. Номер дополнен
+// нулями, поэтому порядок имен совпадает с порядком LSN и при сортировке строк.
+// Номер нового сегмента не больше LSN его первой записи и больше LSN всех записей
+// предыдущих сегментов, поэтому порядок сохраняется и для пустого текущего сегмента
+const (
+	segmentPrefix    = "wal_"
+	segmentSuffix    = ".log"
+	segmentLSNDigits = 20
+)
+
+// SegmentName возвращает имя сегмента, начинающегося с записи lsn
+func SegmentName(lsn uint64) string {
+	return fmt.Sprintf("%s%0*d%s", segmentPrefix, segmentLSNDigits, lsn, segmentSuffix)
+}
+
+// SegmentLSN возвращает LSN первой записи сегмента по имени файла. Для имен старого
+// формата wal_N.log и посторонних файлов возвращает false
+func SegmentLSN(name string) (uint64, bool) {
+	number, ok := segmentNumber(name)
+	if !ok || len(number) != segmentLSNDigits {
+		return 0, false
+	}
+	lsn, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return lsn, true
+}
+
+// ListSegments возвращает имена сегментов директории в порядке LSN
+func ListSegments(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, entry := range entries {
+		if _, ok := SegmentLSN(entry.Name()); ok && !entry.IsDir() {
+			segments = append(segments, entry.Name())
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		a, _ := SegmentLSN(segments[i])
+		b, _ := SegmentLSN(segments[j])
+		return a < b
+	})
+	return segments, nil
+}
+
+// segmentNumber выделяет номер из имени файла wal_N.log
+func segmentNumber(name string) (string, bool) {
+	name = filepath.Base(name)
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return "", false
+	}
+	number := strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix)
+	if number == "" || strings.TrimLeft(number, "0123456789") != "" {
+		return "", false
+	}
+	return number, true
+}
+
+// migrateSegments однократно переименовывает сегменты старого формата wal_N.log, названные
+// по порядковому номеру, в имена по LSN первой записи. Сегменты без записей удаляются,
+// сегменты без единой целой записи переименовываются в *.corrupt и больше не читаются.
+// Прерванная миграция продолжается при следующем запуске
+func migrateSegments(directory string, log logger.Logger) error {
+	legacy, err := legacySegments(directory)
+	if err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	for _, path := range legacy {
+		logs, _, err := readLogs([]string{path}, true)
+		if err != nil {
+			return fmt.Errorf("не удалось прочитать сегмент %s при переименовании: %w", path, err)
+		}
+
+		if len(logs) == 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if info.Size() <= int64(segmentHeaderSize) {
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("не удалось удалить пустой сегмент %s: %w", path, err)
+				}
+				continue
+			}
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				return fmt.Errorf("не удалось переименовать сегмент %s: %w", path, err)
+			}
+			log.Error("Сегмент WAL без целых записей отложен",
+				zap.String("segment", path),
+				zap.String("renamed_to", path+".corrupt"),
+			)
+			continue
+		}
+
+		target := filepath.Join(directory, SegmentName(logs[0].LSN))
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("не удалось переименовать сегмент %s: %s уже существует", path, target)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return fmt.Errorf("не удалось переименовать сегмент %s: %w", path, err)
+		}
+		log.Info("Сегмент WAL переименован по LSN",
+			zap.String("segment", filepath.Base(path)),
+			zap.String("renamed_to", filepath.Base(target)),
+		)
+	}
+
+	syncDir(directory)
+	return nil
+}
+
+// legacySegments возвращает пути сегментов со старыми именами wal_N.log
+func legacySegments(directory string) ([]string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать директорию WAL: %w", err)
+	}
+
+	var legacy []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := SegmentLSN(name); ok || entry.IsDir() {
+			continue
+		}
+		if _, ok := segmentNumber(name); ok {
+			legacy = append(legacy, filepath.Join(directory, name))
+		}
+	}
+	return legacy, nil
+}
+
+// syncDir синхронизирует директорию, чтобы переименование файлов пережило сбой питания
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,79 @@
+package wal
+
+import "sync"
+
+// Subscription - подписка на записи, записанные в WAL. Батчи приходят в канал C в порядке LSN
+// сразу после записи в файл, до подтверждения вызывающим. Если подписчик не успевает забирать
+// батчи и буфер канала заполнен, WAL отменяет подписку и закрывает C: пропущенные записи нужно
+// дочитать через ReadFrom и подписаться снова
+type Subscription struct {
+	C   <-chan []Log
+	ch  chan []Log
+	wal *WAL
+}
+
+// subscribers - подписчики WAL
+type subscribers struct {
+	mutex sync.Mutex
+	list  []*Subscription
+}
+
+// Subscribe подписывает на записи WAL. buffer - сколько батчей может ждать в канале подписки
+func (w *WAL) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = 1
+	}
+	ch := make(chan []Log, buffer)
+	sub := &Subscription{C: ch, ch: ch, wal: w}
+
+	w.subscribers.mutex.Lock()
+	w.subscribers.list = append(w.subscribers.list, sub)
+	w.subscribers.mutex.Unlock()
+	return sub
+}
+
+// Close отменяет подписку. Повторный вызов и вызов после отмены самим WAL ничего не делают
+func (s *Subscription) Close() {
+	subs := &s.wal.subscribers
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+
+	for i, sub := range subs.list {
+		if sub == s {
+			subs.list = append(subs.list[:i], subs.list[i+1:]...)
+			close(s.ch)
+			return
+		}
+	}
+}
+
+// publish передает подписчикам записанный батч. Батчи записываются по одному под flushMutex,
+// поэтому порядок LSN сохраняется. Подписчик с заполненным буфером отписывается
+func (w *WAL) publish(batch []WriteRequest) {
+	subs := &w.subscribers
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+
+	if len(subs.list) == 0 {
+		return
+	}
+
+	logs := make([]Log, len(batch))
+	for i, req := range batch {
+		logs[i] = req.Log
+	}
+
+	kept := subs.list[:0]
+	for _, sub := range subs.list {
+		select {
+		case sub.ch <- logs:
+			kept = append(kept, sub)
+		default:
+			close(sub.ch)
+		}
+	}
+	for i := len(kept); i < len(subs.list); i++ {
+		subs.list[i] = nil
+	}
+	subs.list = kept
+}
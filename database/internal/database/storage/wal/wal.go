@@ -1,34 +1,110 @@
 package wal
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/keij-sama/Concurrency/pkg/logger"
 	"go.uber.org/zap"
 )
 
 const (
-	OperationSet = "SET"
-	OperationDel = "DEL"
+	OperationSet     = "SET"
+	OperationDel     = "DEL"
+	OperationExpire  = "EXPIRE"
+	OperationPersist = "PERSIST"
+	OperationBatch   = "BATCH"
+	// OperationNoop - пустая запись, которую новый лидер Raft пишет в начале своего терма,
+	// чтобы зафиксировать записи предыдущих термов. Данные не меняет
+	OperationNoop = "NOOP"
 )
 
+// ErrInvalidBatch возвращается, если аргументы записи BATCH повреждены
+var ErrInvalidBatch = errors.New("некорректная запись BATCH")
+
 // LogRecord представляет запись в WAL
 type Log struct {
 	LSN       uint64   `json:"lsn"`
+	Timestamp int64    `json:"timestamp,omitempty"` // время записи в unix-наносекундах, 0 для старых сегментов
 	Operation string   `json:"operation"`
 	Args      []string `json:"args"`
 }
 
+// Time возвращает время записи или нулевое время для записей без него
+func (l Log) Time() time.Time {
+	if l.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, l.Timestamp)
+}
+
+// logJSON - представление Log в сегменте. encoding/json заменяет байты, не образующие
+// корректный UTF-8, поэтому аргументы с такими байтами записываются в base64 в поле args_base64
+type logJSON struct {
+	LSN        uint64   `json:"lsn"`
+	Timestamp  int64    `json:"timestamp,omitempty"`
+	Operation  string   `json:"operation"`
+	Args       []string `json:"args"`
+	ArgsBase64 [][]byte `json:"args_base64,omitempty"`
+}
+
+// MarshalJSON кодирует запись, сохраняя произвольные байты в аргументах
+func (l Log) MarshalJSON() ([]byte, error) {
+	record := logJSON{LSN: l.LSN, Timestamp: l.Timestamp, Operation: l.Operation, Args: l.Args}
+	for _, arg := range l.Args {
+		if !utf8.ValidString(arg) {
+			record.Args = nil
+			record.ArgsBase64 = make([][]byte, len(l.Args))
+			for i, arg := range l.Args {
+				record.ArgsBase64[i] = []byte(arg)
+			}
+			break
+		}
+	}
+	return json.Marshal(record)
+}
+
+// UnmarshalJSON декодирует запись в любом из двух представлений аргументов
+func (l *Log) UnmarshalJSON(data []byte) error {
+	var record logJSON
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	l.LSN = record.LSN
+	l.Timestamp = record.Timestamp
+	l.Operation = record.Operation
+	l.Args = record.Args
+	if record.ArgsBase64 != nil {
+		l.Args = make([]string, len(record.ArgsBase64))
+		for i, arg := range record.ArgsBase64 {
+			l.Args[i] = string(arg)
+		}
+	}
+	return nil
+}
+
 // Представляет запрос в WAL
 type WriteRequest struct {
 	Log  Log
-	Done chan error
+	Done chan Result
+}
+
+// Result - ответ на запрос записи: ошибка или гарантия, которую получила запись, и ее LSN
+type Result struct {
+	Err        error
+	Durability Durability
+	LSN        uint64
 }
 
 // NewWriteRequest создает новый запрос на запись
@@ -38,12 +114,12 @@ func NewWriteRequest(operation string, args []string) WriteRequest {
 			Operation: operation,
 			Args:      args,
 		},
-		Done: make(chan error, 1),
+		Done: make(chan Result, 1),
 	}
 }
 
 // Возвращает канал для получения результата операций
-func (w WriteRequest) FutureResponse() chan error {
+func (w WriteRequest) FutureResponse() chan Result {
 	return w.Done
 }
 
@@ -54,6 +130,11 @@ type WALConfig struct {
 	FlushingBatchTimeout time.Duration // таймаут записи
 	MaxSegmentSize       int64         // максимальный размер сегмента в байтах
 	DataDirectory        string        // директория для хранения wal
+	RecoveryMode         RecoveryMode  // обработка поврежденных записей при запуске, по умолчанию truncate_tail
+	Fsync                FsyncPolicy   // always, batch, interval:<dur> или never, по умолчанию batch
+	ReadOnly             bool          // только чтение: файлы сегментов не создаются, не переименовываются и не обрезаются
+	MaxPendingWrites     int           // предел записей, принятых, но еще не записанных на диск, по умолчанию 10000
+	QueueTimeout         time.Duration // сколько запись ждет места в очереди до ErrWALOverloaded, по умолчанию 1s
 }
 
 type WAL struct {
@@ -62,11 +143,31 @@ type WAL struct {
 	currentFile  *os.File
 	currentSize  int64
 	nextLSN      uint64
+	written      atomic.Uint64 // LSN, следующий за последней записью, записанной в файл
 	segments     []string
+	fsync        FsyncPolicy
+	syncInterval time.Duration // период fsync для политики interval
+	dirty        bool          // в текущем сегменте есть записи, не синхронизированные с диском
+	recovered    []Log         // записи, прочитанные при открытии в режиме только для чтения
 	mutex        sync.Mutex
-	batch        []WriteRequest
-	batches      chan []WriteRequest
+	batch        []WriteRequest   // накапливаемый батч
+	queue        [][]WriteRequest // заполненные батчи в порядке LSN, ожидающие записи
+	queued       chan struct{}    // сигнал о новом батче в queue
+	flushMutex   sync.Mutex       // батчи записываются по одному, чтобы сохранить порядок LSN
 	segmentMutex sync.Mutex
+	stop         context.CancelFunc // останавливает горутину, запущенную Start
+	stopped      chan struct{}      // закрывается, когда горутина Start завершилась
+
+	// Состояние очереди под mutex
+	pending   int           // записи, принятые, но еще не записанные на диск
+	freed     chan struct{} // закрывается и заменяется новым, когда в очереди освобождается место
+	accepted  uint64
+	waited    uint64
+	rejected  uint64
+	waitTotal time.Duration
+	waitMax   time.Duration
+
+	subscribers subscribers
 }
 
 // NewWAL создает новый экземпляр WAL
@@ -86,25 +187,65 @@ func NewWAL(config WALConfig, logger logger.Logger) (*WAL, error) {
 	if config.MaxSegmentSize <= 0 {
 		config.MaxSegmentSize = 10 * 1024 * 1024 // 10MB по умолчанию
 	}
+	if config.MaxPendingWrites <= 0 {
+		config.MaxPendingWrites = 10000
+	}
+	if config.MaxPendingWrites < config.FlushingBatchSize {
+		// Иначе батч никогда не заполнится и запись будет ждать таймаута батча
+		config.MaxPendingWrites = config.FlushingBatchSize
+	}
+	if config.QueueTimeout <= 0 {
+		config.QueueTimeout = time.Second
+	}
+	mode, err := ParseRecoveryMode(string(config.RecoveryMode))
+	if err != nil {
+		return nil, err
+	}
+	config.RecoveryMode = mode
+	fsync, syncInterval, err := ParseFsyncPolicy(string(config.Fsync))
+	if err != nil {
+		return nil, err
+	}
 
 	// Создаем директорию для WAL
-	if err := os.MkdirAll(config.DataDirectory, 0755); err != nil {
-		return nil, fmt.Errorf("не удалось создать директорию WAL: %w", err)
+	if !config.ReadOnly {
+		if err := os.MkdirAll(config.DataDirectory, 0755); err != nil {
+			return nil, fmt.Errorf("не удалось создать директорию WAL: %w", err)
+		}
 	}
 
-	// Ищем существующие сегменты
-	segments, err := filepath.Glob(filepath.Join(config.DataDirectory, "wal_*.log"))
+	// Переименовываем сегменты старого формата, названные по порядковому номеру
+	if config.ReadOnly {
+		legacy, err := legacySegments(config.DataDirectory)
+		if err != nil {
+			return nil, err
+		}
+		if len(legacy) > 0 {
+			return nil, fmt.Errorf("сегменты старого формата нельзя прочитать в режиме только для чтения, запустите WAL один раз в обычном режиме: %s", legacy[0])
+		}
+	} else if err := migrateSegments(config.DataDirectory, logger); err != nil {
+		return nil, err
+	}
+
+	// Ищем существующие сегменты в порядке LSN
+	names, err := ListSegments(config.DataDirectory)
 	if err != nil {
 		return nil, fmt.Errorf("не удалось найти сегменты WAL: %w", err)
 	}
+	segments := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		segments = append(segments, filepath.Join(config.DataDirectory, name))
+	}
 
 	// Создаем или открываем текущий файл сегмента
 	var currentFile *os.File
+	var currentSize int64
 	var nextLSN uint64 = 0
+	var logs []Log
 
 	if len(segments) > 0 {
 		// Если есть существующие сегменты, восстанавливаем последний LSN
-		logs, err := readLogs(segments)
+		logs, err = recoverSegments(segments, config.RecoveryMode, config.ReadOnly, logger)
 		if err != nil {
 			return nil, fmt.Errorf("не удалось прочитать логи: %w", err)
 		}
@@ -115,52 +256,70 @@ func NewWAL(config WALConfig, logger logger.Logger) (*WAL, error) {
 			}
 		}
 
-		// Открываем новый сегмент
-		currentFile, err = os.OpenFile(
-			filepath.Join(config.DataDirectory, fmt.Sprintf("wal_%d.log", len(segments))),
-			os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-			0644,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("не удалось создать новый сегмент WAL: %w", err)
+		// После сжатия снимком все сегменты могут быть удалены, тогда LSN продолжит хранилище
+		if lsn, _ := SegmentLSN(names[len(names)-1]); lsn > nextLSN {
+			nextLSN = lsn
 		}
-	} else {
-		// Создаем первый сегмент
-		currentFile, err = os.OpenFile(
-			filepath.Join(config.DataDirectory, "wal_0.log"),
-			os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-			0644,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("не удалось создать первый сегмент WAL: %w", err)
+	}
+
+	if config.ReadOnly {
+		w := &WAL{
+			config:    config,
+			logger:    logger,
+			nextLSN:   nextLSN,
+			segments:  segments,
+			fsync:     fsync,
+			recovered: logs,
+			queued:    make(chan struct{}, 1),
 		}
-		segments = []string{filepath.Join(config.DataDirectory, "wal_0.log")}
+		w.written.Store(nextLSN)
+		return w, nil
 	}
 
-	// Получаем текущий размер файла
-	info, err := currentFile.Stat()
+	// Открываем сегмент для новых записей. Если последний сегмент пуст, он используется повторно
+	path := filepath.Join(config.DataDirectory, SegmentName(nextLSN))
+	currentFile, currentSize, err = createSegment(path)
 	if err != nil {
-		currentFile.Close()
-		return nil, fmt.Errorf("не удалось получить информацию о файле: %w", err)
+		return nil, fmt.Errorf("не удалось создать новый сегмент WAL: %w", err)
+	}
+	if len(segments) == 0 || segments[len(segments)-1] != path {
+		segments = append(segments, path)
 	}
 
-	return &WAL{
-		config:      config,
-		logger:      logger,
-		currentFile: currentFile,
-		currentSize: info.Size(),
-		nextLSN:     nextLSN,
-		segments:    segments,
-		batches:     make(chan []WriteRequest, 1),
-	}, nil
+	w := &WAL{
+		config:       config,
+		logger:       logger,
+		currentFile:  currentFile,
+		currentSize:  currentSize,
+		nextLSN:      nextLSN,
+		segments:     segments,
+		fsync:        fsync,
+		syncInterval: syncInterval,
+		queued:       make(chan struct{}, 1),
+		freed:        make(chan struct{}),
+	}
+	w.written.Store(nextLSN)
+	return w, nil
 }
 
 // Start запускает процесс WAL
 func (w *WAL) Start(ctx context.Context) {
+	ctx, w.stop = context.WithCancel(ctx)
+	w.stopped = make(chan struct{})
 	go func() {
+		defer close(w.stopped)
+
 		ticker := time.NewTicker(w.config.FlushingBatchTimeout)
 		defer ticker.Stop()
 
+		// Периодический fsync только для политики interval, иначе канал остается nil
+		var syncTick <-chan time.Time
+		if w.fsync == FsyncInterval {
+			syncTicker := time.NewTicker(w.syncInterval)
+			defer syncTicker.Stop()
+			syncTick = syncTicker.C
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -173,11 +332,13 @@ func (w *WAL) Start(ctx context.Context) {
 			case <-ctx.Done():
 				w.flushBatch()
 				return
-			case batch := <-w.batches:
-				w.writeBatch(batch)
+			case <-w.queued:
+				w.flushBatch()
 				ticker.Reset(w.config.FlushingBatchTimeout)
 			case <-ticker.C:
 				w.flushBatch()
+			case <-syncTick:
+				w.syncPending()
 			}
 		}
 	}()
@@ -185,88 +346,360 @@ func (w *WAL) Start(ctx context.Context) {
 
 // Recover восстанавливает данные из WAL
 func (w *WAL) Recover() ([]Log, error) {
-	return readLogs(w.segments)
+	if w.config.ReadOnly {
+		// Файлы не изменялись, поэтому недописанный хвост отброшен только при чтении в NewWAL
+		return w.recovered, nil
+	}
+
+	// Хвост уже обрезан в NewWAL, о пропущенных записях сообщено там же
+	logs, _, err := readLogs(w.segments, w.config.RecoveryMode == RecoverySkipCorrupt)
+	return logs, err
 }
 
-// Set записывает операцию SET в WAL
-func (w *WAL) Set(key, value string) chan error {
-	return w.push("SET", []string{key, value})
+// NextLSN возвращает LSN, который получит следующая запись
+func (w *WAL) NextLSN() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.nextLSN
 }
 
-// Del записывает операцию DEL в WAL
-func (w *WAL) Del(key string) chan error {
-	return w.push("DEL", []string{key})
+// WrittenLSN возвращает LSN, следующий за последней записью, записанной в файл. В отличие
+// от NextLSN не учитывает записи, которые еще ждут в очереди
+func (w *WAL) WrittenLSN() uint64 {
+	return w.written.Load()
 }
 
-// push добавляет операцию в батч
-func (w *WAL) push(operation string, args []string) chan error {
+// AdvanceLSN продвигает счетчик LSN не ниже next. Нужен после загрузки снимка: покрытые
+// им сегменты удалены, и по оставшимся нельзя восстановить последний LSN
+func (w *WAL) AdvanceLSN(next uint64) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
+	if next > w.nextLSN {
+		w.nextLSN = next
+	}
+	if next > w.written.Load() {
+		w.written.Store(next)
+	}
+}
+
+// Compact удаляет сегменты, все записи которых имеют LSN не больше lsn, то есть покрыты снимком.
+// Если archiveDir задан, сегменты переносятся туда. Текущий сегмент не затрагивается.
+// Возвращает количество удаленных сегментов
+func (w *WAL) Compact(lsn uint64, archiveDir string) (int, error) {
+	w.segmentMutex.Lock()
+	candidates := make([]string, 0, len(w.segments))
+	for _, segment := range w.segments {
+		if segment == w.currentFile.Name() {
+			break
+		}
+		candidates = append(candidates, segment)
+	}
+	w.segmentMutex.Unlock()
+
+	// Сегменты читаются без блокировки, чтобы не задерживать запись
+	covered := 0
+	for _, segment := range candidates {
+		logs, err := ReadLogsFromFile(segment)
+		if err != nil {
+			return 0, err
+		}
+		if len(logs) > 0 && logs[len(logs)-1].LSN > lsn {
+			break
+		}
+		covered++
+	}
+
+	if archiveDir != "" && covered > 0 {
+		if err := os.MkdirAll(archiveDir, 0755); err != nil {
+			return 0, fmt.Errorf("не удалось создать директорию архива WAL: %w", err)
+		}
+	}
+
+	w.segmentMutex.Lock()
+	defer w.segmentMutex.Unlock()
+
+	removed := 0
+	for ; removed < covered; removed++ {
+		segment := candidates[removed]
+		var err error
+		if archiveDir != "" {
+			err = os.Rename(segment, filepath.Join(archiveDir, filepath.Base(segment)))
+		} else {
+			err = os.Remove(segment)
+		}
+		if err != nil {
+			err = fmt.Errorf("не удалось удалить сегмент WAL: %w", err)
+			w.segments = w.segments[removed:]
+			return removed, err
+		}
+	}
+	w.segments = w.segments[removed:]
+
+	return removed, nil
+}
+
+// Set записывает операцию SET в WAL
+func (w *WAL) Set(key, value string) chan Result {
+	return w.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx записывает операцию SET в WAL. Контекст ограничивает ожидание места в очереди:
+// если он завершится раньше, запись не принимается и возвращается ctx.Err()
+func (w *WAL) SetCtx(ctx context.Context, key, value string) chan Result {
+	return w.push(ctx, OperationSet, []string{key, value})
+}
+
+// SetWithExpiration записывает операцию SET с абсолютным сроком истечения ключа.
+// Срок хранится как unix-время в миллисекундах, поэтому повтор лога не продлевает жизнь ключа
+func (w *WAL) SetWithExpiration(key, value string, expiresAt time.Time) chan Result {
+	return w.SetWithExpirationCtx(context.Background(), key, value, expiresAt)
+}
+
+// SetWithExpirationCtx - SetWithExpiration с ожиданием места в очереди, ограниченным контекстом
+func (w *WAL) SetWithExpirationCtx(ctx context.Context, key, value string, expiresAt time.Time) chan Result {
+	return w.push(ctx, OperationSet, []string{key, value, FormatDeadline(expiresAt)})
+}
+
+// Del записывает операцию DEL в WAL
+func (w *WAL) Del(key string) chan Result {
+	return w.DelCtx(context.Background(), key)
+}
+
+// DelCtx записывает операцию DEL в WAL с ожиданием места в очереди, ограниченным контекстом
+func (w *WAL) DelCtx(ctx context.Context, key string) chan Result {
+	return w.push(ctx, OperationDel, []string{key})
+}
+
+// Expire записывает операцию EXPIRE с абсолютным сроком истечения ключа
+func (w *WAL) Expire(key string, expiresAt time.Time) chan Result {
+	return w.ExpireCtx(context.Background(), key, expiresAt)
+}
+
+// ExpireCtx - Expire с ожиданием места в очереди, ограниченным контекстом
+func (w *WAL) ExpireCtx(ctx context.Context, key string, expiresAt time.Time) chan Result {
+	return w.push(ctx, OperationExpire, []string{key, FormatDeadline(expiresAt)})
+}
+
+// Persist записывает операцию PERSIST, снимающую срок жизни с ключа
+func (w *WAL) Persist(key string) chan Result {
+	return w.PersistCtx(context.Background(), key)
+}
+
+// PersistCtx - Persist с ожиданием места в очереди, ограниченным контекстом
+func (w *WAL) PersistCtx(ctx context.Context, key string) chan Result {
+	return w.push(ctx, OperationPersist, []string{key})
+}
+
+// Batch записывает несколько операций одной записью. При восстановлении и на репликах
+// такая запись применяется целиком, поэтому транзакция не может примениться частично.
+// Единственная операция записывается обычной записью
+func (w *WAL) Batch(logs []Log) chan Result {
+	return w.BatchCtx(context.Background(), logs)
+}
+
+// BatchCtx - Batch с ожиданием места в очереди, ограниченным контекстом
+func (w *WAL) BatchCtx(ctx context.Context, logs []Log) chan Result {
+	req := newBatchRequest(logs)
+	return w.submit(req, w.admit(ctx))
+}
+
+// TryBatch - Batch без ожидания места в очереди: если очередь заполнена, канал сразу
+// содержит ErrWALOverloaded. Подходит для вызова под блокировками, которые нельзя
+// удерживать, пока очередь освобождается
+func (w *WAL) TryBatch(logs []Log) chan Result {
+	req := newBatchRequest(logs)
+	return w.submit(req, w.tryAdmit())
+}
+
+// newBatchRequest создает запрос на запись операций. Единственная операция записывается
+// обычной записью
+func newBatchRequest(logs []Log) WriteRequest {
+	if len(logs) == 1 {
+		return NewWriteRequest(logs[0].Operation, logs[0].Args)
+	}
+	return NewWriteRequest(OperationBatch, EncodeBatch(logs))
+}
+
+// Noop записывает пустую запись NOOP
+func (w *WAL) Noop() chan Result {
+	return w.push(context.Background(), OperationNoop, nil)
+}
+
+// EncodeBatch упаковывает операции в аргументы записи BATCH:
+// для каждой операции ее имя, количество аргументов и сами аргументы
+func EncodeBatch(logs []Log) []string {
+	args := make([]string, 0, 4*len(logs))
+	for _, log := range logs {
+		args = append(args, log.Operation, strconv.Itoa(len(log.Args)))
+		args = append(args, log.Args...)
+	}
+	return args
+}
+
+// DecodeBatch распаковывает операции из аргументов записи BATCH
+func DecodeBatch(args []string) ([]Log, error) {
+	var logs []Log
+	for i := 0; i < len(args); {
+		if i+2 > len(args) {
+			return nil, ErrInvalidBatch
+		}
+		count, err := strconv.Atoi(args[i+1])
+		if err != nil || count < 0 || i+2+count > len(args) {
+			return nil, ErrInvalidBatch
+		}
+		if args[i] == OperationBatch {
+			return nil, fmt.Errorf("%w: вложенный BATCH", ErrInvalidBatch)
+		}
+
+		logs = append(logs, Log{
+			Operation: args[i],
+			Args:      append([]string(nil), args[i+2:i+2+count]...),
+		})
+		i += 2 + count
+	}
+	return logs, nil
+}
+
+// FormatDeadline кодирует абсолютный срок истечения для записи в лог
+func FormatDeadline(deadline time.Time) string {
+	return strconv.FormatInt(deadline.UnixMilli(), 10)
+}
+
+// ParseDeadline декодирует абсолютный срок истечения из аргумента лога
+func ParseDeadline(arg string) (time.Time, error) {
+	ms, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("некорректный срок истечения %q: %w", arg, err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// push добавляет операцию в батч. Если очередь заполнена, ждет места не дольше QueueTimeout
+// и времени жизни ctx, не удерживая блокировку; при отказе канал сразу содержит ErrWALOverloaded
+// или ctx.Err(). Принятая запись будет записана, даже если ctx завершится раньше
+func (w *WAL) push(ctx context.Context, operation string, args []string) chan Result {
 	// Создаем запрос на запись
 	req := NewWriteRequest(operation, args)
+	return w.submit(req, w.admit(ctx))
+}
 
-	// Устанавливаем LSN
+// submit назначает запросу LSN и добавляет его в батч, если admitErr == nil: тогда
+// вызывается под w.mutex, захваченным admit или tryAdmit. Иначе канал сразу содержит admitErr
+func (w *WAL) submit(req WriteRequest, admitErr error) chan Result {
+	if admitErr != nil {
+		req.Done <- Result{Err: admitErr}
+		close(req.Done)
+		return req.Done
+	}
+	defer w.mutex.Unlock()
+
+	// Устанавливаем LSN и время. Время берется под той же блокировкой, поэтому
+	// не убывает вместе с LSN, если не переводить часы назад
 	req.Log.LSN = w.nextLSN
+	req.Log.Timestamp = time.Now().UnixNano()
 	w.nextLSN++
 
+	w.enqueue(req)
+	return req.Done
+}
+
+// enqueue добавляет запрос в батч и ставит заполненный батч в очередь на запись.
+// Вызывается под w.mutex
+func (w *WAL) enqueue(req WriteRequest) {
 	// Добавляем в батч
 	w.batch = append(w.batch, req)
 
-	// Если батч достиг максимального размера, отправляем его на запись
+	// Если батч достиг максимального размера, ставим его в очередь на запись
 	if len(w.batch) >= w.config.FlushingBatchSize {
-		w.batches <- w.batch
-		w.batch = nil
+		w.queueBatch()
 	}
+}
 
-	return req.Done
+// queueBatch ставит текущий батч в очередь на запись, не дожидаясь его заполнения.
+// Вызывается под w.mutex
+func (w *WAL) queueBatch() {
+	if len(w.batch) == 0 {
+		return
+	}
+	w.queue = append(w.queue, w.batch)
+	w.batch = nil
+	select {
+	case w.queued <- struct{}{}:
+	default:
+	}
 }
 
-// flushBatch записывает текущий батч на диск
+// flushBatch записывает на диск заполненные батчи из очереди и текущий батч
 func (w *WAL) flushBatch() {
-	var batch []WriteRequest
+	w.flushMutex.Lock()
+	defer w.flushMutex.Unlock()
 
 	w.mutex.Lock()
-	batch = w.batch
+	batches := w.queue
+	if len(w.batch) > 0 {
+		batches = append(batches, w.batch)
+	}
+	w.queue = nil
 	w.batch = nil
 	w.mutex.Unlock()
 
-	if len(batch) > 0 {
+	for _, batch := range batches {
 		w.writeBatch(batch)
+		w.release(len(batch))
 	}
 }
 
-// writeBatch записывает батч в файл
+// Durability возвращает гарантию, с которой подтверждаются записи
+func (w *WAL) Durability() Durability {
+	return w.fsync.Durability()
+}
+
+// writeBatch записывает батч в файл. В режиме always каждая запись пишется
+// и синхронизируется с диском отдельно
 func (w *WAL) writeBatch(batch []WriteRequest) {
-	if len(batch) == 0 {
+	if w.fsync != FsyncAlways {
+		w.writeRequests(batch)
 		return
 	}
-
-	// Извлекаем логи из запросов
-	logs := make([]Log, len(batch))
-	for i, req := range batch {
-		logs[i] = req.Log
+	for i := range batch {
+		w.writeRequests(batch[i : i+1])
 	}
+}
 
-	// Сериализуем логи в JSON
-	data, err := json.Marshal(logs)
-	if err != nil {
-		w.logger.Error("Не удалось сериализовать логи", zap.Error(err))
-		completeAllWithError(batch, err)
+// writeRequests записывает запросы в файл одним вызовом и подтверждает их
+func (w *WAL) writeRequests(batch []WriteRequest) {
+	if len(batch) == 0 {
 		return
 	}
 
+	// Сериализуем логи в двоичный формат, каждая запись со своей контрольной суммой
+	var data []byte
+	for _, req := range batch {
+		var err error
+		data, err = appendRecord(data, req.Log)
+		if err != nil {
+			w.logger.Error("Не удалось сериализовать логи", zap.Error(err))
+			completeAllWithError(batch, err)
+			return
+		}
+	}
+
 	// Проверяем, нужно ли создать новый сегмент
 	w.segmentMutex.Lock()
-	if w.currentSize+int64(len(data)+1) > w.config.MaxSegmentSize {
-		// Закрываем текущий файл
+	// Пустой сегмент не сменяется, иначе новый получил бы то же имя
+	if w.currentSize+int64(len(data)) > w.config.MaxSegmentSize && w.currentSize > int64(segmentHeaderSize) {
+		// Закрываем текущий файл, при политике interval записи в нем должны попасть на диск
+		if w.fsync == FsyncInterval {
+			w.syncPendingLocked()
+		}
 		w.currentFile.Close()
+		w.dirty = false
 
-		// Создаем новый сегмент
-		newFile, err := os.OpenFile(
-			filepath.Join(w.config.DataDirectory, fmt.Sprintf("wal_%d.log", len(w.segments))),
-			os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-			0644,
+		// Создаем новый сегмент, названный по LSN первой записи батча
+		newFile, size, err := createSegment(
+			filepath.Join(w.config.DataDirectory, SegmentName(batch[0].Log.LSN)),
 		)
 		if err != nil {
 			w.logger.Error("Не удалось создать новый сегмент WAL", zap.Error(err))
@@ -276,13 +709,12 @@ func (w *WAL) writeBatch(batch []WriteRequest) {
 		}
 
 		w.currentFile = newFile
-		w.currentSize = 0
+		w.currentSize = size
 		w.segments = append(w.segments, newFile.Name())
 	}
 	w.segmentMutex.Unlock()
 
-	// Записываем данные с переводом строки в конце
-	data = append(data, '\n')
+	// Записываем данные
 	n, err := w.currentFile.Write(data)
 	if err != nil {
 		w.logger.Error("Не удалось записать данные в WAL", zap.Error(err))
@@ -290,25 +722,68 @@ func (w *WAL) writeBatch(batch []WriteRequest) {
 		return
 	}
 
-	// Синхронизируем с диском
+	// Обновляем размер файла
+	w.currentSize += int64(n)
+
+	// Синхронизируем с диском до подтверждения, если этого требует политика.
+	// Без fsync запись передана ОС, это и сообщается в ответе
+	durability := DurabilityOS
+	if w.fsync.Durability() == DurabilityFsync {
+		if err := w.currentFile.Sync(); err != nil {
+			w.logger.Error("Не удалось синхронизировать WAL с диском", zap.Error(err))
+			completeAllWithError(batch, err)
+			return
+		}
+		durability = DurabilityFsync
+	} else {
+		w.dirty = true
+	}
+
+	// Передаем записи подписчикам, например мастеру репликации, и уведомляем о завершении операций
+	w.written.Store(batch[len(batch)-1].Log.LSN + 1)
+	w.publish(batch)
+	completeAllWithSuccess(batch, durability)
+}
+
+// syncPending синхронизирует с диском записи, подтвержденные без fsync. Захватывает flushMutex:
+// Rewind и Reset под ним закрывают и заменяют текущий сегмент
+func (w *WAL) syncPending() {
+	w.flushMutex.Lock()
+	defer w.flushMutex.Unlock()
+
+	w.syncPendingLocked()
+}
+
+// syncPendingLocked - syncPending для вызова под flushMutex
+func (w *WAL) syncPendingLocked() {
+	if !w.dirty {
+		return
+	}
 	if err := w.currentFile.Sync(); err != nil {
 		w.logger.Error("Не удалось синхронизировать WAL с диском", zap.Error(err))
-		completeAllWithError(batch, err)
 		return
 	}
-
-	// Обновляем размер файла
-	w.currentSize += int64(n)
-
-	// Уведомляем о завершении операций
-	completeAllWithSuccess(batch)
+	w.dirty = false
 }
 
 // Close закрывает WAL
 func (w *WAL) Close() error {
+	// Сначала останавливаем горутину Start, чтобы она не писала в закрываемый файл
+	if w.stop != nil {
+		w.stop()
+		<-w.stopped
+	}
+
 	// Записываем оставшиеся данные
 	w.flushBatch()
 
+	w.flushMutex.Lock()
+	defer w.flushMutex.Unlock()
+
+	if w.fsync == FsyncInterval {
+		w.syncPendingLocked()
+	}
+
 	// Закрываем файл
 	if w.currentFile != nil {
 		return w.currentFile.Close()
@@ -316,47 +791,81 @@ func (w *WAL) Close() error {
 	return nil
 }
 
-// readLogs читает логи из сегментов
-func readLogs(segments []string) ([]Log, error) {
-	var allLogs []Log
+// readLogs читает логи из сегментов. Если skip == true, поврежденные записи пропускаются
+// и возвращаются вторым результатом, иначе первая поврежденная запись возвращается как ошибка
+func readLogs(segments []string, skip bool) ([]Log, []*CorruptionError, error) {
+	var (
+		allLogs []Log
+		skipped []*CorruptionError
+	)
 
 	for _, segment := range segments {
-		// Открываем файл сегмента
-		file, err := os.Open(segment)
+		// Читаем файл сегмента целиком, сегменты ограничены MaxSegmentSize
+		data, err := os.ReadFile(segment)
 		if err != nil {
-			return nil, fmt.Errorf("не удалось открыть сегмент WAL: %w", err)
+			return nil, nil, fmt.Errorf("не удалось открыть сегмент WAL: %w", err)
 		}
-		defer file.Close()
 
-		// Читаем файл построчно
-		decoder := json.NewDecoder(file)
-		for {
-			var logs []Log
-			if err := decoder.Decode(&logs); err != nil {
-				if err.Error() == "EOF" {
-					break
-				}
-				return nil, fmt.Errorf("не удалось декодировать логи: %w", err)
-			}
-			allLogs = append(allLogs, logs...)
+		logs, corrupted, err := decodeSegment(segment, data, skip)
+		if err != nil {
+			return nil, nil, fmt.Errorf("не удалось декодировать логи: %w", err)
+		}
+		allLogs = append(allLogs, logs...)
+		skipped = append(skipped, corrupted...)
+	}
+
+	return allLogs, skipped, nil
+}
+
+// createSegment открывает файл сегмента для дозаписи и записывает заголовок, если файл новый.
+// Возвращает файл и его текущий размер
+func createSegment(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("не удалось получить информацию о файле: %w", err)
+	}
+	if info.Size() > int64(segmentHeaderSize) {
+		return file, info.Size(), nil
+	}
+	if info.Size() > 0 {
+		// Пустой сегмент повторно используется после перезапуска. Если он создан
+		// с прежней версией формата, заголовок переписывается под текущую
+		header := make([]byte, info.Size())
+		if _, err := file.ReadAt(header, 0); err == nil && bytes.Equal(header, appendSegmentHeader(nil)) {
+			return file, info.Size(), nil
+		}
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("не удалось перезаписать заголовок сегмента: %w", err)
 		}
 	}
 
-	return allLogs, nil
+	header := appendSegmentHeader(nil)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("не удалось записать заголовок сегмента: %w", err)
+	}
+	return file, int64(len(header)), nil
 }
 
 // completeAllWithError уведомляет о завершении всех запросов с ошибкой
 func completeAllWithError(batch []WriteRequest, err error) {
 	for _, req := range batch {
-		req.Done <- err
+		req.Done <- Result{Err: err}
 		close(req.Done)
 	}
 }
 
-// completeAllWithSuccess уведомляет о успешном завершении всех запросов
-func completeAllWithSuccess(batch []WriteRequest) {
+// completeAllWithSuccess уведомляет о успешном завершении всех запросов с гарантией durability
+func completeAllWithSuccess(batch []WriteRequest, durability Durability) {
 	for _, req := range batch {
-		req.Done <- nil
+		req.Done <- Result{Durability: durability, LSN: req.Log.LSN}
 		close(req.Done)
 	}
 }
@@ -365,17 +874,8 @@ func (w *WAL) GetDirectory() string {
 	return w.config.DataDirectory
 }
 
+// ReadLogsFromFile читает все записи одного сегмента в двоичном или старом JSON формате
 func ReadLogsFromFile(filename string) ([]Log, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("не удалось прочитать файл WAL: %w", err)
-	}
-
-	var logs []Log
-	err = json.Unmarshal(data, &logs)
-	if err != nil {
-		return nil, fmt.Errorf("не удалось декодировать логи: %w", err)
-	}
-
-	return logs, nil
+	logs, _, err := readLogs([]string{filename}, false)
+	return logs, err
 }
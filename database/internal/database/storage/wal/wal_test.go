@@ -3,7 +3,10 @@ package wal
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
 	"testing"
@@ -48,18 +51,18 @@ func TestWAL(t *testing.T) {
 
 	// Добавляем записи в WAL
 	done1 := wal.Set("key1", "value1")
-	if err := <-done1; err != nil {
+	if err := (<-done1).Err; err != nil {
 		t.Fatalf("Failed to append SET to WAL: %v", err)
 	}
 
 	done2 := wal.Set("key2", "value2")
-	if err := <-done2; err != nil {
+	if err := (<-done2).Err; err != nil {
 		t.Fatalf("Failed to append SET to WAL: %v", err)
 	}
 
 	// Добавляем запись DEL
 	done3 := wal.Del("key1")
-	if err := <-done3; err != nil {
+	if err := (<-done3).Err; err != nil {
 		t.Fatalf("Failed to append DEL to WAL: %v", err)
 	}
 
@@ -168,7 +171,7 @@ func TestWALSegmentation(t *testing.T) {
 		value := fmt.Sprintf("value%d", i)
 
 		done := wal.Set(key, value)
-		if err := <-done; err != nil {
+		if err := (<-done).Err; err != nil {
 			t.Fatalf("Failed to append SET to WAL: %v", err)
 		}
 
@@ -232,3 +235,1071 @@ func TestWALSegmentation(t *testing.T) {
 		t.Fatalf("Failed to close new WAL: %v", err)
 	}
 }
+
+func TestBatchEncoding(t *testing.T) {
+	logs := []Log{
+		{Operation: OperationSet, Args: []string{"key", "value", "1700000000000"}},
+		{Operation: OperationDel, Args: []string{"other"}},
+		{Operation: OperationPersist, Args: []string{""}},
+	}
+
+	decoded, err := DecodeBatch(EncodeBatch(logs))
+	if err != nil {
+		t.Fatalf("DecodeBatch() error: %v", err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(logs) {
+		t.Errorf("DecodeBatch() = %v, want %v", decoded, logs)
+	}
+
+	invalid := [][]string{
+		{OperationSet},
+		{OperationSet, "x"},
+		{OperationSet, "3", "key", "value"},
+		{OperationBatch, "0"},
+	}
+	for _, args := range invalid {
+		if _, err := DecodeBatch(args); err == nil {
+			t.Errorf("DecodeBatch(%q) should fail", args)
+		}
+	}
+}
+
+func TestBinarySafeArgs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "wal_binary_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+	}
+	log := logger.NewLoggerWithZap(zap.NewNop())
+
+	w, err := NewWAL(config, log)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.Start(ctx)
+
+	values := []string{"{\"name\": \"A B\"}\n", "\x00\xff\xfe binary", ""}
+	for i, value := range values {
+		if err := (<-w.Set(fmt.Sprintf("key%d", i), value)).Err; err != nil {
+			t.Fatalf("Set() error: %v", err)
+		}
+	}
+	cancel()
+	w.Close()
+
+	reader, err := NewWAL(config, log)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer reader.Close()
+
+	logs, err := reader.Recover()
+	if err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+	if len(logs) != len(values) {
+		t.Fatalf("Expected %d logs, got %d", len(values), len(logs))
+	}
+	for i, value := range values {
+		if logs[i].Args[1] != value {
+			t.Errorf("Recovered value %d = %q, want %q", i, logs[i].Args[1], value)
+		}
+	}
+}
+
+func TestCorruptRecords(t *testing.T) {
+	logs := []Log{
+		{LSN: 0, Operation: OperationSet, Args: []string{"a", "1"}},
+		{LSN: 1, Operation: OperationDel, Args: []string{"b"}},
+		{LSN: 2, Operation: OperationSet, Args: []string{"c", "\x00binary\n"}},
+	}
+
+	data := appendSegmentHeader(nil)
+	offsets := make([]int, 0, len(logs))
+	for _, log := range logs {
+		offsets = append(offsets, len(data))
+		var err error
+		if data, err = appendRecord(data, log); err != nil {
+			t.Fatalf("appendRecord() error: %v", err)
+		}
+	}
+
+	decoded, _, err := decodeSegment("wal_0.log", data, false)
+	if err != nil {
+		t.Fatalf("decodeSegment() error: %v", err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(logs) {
+		t.Errorf("decodeSegment() = %v, want %v", decoded, logs)
+	}
+
+	// Измененный бит во второй записи
+	flipped := append([]byte(nil), data...)
+	flipped[offsets[1]+recordHeaderSize+2] ^= 0x01
+
+	// Недописанная последняя запись
+	torn := data[:len(data)-3]
+
+	for name, tc := range map[string]struct {
+		data   []byte
+		offset int
+		valid  int
+	}{
+		"flipped bit": {flipped, offsets[1], 1},
+		"torn write":  {torn, offsets[2], 2},
+	} {
+		decoded, _, err := decodeSegment("wal_0.log", tc.data, false)
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) || !errors.Is(err, ErrCorruptRecord) {
+			t.Fatalf("%s: decodeSegment() error = %v, want CorruptionError", name, err)
+		}
+		if corruption.Offset != int64(tc.offset) || corruption.Segment != "wal_0.log" {
+			t.Errorf("%s: corruption at %s:%d, want offset %d", name, corruption.Segment, corruption.Offset, tc.offset)
+		}
+		if len(decoded) != tc.valid {
+			t.Errorf("%s: decoded %d records before corruption, want %d", name, len(decoded), tc.valid)
+		}
+	}
+
+	if _, err := appendRecord(nil, Log{Operation: "UNKNOWN"}); !errors.Is(err, ErrUnknownOperation) {
+		t.Errorf("appendRecord() of unknown operation error = %v, want ErrUnknownOperation", err)
+	}
+}
+
+func TestReadLegacyJSONSegment(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "wal_legacy_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	legacy := `[{"lsn":0,"operation":"SET","args":["a","1"]},{"lsn":1,"operation":"SET","args":["b","2"]}]` + "\n" +
+		`[{"lsn":2,"operation":"DEL","args":["a"]}]` + "\n"
+	if err := os.WriteFile(filepath.Join(tempDir, "wal_0.log"), []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write legacy segment: %v", err)
+	}
+
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+	}
+	log := logger.NewLoggerWithZap(zap.NewNop())
+
+	// Новые записи дописываются в двоичный сегмент, LSN продолжается
+	w, err := NewWAL(config, log)
+	if err != nil {
+		t.Fatalf("Failed to open WAL with legacy segment: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.Start(ctx)
+	if err := (<-w.Set("c", "3")).Err; err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	cancel()
+	w.Close()
+
+	reader, err := NewWAL(config, log)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer reader.Close()
+
+	logs, err := reader.Recover()
+	if err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+	if len(logs) != 4 || logs[2].Operation != OperationDel || logs[3].LSN != 3 || logs[3].Args[0] != "c" {
+		t.Errorf("Recover() = %+v", logs)
+	}
+
+	// Поврежденная строка старого формата также сообщается с указанием смещения
+	broken := filepath.Join(tempDir, "broken.log")
+	os.WriteFile(broken, []byte(legacy+`[{"lsn":3,`), 0644)
+	if _, err := ReadLogsFromFile(broken); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ReadLogsFromFile() of broken JSON error = %v, want ErrCorruptRecord", err)
+	}
+}
+
+// writeTestSegment записывает сегмент двоичного формата с записями logs и возвращает его содержимое
+func writeTestSegment(t *testing.T, path string, logs []Log, mutate func([]byte) []byte) []byte {
+	t.Helper()
+
+	data := appendSegmentHeader(nil)
+	for _, log := range logs {
+		var err error
+		if data, err = appendRecord(data, log); err != nil {
+			t.Fatalf("appendRecord() error: %v", err)
+		}
+	}
+	if mutate != nil {
+		data = mutate(data)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write segment: %v", err)
+	}
+	return data
+}
+
+func TestRecoveryModes(t *testing.T) {
+	first := []Log{
+		{LSN: 0, Operation: OperationSet, Args: []string{"a", "1"}},
+		{LSN: 1, Operation: OperationSet, Args: []string{"b", "2"}},
+	}
+	second := []Log{
+		{LSN: 2, Operation: OperationSet, Args: []string{"c", "3"}},
+		{LSN: 3, Operation: OperationSet, Args: []string{"d", "4"}},
+	}
+	tornTail := func(data []byte) []byte { return data[:len(data)-5] }
+	// После сбоя файл может быть продлен страницами нулей за недописанной записью
+	zeroedTail := func(data []byte) []byte { return append(data[:len(data)-5], make([]byte, 4096)...) }
+	flipBit := func(data []byte) []byte {
+		data[segmentHeaderSize+recordHeaderSize+1] ^= 0x80
+		return data
+	}
+
+	tests := []struct {
+		name      string
+		mode      RecoveryMode
+		mutate    [2]func([]byte) []byte
+		wantErr   bool
+		wantLogs  int
+		truncated bool // второй сегмент должен быть обрезан до последней целой записи
+	}{
+		{name: "strict fails on torn tail", mode: RecoveryStrict, mutate: [2]func([]byte) []byte{nil, tornTail}, wantErr: true},
+		{name: "truncate_tail drops torn tail", mode: RecoveryTruncateTail, mutate: [2]func([]byte) []byte{nil, tornTail}, wantLogs: 3, truncated: true},
+		{name: "default mode truncates tail", mutate: [2]func([]byte) []byte{nil, tornTail}, wantLogs: 3, truncated: true},
+		{name: "truncate_tail fails in the middle", mode: RecoveryTruncateTail, mutate: [2]func([]byte) []byte{flipBit, nil}, wantErr: true},
+		{name: "truncate_tail fails before valid records in tail", mode: RecoveryTruncateTail, mutate: [2]func([]byte) []byte{nil, flipBit}, wantErr: true},
+		{name: "truncate_tail drops torn tail with zeroed pages", mode: RecoveryTruncateTail, mutate: [2]func([]byte) []byte{nil, zeroedTail}, wantLogs: 3, truncated: true},
+		{name: "skip_corrupt skips in the middle", mode: RecoverySkipCorrupt, mutate: [2]func([]byte) []byte{flipBit, nil}, wantLogs: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			tail := filepath.Join(tempDir, SegmentName(second[0].LSN))
+			writeTestSegment(t, filepath.Join(tempDir, SegmentName(first[0].LSN)), first, tt.mutate[0])
+			writeTestSegment(t, tail, second, tt.mutate[1])
+
+			// Размер сегмента без недописанной записи
+			valid := writeTestSegment(t, filepath.Join(t.TempDir(), "valid.log"), second[:1], nil)
+
+			config := WALConfig{
+				Enabled:              true,
+				FlushingBatchSize:    1,
+				FlushingBatchTimeout: 10 * time.Millisecond,
+				MaxSegmentSize:       1 << 20,
+				DataDirectory:        tempDir,
+				RecoveryMode:         tt.mode,
+			}
+			w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+			if tt.wantErr {
+				if !errors.Is(err, ErrCorruptRecord) {
+					t.Fatalf("NewWAL() error = %v, want ErrCorruptRecord", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewWAL() error: %v", err)
+			}
+			defer w.Close()
+
+			logs, err := w.Recover()
+			if err != nil {
+				t.Fatalf("Recover() error: %v", err)
+			}
+			if len(logs) != tt.wantLogs {
+				t.Errorf("Recover() returned %d logs, want %d", len(logs), tt.wantLogs)
+			}
+
+			if tt.truncated {
+				info, err := os.Stat(tail)
+				if err != nil {
+					t.Fatalf("Stat() error: %v", err)
+				}
+				if info.Size() != int64(len(valid)) {
+					t.Errorf("Tail segment size after truncation = %d, want %d", info.Size(), len(valid))
+				}
+			}
+		})
+	}
+
+	if _, err := ParseRecoveryMode("repair"); err == nil {
+		t.Errorf("ParseRecoveryMode() of unknown mode should fail")
+	}
+}
+
+func TestCheckTornTail(t *testing.T) {
+	logs := []Log{
+		{LSN: 10, Operation: OperationSet, Args: []string{"a", "1"}},
+		{LSN: 11, Operation: OperationSet, Args: []string{"b", "2"}},
+		{LSN: 12, Operation: OperationSet, Args: []string{"c", "3"}},
+	}
+	// Смещения записей в сегменте
+	offsets := make([]int, len(logs))
+	data := appendSegmentHeader(nil)
+	for i, log := range logs {
+		offsets[i] = len(data)
+		var err error
+		if data, err = appendRecord(data, log); err != nil {
+			t.Fatalf("appendRecord() error: %v", err)
+		}
+	}
+
+	check := func(t *testing.T, segment []byte) error {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), SegmentName(logs[0].LSN))
+		if err := os.WriteFile(path, segment, 0644); err != nil {
+			t.Fatalf("Failed to write segment: %v", err)
+		}
+		_, _, err := decodeSegment(path, segment, false)
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) {
+			t.Fatalf("decodeSegment() error = %v, want CorruptionError", err)
+		}
+		return checkTornTail(corruption)
+	}
+
+	t.Run("corrupt record in the middle", func(t *testing.T) {
+		segment := append([]byte(nil), data...)
+		segment[offsets[1]+recordHeaderSize+1] ^= 0x80
+
+		if !hasRecordAfter(segment, offsets[1], 11) {
+			t.Error("hasRecordAfter() = false, want the valid record after the corrupt one")
+		}
+		if err := check(t, segment); !errors.Is(err, ErrCorruptRecord) {
+			t.Errorf("checkTornTail() error = %v, want ErrCorruptRecord", err)
+		}
+	})
+
+	t.Run("torn last record", func(t *testing.T) {
+		segment := append([]byte(nil), data[:len(data)-5]...)
+
+		if hasRecordAfter(segment, offsets[2], 12) {
+			t.Error("hasRecordAfter() = true, want no records after the torn tail")
+		}
+		if err := check(t, segment); err != nil {
+			t.Errorf("checkTornTail() error = %v, want nil", err)
+		}
+	})
+
+	t.Run("records from another segment do not count", func(t *testing.T) {
+		segment := append([]byte(nil), data...)
+		segment[offsets[1]+recordHeaderSize+1] ^= 0x80
+
+		// Запись с LSN меньше ожидаемого не продолжает сегмент
+		if hasRecordAfter(segment, offsets[1], 13) {
+			t.Error("hasRecordAfter() = true for a record before next LSN")
+		}
+	})
+}
+
+func TestSegmentNames(t *testing.T) {
+	if name := SegmentName(42); name != "wal_00000000000000000042.log" {
+		t.Errorf("SegmentName(42) = %s", name)
+	}
+	for name, want := range map[string]bool{
+		SegmentName(7):                 true,
+		"wal_7.log":                    false,
+		"wal_0000000000000000000x.log": false,
+		"snapshot_1.snap":              false,
+	} {
+		if _, ok := SegmentLSN(name); ok != want {
+			t.Errorf("SegmentLSN(%s) ok = %v, want %v", name, ok, want)
+		}
+	}
+
+	// Сегменты упорядочиваются по LSN, а не по длине номера
+	tempDir := t.TempDir()
+	for _, lsn := range []uint64{100, 2, 30} {
+		os.WriteFile(filepath.Join(tempDir, SegmentName(lsn)), nil, 0644)
+	}
+	segments, err := ListSegments(tempDir)
+	if err != nil {
+		t.Fatalf("ListSegments() error: %v", err)
+	}
+	want := []string{SegmentName(2), SegmentName(30), SegmentName(100)}
+	if fmt.Sprint(segments) != fmt.Sprint(want) {
+		t.Errorf("ListSegments() = %v, want %v", segments, want)
+	}
+}
+
+func TestMigrateLegacySegments(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// 12 сегментов старого формата: при сортировке строк wal_10.log и wal_11.log шли бы перед wal_2.log
+	for i := 0; i < 12; i++ {
+		logs := []Log{
+			{LSN: uint64(2 * i), Operation: OperationSet, Args: []string{fmt.Sprintf("key%d", i), "a"}},
+			{LSN: uint64(2*i + 1), Operation: OperationSet, Args: []string{fmt.Sprintf("key%d", i), "b"}},
+		}
+		writeTestSegment(t, filepath.Join(tempDir, fmt.Sprintf("wal_%d.log", i)), logs, nil)
+	}
+	// Пустой сегмент, созданный перезапуском, и сегмент без единой целой записи
+	writeTestSegment(t, filepath.Join(tempDir, "wal_12.log"), nil, nil)
+	os.WriteFile(filepath.Join(tempDir, "wal_13.log"), []byte("not a wal segment"), 0644)
+
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+		RecoveryMode:         RecoveryStrict,
+	}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+
+	logs, err := w.Recover()
+	if err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+	if len(logs) != 24 {
+		t.Fatalf("Recover() returned %d logs, want 24", len(logs))
+	}
+	for i, log := range logs {
+		if log.LSN != uint64(i) {
+			t.Fatalf("Log %d has LSN %d, logs are out of order", i, log.LSN)
+		}
+	}
+
+	// Новая запись попадает в сегмент, названный по ее LSN
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx)
+	if err := (<-w.Set("after", "migration")).Err; err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	w.Close()
+
+	segments, _ := ListSegments(tempDir)
+	if len(segments) != 13 || segments[0] != SegmentName(0) || segments[11] != SegmentName(22) || segments[12] != SegmentName(24) {
+		t.Errorf("Unexpected segments after migration: %v", segments)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "wal_12.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected empty legacy segment to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "wal_13.log.corrupt")); err != nil {
+		t.Errorf("Expected unreadable legacy segment to be set aside: %v", err)
+	}
+}
+
+func TestFsyncPolicies(t *testing.T) {
+	parseTests := []struct {
+		value    string
+		policy   FsyncPolicy
+		interval time.Duration
+		wantErr  bool
+	}{
+		{value: "", policy: FsyncBatch},
+		{value: "always", policy: FsyncAlways},
+		{value: "never", policy: FsyncNever},
+		{value: "interval:250ms", policy: FsyncInterval, interval: 250 * time.Millisecond},
+		{value: "interval:0s", wantErr: true},
+		{value: "interval", wantErr: true},
+		{value: "sometimes", wantErr: true},
+	}
+	for _, tt := range parseTests {
+		policy, interval, err := ParseFsyncPolicy(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFsyncPolicy(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if policy != tt.policy || interval != tt.interval {
+			t.Errorf("ParseFsyncPolicy(%q) = %s, %v, want %s, %v", tt.value, policy, interval, tt.policy, tt.interval)
+		}
+	}
+
+	// В каждом режиме подтвержденные записи читаются после перезапуска
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncBatch, "interval:5ms", FsyncNever} {
+		t.Run(string(policy), func(t *testing.T) {
+			config := WALConfig{
+				Enabled:              true,
+				FlushingBatchSize:    4,
+				FlushingBatchTimeout: time.Millisecond,
+				MaxSegmentSize:       256,
+				DataDirectory:        t.TempDir(),
+				Fsync:                policy,
+			}
+			log := logger.NewLoggerWithZap(zap.NewNop())
+
+			w, err := NewWAL(config, log)
+			if err != nil {
+				t.Fatalf("NewWAL() error: %v", err)
+			}
+			want := DurabilityOS
+			if policy == FsyncAlways || policy == FsyncBatch {
+				want = DurabilityFsync
+			}
+			if w.Durability() != want {
+				t.Errorf("Durability() = %s, want %s", w.Durability(), want)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			w.Start(ctx)
+
+			done := make([]chan Result, 0, 20)
+			for i := 0; i < 20; i++ {
+				done = append(done, w.Set(fmt.Sprintf("key%d", i), "value"))
+			}
+			// Каждый ответ сообщает гарантию, которую получила запись
+			for _, ch := range done {
+				result := <-ch
+				if result.Err != nil {
+					t.Fatalf("Set() error: %v", result.Err)
+				}
+				if result.Durability != want {
+					t.Errorf("Set() durability = %s, want %s", result.Durability, want)
+				}
+			}
+			cancel()
+			w.Close()
+
+			reopened, err := NewWAL(config, log)
+			if err != nil {
+				t.Fatalf("NewWAL() error: %v", err)
+			}
+			defer reopened.Close()
+			logs, err := reopened.Recover()
+			if err != nil {
+				t.Fatalf("Recover() error: %v", err)
+			}
+			if len(logs) != 20 {
+				t.Errorf("Recover() returned %d logs, want 20", len(logs))
+			}
+		})
+	}
+
+	if _, err := NewWAL(WALConfig{Enabled: true, DataDirectory: t.TempDir(), Fsync: "sometimes"}, logger.NewLoggerWithZap(zap.NewNop())); err == nil {
+		t.Errorf("NewWAL() with unknown fsync policy should fail")
+	}
+}
+
+// BenchmarkWALFsync сравнивает пропускную способность записи при разных политиках fsync.
+// Записи идут из нескольких горутин, как запросы разных клиентов
+func BenchmarkWALFsync(b *testing.B) {
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncBatch, "interval:100ms", FsyncNever} {
+		b.Run(string(policy), func(b *testing.B) {
+			config := WALConfig{
+				Enabled:              true,
+				FlushingBatchSize:    100,
+				FlushingBatchTimeout: time.Millisecond,
+				MaxSegmentSize:       64 << 20,
+				DataDirectory:        b.TempDir(),
+				Fsync:                policy,
+			}
+			w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+			if err != nil {
+				b.Fatalf("NewWAL() error: %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			w.Start(ctx)
+
+			value := string(make([]byte, 100))
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := (<-w.Set("key", value)).Err; err != nil {
+						b.Errorf("Set() error: %v", err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			cancel()
+			w.Close()
+		})
+	}
+}
+
+func TestRecordTimestamps(t *testing.T) {
+	// Запись версии 1 без времени читается с нулевым временем
+	payload := binary.LittleEndian.AppendUint64(nil, 7)
+	payload = append(payload, operationCodes[OperationDel])
+	payload = binary.AppendUvarint(payload, 1)
+	payload = binary.AppendUvarint(payload, 3)
+	payload = append(payload, "key"...)
+	v1 := binary.LittleEndian.AppendUint32([]byte(segmentMagic), segmentVersionV1)
+	v1 = binary.LittleEndian.AppendUint32(v1, uint32(len(payload)))
+	v1 = binary.LittleEndian.AppendUint32(v1, crc32.Checksum(payload, crcTable))
+	v1 = append(v1, payload...)
+
+	logs, _, err := decodeSegment("v1", v1, false)
+	if err != nil {
+		t.Fatalf("decodeSegment() of version 1 error: %v", err)
+	}
+	if len(logs) != 1 || logs[0].LSN != 7 || logs[0].Operation != OperationDel || !logs[0].Time().IsZero() {
+		t.Errorf("Unexpected version 1 record: %+v", logs)
+	}
+
+	// Новые записи получают время записи
+	tempDir := t.TempDir()
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: time.Millisecond,
+		DataDirectory:        tempDir,
+	}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx)
+
+	before := time.Now()
+	if err := (<-w.Set("a", "1")).Err; err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	if err := (<-w.Set("b", "2")).Err; err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	w.Close()
+
+	logs, err = ReadLogsFromFile(filepath.Join(tempDir, SegmentName(0)))
+	if err != nil {
+		t.Fatalf("ReadLogsFromFile() error: %v", err)
+	}
+	if len(logs) != 2 || logs[0].Time().Before(before) || logs[1].Timestamp < logs[0].Timestamp {
+		t.Errorf("Unexpected timestamps: %+v", logs)
+	}
+}
+
+func TestReadOnlyWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	logs := []Log{
+		{LSN: 0, Operation: OperationSet, Args: []string{"a", "1"}},
+		{LSN: 1, Operation: OperationSet, Args: []string{"b", "2"}},
+	}
+	segment := filepath.Join(tempDir, SegmentName(0))
+	torn := writeTestSegment(t, segment, logs, func(data []byte) []byte { return data[:len(data)-3] })
+
+	config := WALConfig{Enabled: true, DataDirectory: tempDir, ReadOnly: true}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	defer w.Close()
+
+	recovered, err := w.Recover()
+	if err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+	if len(recovered) != 1 || recovered[0].LSN != 0 {
+		t.Errorf("Recover() = %+v, want only the first record", recovered)
+	}
+
+	// Хвост не обрезан, новые сегменты не созданы
+	data, _ := os.ReadFile(segment)
+	if len(data) != len(torn) {
+		t.Errorf("Segment was modified in read-only mode: %d bytes, want %d", len(data), len(torn))
+	}
+	if segments, _ := ListSegments(tempDir); len(segments) != 1 {
+		t.Errorf("Expected no new segments in read-only mode, got %v", segments)
+	}
+
+	// Сегменты старого формата в режиме только для чтения не переименовываются
+	os.WriteFile(filepath.Join(tempDir, "wal_5.log"), appendSegmentHeader(nil), 0644)
+	if _, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop())); err == nil {
+		t.Errorf("NewWAL() in read-only mode should fail on legacy segments")
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	tempDir := t.TempDir()
+	var logs []Log
+	for i := 0; i < 9; i++ {
+		logs = append(logs, Log{LSN: uint64(i), Operation: OperationSet, Args: []string{fmt.Sprintf("key%d", i), "value"}})
+	}
+	for i := 0; i < 9; i += 3 {
+		writeTestSegment(t, filepath.Join(tempDir, SegmentName(uint64(i))), logs[i:i+3], nil)
+	}
+
+	result, err := TruncateAfter(tempDir, 4)
+	if err != nil {
+		t.Fatalf("TruncateAfter() error: %v", err)
+	}
+	if len(result.Removed) != 1 || filepath.Base(result.Removed[0]) != SegmentName(6) {
+		t.Errorf("Removed = %v, want only %s", result.Removed, SegmentName(6))
+	}
+	if filepath.Base(result.Rewritten) != SegmentName(3) || result.Dropped != 4 {
+		t.Errorf("Rewritten = %s, Dropped = %d, want %s and 4", result.Rewritten, result.Dropped, SegmentName(3))
+	}
+
+	// Обрезка по границе сегмента ничего не перезаписывает
+	if result, err = TruncateAfter(tempDir, 4); err != nil || result.Rewritten != "" || result.Dropped != 0 {
+		t.Errorf("Repeated TruncateAfter() = %+v, %v, want no changes", result, err)
+	}
+
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        tempDir,
+	}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	defer w.Close()
+
+	recovered, err := w.Recover()
+	if err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+	if len(recovered) != 5 || recovered[4].LSN != 4 {
+		t.Errorf("Recover() after truncation returned %d logs, want LSN 0..4", len(recovered))
+	}
+	if next := w.NextLSN(); next != 5 {
+		t.Errorf("NextLSN() after truncation = %d, want 5", next)
+	}
+
+	// Поврежденная запись до точки обрезки не дает обрезать WAL
+	corruptDir := t.TempDir()
+	writeTestSegment(t, filepath.Join(corruptDir, SegmentName(0)), logs[:3], func(data []byte) []byte {
+		data[segmentHeaderSize+recordHeaderSize+1] ^= 0x80
+		return data
+	})
+	if _, err := TruncateAfter(corruptDir, 1); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("TruncateAfter() over corrupt record error = %v, want ErrCorruptRecord", err)
+	}
+}
+
+func TestWALBackpressure(t *testing.T) {
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        t.TempDir(),
+		MaxPendingWrites:     2,
+		QueueTimeout:         200 * time.Millisecond,
+	}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	defer w.Close()
+
+	// WAL не запущен, поэтому принятые записи остаются в очереди
+	first := w.Set("a", "1")
+	second := w.Del("b")
+
+	if err := (<-w.Set("c", "3")).Err; !errors.Is(err, ErrWALOverloaded) {
+		t.Errorf("Set() on full queue error = %v, want ErrWALOverloaded", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (<-w.SetCtx(ctx, "c", "3")).Err; !errors.Is(err, context.Canceled) || errors.Is(err, ErrWALOverloaded) {
+		t.Errorf("SetCtx() with canceled context error = %v, want context.Canceled", err)
+	}
+
+	// TryBatch не ждет места в очереди
+	start := time.Now()
+	if err := (<-w.TryBatch([]Log{{Operation: OperationDel, Args: []string{"c"}}})).Err; !errors.Is(err, ErrWALOverloaded) {
+		t.Errorf("TryBatch() on full queue error = %v, want ErrWALOverloaded", err)
+	}
+	if elapsed := time.Since(start); elapsed >= config.QueueTimeout {
+		t.Errorf("TryBatch() waited %v for the queue", elapsed)
+	}
+
+	// Отмена во время ожидания места тоже не считается перегрузкой
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := (<-w.SetCtx(ctx, "c", "3")).Err; !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrWALOverloaded) {
+		t.Errorf("SetCtx() past deadline error = %v, want context.DeadlineExceeded", err)
+	}
+
+	stats := w.Stats()
+	if stats.Pending != 2 || stats.MaxPending != 2 || stats.Rejected != 2 || stats.Waited != 2 {
+		t.Errorf("Stats() = %+v, want 2 pending and 2 rejected", stats)
+	}
+
+	// Ожидающая запись принимается, как только место освобождается
+	waiting := make(chan chan Result, 1)
+	go func() { waiting <- w.DelCtx(context.Background(), "c") }()
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx)
+
+	for _, done := range []chan Result{first, second, <-waiting} {
+		if err := (<-done).Err; err != nil {
+			t.Errorf("Write error after queue drained: %v", err)
+		}
+	}
+	if stats := w.Stats(); stats.Pending != 0 || stats.Accepted != 3 || stats.Waited != 3 {
+		t.Errorf("Stats() after drain = %+v, want empty queue and 3 accepted", stats)
+	}
+}
+
+func TestReadFromAndAppend(t *testing.T) {
+	tempDir := t.TempDir()
+	var logs []Log
+	for i := 3; i < 9; i++ {
+		logs = append(logs, Log{LSN: uint64(i), Timestamp: int64(i), Operation: OperationSet, Args: []string{fmt.Sprintf("key%d", i), "value"}})
+	}
+	// Первые записи удалены сжатием, в конце текущего сегмента недописанная запись
+	writeTestSegment(t, filepath.Join(tempDir, SegmentName(3)), logs[:3], nil)
+	writeTestSegment(t, filepath.Join(tempDir, SegmentName(6)), logs[3:], func(data []byte) []byte { return data[:len(data)-4] })
+
+	w, err := NewWAL(WALConfig{Enabled: true, DataDirectory: tempDir, ReadOnly: true}, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	defer w.Close()
+
+	got, err := w.ReadFrom(4, 100)
+	if err != nil {
+		t.Fatalf("ReadFrom() error: %v", err)
+	}
+	if len(got) != 4 || got[0].LSN != 4 || got[3].LSN != 7 {
+		t.Errorf("ReadFrom(4) = %+v, want LSN 4..7 without the torn record", got)
+	}
+	if got, _ := w.ReadFrom(4, 2); len(got) != 2 || got[1].LSN != 5 {
+		t.Errorf("ReadFrom(4, 2) = %+v, want LSN 4 and 5", got)
+	}
+	if _, err := w.ReadFrom(1, 100); !errors.Is(err, ErrLSNUnavailable) {
+		t.Errorf("ReadFrom() of compacted records error = %v, want ErrLSNUnavailable", err)
+	}
+
+	// Реплика сохраняет LSN и время записей мастера
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    2,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        t.TempDir(),
+	}
+	replica, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	defer replica.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replica.Start(ctx)
+
+	if written, err := replica.Append(ctx, logs[:3]); err != nil || written != 3 {
+		t.Fatalf("Append() = %d, %v, want 3 records", written, err)
+	}
+	if next := replica.NextLSN(); next != 6 {
+		t.Errorf("NextLSN() after Append() = %d, want 6", next)
+	}
+	if written, err := replica.Append(ctx, logs[2:4]); !errors.Is(err, ErrLSNOutOfOrder) || written != 0 {
+		t.Errorf("Append() of already written record = %d, %v, want ErrLSNOutOfOrder", written, err)
+	}
+
+	stored, err := replica.ReadFrom(0, 100)
+	if err != nil {
+		t.Fatalf("ReadFrom() error: %v", err)
+	}
+	if len(stored) != 3 || stored[0].LSN != 3 || stored[2].Timestamp != 5 {
+		t.Errorf("Replica records = %+v, want master LSN and timestamps", stored)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       1 << 20,
+		DataDirectory:        t.TempDir(),
+	}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx)
+
+	sub := w.Subscribe(1)
+	slow := w.Subscribe(1)
+
+	if err := (<-w.Set("a", "1")).Err; err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	select {
+	case batch := <-sub.C:
+		if len(batch) != 1 || batch[0].LSN != 0 || batch[0].Args[0] != "a" {
+			t.Errorf("Subscription batch = %+v, want record with LSN 0", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscription did not receive written record")
+	}
+
+	// Подписчик с заполненным буфером отписывается, остальные продолжают получать записи
+	if err := (<-w.Del("a")).Err; err != nil {
+		t.Fatalf("Del() error: %v", err)
+	}
+	<-slow.C
+	if _, ok := <-slow.C; ok {
+		t.Error("Overflowed subscription channel is still open")
+	}
+	if batch := <-sub.C; len(batch) != 1 || batch[0].LSN != 1 {
+		t.Errorf("Subscription batch = %+v, want record with LSN 1", batch)
+	}
+
+	sub.Close()
+	sub.Close()
+	slow.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("Closed subscription channel is still open")
+	}
+}
+
+func TestRewind(t *testing.T) {
+	tempDir := t.TempDir()
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       64, // по сегменту на одну-две записи
+		DataDirectory:        tempDir,
+	}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx)
+
+	for i := 0; i < 6; i++ {
+		if err := (<-w.Set(fmt.Sprintf("key%d", i), "value")).Err; err != nil {
+			t.Fatalf("Set() error: %v", err)
+		}
+	}
+	if err := (<-w.Noop()).Err; err != nil {
+		t.Fatalf("Noop() error: %v", err)
+	}
+	if next, written := w.NextLSN(), w.WrittenLSN(); next != 7 || written != 7 {
+		t.Fatalf("NextLSN() = %d, WrittenLSN() = %d, want 7", next, written)
+	}
+
+	// Отброшенные записи не читаются, а новые продолжают WAL с точки обрезки
+	if err := w.Rewind(3); err != nil {
+		t.Fatalf("Rewind() error: %v", err)
+	}
+	if next, written := w.NextLSN(), w.WrittenLSN(); next != 3 || written != 3 {
+		t.Errorf("After Rewind(3) NextLSN() = %d, WrittenLSN() = %d, want 3", next, written)
+	}
+	if err := w.Rewind(5); err != nil {
+		t.Errorf("Rewind() beyond the end error: %v", err)
+	}
+	if err := (<-w.Set("new", "value")).Err; err != nil {
+		t.Fatalf("Set() after Rewind() error: %v", err)
+	}
+
+	logs, err := w.ReadFrom(0, 100)
+	if err != nil {
+		t.Fatalf("ReadFrom() error: %v", err)
+	}
+	if len(logs) != 4 || logs[2].Args[0] != "key2" || logs[3].LSN != 3 || logs[3].Args[0] != "new" {
+		t.Errorf("ReadFrom() after Rewind() = %+v, want key0..key2 and new with LSN 3", logs)
+	}
+	w.Close()
+
+	// После перезапуска WAL содержит те же записи
+	w, err = NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() after Rewind() error: %v", err)
+	}
+	defer w.Close()
+	recovered, err := w.Recover()
+	if err != nil || len(recovered) != 4 || recovered[3].Args[0] != "new" {
+		t.Errorf("Recover() after Rewind() = %+v, %v, want 4 records", recovered, err)
+	}
+	if next := w.NextLSN(); next != 4 {
+		t.Errorf("NextLSN() after restart = %d, want 4", next)
+	}
+
+	// Обрезка до начала WAL удаляет все записи
+	if err := w.Rewind(0); err != nil {
+		t.Fatalf("Rewind(0) error: %v", err)
+	}
+	if logs, err := w.ReadFrom(0, 100); err != nil || len(logs) != 0 {
+		t.Errorf("ReadFrom() after Rewind(0) = %+v, %v, want no records", logs, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	tempDir := t.TempDir()
+	config := WALConfig{
+		Enabled:              true,
+		FlushingBatchSize:    1,
+		FlushingBatchTimeout: 10 * time.Millisecond,
+		MaxSegmentSize:       64, // по сегменту на одну-две записи
+		DataDirectory:        tempDir,
+	}
+	w, err := NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx)
+
+	for i := 0; i < 4; i++ {
+		if err := (<-w.Set(fmt.Sprintf("key%d", i), "value")).Err; err != nil {
+			t.Fatalf("Set() error: %v", err)
+		}
+	}
+
+	// После сброса старых записей нет, новые продолжают с заданного LSN
+	if err := w.Reset(10); err != nil {
+		t.Fatalf("Reset() error: %v", err)
+	}
+	if next, written := w.NextLSN(), w.WrittenLSN(); next != 10 || written != 10 {
+		t.Errorf("After Reset(10) NextLSN() = %d, WrittenLSN() = %d, want 10", next, written)
+	}
+	if _, err := w.ReadFrom(0, 100); !errors.Is(err, ErrLSNUnavailable) {
+		t.Errorf("ReadFrom(0) after Reset() error = %v, want ErrLSNUnavailable", err)
+	}
+	if err := (<-w.Set("new", "value")).Err; err != nil {
+		t.Fatalf("Set() after Reset() error: %v", err)
+	}
+	if logs, err := w.ReadFrom(10, 100); err != nil || len(logs) != 1 || logs[0].LSN != 10 {
+		t.Errorf("ReadFrom(10) after Reset() = %+v, %v, want one record with LSN 10", logs, err)
+	}
+	w.Close()
+
+	segments, err := ListSegments(tempDir)
+	if err != nil || len(segments) != 1 || filepath.Base(segments[0]) != SegmentName(10) {
+		t.Errorf("Segments after Reset() = %v, %v, want only %s", segments, err, SegmentName(10))
+	}
+
+	// После перезапуска WAL продолжает с записей после сброса
+	w, err = NewWAL(config, logger.NewLoggerWithZap(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewWAL() after Reset() error: %v", err)
+	}
+	defer w.Close()
+	recovered, err := w.Recover()
+	if err != nil || len(recovered) != 1 || recovered[0].Args[0] != "new" {
+		t.Errorf("Recover() after Reset() = %+v, %v, want the record written after reset", recovered, err)
+	}
+	if next := w.NextLSN(); next != 11 {
+		t.Errorf("NextLSN() after restart = %d, want 11", next)
+	}
+}
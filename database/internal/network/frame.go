@@ -0,0 +1,58 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Каждое сообщение передается кадром: 4 байта длины в big-endian и сами данные.
+// Так одно сообщение может прийти несколькими сегментами TCP или быть больше буфера чтения
+
+const (
+	frameHeaderSize = 4
+
+	// Жесткий предел размера сообщения по умолчанию
+	defaultMaxMessageSize = 4 << 20 // 4MB
+)
+
+// ErrMessageTooLarge возвращается, если размер сообщения превышает жесткий предел
+var ErrMessageTooLarge = errors.New("message too large")
+
+// WriteFrame записывает сообщение кадром с префиксом длины
+func WriteFrame(w io.Writer, payload []byte) error {
+	if uint64(len(payload)) > uint64(^uint32(0)) {
+		return ErrMessageTooLarge
+	}
+
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame читает одно сообщение. Сообщения длиннее maxSize отклоняются до чтения данных
+func ReadFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if maxSize > 0 && uint64(size) > uint64(maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrMessageTooLarge, size, maxSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return payload, nil
+}
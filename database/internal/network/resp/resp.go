@@ -0,0 +1,280 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Версии протокола RESP
+const (
+	Version2 = 2
+	Version3 = 3
+)
+
+// Максимальное количество элементов в массиве команды
+const maxArrayLength = 1 << 20
+
+// Предел длины строки inline-команды и заголовков, если размер сообщения не ограничен,
+// как у Redis
+const maxInlineSize = 64 << 10
+
+// Ошибки
+var (
+	ErrProtocol = errors.New("protocol error")
+	ErrTooLarge = errors.New("protocol error: request too large")
+)
+
+// Kind определяет тип значения RESP
+type Kind int
+
+const (
+	KindSimpleString Kind = iota
+	KindError
+	KindInteger
+	KindBulkString
+	KindNull
+	KindArray
+	KindMap
+)
+
+// Value представляет значение RESP. Для Map элементы хранятся плоским списком ключ, значение, ...
+type Value struct {
+	Kind  Kind
+	Str   string
+	Int   int64
+	Elems []Value
+}
+
+// SimpleString создает простую строку (+OK)
+func SimpleString(s string) Value {
+	return Value{Kind: KindSimpleString, Str: s}
+}
+
+// Error создает ошибку (-ERR ...)
+func Error(msg string) Value {
+	return Value{Kind: KindError, Str: msg}
+}
+
+// Integer создает целое число
+func Integer(n int64) Value {
+	return Value{Kind: KindInteger, Int: n}
+}
+
+// BulkString создает бинарно-безопасную строку
+func BulkString(s string) Value {
+	return Value{Kind: KindBulkString, Str: s}
+}
+
+// Null создает пустое значение
+func Null() Value {
+	return Value{Kind: KindNull}
+}
+
+// Array создает массив значений
+func Array(elems ...Value) Value {
+	if elems == nil {
+		elems = []Value{}
+	}
+	return Value{Kind: KindArray, Elems: elems}
+}
+
+// Map создает словарь из плоского списка ключ, значение, ... В RESP2 кодируется массивом
+func Map(pairs ...Value) Value {
+	if pairs == nil {
+		pairs = []Value{}
+	}
+	return Value{Kind: KindMap, Elems: pairs}
+}
+
+// BulkStrings создает массив бинарно-безопасных строк
+func BulkStrings(items []string) Value {
+	elems := make([]Value, len(items))
+	for i, item := range items {
+		elems[i] = BulkString(item)
+	}
+	return Array(elems...)
+}
+
+// Append кодирует значение в буфер в соответствии с версией протокола
+func (v Value) Append(buf []byte, version int) []byte {
+	switch v.Kind {
+	case KindSimpleString:
+		buf = append(buf, '+')
+		buf = append(buf, sanitizeLine(v.Str)...)
+		return append(buf, '\r', '\n')
+
+	case KindError:
+		buf = append(buf, '-')
+		buf = append(buf, sanitizeLine(v.Str)...)
+		return append(buf, '\r', '\n')
+
+	case KindInteger:
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, v.Int, 10)
+		return append(buf, '\r', '\n')
+
+	case KindBulkString:
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(v.Str)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, v.Str...)
+		return append(buf, '\r', '\n')
+
+	case KindNull:
+		if version >= Version3 {
+			return append(buf, '_', '\r', '\n')
+		}
+		return append(buf, "$-1\r\n"...)
+
+	case KindArray, KindMap:
+		if v.Kind == KindMap && version >= Version3 {
+			buf = append(buf, '%')
+			buf = strconv.AppendInt(buf, int64(len(v.Elems)/2), 10)
+		} else {
+			buf = append(buf, '*')
+			buf = strconv.AppendInt(buf, int64(len(v.Elems)), 10)
+		}
+		buf = append(buf, '\r', '\n')
+		for _, elem := range v.Elems {
+			buf = elem.Append(buf, version)
+		}
+		return buf
+	}
+
+	return buf
+}
+
+// sanitizeLine убирает переводы строк, недопустимые в простых строках и ошибках
+func sanitizeLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// ReadCommand читает одну команду: массив bulk-строк или inline-команду, разделенную пробелами.
+// Bulk-строки и строки длиннее maxBulkSize отклоняются; если maxBulkSize не задан, длина
+// строки ограничена 64KB
+func ReadCommand(r *bufio.Reader, maxBulkSize int) ([]string, error) {
+	lineLimit := maxBulkSize
+	if lineLimit <= 0 {
+		lineLimit = maxInlineSize
+	}
+
+	for {
+		prefix, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if prefix[0] != '*' {
+			// Inline-команда, например набранная в telnet
+			line, err := readLine(r, lineLimit)
+			if err != nil {
+				return nil, err
+			}
+			args := strings.Fields(line)
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		r.ReadByte()
+		count, err := readInt(r, lineLimit)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			continue
+		}
+		if count > maxArrayLength {
+			return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+		}
+
+		args := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			arg, err := readBulkString(r, maxBulkSize, lineLimit)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+		return args, nil
+	}
+}
+
+// readBulkString читает строку вида $<len>\r\n<data>\r\n
+func readBulkString(r *bufio.Reader, maxBulkSize, lineLimit int) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if b != '$' {
+		return "", fmt.Errorf("%w: expected '$', got '%c'", ErrProtocol, b)
+	}
+
+	size, err := readInt(r, lineLimit)
+	if err != nil {
+		return "", err
+	}
+	if size < 0 {
+		return "", fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+	if maxBulkSize > 0 && size > maxBulkSize {
+		return "", fmt.Errorf("%w: bulk string of %d bytes", ErrTooLarge, size)
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string is not terminated by CRLF", ErrProtocol)
+	}
+
+	return string(data[:size]), nil
+}
+
+// readInt читает целое число до конца строки
+func readInt(r *bufio.Reader, limit int) (int, error) {
+	line, err := readLine(r, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(line)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid integer %q", ErrProtocol, line)
+	}
+	return n, nil
+}
+
+// readLine читает строку, завершенную \n, и отбрасывает \r\n. Строка длиннее limit байт
+// без учета \r\n отклоняется до того, как будет прочитана целиком
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit+2 {
+			return "", fmt.Errorf("%w: line longer than %d bytes", ErrTooLarge, limit)
+		}
+		line = append(line, chunk...)
+
+		switch {
+		case err == nil:
+			return strings.TrimRight(string(line), "\r\n"), nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			// Строка длиннее буфера, дочитываем ее по частям
+		case errors.Is(err, io.EOF) && len(line) > 0:
+			return "", io.ErrUnexpectedEOF
+		default:
+			return "", err
+		}
+	}
+}
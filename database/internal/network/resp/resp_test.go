@@ -0,0 +1,117 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$12\r\nhello\r\nworld\r\n" +
+		"*0\r\n" +
+		"\r\n" +
+		"GET  key\r\n" +
+		"*2\r\n$3\r\nGET\r\n$0\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(input))
+
+	want := [][]string{
+		{"SET", "key", "hello\r\nworld"},
+		{"GET", "key"},
+		{"GET", ""},
+	}
+	for _, expected := range want {
+		args, err := ReadCommand(reader, 0)
+		if err != nil {
+			t.Fatalf("ReadCommand() error: %v", err)
+		}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("ReadCommand() = %q, want %q", args, expected)
+		}
+	}
+
+	if _, err := ReadCommand(reader, 0); err != io.EOF {
+		t.Errorf("ReadCommand() at end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"bulk too large", "*1\r\n$100\r\n", ErrTooLarge},
+		{"not a bulk string", "*1\r\n:1\r\n", ErrProtocol},
+		{"invalid length", "*x\r\n", ErrProtocol},
+		{"missing CRLF", "*1\r\n$3\r\nGETX\r\n", ErrProtocol},
+		{"truncated", "*2\r\n$3\r\nGET\r\n", io.EOF},
+		{"inline too long", "GET " + strings.Repeat("k", 20) + "\r\n", ErrTooLarge},
+		{"inline without newline", strings.Repeat("k", 100), ErrTooLarge},
+		{"header too long", "*" + strings.Repeat("1", 20) + "\r\n", ErrTooLarge},
+		{"bulk header too long", "*1\r\n$" + strings.Repeat("0", 20) + "1\r\n", ErrTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadCommand(bufio.NewReader(strings.NewReader(tt.input)), 10)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ReadCommand() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// endlessReader бесконечно возвращает один и тот же байт
+type endlessReader byte
+
+func (r endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestReadCommandLineLimit(t *testing.T) {
+	// Строка длиннее буфера, но в пределах ограничения, читается целиком
+	key := strings.Repeat("k", 10000)
+	args, err := ReadCommand(bufio.NewReader(strings.NewReader("GET "+key+"\r\n")), 0)
+	if err != nil || len(args) != 2 || args[1] != key {
+		t.Errorf("ReadCommand() long inline = %d args, %v, want GET and the key", len(args), err)
+	}
+
+	// Без ограничения размера сообщения строка без перевода не растет бесконечно
+	for _, prefix := range []string{"", "*", "*1\r\n$"} {
+		reader := bufio.NewReader(io.MultiReader(strings.NewReader(prefix), endlessReader('1')))
+		if _, err := ReadCommand(reader, 0); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("ReadCommand() endless line after %q error = %v, want ErrTooLarge", prefix, err)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	value := Array(
+		SimpleString("OK"),
+		Error("ERR bad\nthing"),
+		Integer(-2),
+		BulkString("a\r\nb"),
+		Null(),
+		Map(BulkString("k"), BulkString("v")),
+	)
+
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{Version2, "*6\r\n+OK\r\n-ERR bad thing\r\n:-2\r\n$4\r\na\r\nb\r\n$-1\r\n*2\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+		{Version3, "*6\r\n+OK\r\n-ERR bad thing\r\n:-2\r\n$4\r\na\r\nb\r\n_\r\n%1\r\n$1\r\nk\r\n$1\r\nv\r\n"},
+	}
+
+	for _, tt := range tests {
+		if got := string(value.Append(nil, tt.version)); got != tt.want {
+			t.Errorf("Append(RESP%d) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/network/resp"
+	"go.uber.org/zap"
+)
+
+// Protocol определяет протокол общения с клиентами
+type Protocol string
+
+const (
+	// ProtocolAuto - протокол определяется по первому байту соединения
+	ProtocolAuto Protocol = "auto"
+	// ProtocolText - текстовые команды в кадрах с префиксом длины
+	ProtocolText Protocol = "text"
+	// ProtocolRESP - протокол Redis (RESP2/RESP3)
+	ProtocolRESP Protocol = "resp"
+)
+
+// Сведения о сервере в ответе на HELLO
+const (
+	serverName    = "concurrency"
+	serverVersion = "1.0.0"
+)
+
+// Обработка команд RESP: args - элементы массива команды, первый из них - имя команды
+type RESPHandler func(ctx context.Context, args []string) resp.Value
+
+// ParseProtocol разбирает название протокола. Пустая строка означает auto
+func ParseProtocol(name string) (Protocol, error) {
+	switch protocol := Protocol(name); protocol {
+	case "":
+		return ProtocolAuto, nil
+	case ProtocolAuto, ProtocolText, ProtocolRESP:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("unknown protocol: %s", name)
+	}
+}
+
+// detectRESP определяет протокол по первому байту соединения. Команда RESP начинается с '*',
+// inline-команда - с буквы. Кадр текстового протокола начинается со старшего байта длины,
+// который для сообщений меньше 1GB не попадает в этот диапазон
+func (s *TCPServer) detectRESP(connection net.Conn, reader *bufio.Reader) (bool, error) {
+	if s.idleTimeout > 0 {
+		if err := connection.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+			s.logger.Warn("failed to set read deadline", zap.Error(err))
+			return false, err
+		}
+	}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	b := first[0]
+	return b == '*' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z'), nil
+}
+
+// serveRESP обслуживает соединение по протоколу RESP. Ответы буферизуются и отправляются,
+// когда во входном буфере не осталось команд, поэтому конвейер запросов обрабатывается пачкой
+func (s *TCPServer) serveRESP(ctx context.Context, connection net.Conn, reader *bufio.Reader, session *Session) {
+	writer := bufio.NewWriterSize(connection, s.bufferSize)
+	version := resp.Version2
+	var out []byte
+
+	for {
+		// Проверяем контекст
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			//Продолжаем обработку
+		}
+
+		// Устанавливаем таймаут чтения, если указан
+		if s.idleTimeout > 0 {
+			if err := connection.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+				s.logger.Warn("failed to set read deadline", zap.Error(err))
+				return
+			}
+		}
+
+		// Читаем команду
+		args, err := resp.ReadCommand(reader, s.maxMessageSize)
+		if err != nil {
+			if errors.Is(err, resp.ErrProtocol) || errors.Is(err, resp.ErrTooLarge) {
+				// Как и Redis, сообщаем об ошибке протокола и закрываем соединение
+				out = resp.Error("ERR "+err.Error()).Append(out[:0], version)
+				writer.Write(out)
+				writer.Flush()
+			}
+			if err != io.EOF {
+				s.logger.Warn(
+					"failed to read data",
+					zap.String("address", connection.RemoteAddr().String()),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		// Устанавливаем таймаут записи, если указан
+		if s.idleTimeout > 0 {
+			if err := connection.SetWriteDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+				s.logger.Warn("failed to set write deadline", zap.Error(err))
+				return
+			}
+		}
+
+		// Команды уровня соединения обрабатываются здесь, остальные передаются обработчику
+		var reply resp.Value
+		quit := false
+		switch strings.ToUpper(args[0]) {
+		case "HELLO":
+			reply, version = hello(args[1:], version, session.ID)
+		case "QUIT":
+			reply, quit = resp.SimpleString("OK"), true
+		default:
+			requestCtx, cancel := s.requestContext(ctx)
+			stop := s.watchConnection(connection, reader, cancel)
+			reply = s.respHandler(requestCtx, args)
+			stop()
+			cancel()
+		}
+
+		// Отправляем ответ
+		out = reply.Append(out[:0], version)
+		_, err = writer.Write(out)
+		if err == nil && (quit || reader.Buffered() == 0) {
+			err = writer.Flush()
+		}
+		if err != nil {
+			s.logger.Warn(
+				"failed to write data",
+				zap.String("address", connection.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			return
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+// hello обрабатывает HELLO [protover [AUTH username password] [SETNAME clientname]]
+// и возвращает ответ и версию протокола для дальнейшего обмена
+func hello(args []string, version int, id int64) (resp.Value, int) {
+	if len(args) > 0 {
+		requested, err := strconv.Atoi(args[0])
+		if err != nil {
+			return resp.Error("ERR Protocol version is not an integer or out of range"), version
+		}
+		if requested != resp.Version2 && requested != resp.Version3 {
+			return resp.Error("NOPROTO unsupported protocol version"), version
+		}
+		version = requested
+	}
+
+	return resp.Map(
+		resp.BulkString("server"), resp.BulkString(serverName),
+		resp.BulkString("version"), resp.BulkString(serverVersion),
+		resp.BulkString("proto"), resp.Integer(int64(version)),
+		resp.BulkString("id"), resp.Integer(id),
+		resp.BulkString("mode"), resp.BulkString("standalone"),
+		resp.BulkString("modules"), resp.Array(),
+	), version
+}
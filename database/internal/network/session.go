@@ -0,0 +1,54 @@
+package network
+
+import "context"
+
+// Session хранит состояние одного клиентского соединения, например открытую транзакцию.
+// Запросы соединения обрабатываются последовательно, поэтому синхронизация не нужна
+type Session struct {
+	ID      int64
+	state   any
+	closers []func()
+}
+
+// sessionKey - ключ сессии в контексте запроса
+type sessionKey struct{}
+
+// NewSession создает сессию соединения
+func NewSession(id int64) *Session {
+	return &Session{ID: id}
+}
+
+// State возвращает состояние, сохраненное обработчиком запросов
+func (s *Session) State() any {
+	return s.state
+}
+
+// SetState сохраняет состояние обработчика запросов до конца соединения
+func (s *Session) SetState(state any) {
+	s.state = state
+}
+
+// OnClose регистрирует функцию, которая будет вызвана после закрытия соединения, например
+// для освобождения ресурсов, связанных с состоянием сессии
+func (s *Session) OnClose(fn func()) {
+	s.closers = append(s.closers, fn)
+}
+
+// close вызывает функции, зарегистрированные через OnClose, в обратном порядке
+func (s *Session) close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+	s.closers = nil
+}
+
+// ContextWithSession возвращает контекст, содержащий сессию
+func ContextWithSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFromContext возвращает сессию соединения, к которому относится запрос
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(*Session)
+	return session, ok
+}
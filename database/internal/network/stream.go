@@ -0,0 +1,98 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Обработка долгоживущего соединения целиком
+type TCPStreamHandler func(context.Context, *Stream)
+
+// Stream - долгоживущее соединение, по которому обе стороны отправляют кадры независимо
+// друг от друга, не дожидаясь ответов. Read и Write можно вызывать из разных горутин
+type Stream struct {
+	ID             int64 // Идентификатор соединения на сервере, 0 на стороне клиента
+	connection     net.Conn
+	reader         *bufio.Reader
+	idleTimeout    time.Duration
+	maxMessageSize int
+	writeMutex     sync.Mutex
+}
+
+// Read читает следующее сообщение. Если сообщений нет дольше таймаута неактивности,
+// возвращает ошибку
+func (s *Stream) Read() ([]byte, error) {
+	if s.idleTimeout > 0 {
+		if err := s.connection.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+			return nil, err
+		}
+	}
+	return ReadFrame(s.reader, s.maxMessageSize)
+}
+
+// Write отправляет сообщение
+func (s *Stream) Write(message []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.idleTimeout > 0 {
+		if err := s.connection.SetWriteDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+			return err
+		}
+	}
+	return WriteFrame(s.connection, message)
+}
+
+// Close закрывает соединение, прерывая ожидающие Read и Write
+func (s *Stream) Close() error {
+	return s.connection.Close()
+}
+
+// RemoteAddr возвращает адрес другой стороны соединения
+func (s *Stream) RemoteAddr() string {
+	return s.connection.RemoteAddr().String()
+}
+
+// HandleStreams передает каждое соединение handler целиком, пока ctx не завершится. Соединение
+// закрывается после возврата handler, а при завершении ctx - сразу, прерывая чтение и запись
+func (s *TCPServer) HandleStreams(ctx context.Context, handler TCPStreamHandler) {
+	s.serve(ctx, func(ctx context.Context, connection net.Conn) {
+		s.handleStream(ctx, connection, handler)
+	})
+}
+
+// обслуживает долгоживущее соединение
+func (s *TCPServer) handleStream(ctx context.Context, connection net.Conn, handler TCPStreamHandler) {
+	stop := context.AfterFunc(ctx, func() { connection.Close() })
+	defer func() {
+		stop()
+		if v := recover(); v != nil {
+			s.logger.Error("captured panic", zap.Any("panic", v))
+		}
+		connection.Close()
+	}()
+
+	handler(ctx, &Stream{
+		ID:             s.connID.Add(1),
+		connection:     connection,
+		reader:         bufio.NewReaderSize(connection, s.bufferSize),
+		idleTimeout:    s.idleTimeout,
+		maxMessageSize: s.maxMessageSize,
+	})
+}
+
+// Stream переводит соединение клиента в потоковый режим. После этого Send и Pipeline
+// использовать нельзя: сообщения читаются и отправляются через Stream
+func (c *TCPClient) Stream() *Stream {
+	return &Stream{
+		connection:     c.connection,
+		reader:         c.reader,
+		idleTimeout:    c.idleTimeout,
+		maxMessageSize: c.maxMessageSize,
+	}
+}
@@ -1,9 +1,8 @@
 package network
 
 import (
-	"errors"
+	"bufio"
 	"fmt"
-	"io"
 	"net"
 	"time"
 )
@@ -12,9 +11,11 @@ const defaultBufferSize = 4 << 10 // 4KB
 
 // Представляет клиента для TCP-подключения к базе данных
 type TCPClient struct {
-	connection  net.Conn
-	idleTimeout time.Duration
-	bufferSize  int
+	connection     net.Conn
+	reader         *bufio.Reader
+	idleTimeout    time.Duration
+	bufferSize     int
+	maxMessageSize int
 }
 
 // Опция для конфигурации клиента
@@ -34,6 +35,13 @@ func WithClientBufferSize(size int) TCPClientOption {
 	}
 }
 
+// устанавливает жесткий предел размера ответа
+func WithClientMaxMessageSize(size int) TCPClientOption {
+	return func(c *TCPClient) {
+		c.maxMessageSize = size
+	}
+}
+
 // создает нового TCP клиента
 func NewTCPClient(address string, options ...TCPClientOption) (*TCPClient, error) {
 	connection, err := net.Dial("tcp", address)
@@ -42,37 +50,77 @@ func NewTCPClient(address string, options ...TCPClientOption) (*TCPClient, error
 	}
 
 	client := &TCPClient{
-		connection: connection,
-		bufferSize: defaultBufferSize,
+		connection:     connection,
+		bufferSize:     defaultBufferSize,
+		maxMessageSize: defaultMaxMessageSize,
 	}
 
 	for _, option := range options {
 		option(client)
 	}
 
-	if client.idleTimeout != 0 {
-		if err := connection.SetDeadline(time.Now().Add(client.idleTimeout)); err != nil {
-			return nil, fmt.Errorf("failed to set deadline for connection: %w", err)
-		}
-	}
-
+	client.reader = bufio.NewReaderSize(connection, client.bufferSize)
 	return client, nil
 }
 
 // Send отправляет запрос и получает ответ
 func (c *TCPClient) Send(request []byte) ([]byte, error) {
-	if _, err := c.connection.Write(request); err != nil {
+	// Таймаут неактивности отсчитывается заново для каждого запроса
+	if c.idleTimeout != 0 {
+		if err := c.connection.SetDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return nil, fmt.Errorf("failed to set deadline for connection: %w", err)
+		}
+	}
+
+	if err := WriteFrame(c.connection, request); err != nil {
 		return nil, err
 	}
 
-	response := make([]byte, c.bufferSize)
-	count, err := c.connection.Read(response)
-	if err != nil && err != io.EOF {
+	return ReadFrame(c.reader, c.maxMessageSize)
+}
+
+// Pipeline отправляет несколько запросов, не дожидаясь ответов, и возвращает ответы в том же порядке.
+// Запросы записываются параллельно с чтением ответов, чтобы большой конвейер не заблокировал
+// сервер, ожидающий, пока клиент прочитает уже отправленные ответы
+func (c *TCPClient) Pipeline(requests []string) ([]string, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+
+	if c.idleTimeout != 0 {
+		if err := c.connection.SetDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return nil, fmt.Errorf("failed to set deadline for connection: %w", err)
+		}
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		writer := bufio.NewWriterSize(c.connection, c.bufferSize)
+		for _, request := range requests {
+			if err := WriteFrame(writer, []byte(request)); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- writer.Flush()
+	}()
+
+	responses := make([]string, 0, len(requests))
+	for range requests {
+		response, err := ReadFrame(c.reader, c.maxMessageSize)
+		if err != nil {
+			// Закрываем соединение, чтобы завершить запись, если она еще идет
+			c.connection.Close()
+			<-writeErr
+			return nil, err
+		}
+		responses = append(responses, string(response))
+	}
+
+	if err := <-writeErr; err != nil {
 		return nil, err
-	} else if count == c.bufferSize {
-		return nil, errors.New("small buffer size")
 	}
-	return response[:count], nil
+	return responses, nil
 }
 
 // Close закрывает соединение
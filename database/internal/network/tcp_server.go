@@ -1,12 +1,15 @@
 package network
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -19,10 +22,15 @@ type TCPHandler func(context.Context, []byte) []byte
 type TCPServer struct {
 	listener       net.Listener
 	idleTimeout    time.Duration
+	requestTimeout time.Duration
 	bufferSize     int
+	maxMessageSize int
 	maxConnections int
 	logger         *zap.Logger
 	activeConns    chan struct{} // Канал для ограничения количества соединений
+	protocol       Protocol
+	respHandler    RESPHandler
+	connID         atomic.Int64 // Счетчик идентификаторов соединений
 }
 
 // Опция для конфигурации сервера
@@ -42,6 +50,14 @@ func WithIdleTimeout(timeout time.Duration) TCPServerOption {
 	}
 }
 
+// Устанавливает предельное время обработки одного запроса. Контекст запроса, передаваемый
+// обработчику, завершается по истечении этого времени
+func WithRequestTimeout(timeout time.Duration) TCPServerOption {
+	return func(s *TCPServer) {
+		s.requestTimeout = timeout
+	}
+}
+
 // Устанавливает размер буфера для чтения
 func WithBufferSize(size int) TCPServerOption {
 	return func(s *TCPServer) {
@@ -49,6 +65,29 @@ func WithBufferSize(size int) TCPServerOption {
 	}
 }
 
+// Устанавливает жесткий предел размера сообщения. Сообщения больше буфера чтения,
+// но не больше этого предела, принимаются целиком
+func WithMaxMessageSize(size int) TCPServerOption {
+	return func(s *TCPServer) {
+		s.maxMessageSize = size
+	}
+}
+
+// Устанавливает протокол для всех соединений слушателя. По умолчанию протокол
+// определяется по первому байту соединения
+func WithProtocol(protocol Protocol) TCPServerOption {
+	return func(s *TCPServer) {
+		s.protocol = protocol
+	}
+}
+
+// Устанавливает обработчик команд RESP. Без него сервер понимает только текстовый протокол
+func WithRESPHandler(handler RESPHandler) TCPServerOption {
+	return func(s *TCPServer) {
+		s.respHandler = handler
+	}
+}
+
 // создает новый TCP сервер
 func NewTCPServer(address string, logger *zap.Logger, options ...TCPServerOption) (*TCPServer, error) {
 	if logger == nil {
@@ -78,13 +117,31 @@ func NewTCPServer(address string, logger *zap.Logger, options ...TCPServerOption
 		server.bufferSize = 4 << 10 // по умолчанию 4
 	}
 
+	if server.maxMessageSize <= 0 {
+		server.maxMessageSize = defaultMaxMessageSize
+	}
+
 	// Создаем канал для ограничения соединений
 	server.activeConns = make(chan struct{}, server.maxConnections)
 
 	return server, nil
 }
 
+// Addr возвращает адрес, на котором слушает сервер. Полезно, если сервер создан на порту 0
+func (s *TCPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// HandleQueries обслуживает соединения, отвечая на каждый запрос через handler, пока ctx не завершится
 func (s *TCPServer) HandleQueries(ctx context.Context, handler TCPHandler) {
+	s.serve(ctx, func(ctx context.Context, connection net.Conn) {
+		s.handleConnection(ctx, connection, handler)
+	})
+}
+
+// serve принимает соединения и обслуживает каждое в отдельной горутине через handle,
+// пока ctx не завершится. Возвращается после завершения всех соединений
+func (s *TCPServer) serve(ctx context.Context, handle func(context.Context, net.Conn)) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 
@@ -117,7 +174,7 @@ func (s *TCPServer) HandleQueries(ctx context.Context, handler TCPHandler) {
 				go func(connection net.Conn) {
 					defer wg.Done()
 					defer func() { <-s.activeConns }() // Освобождаем место
-					s.handleConnection(ctx, connection, handler)
+					handle(ctx, connection)
 				}(connection)
 			default:
 				// Если достигнут лимит, закрываем соединение
@@ -142,8 +199,36 @@ func (s *TCPServer) handleConnection(ctx context.Context, connection net.Conn, h
 		}
 	}()
 
-	// Буфер для запросов
-	request := make([]byte, s.bufferSize)
+	// Буферизованное чтение кадров: запрос может прийти несколькими сегментами
+	reader := bufio.NewReaderSize(connection, s.bufferSize)
+
+	// Состояние соединения доступно обработчику через контекст запроса
+	session := NewSession(s.connID.Add(1))
+	ctx = ContextWithSession(ctx, session)
+	defer session.close()
+
+	if s.respHandler != nil && s.protocol != ProtocolText {
+		isRESP := s.protocol == ProtocolRESP
+		if !isRESP {
+			var err error
+			if isRESP, err = s.detectRESP(connection, reader); err != nil {
+				return
+			}
+		}
+		if isRESP {
+			s.serveRESP(ctx, connection, reader, session)
+			return
+		}
+	}
+
+	s.serveText(ctx, connection, reader, handler)
+}
+
+// serveText обслуживает соединение по текстовому протоколу с кадрами длины. Клиент может
+// отправить несколько запросов подряд, не дожидаясь ответов: они обрабатываются по порядку,
+// а ответы отправляются одной записью, когда во входном буфере не осталось запросов
+func (s *TCPServer) serveText(ctx context.Context, connection net.Conn, reader *bufio.Reader, handler TCPHandler) {
+	writer := bufio.NewWriterSize(connection, s.bufferSize)
 
 	for {
 		// Проверяем контекст
@@ -163,9 +248,15 @@ func (s *TCPServer) handleConnection(ctx context.Context, connection net.Conn, h
 		}
 
 		// Читаем запрос
-		count, err := connection.Read(request)
+		request, err := ReadFrame(reader, s.maxMessageSize)
 		if err != nil {
-			if err != io.EOF {
+			if errors.Is(err, ErrMessageTooLarge) {
+				s.logger.Warn("message exceeds size limit",
+					zap.String("address", connection.RemoteAddr().String()),
+					zap.Int("max_message_size", s.maxMessageSize),
+					zap.Error(err),
+				)
+			} else if err != io.EOF {
 				s.logger.Warn(
 					"failed to read data",
 					zap.String("address", connection.RemoteAddr().String()),
@@ -173,9 +264,6 @@ func (s *TCPServer) handleConnection(ctx context.Context, connection net.Conn, h
 				)
 			}
 			break
-		} else if count == s.bufferSize {
-			s.logger.Warn("buffer size may be too small", zap.Int("buffer_size", s.bufferSize))
-			break
 		}
 
 		// Устанавливаем таймаут записи, если указан
@@ -187,10 +275,18 @@ func (s *TCPServer) handleConnection(ctx context.Context, connection net.Conn, h
 		}
 
 		// Обрабатываем запрос
-		response := handler(ctx, request[:count])
+		requestCtx, cancel := s.requestContext(ctx)
+		stop := s.watchConnection(connection, reader, cancel)
+		response := handler(requestCtx, request)
+		stop()
+		cancel()
 
 		// Отправляем ответ
-		if _, err := connection.Write(response); err != nil {
+		err = WriteFrame(writer, response)
+		if err == nil && reader.Buffered() == 0 {
+			err = writer.Flush()
+		}
+		if err != nil {
 			s.logger.Warn(
 				"failed to write data",
 				zap.String("address", connection.RemoteAddr().String()),
@@ -200,3 +296,44 @@ func (s *TCPServer) handleConnection(ctx context.Context, connection net.Conn, h
 		}
 	}
 }
+
+// requestContext возвращает контекст одного запроса с дедлайном, если задан таймаут запроса
+func (s *TCPServer) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.requestTimeout > 0 {
+		return context.WithTimeout(ctx, s.requestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// watchConnection отменяет запрос через cancel, если клиент закрыл соединение, пока запрос
+// выполняется. Соединение читается через reader, поэтому данные следующих запросов конвейера
+// остаются в буфере. Возвращенная функция прекращает наблюдение до следующего чтения запроса
+func (s *TCPServer) watchConnection(connection net.Conn, reader *bufio.Reader, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// Ждем байт сверх уже прочитанных: закрытие заметно и после запросов в буфере
+		_, err := reader.Peek(reader.Buffered() + 1)
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, bufio.ErrBufferFull) {
+			return
+		}
+
+		s.logger.Debug("client disconnected, cancelling request",
+			zap.String("address", connection.RemoteAddr().String()),
+			zap.Error(err),
+		)
+		cancel()
+	}()
+
+	return func() {
+		// Прерываем ожидание данных, таймаут чтения следующего запроса устанавливается заново
+		if err := connection.SetReadDeadline(time.Now()); err != nil {
+			s.logger.Warn("failed to set read deadline", zap.Error(err))
+		}
+		<-done
+		if err := connection.SetReadDeadline(time.Time{}); err != nil {
+			s.logger.Warn("failed to set read deadline", zap.Error(err))
+		}
+	}
+}
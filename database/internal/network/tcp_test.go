@@ -0,0 +1,417 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keij-sama/Concurrency/database/internal/network/resp"
+	"go.uber.org/zap"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	messages := [][]byte{[]byte("SET key value"), {}, bytes.Repeat([]byte("x"), 100000)}
+
+	for _, message := range messages {
+		if err := WriteFrame(&buf, message); err != nil {
+			t.Fatalf("WriteFrame() error: %v", err)
+		}
+	}
+
+	for _, want := range messages {
+		got, err := ReadFrame(&buf, 0)
+		if err != nil {
+			t.Fatalf("ReadFrame() error: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadFrame() returned %d bytes, want %d", len(got), len(want))
+		}
+	}
+
+	WriteFrame(&buf, make([]byte, 1024))
+	if _, err := ReadFrame(&buf, 512); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("ReadFrame() over limit should return ErrMessageTooLarge, got %v", err)
+	}
+}
+
+// startEchoServer запускает сервер, возвращающий запрос без изменений
+func startEchoServer(t *testing.T, options ...TCPServerOption) string {
+	t.Helper()
+
+	server, err := NewTCPServer("127.0.0.1:0", zap.NewNop(), options...)
+	if err != nil {
+		t.Fatalf("NewTCPServer() error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.HandleQueries(ctx, func(_ context.Context, request []byte) []byte {
+			return request
+		})
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return server.listener.Addr().String()
+}
+
+func TestServerLargeAndSplitMessages(t *testing.T) {
+	address := startEchoServer(t, WithBufferSize(64), WithMaxMessageSize(1<<20))
+
+	client, err := NewTCPClient(address, WithClientIdleTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewTCPClient() error: %v", err)
+	}
+	defer client.Close()
+
+	// Сообщение больше буфера чтения сервера
+	large := bytes.Repeat([]byte("abcdef"), 10000)
+	response, err := client.Send(large)
+	if err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if !bytes.Equal(response, large) {
+		t.Errorf("Send() returned %d bytes, want %d", len(response), len(large))
+	}
+
+	// Кадр, пришедший по частям, собирается в одно сообщение
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+
+	var frame bytes.Buffer
+	WriteFrame(&frame, []byte("GET key"))
+	for _, b := range frame.Bytes() {
+		conn.Write([]byte{b})
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed, err := ReadFrame(conn, 0)
+	if err != nil {
+		t.Fatalf("ReadFrame() error: %v", err)
+	}
+	if string(echoed) != "GET key" {
+		t.Errorf("server received %q, want %q", echoed, "GET key")
+	}
+}
+
+func TestServerRejectsOversizedMessage(t *testing.T) {
+	address := startEchoServer(t, WithBufferSize(64), WithMaxMessageSize(1024))
+
+	client, err := NewTCPClient(address, WithClientIdleTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewTCPClient() error: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Send(make([]byte, 2048)); err == nil {
+		t.Errorf("Send() of an oversized message should fail")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	address := startEchoServer(t, WithBufferSize(64))
+
+	client, err := NewTCPClient(address, WithClientIdleTimeout(5*time.Second), WithClientBufferSize(64))
+	if err != nil {
+		t.Fatalf("NewTCPClient() error: %v", err)
+	}
+	defer client.Close()
+
+	// Ответов больше, чем помещается в буферы сокетов, если их не читать во время записи
+	requests := make([]string, 20000)
+	for i := range requests {
+		requests[i] = fmt.Sprintf("SET key%d %s", i, strings.Repeat("v", i%100))
+	}
+
+	responses, err := client.Pipeline(requests)
+	if err != nil {
+		t.Fatalf("Pipeline() error: %v", err)
+	}
+	if len(responses) != len(requests) {
+		t.Fatalf("Pipeline() returned %d responses, want %d", len(responses), len(requests))
+	}
+	for i := range requests {
+		if responses[i] != requests[i] {
+			t.Fatalf("response[%d] = %q, want %q", i, responses[i], requests[i])
+		}
+	}
+
+	// Соединение остается пригодным для обычных запросов
+	response, err := client.Send([]byte("GET key"))
+	if err != nil || string(response) != "GET key" {
+		t.Errorf("Send() after Pipeline() = %q, %v", response, err)
+	}
+
+	// Несколько кадров в одном сегменте не склеиваются в один запрос
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var batch bytes.Buffer
+	WriteFrame(&batch, []byte("first"))
+	WriteFrame(&batch, []byte("second"))
+	conn.Write(batch.Bytes())
+
+	for _, want := range []string{"first", "second"} {
+		got, err := ReadFrame(conn, 0)
+		if err != nil {
+			t.Fatalf("ReadFrame() error: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("ReadFrame() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestServerDetectsRESP(t *testing.T) {
+	address := startEchoServer(t, WithRESPHandler(func(_ context.Context, args []string) resp.Value {
+		return resp.BulkStrings(args)
+	}))
+
+	// Текстовый протокол продолжает работать рядом с RESP
+	client, err := NewTCPClient(address, WithClientIdleTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewTCPClient() error: %v", err)
+	}
+	defer client.Close()
+
+	response, err := client.Send([]byte("GET key"))
+	if err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if string(response) != "GET key" {
+		t.Errorf("text response = %q, want %q", response, "GET key")
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Две команды одним пакетом и переход на RESP3
+	conn.Write([]byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\nHELLO 3\r\n*1\r\n$4\r\nPING\r\n"))
+
+	reader := bufio.NewReader(conn)
+	expectations := []string{
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n",
+		"%6\r\n",
+	}
+	for _, want := range expectations {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(reader, got); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("response = %q, want %q", got, want)
+		}
+	}
+
+	// Пропускаем тело ответа HELLO: 6 ключей и 3 строковых значения по 2 строки,
+	// 2 числа и пустой массив modules по 1 строке
+	for i := 0; i < 6*2+3*2+3; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+	}
+
+	want := "*1\r\n$4\r\nPING\r\n"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("response = %q, want %q", got, want)
+	}
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", zap.NewNop(), WithRequestTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewTCPServer() error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// Обработчик ждет завершения контекста запроса и сообщает причину
+		server.HandleQueries(ctx, func(ctx context.Context, _ []byte) []byte {
+			select {
+			case <-ctx.Done():
+				return []byte(ctx.Err().Error())
+			case <-time.After(5 * time.Second):
+				return []byte("no deadline")
+			}
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	client, err := NewTCPClient(server.listener.Addr().String(), WithClientIdleTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewTCPClient() error: %v", err)
+	}
+	defer client.Close()
+
+	// Дедлайн задается каждому запросу отдельно
+	for i := 0; i < 2; i++ {
+		response, err := client.Send([]byte("GET key"))
+		if err != nil {
+			t.Fatalf("Send() error: %v", err)
+		}
+		if string(response) != context.DeadlineExceeded.Error() {
+			t.Errorf("Handler context ended with %q, want deadline exceeded", response)
+		}
+	}
+}
+
+func TestServerCancelsRequestOnDisconnect(t *testing.T) {
+	cancelled := make(chan error, 2)
+	wait := func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	}
+
+	server, err := NewTCPServer("127.0.0.1:0", zap.NewNop(),
+		WithIdleTimeout(5*time.Second),
+		WithRESPHandler(func(ctx context.Context, _ []string) resp.Value {
+			wait(ctx)
+			return resp.SimpleString("OK")
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewTCPServer() error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.HandleQueries(ctx, func(ctx context.Context, _ []byte) []byte {
+			wait(ctx)
+			return []byte("OK")
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var text bytes.Buffer
+	WriteFrame(&text, []byte("GET key"))
+	requests := map[string][]byte{
+		"text": text.Bytes(),
+		"resp": []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"),
+	}
+
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error: %v", err)
+			}
+			if _, err := conn.Write(request); err != nil {
+				t.Fatalf("Write() error: %v", err)
+			}
+			// Даем серверу начать обработку и отключаемся, не дождавшись ответа
+			time.Sleep(50 * time.Millisecond)
+			conn.Close()
+
+			select {
+			case err := <-cancelled:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Request context ended with %v, want context.Canceled", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Request was not cancelled after client disconnected")
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	server, err := NewTCPServer("127.0.0.1:0", zap.NewNop(), WithIdleTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewTCPServer() error: %v", err)
+	}
+
+	// Сервер отправляет сообщения сам, не дожидаясь запросов, и отвечает на входящие
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.HandleStreams(ctx, func(ctx context.Context, stream *Stream) {
+			stream.Write([]byte("hello"))
+			stream.Write([]byte("world"))
+			for {
+				message, err := stream.Read()
+				if err != nil {
+					return
+				}
+				stream.Write(append([]byte("ack "), message...))
+			}
+		})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	client, err := NewTCPClient(server.Addr(), WithClientIdleTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewTCPClient() error: %v", err)
+	}
+	defer client.Close()
+	stream := client.Stream()
+
+	if err := stream.Write([]byte("1")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	for _, want := range []string{"hello", "world", "ack 1"} {
+		got, err := stream.Read()
+		if err != nil {
+			t.Fatalf("Read() error: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Read() = %q, want %q", got, want)
+		}
+	}
+
+	// Остановка сервера закрывает соединение, хотя обработчик ждет сообщений
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleStreams() did not return after cancellation")
+	}
+	if _, err := stream.Read(); err == nil {
+		t.Error("Read() after server shutdown should fail")
+	}
+}